@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,9 +13,11 @@ import (
 	_ "github.com/lib/pq"
 	"go.uber.org/zap"
 
+	"ecommerce-shop/internal/auth"
 	"ecommerce-shop/internal/config"
 	"ecommerce-shop/internal/db"
 	"ecommerce-shop/internal/logger"
+	"ecommerce-shop/internal/mailer"
 	"ecommerce-shop/internal/server"
 	"ecommerce-shop/internal/worker"
 )
@@ -33,7 +36,17 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	r := server.BuildRouter(cfg, log, database)
+	keys, err := loadKeys(cfg, log)
+	if err != nil {
+		log.Fatal("failed to load jwt keys", zap.Error(err))
+	}
+
+	mail, err := mailer.New(cfg, log)
+	if err != nil {
+		log.Fatal("failed to set up mailer", zap.Error(err))
+	}
+
+	r := server.BuildRouter(cfg, log, database, keys, mail)
 
 	srv := server.NewHTTPServer(cfg, log, r)
 
@@ -58,3 +71,17 @@ func main() {
 		log.Error("graceful shutdown failed", zap.Error(err))
 	}
 }
+
+// loadKeys reads the JWT keys listed in JWT_KEYS_FILE. Outside production a
+// missing manifest falls back to a throwaway key, which logs everyone out on
+// restart.
+func loadKeys(cfg config.Config, log *zap.Logger) (*auth.KeySet, error) {
+	if cfg.JWTKeysFile != "" {
+		return auth.LoadKeySet(cfg.JWTKeysFile)
+	}
+	if cfg.Env == "production" {
+		return nil, errors.New("JWT_KEYS_FILE is not set")
+	}
+	log.Warn("JWT_KEYS_FILE not set, signing tokens with a temporary key")
+	return auth.GenerateKeySet()
+}
@@ -0,0 +1,47 @@
+// Command reconcile recomputes every inventory balance from the
+// inventory_movements ledger and reports the rows whose stored quantity
+// disagrees. It exits with status 1 when it finds a mismatch.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"ecommerce-shop/internal/config"
+	"ecommerce-shop/internal/db"
+	"ecommerce-shop/internal/logger"
+	"ecommerce-shop/internal/repo"
+)
+
+func main() {
+	cfg := config.Load()
+	log := logger.New(cfg)
+
+	database, err := db.Connect(cfg, log)
+	if err != nil {
+		log.Fatal("failed to connect to db", zap.Error(err))
+	}
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	mismatches, err := repo.ReconcileInventory(ctx, database)
+	if err != nil {
+		log.Fatal("reconcile failed", zap.Error(err))
+	}
+	if len(mismatches) == 0 {
+		log.Info("inventory matches ledger")
+		return
+	}
+	fmt.Printf("%-36s  %-36s  %8s  %8s  %8s\n", "WAREHOUSE", "PRODUCT", "ON_HAND", "LEDGER", "DRIFT")
+	for _, m := range mismatches {
+		fmt.Printf("%-36s  %-36s  %8d  %8d  %8d\n", m.WarehouseID, m.ProductID, m.OnHand, m.Ledger, m.OnHand-m.Ledger)
+	}
+	log.Error("inventory differs from ledger", zap.Int("rows", len(mismatches)))
+	os.Exit(1)
+}
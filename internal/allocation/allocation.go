@@ -0,0 +1,193 @@
+// Package allocation decides which warehouses fulfil an order line.
+//
+// A Strategy only ranks the candidate warehouses; Allocate then fills the line
+// greedily in that order, so every strategy can split a line when no single
+// warehouse has enough stock.
+package allocation
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	Priority     = "priority"
+	MostStock    = "most_stock"
+	FewestSplits = "fewest_splits"
+	RoundRobin   = "round_robin"
+	Nearest      = "nearest"
+)
+
+var ErrUnknownStrategy = errors.New("unknown allocation strategy")
+
+// Point is a WGS84 coordinate in degrees.
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Candidate is an active warehouse together with its free stock for the line.
+type Candidate struct {
+	WarehouseID string
+	Priority    int // lower ships first
+	Location    *Point
+	Available   int
+}
+
+// Line is the quantity to place plus the context strategies may use.
+type Line struct {
+	Quantity int
+	ShipTo   *Point
+	Seq      int64 // round-robin turn for the order
+}
+
+// Allocation is the quantity reserved from one warehouse.
+type Allocation struct {
+	WarehouseID string
+	Quantity    int
+}
+
+type Strategy interface {
+	Name() string
+	// Rank returns the candidates in the order they should be drawn from.
+	// It must not modify cands.
+	Rank(line Line, cands []Candidate) []Candidate
+}
+
+// ByName returns the strategy stored in shops.allocation_strategy.
+func ByName(name string) (Strategy, error) {
+	switch name {
+	case Priority, "":
+		return priority{}, nil
+	case MostStock:
+		return mostStock{}, nil
+	case FewestSplits:
+		return fewestSplits{}, nil
+	case RoundRobin:
+		return roundRobin{}, nil
+	case Nearest:
+		return nearest{}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownStrategy, name)
+}
+
+// Allocate draws the line from the ranked candidates and returns the shortfall
+// when their combined stock is not enough.
+func Allocate(s Strategy, line Line, cands []Candidate) ([]Allocation, int) {
+	remaining := line.Quantity
+	var out []Allocation
+	for _, c := range s.Rank(line, cands) {
+		if remaining == 0 {
+			break
+		}
+		if c.Available <= 0 {
+			continue
+		}
+		take := min(c.Available, remaining)
+		out = append(out, Allocation{WarehouseID: c.WarehouseID, Quantity: take})
+		remaining -= take
+	}
+	return out, remaining
+}
+
+// byPriority copies cands sorted by priority, then id, which is the tie-break
+// every strategy falls back to.
+func byPriority(cands []Candidate) []Candidate {
+	out := append([]Candidate(nil), cands...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority < out[j].Priority
+		}
+		return out[i].WarehouseID < out[j].WarehouseID
+	})
+	return out
+}
+
+type priority struct{}
+
+func (priority) Name() string { return Priority }
+
+func (priority) Rank(_ Line, cands []Candidate) []Candidate { return byPriority(cands) }
+
+type mostStock struct{}
+
+func (mostStock) Name() string { return MostStock }
+
+func (mostStock) Rank(_ Line, cands []Candidate) []Candidate {
+	out := byPriority(cands)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Available > out[j].Available })
+	return out
+}
+
+// fewestSplits prefers a warehouse that can ship the whole line on its own and
+// otherwise draws from the largest stocks first.
+type fewestSplits struct{}
+
+func (fewestSplits) Name() string { return FewestSplits }
+
+func (fewestSplits) Rank(line Line, cands []Candidate) []Candidate {
+	out := byPriority(cands)
+	sort.SliceStable(out, func(i, j int) bool {
+		fi, fj := out[i].Available >= line.Quantity, out[j].Available >= line.Quantity
+		if fi != fj {
+			return fi
+		}
+		if fi {
+			return false
+		}
+		return out[i].Available > out[j].Available
+	})
+	return out
+}
+
+// roundRobin rotates the priority order by one warehouse per order.
+type roundRobin struct{}
+
+func (roundRobin) Name() string { return RoundRobin }
+
+func (roundRobin) Rank(line Line, cands []Candidate) []Candidate {
+	out := byPriority(cands)
+	if len(out) == 0 {
+		return out
+	}
+	k := int(line.Seq % int64(len(out)))
+	if k < 0 {
+		k += len(out)
+	}
+	return append(out[k:], out[:k]...)
+}
+
+// nearest orders by great-circle distance to the shipping address. Warehouses
+// without coordinates, or every warehouse when no address is given, keep the
+// priority order after the located ones.
+type nearest struct{}
+
+func (nearest) Name() string { return Nearest }
+
+func (nearest) Rank(line Line, cands []Candidate) []Candidate {
+	out := byPriority(cands)
+	if line.ShipTo == nil {
+		return out
+	}
+	dist := func(c Candidate) float64 {
+		if c.Location == nil {
+			return math.Inf(1)
+		}
+		return Distance(*line.ShipTo, *c.Location)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return dist(out[i]) < dist(out[j]) })
+	return out
+}
+
+// Distance is the haversine distance between a and b in kilometres.
+func Distance(a, b Point) float64 {
+	const earthRadiusKm = 6371.0
+	rad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := rad(b.Lat - a.Lat)
+	dLng := rad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(a.Lat))*math.Cos(rad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
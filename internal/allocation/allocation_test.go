@@ -0,0 +1,127 @@
+package allocation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestByName(t *testing.T) {
+	for _, name := range []string{Priority, MostStock, FewestSplits, RoundRobin, Nearest} {
+		s, err := ByName(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, s.Name())
+	}
+
+	s, err := ByName("")
+	require.NoError(t, err)
+	assert.Equal(t, Priority, s.Name())
+
+	_, err = ByName("cheapest")
+	assert.ErrorIs(t, err, ErrUnknownStrategy)
+}
+
+func TestAllocate(t *testing.T) {
+	berlin := &Point{Lat: 52.52, Lng: 13.40}
+	paris := &Point{Lat: 48.86, Lng: 2.35}
+	madrid := &Point{Lat: 40.42, Lng: -3.70}
+
+	cands := []Candidate{
+		{WarehouseID: "wh-a", Priority: 20, Location: madrid, Available: 4},
+		{WarehouseID: "wh-b", Priority: 10, Location: berlin, Available: 2},
+		{WarehouseID: "wh-c", Priority: 30, Location: paris, Available: 6},
+		{WarehouseID: "wh-d", Priority: 10, Available: 0},
+	}
+
+	tests := []struct {
+		name      string
+		strategy  string
+		line      Line
+		want      []Allocation
+		shortfall int
+	}{
+		{
+			name:     "priority splits in priority order",
+			strategy: Priority,
+			line:     Line{Quantity: 5},
+			want:     []Allocation{{"wh-b", 2}, {"wh-a", 3}},
+		},
+		{
+			name:     "most stock first",
+			strategy: MostStock,
+			line:     Line{Quantity: 8},
+			want:     []Allocation{{"wh-c", 6}, {"wh-a", 2}},
+		},
+		{
+			name:     "fewest splits picks a warehouse that holds the whole line",
+			strategy: FewestSplits,
+			line:     Line{Quantity: 3},
+			want:     []Allocation{{"wh-a", 3}},
+		},
+		{
+			name:     "fewest splits falls back to largest stocks",
+			strategy: FewestSplits,
+			line:     Line{Quantity: 9},
+			want:     []Allocation{{"wh-c", 6}, {"wh-a", 3}},
+		},
+		{
+			name:     "round robin starts at the order's turn",
+			strategy: RoundRobin,
+			line:     Line{Quantity: 3, Seq: 2},
+			want:     []Allocation{{"wh-a", 3}},
+		},
+		{
+			name:     "round robin wraps around",
+			strategy: RoundRobin,
+			line:     Line{Quantity: 3, Seq: 7},
+			want:     []Allocation{{"wh-c", 3}},
+		},
+		{
+			name:     "nearest to shipping address",
+			strategy: Nearest,
+			line:     Line{Quantity: 7, ShipTo: &Point{Lat: 50.85, Lng: 4.35}},
+			want:     []Allocation{{"wh-c", 6}, {"wh-b", 1}},
+		},
+		{
+			name:     "nearest without address uses priority",
+			strategy: Nearest,
+			line:     Line{Quantity: 1},
+			want:     []Allocation{{"wh-b", 1}},
+		},
+		{
+			name:      "shortfall when stock runs out",
+			strategy:  Priority,
+			line:      Line{Quantity: 15},
+			want:      []Allocation{{"wh-b", 2}, {"wh-a", 4}, {"wh-c", 6}},
+			shortfall: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ByName(tt.strategy)
+			require.NoError(t, err)
+
+			got, short := Allocate(s, tt.line, cands)
+
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.shortfall, short)
+		})
+	}
+}
+
+func TestRankDoesNotModifyInput(t *testing.T) {
+	cands := []Candidate{
+		{WarehouseID: "wh-b", Priority: 2, Available: 1},
+		{WarehouseID: "wh-a", Priority: 1, Available: 5},
+	}
+	s, _ := ByName(MostStock)
+	s.Rank(Line{Quantity: 1}, cands)
+	assert.Equal(t, "wh-b", cands[0].WarehouseID)
+}
+
+func TestDistance(t *testing.T) {
+	d := Distance(Point{Lat: 52.52, Lng: 13.40}, Point{Lat: 48.86, Lng: 2.35})
+	assert.InDelta(t, 878, d, 5)
+}
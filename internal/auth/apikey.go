@@ -0,0 +1,23 @@
+package auth
+
+import "errors"
+
+// ErrInvalidAPIKey covers unknown, expired and revoked keys alike.
+var ErrInvalidAPIKey = errors.New("api key is invalid, expired or revoked")
+
+const (
+	apiKeyPrefix = "esk_"
+	// apiKeyDisplayLen is how much of a key is kept in clear to identify it.
+	apiKeyDisplayLen = len(apiKeyPrefix) + 8
+)
+
+// NewAPIKey returns a random key and the prefix of it that is kept for
+// display. Store the key with HashOpaqueToken.
+func NewAPIKey() (key, prefix string, err error) {
+	s, err := randomString(24)
+	if err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + s
+	return key, key[:apiKeyDisplayLen], nil
+}
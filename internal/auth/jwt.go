@@ -1,17 +1,173 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+
+	"ecommerce-shop/internal/models"
+)
+
+var (
+	ErrMissingSubject = errors.New("token has no subject")
+	ErrMissingTokenID = errors.New("token has no jti")
+)
+
+// Principal is the authenticated caller extracted from a verified token.
+type Principal struct {
+	UserID string
+	Role   models.UserRole
+	// Shops maps the id of every shop the user is a member of to their role
+	// there, as of when the token was issued.
+	Shops map[string]models.ShopRole
+	// TokenID is the jti of the access token, used to revoke it before
+	// ExpiresAt.
+	TokenID   string
+	ExpiresAt time.Time
+	// AMR lists how the user authenticated for the session (RFC 8176).
+	AMR []string
+	// APIKeyID is set when the caller authenticated with an API key instead
+	// of a token. Such callers act for UserID, the key's creator, as staff of
+	// the key's shop, and only where Permissions allow.
+	APIKeyID    string
+	Permissions []models.APIPermission
+}
+
+// HasPermission reports whether an API key caller holds perm.
+func (p Principal) HasPermission(perm models.APIPermission) bool {
+	for _, have := range p.Permissions {
+		if have == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Authentication method references used in the amr claim.
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	// AMRMFA marks a session that passed a second factor, whether an
+	// authenticator code or a recovery code.
+	AMRMFA = "mfa"
+	// AMRFederated marks a login through an external identity provider. It is
+	// not one of the RFC 8176 values; the provider's own amr values follow it.
+	AMRFederated = "fed"
 )
 
-func GenerateToken(userID string, secret string, ttl time.Duration) (string, error) {
-	claims := jwt.MapClaims{
-		"sub": userID,
-		"exp": time.Now().Add(ttl).Unix(),
+// HasAMR reports whether the session authenticated with method.
+func (p Principal) HasAMR(method string) bool {
+	for _, m := range p.AMR {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HasShopRole reports whether the caller may act with role in the shop.
+// Platform admins may act in every shop.
+func (p Principal) HasShopRole(shopID string, role models.ShopRole) bool {
+	if p.Role == models.RolePlatformAdmin {
+		return true
+	}
+	return shopID != "" && p.Shops[shopID].Satisfies(role)
+}
+
+type claims struct {
+	Role  models.UserRole            `json:"role,omitempty"`
+	Shops map[string]models.ShopRole `json:"shops,omitempty"`
+	AMR   []string                   `json:"amr,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// AccessToken is a signed JWT together with the claims needed to revoke it.
+type AccessToken struct {
+	Token     string
+	ID        string
+	ExpiresAt time.Time
+}
+
+// GenerateToken signs an access token for p with the active key of keys. It
+// gets a fresh jti; p.TokenID and p.ExpiresAt are ignored.
+func GenerateToken(p Principal, keys *KeySet, ttl time.Duration) (AccessToken, error) {
+	key, err := keys.signingKey()
+	if err != nil {
+		return AccessToken{}, err
+	}
+	id, err := randomString(16)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	now := time.Now()
+	exp := now.Add(ttl)
+	t := jwt.NewWithClaims(key.Method(), claims{
+		Role:  p.Role,
+		Shops: p.Shops,
+		AMR:   p.AMR,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Subject:   p.UserID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(exp),
+		},
+	})
+	t.Header["kid"] = key.ID
+	signed, err := t.SignedString(key.Private)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	// round to the second the exp claim is encoded with
+	return AccessToken{Token: signed, ID: id, ExpiresAt: exp.Truncate(time.Second)}, nil
+}
+
+// ParseToken verifies tokenStr against the key named by its kid header and
+// returns the principal named by its sub claim. Only RS256 and EdDSA are
+// accepted, and only with a key of the matching type. Tokens without a role
+// claim belong to customers; tokens without a jti cannot be revoked and are
+// rejected.
+func ParseToken(tokenStr string, keys *KeySet) (Principal, error) {
+	var c claims
+	token, err := jwt.ParseWithClaims(tokenStr, &c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := keys.verificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method != key.Method() {
+			return nil, jwt.ErrTokenSignatureInvalid
+		}
+		return key.Public, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil {
+		return Principal{}, err
+	}
+	if !token.Valid {
+		return Principal{}, jwt.ErrTokenInvalidClaims
+	}
+	if c.Subject == "" {
+		return Principal{}, ErrMissingSubject
+	}
+	if c.ID == "" {
+		return Principal{}, ErrMissingTokenID
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString([]byte(secret))
+	p := Principal{UserID: c.Subject, Role: c.Role, Shops: c.Shops, TokenID: c.ID, AMR: c.AMR}
+	if c.ExpiresAt != nil {
+		p.ExpiresAt = c.ExpiresAt.Time
+	}
+	if p.Role == "" {
+		p.Role = models.RoleCustomer
+	}
+	return p, nil
 }
 
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
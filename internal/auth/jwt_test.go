@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ecommerce-shop/internal/models"
+)
+
+func TestToken_RoundTrip(t *testing.T) {
+	in := Principal{
+		UserID: "user-1",
+		Role:   models.RoleCustomer,
+		Shops:  map[string]models.ShopRole{"shop-1": models.ShopAdmin},
+		AMR:    []string{AMRPassword, AMROTP, AMRMFA},
+	}
+	keys, err := GenerateKeySet()
+	require.NoError(t, err)
+	tok, err := GenerateToken(in, keys, time.Minute)
+	require.NoError(t, err)
+	assert.NotEmpty(t, tok.ID)
+
+	out, err := ParseToken(tok.Token, keys)
+	require.NoError(t, err)
+	assert.Equal(t, tok.ID, out.TokenID)
+	assert.True(t, tok.ExpiresAt.Equal(out.ExpiresAt))
+	out.TokenID, out.ExpiresAt = "", time.Time{}
+	assert.Equal(t, in, out)
+
+	otherKeys, err := GenerateKeySet()
+	require.NoError(t, err)
+	_, err = ParseToken(tok.Token, otherKeys)
+	assert.Error(t, err)
+
+	other, err := GenerateToken(in, keys, time.Minute)
+	require.NoError(t, err)
+	assert.NotEqual(t, tok.ID, other.ID)
+}
+
+// signClaims signs arbitrary claims with the set's active key.
+func signClaims(t *testing.T, keys *KeySet, c jwt.MapClaims) string {
+	key, err := keys.signingKey()
+	require.NoError(t, err)
+	tok := jwt.NewWithClaims(key.Method(), c)
+	tok.Header["kid"] = key.ID
+	signed, err := tok.SignedString(key.Private)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestParseToken_WithoutRoleClaims(t *testing.T) {
+	keys, err := GenerateKeySet()
+	require.NoError(t, err)
+	tok := signClaims(t, keys, jwt.MapClaims{
+		"sub": "user-1",
+		"jti": "token-1",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+
+	p, err := ParseToken(tok, keys)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleCustomer, p.Role)
+	assert.Empty(t, p.Shops)
+}
+
+func TestParseToken_WithoutTokenID(t *testing.T) {
+	keys, err := GenerateKeySet()
+	require.NoError(t, err)
+	tok := signClaims(t, keys, jwt.MapClaims{
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+
+	_, err = ParseToken(tok, keys)
+	assert.ErrorIs(t, err, ErrMissingTokenID)
+}
+
+func TestParseToken_SigningMethod(t *testing.T) {
+	keys, err := GenerateKeySet()
+	require.NoError(t, err)
+	key, err := keys.signingKey()
+	require.NoError(t, err)
+	c := jwt.MapClaims{"sub": "user-1", "jti": "token-1", "exp": time.Now().Add(time.Minute).Unix()}
+
+	// HS256 keyed with the public key bytes, the classic algorithm confusion
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, c)
+	hs.Header["kid"] = key.ID
+	forged, err := hs.SignedString([]byte(key.Public.(ed25519.PublicKey)))
+	require.NoError(t, err)
+	_, err = ParseToken(forged, keys)
+	assert.Error(t, err)
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, c)
+	none.Header["kid"] = key.ID
+	unsigned, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = ParseToken(unsigned, keys)
+	assert.Error(t, err)
+
+	missingKid := jwt.NewWithClaims(key.Method(), c)
+	signed, err := missingKid.SignedString(key.Private)
+	require.NoError(t, err)
+	_, err = ParseToken(signed, keys)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestHashOpaqueToken(t *testing.T) {
+	tok, err := NewOpaqueToken()
+	require.NoError(t, err)
+
+	assert.Len(t, tok, 64)
+	assert.Equal(t, HashOpaqueToken(tok), HashOpaqueToken(tok))
+	assert.NotEqual(t, tok, HashOpaqueToken(tok))
+}
+
+func TestPrincipal_HasShopRole(t *testing.T) {
+	staff := Principal{UserID: "u", Role: models.RoleCustomer, Shops: map[string]models.ShopRole{"shop-1": models.ShopStaff}}
+	admin := Principal{UserID: "a", Role: models.RolePlatformAdmin}
+
+	assert.True(t, staff.HasShopRole("shop-1", models.ShopStaff))
+	assert.False(t, staff.HasShopRole("shop-1", models.ShopAdmin))
+	assert.False(t, staff.HasShopRole("shop-2", models.ShopStaff))
+	assert.False(t, staff.HasShopRole("", models.ShopStaff))
+	assert.True(t, admin.HasShopRole("shop-2", models.ShopAdmin))
+	assert.True(t, admin.HasShopRole("", models.ShopAdmin))
+}
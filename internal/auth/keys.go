@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrNoSigningKey = errors.New("no signing key is active")
+	ErrUnknownKey   = errors.New("token signed with an unknown or retired key")
+)
+
+const minRSABits = 2048
+
+// Key is one JWT signing key. It signs from NotBefore until a newer key takes
+// over and verifies until NotAfter, which must leave room for the last tokens
+// it signed to expire. Keys without a private half only verify.
+type Key struct {
+	ID        string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+	NotBefore time.Time
+	// NotAfter is zero for a key with no planned retirement.
+	NotAfter time.Time
+}
+
+// Method returns the signing method matching the key type: RS256 for RSA and
+// EdDSA for Ed25519.
+func (k Key) Method() jwt.SigningMethod {
+	if _, ok := k.Public.(*rsa.PublicKey); ok {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+func (k Key) verifies(at time.Time) bool {
+	return k.NotAfter.IsZero() || at.Before(k.NotAfter)
+}
+
+// KeySet holds every key that is scheduled, in use or still verifying. The
+// active signing key is the newest one whose NotBefore has passed, so
+// rotating is adding a key with a future NotBefore and retiring is setting
+// NotAfter on the old one.
+type KeySet struct {
+	keys []Key
+	now  func() time.Time
+}
+
+// NewKeySet checks the keys and returns them as a set.
+func NewKeySet(keys ...Key) (*KeySet, error) {
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if k.ID == "" {
+			return nil, errors.New("key has no kid")
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("duplicate kid %q", k.ID)
+		}
+		seen[k.ID] = true
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			if pub.N.BitLen() < minRSABits {
+				return nil, fmt.Errorf("key %q: RSA keys need at least %d bits", k.ID, minRSABits)
+			}
+		case ed25519.PublicKey:
+		default:
+			return nil, fmt.Errorf("key %q: unsupported key type %T", k.ID, k.Public)
+		}
+		if !k.NotAfter.IsZero() && !k.NotAfter.After(k.NotBefore) {
+			return nil, fmt.Errorf("key %q: not_after must be after not_before", k.ID)
+		}
+	}
+	sorted := append([]Key(nil), keys...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].NotBefore.After(sorted[j].NotBefore) })
+	return &KeySet{keys: sorted, now: time.Now}, nil
+}
+
+// GenerateKeySet returns a set with a single fresh Ed25519 key. Tokens it
+// signs stop verifying when the process exits, so it is only meant for
+// development and tests.
+func GenerateKeySet() (*KeySet, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeySet(Key{ID: id, Private: priv, Public: pub})
+}
+
+// signingKey returns the key new tokens are signed with.
+func (ks *KeySet) signingKey() (Key, error) {
+	now := ks.now()
+	for _, k := range ks.keys {
+		if k.Private != nil && !k.NotBefore.After(now) && k.verifies(now) {
+			return k, nil
+		}
+	}
+	return Key{}, ErrNoSigningKey
+}
+
+// verificationKey returns the key with the given kid if it has not been
+// retired.
+func (ks *KeySet) verificationKey(kid string) (Key, error) {
+	now := ks.now()
+	for _, k := range ks.keys {
+		if k.ID == kid && k.verifies(now) {
+			return k, nil
+		}
+	}
+	return Key{}, ErrUnknownKey
+}
+
+type keyManifest struct {
+	Keys []struct {
+		ID             string    `json:"kid"`
+		PrivateKeyFile string    `json:"private_key_file"`
+		PublicKeyFile  string    `json:"public_key_file"`
+		NotBefore      time.Time `json:"not_before"`
+		NotAfter       time.Time `json:"not_after"`
+	} `json:"keys"`
+}
+
+// LoadKeySet reads a JSON manifest listing the keys and their schedule. Key
+// files are PEM encoded (PKCS#8 or PKCS#1 private keys, PKIX public keys)
+// and relative paths are resolved against the manifest's directory.
+func LoadKeySet(manifestPath string) (*KeySet, error) {
+	raw, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var m keyManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestPath, err)
+	}
+	dir := filepath.Dir(manifestPath)
+	keys := make([]Key, 0, len(m.Keys))
+	for _, e := range m.Keys {
+		k := Key{ID: e.ID, NotBefore: e.NotBefore, NotAfter: e.NotAfter}
+		switch {
+		case e.PrivateKeyFile != "":
+			if k.Private, err = readPrivateKey(resolve(dir, e.PrivateKeyFile)); err != nil {
+				return nil, fmt.Errorf("key %q: %w", e.ID, err)
+			}
+			k.Public = k.Private.Public()
+		case e.PublicKeyFile != "":
+			if k.Public, err = readPublicKey(resolve(dir, e.PublicKeyFile)); err != nil {
+				return nil, fmt.Errorf("key %q: %w", e.ID, err)
+			}
+		default:
+			return nil, fmt.Errorf("key %q: no key file", e.ID)
+		}
+		keys = append(keys, k)
+	}
+	ks, err := NewKeySet(keys...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ks.signingKey(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func resolve(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
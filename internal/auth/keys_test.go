@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "old.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edPriv)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "current.pem"), "PRIVATE KEY", der)
+
+	nextPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err = x509.MarshalPKIXPublicKey(nextPub)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "retired.pub.pem"), "PUBLIC KEY", der)
+
+	manifest := `{"keys": [
+		{"kid": "old", "private_key_file": "old.pem", "not_before": "2020-01-01T00:00:00Z"},
+		{"kid": "current", "private_key_file": "current.pem", "not_before": "2021-01-01T00:00:00Z"},
+		{"kid": "retired", "public_key_file": "retired.pub.pem", "not_before": "2019-01-01T00:00:00Z", "not_after": "2019-06-01T00:00:00Z"}
+	]}`
+	path := filepath.Join(dir, "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(manifest), 0o600))
+
+	keys, err := LoadKeySet(path)
+	require.NoError(t, err)
+
+	active, err := keys.signingKey()
+	require.NoError(t, err)
+	assert.Equal(t, "current", active.ID)
+	assert.Equal(t, edPub, active.Public)
+
+	_, err = keys.verificationKey("old")
+	assert.NoError(t, err)
+	_, err = keys.verificationKey("retired")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	jwks := keys.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, JWK{KeyType: "OKP", ID: "current", Use: "sig", Alg: "EdDSA", Curve: "Ed25519", X: b64(edPub)}, jwks.Keys[0])
+	assert.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	assert.Equal(t, "RS256", jwks.Keys[1].Alg)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+}
+
+func TestLoadKeySet_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "small.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(small))
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	writePEM(t, filepath.Join(dir, "verify-only.pem"), "PUBLIC KEY", der)
+
+	tests := []struct {
+		name     string
+		manifest string
+	}{
+		{name: "weak RSA key", manifest: `{"keys": [{"kid": "a", "private_key_file": "small.pem"}]}`},
+		{name: "no signing key", manifest: `{"keys": [{"kid": "a", "public_key_file": "verify-only.pem"}]}`},
+		{name: "duplicate kid", manifest: `{"keys": [{"kid": "a", "public_key_file": "verify-only.pem"}, {"kid": "a", "public_key_file": "verify-only.pem"}]}`},
+		{name: "missing file", manifest: `{"keys": [{"kid": "a", "private_key_file": "nope.pem"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "keys.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.manifest), 0o600))
+
+			_, err := LoadKeySet(path)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestKeySet_Rotation(t *testing.T) {
+	oldPub, oldPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	newPub, newPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys, err := NewKeySet(
+		Key{ID: "old", Private: oldPriv, Public: oldPub, NotBefore: start, NotAfter: start.Add(48 * time.Hour)},
+		Key{ID: "new", Private: newPriv, Public: newPub, NotBefore: start.Add(24 * time.Hour)},
+	)
+	require.NoError(t, err)
+
+	keys.now = func() time.Time { return start.Add(time.Hour) }
+	_, err = GenerateToken(Principal{UserID: "user-1"}, keys, time.Hour)
+	require.NoError(t, err)
+	k, _ := keys.signingKey()
+	assert.Equal(t, "old", k.ID)
+	assert.Len(t, keys.JWKS().Keys, 2, "the scheduled key is published ahead of use")
+
+	// after the switch the new key signs and the old one still verifies
+	keys.now = func() time.Time { return start.Add(30 * time.Hour) }
+	k, _ = keys.signingKey()
+	assert.Equal(t, "new", k.ID)
+	_, err = keys.verificationKey("old")
+	assert.NoError(t, err)
+
+	// once retired, tokens signed with the old key are refused
+	keys.now = func() time.Time { return start.Add(49 * time.Hour) }
+	_, err = keys.verificationKey("old")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.Len(t, keys.JWKS().Keys, 1)
+}
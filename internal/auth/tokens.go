@@ -0,0 +1,19 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// NewOpaqueToken returns a random token for refresh, password reset and email
+// verification links. Only its hash is stored.
+func NewOpaqueToken() (string, error) {
+	return randomString(32)
+}
+
+// HashOpaqueToken returns the form an opaque token is stored and looked up
+// by. The token is random, so a plain SHA-256 is enough.
+func HashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
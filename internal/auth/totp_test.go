@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// RFC 6238 appendix B, SHA-1, truncated to six digits.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+
+func TestTOTPCode_RFCVectors(t *testing.T) {
+	tests := []struct {
+		at   int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		code, err := TOTPCode(rfcSecret, time.Unix(tt.at, 0))
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, code, "t=%d", tt.at)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	code, err := TOTPCode(secret, now)
+	require.NoError(t, err)
+
+	step, ok := VerifyTOTP(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Unix()/30, step)
+
+	_, ok = VerifyTOTP(secret, code, now.Add(30*time.Second))
+	assert.True(t, ok, "one step of drift is allowed")
+	_, ok = VerifyTOTP(secret, code, now.Add(90*time.Second))
+	assert.False(t, ok)
+	_, ok = VerifyTOTP(secret, "12345", now)
+	assert.False(t, ok)
+	_, ok = VerifyTOTP("not base32!", code, now)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	u, err := url.Parse(TOTPURI("Shop Admin", "a@b.com", rfcSecret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/Shop Admin:a@b.com", u.Path)
+	assert.Equal(t, rfcSecret, u.Query().Get("secret"))
+	assert.Equal(t, "Shop Admin", u.Query().Get("issuer"))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+	seen := map[string]bool{}
+	for _, c := range codes {
+		assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, c)
+		assert.False(t, seen[c])
+		seen[c] = true
+	}
+	assert.Equal(t, "k3m9x7qp2d", NormalizeRecoveryCode(" K3M9X-7QP2D "))
+}
@@ -0,0 +1,29 @@
+package entity
+
+import "time"
+
+type CreateAPIKeyReq struct {
+	Name        string     `json:"name" binding:"required,max=200"`
+	Permissions []string   `json:"permissions" binding:"required,min=1,dive,oneof=inventory:read inventory:write transfers:read transfers:write"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+type APIKeyResponse struct {
+	ID          string     `json:"id"`
+	ShopID      string     `json:"shop_id"`
+	Name        string     `json:"name"`
+	Prefix      string     `json:"prefix"`
+	Permissions []string   `json:"permissions"`
+	CreatedBy   *string    `json:"created_by,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CreatedAPIKeyResponse carries the key itself, which is only ever returned
+// here.
+type CreatedAPIKeyResponse struct {
+	APIKeyResponse
+	Key string `json:"key"`
+}
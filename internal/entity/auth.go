@@ -1,5 +1,7 @@
 package entity
 
+import "time"
+
 type LoginReq struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
@@ -10,7 +12,65 @@ type RegisterReq struct {
 	Password string `json:"password" validate:"required,min=8"`
 }
 
+type RefreshReq struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// EmailReq asks for a password reset or verification link.
+type EmailReq struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// TokenReq confirms an email verification link.
+type TokenReq struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type ResetPasswordReq struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=8"`
+}
+
+// MFALoginReq finishes a login with the challenge token it returned and an
+// authenticator or recovery code.
+type MFALoginReq struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+type MFACodeReq struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// AuthResponse carries a short-lived access token in Token and the refresh
+// token that renews it. Both are left out when registration has to wait for
+// email verification, and when login needs a second factor, in which case
+// MFAToken is set instead.
 type AuthResponse struct {
-	ID    string `json:"id"`
-	Token string `json:"token"`
+	ID           string     `json:"id"`
+	Token        string     `json:"token,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	MFAToken     string     `json:"mfa_token,omitempty"`
+	// MFAEnrolmentRequired means the token lacks the user's privileges until
+	// they enrol a second factor.
+	MFAEnrolmentRequired bool `json:"mfa_enrolment_required,omitempty"`
+}
+
+// MFAEnrolmentResponse is shown as a QR code of OTPAuthURI, with Secret for
+// typing in by hand.
+type MFAEnrolmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFAConfirmResponse is the session that replaces the caller's, plus the
+// recovery codes, which are only ever shown this once.
+type MFAConfirmResponse struct {
+	AuthResponse
+	RecoveryCodes []string `json:"recovery_codes"`
 }
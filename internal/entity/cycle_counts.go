@@ -0,0 +1,38 @@
+package entity
+
+import "time"
+
+// OpenCountReq picks the products to count; leave product_ids empty to count
+// everything the warehouse stocks.
+type OpenCountReq struct {
+	ProductIDs []string `json:"product_ids"`
+}
+
+type CountedLineReq struct {
+	ProductID string `json:"product_id" binding:"required"`
+	Quantity  *int   `json:"quantity" binding:"required,min=0"`
+}
+
+type SubmitCountReq struct {
+	Lines []CountedLineReq `json:"lines" binding:"required,min=1,dive"`
+}
+
+type CountLineResponse struct {
+	ProductID string `json:"product_id"`
+	Snapshot  int    `json:"snapshot"`
+	Counted   *int   `json:"counted,omitempty"`
+	Variance  *int   `json:"variance,omitempty"`
+	OnHand    int    `json:"on_hand"`
+	Reserved  int    `json:"reserved"`
+	// Projected is the on-hand quantity approving the count would leave.
+	Projected *int `json:"projected,omitempty"`
+}
+
+type CountResponse struct {
+	ID          string              `json:"id"`
+	WarehouseID string              `json:"warehouse_id"`
+	Status      string              `json:"status"`
+	CreatedAt   time.Time           `json:"created_at"`
+	ApprovedAt  *time.Time          `json:"approved_at,omitempty"`
+	Lines       []CountLineResponse `json:"lines,omitempty"`
+}
@@ -1,15 +1,71 @@
 package entity
 
+import "time"
+
 type OrderItemReq struct {
 	ProductID string `json:"product_id" validate:"required,uuid"`
 	Quantity  int    `json:"quantity" validate:"required,min=1"`
 }
+
+type GeoPoint struct {
+	Lat float64 `json:"lat" validate:"min=-90,max=90"`
+	Lng float64 `json:"lng" validate:"min=-180,max=180"`
+}
+
 type CreateOrderReq struct {
 	ShopID string         `json:"shop_id" validate:"required,uuid"`
-	Items  []OrderItemReq `json:"items" validate:"required,min=1,dive"`
+	Items  []OrderItemReq `json:"items" validate:"required,min=1,unique=ProductID,dive"`
+	ShipTo *GeoPoint      `json:"ship_to,omitempty"`
 }
 
 type OrderResponse struct {
-	ID     string `json:"id"`
-	Status string `json:"status"`
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	TotalCents int64  `json:"total_cents"`
+	Currency   string `json:"currency"`
+}
+
+type ListOrdersQuery struct {
+	Status string    `form:"status" validate:"omitempty,oneof=reserved paid fulfilled shipped delivered cancelled expired refunded"`
+	From   time.Time `form:"from"`
+	To     time.Time `form:"to"`
+	Cursor string    `form:"cursor"`
+	Limit  int       `form:"limit" validate:"omitempty,min=1,max=100"`
+}
+
+type OrderItemResponse struct {
+	ProductID      string `json:"product_id"`
+	Quantity       int    `json:"quantity"`
+	UnitPriceCents int64  `json:"unit_price_cents"`
+	Currency       string `json:"currency"`
+}
+
+type ReservationResponse struct {
+	WarehouseID string    `json:"warehouse_id"`
+	ProductID   string    `json:"product_id"`
+	Quantity    int       `json:"quantity"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Released    bool      `json:"released"`
+}
+
+type OrderSummaryResponse struct {
+	ID           string    `json:"id"`
+	ShopID       string    `json:"shop_id"`
+	Status       string    `json:"status"`
+	StatusReason string    `json:"status_reason,omitempty"`
+	TotalCents   int64     `json:"total_cents"`
+	Currency     string    `json:"currency"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type OrderDetailResponse struct {
+	OrderSummaryResponse
+	Items        []OrderItemResponse   `json:"items"`
+	Reservations []ReservationResponse `json:"reservations"`
+}
+
+type OrderListResponse struct {
+	Orders     []OrderSummaryResponse `json:"orders"`
+	NextCursor string                 `json:"next_cursor,omitempty"`
 }
@@ -190,10 +190,56 @@ func TestCreateOrderReq_Validation(t *testing.T) {
 
 func TestOrderResponse_Structure(t *testing.T) {
 	response := OrderResponse{
-		ID:     "order-123",
-		Status: "reserved",
+		ID:         "order-123",
+		Status:     "reserved",
+		TotalCents: 2250,
+		Currency:   "USD",
 	}
 
 	assert.Equal(t, "order-123", response.ID)
 	assert.Equal(t, "reserved", response.Status)
+	assert.Equal(t, int64(2250), response.TotalCents)
+	assert.Equal(t, "USD", response.Currency)
+}
+
+func TestListOrdersQuery_Validation(t *testing.T) {
+	validate := validator.New()
+
+	tests := []struct {
+		name    string
+		req     ListOrdersQuery
+		wantErr bool
+	}{
+		{
+			name:    "empty query",
+			req:     ListOrdersQuery{},
+			wantErr: false,
+		},
+		{
+			name:    "known status",
+			req:     ListOrdersQuery{Status: "paid", Limit: 50},
+			wantErr: false,
+		},
+		{
+			name:    "unknown status",
+			req:     ListOrdersQuery{Status: "lost"},
+			wantErr: true,
+		},
+		{
+			name:    "limit too large",
+			req:     ListOrdersQuery{Limit: 101},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate.Struct(tt.req)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
 }
@@ -1,8 +1,58 @@
 package entity
 
+import "time"
+
 type ProductResponse struct {
-	ID        string `json:"id"`
-	SKU       string `json:"sku"`
-	Name      string `json:"name"`
-	Available int    `json:"available"`
+	ID         string `json:"id"`
+	SKU        string `json:"sku"`
+	Name       string `json:"name"`
+	PriceCents int64  `json:"price_cents"`
+	Currency   string `json:"currency"`
+	Available  int    `json:"available"`
+	InTransit  int    `json:"in_transit"`
+}
+
+type CreateProductReq struct {
+	SKU        string  `json:"sku" binding:"required,max=64"`
+	Name       string  `json:"name" binding:"required,max=200"`
+	PriceCents *int64  `json:"price_cents" binding:"required,min=0"`
+	Currency   *string `json:"currency" binding:"required,iso4217"`
+}
+
+type UpdateProductReq struct {
+	SKU        *string `json:"sku" binding:"omitempty,min=1,max=64"`
+	Name       *string `json:"name" binding:"omitempty,min=1,max=200"`
+	PriceCents *int64  `json:"price_cents" binding:"omitempty,min=0"`
+	Currency   *string `json:"currency" binding:"omitempty,iso4217"`
+}
+
+// SetShopPriceReq overrides a product's list price in one shop.
+type SetShopPriceReq struct {
+	PriceCents *int64 `json:"price_cents" binding:"required,min=0"`
+	Currency   string `json:"currency" binding:"required,iso4217"`
+}
+
+type ShopPriceResponse struct {
+	ShopID     string `json:"shop_id"`
+	ProductID  string `json:"product_id"`
+	PriceCents int64  `json:"price_cents"`
+	Currency   string `json:"currency"`
+}
+
+// CatalogProductResponse is a product as managed in the catalogue, without
+// shop pricing or stock.
+type CatalogProductResponse struct {
+	ID         string     `json:"id"`
+	SKU        string     `json:"sku"`
+	Name       string     `json:"name"`
+	PriceCents int64      `json:"price_cents"`
+	Currency   string     `json:"currency"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+}
+
+type CatalogProductListResponse struct {
+	Products   []CatalogProductResponse `json:"products"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
 }
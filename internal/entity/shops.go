@@ -0,0 +1,45 @@
+package entity
+
+import "time"
+
+type CreateShopReq struct {
+	Name               string  `json:"name" binding:"required,max=200"`
+	AllocationStrategy *string `json:"allocation_strategy" binding:"omitempty,oneof=priority most_stock fewest_splits round_robin nearest"`
+}
+
+type UpdateShopReq struct {
+	Name               *string `json:"name" binding:"omitempty,min=1,max=200"`
+	AllocationStrategy *string `json:"allocation_strategy" binding:"omitempty,oneof=priority most_stock fewest_splits round_robin nearest"`
+}
+
+type ShopResponse struct {
+	ID                 string     `json:"id"`
+	Name               string     `json:"name"`
+	AllocationStrategy string     `json:"allocation_strategy"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+	DeletedAt          *time.Time `json:"deleted_at,omitempty"`
+}
+
+type ShopListResponse struct {
+	Shops      []ShopResponse `json:"shops"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// ListCatalogQuery pages through shops or products.
+type ListCatalogQuery struct {
+	IncludeDeleted bool   `form:"include_deleted"`
+	Cursor         string `form:"cursor"`
+	Limit          int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+type SetMemberReq struct {
+	Role string `json:"role" binding:"required,oneof=staff admin"`
+}
+
+type MemberResponse struct {
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -1,16 +1,175 @@
 package entity
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type TransferReq struct {
-	From      string `json:"from" binding:"required"`
-	To        string `json:"to" binding:"required"`
-	ProductID string `json:"product_id" binding:"required"`
+	From      string `json:"from" binding:"required,uuid"`
+	To        string `json:"to" binding:"required,uuid"`
+	ProductID string `json:"product_id" binding:"required,uuid"`
 	Quantity  int    `json:"quantity" binding:"required,min=1"`
 }
 
 type TransferResponse struct {
-	From      string `json:"from"`
-	To        string `json:"to"`
-	ProductID string `json:"product_id"`
-	Quantity  int    `json:"quantity"`
-	Status    string `json:"status"`
+	ID               string     `json:"id"`
+	From             string     `json:"from"`
+	To               string     `json:"to"`
+	ProductID        string     `json:"product_id"`
+	Quantity         int        `json:"quantity"`
+	ReceivedQuantity int        `json:"received_quantity"`
+	Status           string     `json:"status"`
+	CreatedAt        time.Time  `json:"created_at"`
+	DispatchedAt     *time.Time `json:"dispatched_at,omitempty"`
+	ReceivedAt       *time.Time `json:"received_at,omitempty"`
+}
+
+// ReceiveTransferReq reports how many units arrived; omit quantity when the
+// whole shipment did.
+type ReceiveTransferReq struct {
+	Quantity *int `json:"quantity" binding:"omitempty,min=0"`
+}
+
+type ListTransfersQuery struct {
+	Status      string `form:"status" binding:"omitempty,oneof=requested dispatched received partially_received cancelled"`
+	WarehouseID string `form:"warehouse_id"`
+	ProductID   string `form:"product_id"`
+	Limit       int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+type ListMovementsQuery struct {
+	ProductID  string    `form:"product_id" binding:"omitempty,uuid"`
+	Reason     string    `form:"reason" binding:"omitempty,oneof=opening sale transfer_out transfer_in receipt damage shrinkage correction cycle_count"`
+	OrderID    string    `form:"order_id" binding:"omitempty,uuid"`
+	TransferID string    `form:"transfer_id" binding:"omitempty,uuid"`
+	From       time.Time `form:"from"`
+	To         time.Time `form:"to"`
+	Cursor     string    `form:"cursor"`
+	Limit      int       `form:"limit" binding:"omitempty,min=1,max=200"`
+}
+
+type MovementResponse struct {
+	ID         int64     `json:"id"`
+	ProductID  string    `json:"product_id"`
+	Delta      int       `json:"delta"`
+	Balance    int       `json:"balance"`
+	Reason     string    `json:"reason"`
+	OrderID    *string   `json:"order_id,omitempty"`
+	TransferID *string   `json:"transfer_id,omitempty"`
+	CountID    *string   `json:"cycle_count_id,omitempty"`
+	ActorID    *string   `json:"actor_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type MovementListResponse struct {
+	Movements  []MovementResponse `json:"movements"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// AdjustStockReq changes stock by a signed delta: receipts add, damage and
+// shrinkage remove, corrections go either way.
+type AdjustStockReq struct {
+	ProductID string `json:"product_id" binding:"required"`
+	Delta     int    `json:"delta" binding:"required"`
+	Reason    string `json:"reason" binding:"required,oneof=receipt damage shrinkage correction"`
+}
+
+// SetStockReq replaces the on-hand count, e.g. after a stock take.
+type SetStockReq struct {
+	ProductID string `json:"product_id" binding:"required"`
+	Quantity  *int   `json:"quantity" binding:"required,min=0"`
+	Reason    string `json:"reason" binding:"required,oneof=receipt damage shrinkage correction"`
+}
+
+type StockLevelResponse struct {
+	WarehouseID string `json:"warehouse_id"`
+	ProductID   string `json:"product_id"`
+	OnHand      int    `json:"on_hand"`
+	Reserved    int    `json:"reserved"`
+	Available   int    `json:"available"`
+}
+
+type DeactivateQuery struct {
+	Policy string `form:"policy" binding:"omitempty,oneof=block drain reallocate"`
+}
+
+type MovedReservationResponse struct {
+	WarehouseID string `json:"warehouse_id"`
+	Quantity    int    `json:"quantity"`
+}
+
+type AffectedLineResponse struct {
+	ProductID string                     `json:"product_id"`
+	Quantity  int                        `json:"quantity"`
+	MovedTo   []MovedReservationResponse `json:"moved_to,omitempty"`
+}
+
+type AffectedOrderResponse struct {
+	OrderID string                 `json:"order_id"`
+	Lines   []AffectedLineResponse `json:"lines"`
+}
+
+// DeactivationResponse reports the orders that held stock in the warehouse.
+type DeactivationResponse struct {
+	WarehouseID string                  `json:"warehouse_id"`
+	Policy      string                  `json:"policy"`
+	Orders      []AffectedOrderResponse `json:"orders"`
+}
+
+type Address struct {
+	Line1      string `json:"line1" binding:"max=200"`
+	Line2      string `json:"line2" binding:"max=200"`
+	City       string `json:"city" binding:"max=100"`
+	Region     string `json:"region" binding:"max=100"`
+	PostalCode string `json:"postal_code" binding:"max=20"`
+	Country    string `json:"country" binding:"omitempty,iso3166_1_alpha2"`
+}
+
+type CreateWarehouseReq struct {
+	ShopID    string                 `json:"shop_id" binding:"required"`
+	Name      string                 `json:"name" binding:"required,max=200"`
+	Priority  *int                   `json:"priority" binding:"omitempty,min=0"`
+	Latitude  *float64               `json:"latitude" binding:"omitempty,min=-90,max=90"`
+	Longitude *float64               `json:"longitude" binding:"omitempty,min=-180,max=180"`
+	Address   *Address               `json:"address"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+// UpdateWarehouseReq changes the given fields. An address or metadata object
+// replaces the stored one; omit it to keep it.
+type UpdateWarehouseReq struct {
+	Name      *string                `json:"name" binding:"omitempty,min=1,max=200"`
+	Priority  *int                   `json:"priority" binding:"omitempty,min=0"`
+	Latitude  *float64               `json:"latitude" binding:"omitempty,min=-90,max=90"`
+	Longitude *float64               `json:"longitude" binding:"omitempty,min=-180,max=180"`
+	Address   *Address               `json:"address"`
+	Metadata  map[string]interface{} `json:"metadata"`
+}
+
+type ListWarehousesQuery struct {
+	ShopID         string `form:"shop_id"`
+	IncludeDeleted bool   `form:"include_deleted"`
+	Cursor         string `form:"cursor"`
+	Limit          int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+type WarehouseResponse struct {
+	ID        string          `json:"id"`
+	ShopID    string          `json:"shop_id"`
+	Name      string          `json:"name"`
+	Active    bool            `json:"active"`
+	Priority  int             `json:"priority"`
+	Latitude  *float64        `json:"latitude,omitempty"`
+	Longitude *float64        `json:"longitude,omitempty"`
+	Address   Address         `json:"address"`
+	Metadata  json.RawMessage `json:"metadata"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	DeletedAt *time.Time      `json:"deleted_at,omitempty"`
+}
+
+type WarehouseListResponse struct {
+	Warehouses []WarehouseResponse `json:"warehouses"`
+	NextCursor string              `json:"next_cursor,omitempty"`
 }
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/server/web"
+	"ecommerce-shop/internal/service"
+)
+
+type APIKeysHandler struct {
+	DB  *sqlx.DB
+	Svc *service.APIKeysService
+}
+
+// Create issues an API key for the shop. The key is in the response and
+// cannot be retrieved later.
+func (h *APIKeysHandler) Create(c *gin.Context) {
+	var req entity.CreateAPIKeyReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	p, _ := web.CurrentPrincipal(c)
+	in := service.APIKeyInput{Name: req.Name, ExpiresAt: req.ExpiresAt}
+	for _, perm := range req.Permissions {
+		in.Permissions = append(in.Permissions, models.APIPermission(perm))
+	}
+	k, key, err := h.Svc.Create(c, c.Param("shop_id"), p.UserID, in)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "API key created, store it now as it will not be shown again",
+		entity.CreatedAPIKeyResponse{APIKeyResponse: apiKeyResponse(k), Key: key})
+}
+
+func (h *APIKeysHandler) List(c *gin.Context) {
+	list, err := h.Svc.List(c, c.Param("shop_id"))
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	out := make([]entity.APIKeyResponse, 0, len(list))
+	for _, k := range list {
+		out = append(out, apiKeyResponse(k))
+	}
+	helpers.WriteSuccess(c.Writer, "API keys listed", out)
+}
+
+func (h *APIKeysHandler) Revoke(c *gin.Context) {
+	p, _ := web.CurrentPrincipal(c)
+	k, err := h.Svc.Revoke(c, c.Param("shop_id"), c.Param("key_id"), p.UserID)
+	if err != nil {
+		writeAPIKeyError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "API key revoked", apiKeyResponse(k))
+}
+
+func writeAPIKeyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrShopNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", err.Error(), nil)
+	case errors.Is(err, service.ErrAPIKeyNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "API key not found", err.Error(), nil)
+	case errors.Is(err, service.ErrInvalidPermission), errors.Is(err, service.ErrExpiryInPast):
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid API key", err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	}
+}
+
+func apiKeyResponse(k models.APIKey) entity.APIKeyResponse {
+	return entity.APIKeyResponse{
+		ID:          k.ID,
+		ShopID:      k.ShopID,
+		Name:        k.Name,
+		Prefix:      k.Prefix,
+		Permissions: k.Permissions,
+		CreatedBy:   k.CreatedBy,
+		ExpiresAt:   k.ExpiresAt,
+		LastUsedAt:  k.LastUsedAt,
+		RevokedAt:   k.RevokedAt,
+		CreatedAt:   k.CreatedAt,
+	}
+}
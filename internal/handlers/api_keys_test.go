@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/service"
+	"ecommerce-shop/testutils"
+)
+
+var apiKeyCols = []string{"id", "shop_id", "name", "prefix", "permissions", "created_by", "expires_at", "last_used_at", "revoked_at", "created_at"}
+
+func TestAPIKeysHandler_Create(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "created",
+			request: map[string]interface{}{"name": "WMS", "permissions": []string{"inventory:read"}},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1`).
+					WithArgs("shop-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO api_keys`).
+					WillReturnRows(sqlmock.NewRows(apiKeyCols).
+						AddRow("key-1", "shop-1", "WMS", "esk_abcdef12", `{"inventory:read"}`, "user-1", nil, nil, nil, time.Now()))
+				mock.ExpectExec(`INSERT INTO audit_log`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown permission",
+			request:        map[string]interface{}{"name": "WMS", "permissions": []string{"orders:write"}},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:           "no permissions",
+			request:        map[string]interface{}{"name": "WMS", "permissions": []string{}},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:    "unknown shop",
+			request: map[string]interface{}{"name": "WMS", "permissions": []string{"inventory:read"}},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &APIKeysHandler{DB: db, Svc: &service.APIKeysService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+			testutils.WithPrincipal(c, "user-1")
+			c.Params = gin.Params{{Key: "shop_id", Value: "shop-1"}}
+
+			handler.Create(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), `"key":"esk_`)
+				assert.NotContains(t, w.Body.String(), "key_hash")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAPIKeysHandler_List_HidesKeys(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(`FROM api_keys WHERE shop_id=\$1 ORDER BY created_at DESC`).
+		WithArgs("shop-1").
+		WillReturnRows(sqlmock.NewRows(apiKeyCols).
+			AddRow("key-1", "shop-1", "WMS", "esk_abcdef12", `{"inventory:read"}`, "user-1", nil, nil, nil, time.Now()))
+
+	handler := &APIKeysHandler{DB: db, Svc: &service.APIKeysService{DB: db}}
+	c, w := testutils.TestGinContext()
+	c.Params = gin.Params{{Key: "shop_id", Value: "shop-1"}}
+
+	handler.List(c)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"prefix":"esk_abcdef12"`)
+	assert.NotContains(t, w.Body.String(), `"key":`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -11,6 +14,7 @@ import (
 	"ecommerce-shop/internal/config"
 	"ecommerce-shop/internal/entity"
 	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/server/web"
 	"ecommerce-shop/internal/service"
 )
 
@@ -32,15 +36,16 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		helpers.WriteError(c.Writer, http.StatusBadRequest, "Validation error", err.Error(), h.Log)
 		return
 	}
-	id, token, err := h.Svc.Register(c, req.Email, req.Password)
+	sess, err := h.Svc.Register(c, req.Email, req.Password)
 	if err != nil {
 		helpers.WriteError(c.Writer, http.StatusConflict, "Email exists", err.Error(), h.Log)
 		return
 	}
-	helpers.WriteSuccess(c.Writer, "Register successful", entity.AuthResponse{
-		ID:    id,
-		Token: token,
-	})
+	if sess.AccessToken == "" {
+		helpers.WriteSuccess(c.Writer, "Register successful, verify your email to log in", authResponse(sess))
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Register successful", authResponse(sess))
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -53,13 +58,174 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		helpers.WriteError(c.Writer, http.StatusBadRequest, "Validation error", err.Error(), h.Log)
 		return
 	}
-	id, token, err := h.Svc.Login(c, req.Email, req.Password)
-	if err != nil {
+	sess, err := h.Svc.Login(c, req.Email, req.Password, c.ClientIP())
+	switch {
+	case errors.Is(err, service.ErrLoginThrottled):
+		h.writeThrottled(c, err)
+		return
+	case errors.Is(err, service.ErrInvalidCredentials):
 		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Invalid credentials", err.Error(), h.Log)
 		return
+	case errors.Is(err, service.ErrEmailNotVerified):
+		helpers.WriteError(c.Writer, http.StatusForbidden, "Email not verified", err.Error(), h.Log)
+		return
+	case err != nil:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	if sess.MFAToken != "" {
+		helpers.WriteSuccess(c.Writer, "MFA code required", authResponse(sess))
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Login successful", authResponse(sess))
+}
+
+// Unlock lifts a login lockout on a user's account.
+func (h *AuthHandler) Unlock(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	err := h.Svc.UnlockAccount(c, p.UserID, c.Param("id"))
+	switch {
+	case errors.Is(err, service.ErrUserNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "User not found", err.Error(), h.Log)
+		return
+	case err != nil:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Account unlocked", nil)
+}
+
+// Refresh exchanges a refresh token for a new token pair.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req entity.RefreshReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	sess, err := h.Svc.Refresh(c, req.RefreshToken)
+	switch {
+	case errors.Is(err, service.ErrInvalidRefreshToken):
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Invalid refresh token", err.Error(), h.Log)
+		return
+	case errors.Is(err, service.ErrRefreshTokenReused):
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Refresh token reused", err.Error(), h.Log)
+		return
+	case err != nil:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Token refreshed", authResponse(sess))
+}
+
+// Logout revokes the caller's access token and the session's refresh token.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	if err := h.Svc.Logout(c, p); err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Logged out", nil)
+}
+
+// RequestPasswordReset mails a reset link. The response is the same whether
+// or not the email is registered.
+func (h *AuthHandler) RequestPasswordReset(c *gin.Context) {
+	var req entity.EmailReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	if err := h.Svc.RequestPasswordReset(c, req.Email); err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "If the email is registered, a reset link has been sent", nil)
+}
+
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req entity.ResetPasswordReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	if err := h.Svc.ResetPassword(c, req.Token, req.Password); err != nil {
+		h.writeLinkError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Password reset, log in with the new password", nil)
+}
+
+// RequestEmailVerification mails a new verification link. The response is the
+// same whether or not the email is registered or already verified.
+func (h *AuthHandler) RequestEmailVerification(c *gin.Context) {
+	var req entity.EmailReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	if err := h.Svc.RequestEmailVerification(c, req.Email); err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "If the email needs verifying, a link has been sent", nil)
+}
+
+func (h *AuthHandler) VerifyEmail(c *gin.Context) {
+	var req entity.TokenReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	if err := h.Svc.VerifyEmail(c, req.Token); err != nil {
+		h.writeLinkError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Email verified", nil)
+}
+
+func (h *AuthHandler) bindAndValidate(c *gin.Context, req interface{}) bool {
+	if err := c.ShouldBindJSON(req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), h.Log)
+		return false
+	}
+	if err := h.Validate.Struct(req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Validation error", err.Error(), h.Log)
+		return false
+	}
+	return true
+}
+
+// writeThrottled answers 429 with the wait in Retry-After.
+func (h *AuthHandler) writeThrottled(c *gin.Context, err error) {
+	var throttled *service.ThrottledError
+	if errors.As(err, &throttled) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+	}
+	helpers.WriteError(c.Writer, http.StatusTooManyRequests, "Too many login attempts", err.Error(), h.Log)
+}
+
+func (h *AuthHandler) writeLinkError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrInvalidEmailToken) {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid or expired link", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+}
+
+func authResponse(s service.Session) entity.AuthResponse {
+	out := entity.AuthResponse{
+		ID:           s.UserID,
+		Token:        s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		MFAToken:     s.MFAToken,
+
+		MFAEnrolmentRequired: s.MFAEnrolmentRequired,
+	}
+	if s.AccessToken != "" {
+		out.ExpiresAt = &s.ExpiresAt
 	}
-	helpers.WriteSuccess(c.Writer, "Login successful", entity.AuthResponse{
-		ID:    id,
-		Token: token,
-	})
+	return out
 }
@@ -3,9 +3,11 @@ package handlers
 import (
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 
 	"ecommerce-shop/internal/entity"
 	"ecommerce-shop/internal/service"
@@ -13,6 +15,7 @@ import (
 )
 
 func TestAuthHandler_Register(t *testing.T) {
+	keys := testutils.TestKeySet(t)
 	tests := []struct {
 		name           string
 		request        entity.RegisterReq
@@ -27,9 +30,19 @@ func TestAuthHandler_Register(t *testing.T) {
 				Password: "password123",
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
 				mock.ExpectQuery(`INSERT INTO users\(email, password_hash\) VALUES \(\$1,\$2\) RETURNING id`).
 					WithArgs("test@example.com", sqlmock.AnyArg()).
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
+				mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\)`).
+					WithArgs("user-123", "email_verification").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`INSERT INTO user_tokens`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO refresh_tokens`).
+					WithArgs("user-123", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
 			},
 			expectedStatus: 200,
 		},
@@ -60,9 +73,11 @@ func TestAuthHandler_Register(t *testing.T) {
 				Password: "password123",
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
 				mock.ExpectQuery(`INSERT INTO users\(email, password_hash\) VALUES \(\$1,\$2\) RETURNING id`).
 					WithArgs("test@example.com", sqlmock.AnyArg()).
 					WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
 			},
 			expectedStatus: 409,
 			expectedError:  "Email exists",
@@ -80,9 +95,10 @@ func TestAuthHandler_Register(t *testing.T) {
 			config := testutils.TestConfig()
 
 			authService := &service.AuthService{
-				DB:        db,
-				Log:       logger,
-				JWTSecret: "test-secret-key",
+				DB:     db,
+				Log:    logger,
+				Keys:   keys,
+				Mailer: &testutils.MockMailer{},
 			}
 			handler := &AuthHandler{
 				DB:       db,
@@ -115,12 +131,20 @@ func TestAuthHandler_Register(t *testing.T) {
 }
 
 func TestAuthHandler_Login(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashedPassword := string(hash)
+
 	tests := []struct {
 		name           string
 		request        entity.LoginReq
 		mockSetup      func(sqlmock.Sqlmock)
 		expectedStatus int
 		expectedError  string
+		retryAfter     string
 	}{
 		{
 			name: "successful login",
@@ -129,11 +153,32 @@ func TestAuthHandler_Login(t *testing.T) {
 				Password: "password123",
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock password hash for "password123"
-				hashedPassword := "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
-				mock.ExpectQuery(`SELECT id, password_hash FROM users WHERE email=\$1`).
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("ip", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
 					WithArgs("test@example.com").
-					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow("user-123", hashedPassword))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "role", "email_verified_at"}).AddRow("user-123", hashedPassword, "customer", time.Now()))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+					WithArgs("user-123").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.ExpectQuery(`FROM shop_members m`).
+					WithArgs("user-123").
+					WillReturnRows(sqlmock.NewRows([]string{"shop_id", "role"}).AddRow("shop-1", "staff"))
+				mock.ExpectExec(`INSERT INTO refresh_tokens`).
+					WithArgs("user-123", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`DELETE FROM login_attempts WHERE scope=\$1 AND key=\$2`).
+					WithArgs("account", "test@example.com").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE login_attempts SET failures=GREATEST\(failures-1, 0\), locked_until=NULL`).
+					WithArgs("ip", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 			expectedStatus: 200,
 		},
@@ -154,7 +199,15 @@ func TestAuthHandler_Login(t *testing.T) {
 				Password: "password123",
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT id, password_hash FROM users WHERE email=\$1`).
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("ip", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
 					WithArgs("test@example.com").
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -168,15 +221,68 @@ func TestAuthHandler_Login(t *testing.T) {
 				Password: "wrongpassword",
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock password hash for "password123"
-				hashedPassword := "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"
-				mock.ExpectQuery(`SELECT id, password_hash FROM users WHERE email=\$1`).
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("ip", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
 					WithArgs("test@example.com").
-					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash"}).AddRow("user-123", hashedPassword))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "role", "email_verified_at"}).AddRow("user-123", hashedPassword, "customer", time.Now()))
+			},
+			expectedStatus: 401,
+			expectedError:  "Invalid credentials",
+		},
+		{
+			name: "attempt that reaches the lockout is audited",
+			request: entity.LoginReq{
+				Email:    "Test@Example.com",
+				Password: "wrongpassword",
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(10))
+				mock.ExpectExec(`UPDATE login_attempts SET locked_until=\$3`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO audit_log`).
+					WithArgs("", "login.locked", "account:test@example.com", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("ip", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+				mock.ExpectCommit()
+				mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "role", "email_verified_at"}).AddRow("user-123", hashedPassword, "customer", time.Now()))
 			},
 			expectedStatus: 401,
 			expectedError:  "Invalid credentials",
 		},
+		{
+			name: "locked out",
+			request: entity.LoginReq{
+				Email:    "test@example.com",
+				Password: "password123",
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}))
+				mock.ExpectQuery(`SELECT locked_until FROM login_attempts`).
+					WithArgs("account", "test@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(90 * time.Second)))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 429,
+			expectedError:  "Too many login attempts",
+			retryAfter:     "90",
+		},
 	}
 
 	for _, tt := range tests {
@@ -190,9 +296,10 @@ func TestAuthHandler_Login(t *testing.T) {
 			config := testutils.TestConfig()
 
 			authService := &service.AuthService{
-				DB:        db,
-				Log:       logger,
-				JWTSecret: "test-secret-key",
+				DB:     db,
+				Log:    logger,
+				Keys:   keys,
+				Mailer: &testutils.MockMailer{},
 			}
 			handler := &AuthHandler{
 				DB:       db,
@@ -211,6 +318,9 @@ func TestAuthHandler_Login(t *testing.T) {
 			handler.Login(c)
 
 			// Assert
+			if tt.retryAfter != "" {
+				assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+			}
 			if tt.expectedError != "" {
 				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
 			} else {
@@ -223,3 +333,149 @@ func TestAuthHandler_Login(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthHandler_Refresh(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	tests := []struct {
+		name           string
+		request        entity.RefreshReq
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "reused token",
+			request: entity.RefreshReq{RefreshToken: "refresh-1"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "family_id", "expires_at", "used_at", "revoked_at"}).
+						AddRow("rt-1", "user-123", "fam-1", time.Now().Add(time.Hour), time.Now(), nil))
+				mock.ExpectExec(`INSERT INTO revoked_tokens`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at=now\(\)`).WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 401,
+			expectedError:  "Refresh token reused",
+		},
+		{
+			name:    "unknown token",
+			request: entity.RefreshReq{RefreshToken: "refresh-1"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: 401,
+			expectedError:  "Invalid refresh token",
+		},
+		{
+			name:           "missing token",
+			request:        entity.RefreshReq{},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Validation error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &AuthHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				Cfg:      testutils.TestConfig(),
+				Svc:      &service.AuthService{DB: db, Log: logger, Keys: keys, Mailer: &testutils.MockMailer{}},
+			}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+
+			handler.Refresh(c)
+
+			testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuthHandler_ResetPassword(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        entity.ResetPasswordReq
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "password reset",
+			request: entity.ResetPasswordReq{Token: "reset-1", Password: "new-password"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used_at"}).
+						AddRow("tok-1", "user-123", time.Now().Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\)`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE users SET password_hash=\$2`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO revoked_tokens`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at=now\(\)`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:    "used link",
+			request: entity.ResetPasswordReq{Token: "reset-1", Password: "new-password"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used_at"}).
+						AddRow("tok-1", "user-123", time.Now().Add(time.Minute), time.Now()))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 400,
+			expectedError:  "Invalid or expired link",
+		},
+		{
+			name:           "password too short",
+			request:        entity.ResetPasswordReq{Token: "reset-1", Password: "short"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Validation error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &AuthHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				Cfg:      testutils.TestConfig(),
+				Svc:      &service.AuthService{DB: db, Log: logger, Mailer: &testutils.MockMailer{}},
+			}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+
+			handler.ResetPassword(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Password reset")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/service"
+)
+
+// CatalogHandler manages products. The storefront listing with shop prices and
+// stock is served by ProductsHandler.
+type CatalogHandler struct {
+	DB  *sqlx.DB
+	Svc *service.CatalogService
+}
+
+func (h *CatalogHandler) Create(c *gin.Context) {
+	var req entity.CreateProductReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	p, err := h.Svc.Create(c, service.ProductInput{SKU: &req.SKU, Name: &req.Name, PriceCents: req.PriceCents, Currency: req.Currency})
+	if err != nil {
+		writeProductError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Product created", catalogProductResponse(p))
+}
+
+func (h *CatalogHandler) Get(c *gin.Context) {
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", "product id is not a uuid", nil)
+		return
+	}
+	p, err := h.Svc.Get(c, id)
+	if err != nil {
+		writeProductError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Product retrieved", catalogProductResponse(p))
+}
+
+func (h *CatalogHandler) Update(c *gin.Context) {
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", "product id is not a uuid", nil)
+		return
+	}
+	var req entity.UpdateProductReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	p, err := h.Svc.Update(c, id, service.ProductInput{SKU: req.SKU, Name: req.Name, PriceCents: req.PriceCents, Currency: req.Currency})
+	if err != nil {
+		writeProductError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Product updated", catalogProductResponse(p))
+}
+
+func (h *CatalogHandler) List(c *gin.Context) {
+	var q entity.ListCatalogQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), nil)
+		return
+	}
+	list, next, err := h.Svc.List(c, service.PageFilter{IncludeDeleted: q.IncludeDeleted, Cursor: q.Cursor, Limit: q.Limit})
+	if err != nil {
+		writeProductError(c, err)
+		return
+	}
+	out := entity.CatalogProductListResponse{
+		Products:   make([]entity.CatalogProductResponse, 0, len(list)),
+		NextCursor: next,
+	}
+	for _, p := range list {
+		out.Products = append(out.Products, catalogProductResponse(p))
+	}
+	helpers.WriteSuccess(c.Writer, "Products listed", out)
+}
+
+// Delete soft-deletes a product; orders that already reserved it are kept.
+func (h *CatalogHandler) Delete(c *gin.Context) {
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", "product id is not a uuid", nil)
+		return
+	}
+	if err := h.Svc.Delete(c, id); err != nil {
+		writeProductError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Product deleted", nil)
+}
+
+func writeProductError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrUnknownProduct):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", err.Error(), nil)
+	case errors.Is(err, service.ErrDuplicateSKU):
+		helpers.WriteError(c.Writer, http.StatusConflict, "SKU already exists", err.Error(), nil)
+	case errors.Is(err, service.ErrInvalidCursor):
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid cursor", err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	}
+}
+
+func catalogProductResponse(p models.Product) entity.CatalogProductResponse {
+	return entity.CatalogProductResponse{
+		ID:         p.ID,
+		SKU:        p.SKU,
+		Name:       p.Name,
+		PriceCents: p.PriceCents,
+		Currency:   p.Currency,
+		CreatedAt:  p.CreatedAt,
+		UpdatedAt:  p.UpdatedAt,
+		DeletedAt:  p.DeletedAt,
+	}
+}
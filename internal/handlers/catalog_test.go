@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/service"
+	"ecommerce-shop/testutils"
+)
+
+var productCols = []string{"id", "sku", "name", "price_cents", "currency", "created_at", "updated_at", "deleted_at"}
+
+func TestCatalogHandler_Create(t *testing.T) {
+	price, currency := int64(499), "EUR"
+	tests := []struct {
+		name           string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "created",
+			request: entity.CreateProductReq{SKU: "SKU-1", Name: "Widget", PriceCents: &price, Currency: &currency},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO products`).
+					WithArgs("SKU-1", "Widget", price, currency).
+					WillReturnRows(sqlmock.NewRows(productCols).AddRow("prod-1", "SKU-1", "Widget", price, currency, time.Now(), time.Now(), nil))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "missing SKU",
+			request:        map[string]interface{}{"name": "Widget"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:           "unknown currency",
+			request:        map[string]interface{}{"sku": "SKU-1", "name": "Widget", "price_cents": 499, "currency": "XXY"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:           "missing price",
+			request:        map[string]interface{}{"sku": "SKU-1", "name": "Widget", "currency": "EUR"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:           "missing currency",
+			request:        map[string]interface{}{"sku": "SKU-1", "name": "Widget", "price_cents": 499},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:    "SKU already exists",
+			request: entity.CreateProductReq{SKU: "SKU-1", Name: "Widget", PriceCents: &price, Currency: &currency},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO products`).
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			expectedStatus: 409,
+			expectedError:  "SKU already exists",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &CatalogHandler{DB: db, Svc: &service.CatalogService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+
+			handler.Create(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Product created")
+				assert.Contains(t, w.Body.String(), `"price_cents":499`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCatalogHandler_Update(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "renamed",
+			request: map[string]interface{}{"name": "Gadget"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE products SET`).
+					WithArgs(testProduct1, nil, "Gadget", nil, nil).
+					WillReturnRows(sqlmock.NewRows(productCols).AddRow(testProduct1, "SKU-1", "Gadget", 0, "USD", time.Now(), time.Now(), nil))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:    "SKU taken",
+			request: map[string]interface{}{"sku": "SKU-2"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE products SET`).
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			expectedStatus: 409,
+			expectedError:  "SKU already exists",
+		},
+		{
+			name:    "deleted product",
+			request: map[string]interface{}{"name": "Gadget"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE products SET`).
+					WillReturnRows(sqlmock.NewRows(productCols))
+			},
+			expectedStatus: 404,
+			expectedError:  "Product not found",
+		},
+		{
+			name:           "malformed id",
+			id:             "prod-1",
+			request:        map[string]interface{}{"name": "Gadget"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Product not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &CatalogHandler{DB: db, Svc: &service.CatalogService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+			id := testProduct1
+			if tt.id != "" {
+				id = tt.id
+			}
+			c.Params = gin.Params{{Key: "id", Value: id}}
+
+			handler.Update(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), `"name":"Gadget"`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
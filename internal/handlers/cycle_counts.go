@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/server/web"
+	"ecommerce-shop/internal/service"
+)
+
+type CycleCountsHandler struct {
+	DB  *sqlx.DB
+	Svc *service.CycleCountsService
+}
+
+func (h *CycleCountsHandler) Open(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", nil)
+		return
+	}
+	var req entity.OpenCountReq
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	cc, err := h.Svc.Open(c, p.UserID, c.Param("id"), req.ProductIDs)
+	if err != nil {
+		writeCountError(c, "Cannot open count", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Count opened", countResponse(cc))
+}
+
+// Review shows each line's variance next to the current stock.
+func (h *CycleCountsHandler) Review(c *gin.Context) {
+	r, err := h.Svc.Review(c, c.Param("id"))
+	if err != nil {
+		writeCountError(c, "DB error", err)
+		return
+	}
+	out := countResponse(r.CycleCount)
+	out.Lines = make([]entity.CountLineResponse, 0, len(r.Lines))
+	for _, l := range r.Lines {
+		line := entity.CountLineResponse{
+			ProductID: l.ProductID,
+			Snapshot:  l.SnapshotQty,
+			Counted:   l.CountedQty,
+			Variance:  l.Variance(),
+			OnHand:    l.OnHand,
+			Reserved:  l.Reserved,
+		}
+		if line.Variance != nil {
+			projected := l.OnHand + *line.Variance
+			line.Projected = &projected
+		}
+		out.Lines = append(out.Lines, line)
+	}
+	helpers.WriteSuccess(c.Writer, "Count found", out)
+}
+
+func (h *CycleCountsHandler) Submit(c *gin.Context) {
+	var req entity.SubmitCountReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	lines := make([]service.CountedLine, 0, len(req.Lines))
+	for _, l := range req.Lines {
+		lines = append(lines, service.CountedLine{ProductID: l.ProductID, Quantity: *l.Quantity})
+	}
+	if err := h.Svc.Submit(c, c.Param("id"), lines); err != nil {
+		writeCountError(c, "Cannot submit count", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Count submitted", nil)
+}
+
+func (h *CycleCountsHandler) Approve(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", nil)
+		return
+	}
+	cc, err := h.Svc.Approve(c, p.UserID, c.Param("id"))
+	if err != nil {
+		writeCountError(c, "Cannot approve count", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Count approved", countResponse(cc))
+}
+
+func (h *CycleCountsHandler) Cancel(c *gin.Context) {
+	cc, err := h.Svc.Cancel(c, c.Param("id"))
+	if err != nil {
+		writeCountError(c, "Cannot cancel count", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Count cancelled", countResponse(cc))
+}
+
+func writeCountError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, service.ErrDuplicateProduct):
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Duplicate product", err.Error(), nil)
+	case errors.Is(err, service.ErrCountNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Count not found", err.Error(), nil)
+	case errors.Is(err, service.ErrWarehouseNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", err.Error(), nil)
+	case errors.Is(err, service.ErrUnknownProduct), errors.Is(err, service.ErrProductNotInCount):
+		helpers.WriteError(c.Writer, http.StatusUnprocessableEntity, message, err.Error(), nil)
+	case errors.Is(err, service.ErrBelowReserved):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Stock is reserved", err.Error(), nil)
+	case errors.Is(err, service.ErrCountInProgress), errors.Is(err, service.ErrCountClosed), errors.Is(err, service.ErrCountIncomplete):
+		helpers.WriteError(c.Writer, http.StatusConflict, message, err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, message, err.Error(), nil)
+	}
+}
+
+func countResponse(cc models.CycleCount) entity.CountResponse {
+	return entity.CountResponse{
+		ID:          cc.ID,
+		WarehouseID: cc.WarehouseID,
+		Status:      string(cc.Status),
+		CreatedAt:   cc.CreatedAt,
+		ApprovedAt:  cc.ApprovedAt,
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/service"
+	"ecommerce-shop/testutils"
+)
+
+func TestCycleCountsHandler_Review(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+		expectedBody   []string
+	}{
+		{
+			name: "variance and projected stock",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM cycle_counts WHERE id=\$1`).
+					WithArgs("cc-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "warehouse_id", "status", "opened_by", "approved_by", "created_at", "updated_at", "approved_at"}).
+						AddRow("cc-1", "wh-1", "open", "user-1", nil, time.Now(), time.Now(), nil))
+				mock.ExpectQuery(`FROM cycle_count_lines l`).
+					WithArgs("cc-1", "wh-1").
+					WillReturnRows(sqlmock.NewRows([]string{"count_id", "product_id", "snapshot_qty", "counted_qty", "counted_at", "on_hand", "reserved"}).
+						AddRow("cc-1", "prod-1", 10, 7, time.Now(), 8, 1).
+						AddRow("cc-1", "prod-2", 3, nil, nil, 3, 0))
+			},
+			expectedStatus: 200,
+			expectedBody:   []string{`"variance":-3`, `"projected":5`, `"reserved":1`},
+		},
+		{
+			name: "count not found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM cycle_counts WHERE id=\$1`).
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: 404,
+			expectedError:  "Count not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &CycleCountsHandler{DB: db, Svc: &service.CycleCountsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			c.Params = gin.Params{{Key: "id", Value: "cc-1"}}
+
+			handler.Review(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				for _, s := range tt.expectedBody {
+					assert.Contains(t, w.Body.String(), s)
+				}
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCycleCountsHandler_Open_DuplicateProduct(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	handler := &CycleCountsHandler{DB: db, Svc: &service.CycleCountsService{DB: db}}
+	c, w := testutils.TestGinContextWithBody(t, map[string]interface{}{"product_ids": []string{"prod-1", "prod-1"}})
+	c.Params = gin.Params{{Key: "id", Value: "wh-1"}}
+	testutils.WithPrincipal(c, "user-1")
+
+	handler.Open(c)
+
+	testutils.AssertErrorResponse(t, w, 400, "Duplicate product")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCycleCountsHandler_Approve(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM cycle_counts WHERE id=\$1 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "warehouse_id", "status", "opened_by", "approved_by", "created_at", "updated_at", "approved_at"}).
+			AddRow("cc-1", "wh-1", "cancelled", "user-1", nil, time.Now(), time.Now(), nil))
+	mock.ExpectRollback()
+
+	handler := &CycleCountsHandler{DB: db, Svc: &service.CycleCountsService{DB: db}}
+	c, w := testutils.TestGinContext()
+	c.Params = gin.Params{{Key: "id", Value: "cc-1"}}
+	testutils.WithPrincipal(c, "user-1")
+
+	handler.Approve(c)
+
+	testutils.AssertErrorResponse(t, w, 409, "Cannot approve count")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
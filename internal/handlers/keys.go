@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"ecommerce-shop/internal/auth"
+)
+
+// KeysHandler publishes the public halves of the JWT signing keys so other
+// services can verify access tokens.
+type KeysHandler struct {
+	Keys *auth.KeySet
+}
+
+// JWKS serves the JSON Web Key Set. Verifiers may cache it for five minutes,
+// so a new key has to be listed at least that long before it starts signing.
+func (h *KeysHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.Keys.JWKS())
+}
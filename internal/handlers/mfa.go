@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/server/web"
+	"ecommerce-shop/internal/service"
+)
+
+// LoginMFA finishes a login that answered with an mfa_token.
+func (h *AuthHandler) LoginMFA(c *gin.Context) {
+	var req entity.MFALoginReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	sess, err := h.Svc.CompleteMFALogin(c, req.MFAToken, req.Code, c.ClientIP())
+	if err != nil {
+		h.writeMFAError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Login successful", authResponse(sess))
+}
+
+// EnrollMFA starts TOTP enrolment for the caller.
+func (h *AuthHandler) EnrollMFA(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	e, err := h.Svc.BeginMFAEnrolment(c, p.UserID)
+	if err != nil {
+		h.writeMFAError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Scan the code, then confirm with a code from the app",
+		entity.MFAEnrolmentResponse{Secret: e.Secret, OTPAuthURI: e.URI})
+}
+
+// ConfirmMFA enables TOTP with a first code and returns the recovery codes
+// and a session with the caller's full privileges.
+func (h *AuthHandler) ConfirmMFA(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	var req entity.MFACodeReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	sess, codes, err := h.Svc.ConfirmMFAEnrolment(c, p.UserID, req.Code, c.ClientIP())
+	if err != nil {
+		h.writeMFAError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Two-factor authentication enabled",
+		entity.MFAConfirmResponse{AuthResponse: authResponse(sess), RecoveryCodes: codes})
+}
+
+func (h *AuthHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	var req entity.MFACodeReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	codes, err := h.Svc.RegenerateRecoveryCodes(c, p.UserID, req.Code, c.ClientIP())
+	if err != nil {
+		h.writeMFAError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Recovery codes replaced", entity.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (h *AuthHandler) DisableMFA(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	var req entity.MFACodeReq
+	if !h.bindAndValidate(c, &req) {
+		return
+	}
+	if err := h.Svc.DisableMFA(c, p.UserID, req.Code, c.ClientIP()); err != nil {
+		h.writeMFAError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Two-factor authentication disabled", nil)
+}
+
+func (h *AuthHandler) writeMFAError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrLoginThrottled):
+		h.writeThrottled(c, err)
+	case errors.Is(err, service.ErrInvalidMFAChallenge):
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Invalid or expired MFA challenge", err.Error(), h.Log)
+	case errors.Is(err, service.ErrInvalidMFACode):
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Invalid code", err.Error(), h.Log)
+	case errors.Is(err, service.ErrMFAAlreadyEnabled):
+		helpers.WriteError(c.Writer, http.StatusConflict, "MFA already enabled", err.Error(), h.Log)
+	case errors.Is(err, service.ErrMFANotEnabled):
+		helpers.WriteError(c.Writer, http.StatusConflict, "MFA not enabled", err.Error(), h.Log)
+	case errors.Is(err, service.ErrMFARequired):
+		helpers.WriteError(c.Writer, http.StatusForbidden, "MFA required for your role", err.Error(), h.Log)
+	case errors.Is(err, service.ErrUserNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "User not found", err.Error(), h.Log)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+	}
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/service"
+	"ecommerce-shop/testutils"
+)
+
+func TestAuthHandler_LoginMFA(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        entity.MFALoginReq
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+		retryAfter     string
+	}{
+		{
+			name:    "expired challenge",
+			request: entity.MFALoginReq{MFAToken: "challenge-1", Code: "123456"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used_at"}).
+						AddRow("tok-1", "user-123", time.Now().Add(-time.Minute), nil))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 401,
+			expectedError:  "Invalid or expired MFA challenge",
+		},
+		{
+			name:    "account locked",
+			request: entity.MFALoginReq{MFAToken: "challenge-1", Code: "123456"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "expires_at", "used_at"}).
+						AddRow("tok-1", "user-123", time.Now().Add(time.Minute), nil))
+				mock.ExpectQuery(`FROM user_mfa m JOIN users u`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "secret", "confirmed_at", "last_used_step"}).
+						AddRow("user-123", "test@example.com", "GEZDGNBVGY3TQOJQ", time.Now(), 0))
+				mock.ExpectQuery(`INSERT INTO login_attempts`).
+					WithArgs("account", "test@example.com", sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"failures"}))
+				mock.ExpectQuery(`SELECT locked_until FROM login_attempts`).
+					WithArgs("account", "test@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(30 * time.Second)))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 429,
+			expectedError:  "Too many login attempts",
+			retryAfter:     "30",
+		},
+		{
+			name:           "missing code",
+			request:        entity.MFALoginReq{MFAToken: "challenge-1"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Validation error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &AuthHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				Cfg:      testutils.TestConfig(),
+				Svc:      &service.AuthService{DB: db, Log: logger, Mailer: &testutils.MockMailer{}},
+			}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+
+			handler.LoginMFA(c)
+
+			if tt.retryAfter != "" {
+				assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+			}
+			testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/oidc"
+	"ecommerce-shop/internal/service"
+)
+
+// oidcStateCookie holds the state of the login the browser started, so a
+// callback only finishes logins begun in the same browser.
+const (
+	oidcStateCookie = "oidc_state"
+	oidcStateMaxAge = 600
+)
+
+// OIDCLogin sends the browser to the identity provider.
+func (h *AuthHandler) OIDCLogin(c *gin.Context) {
+	provider := c.Param("provider")
+	authURL, state, err := h.Svc.BeginOIDCLogin(c, provider)
+	if err != nil {
+		h.writeOIDCError(c, err)
+		return
+	}
+	h.setOIDCState(c, provider, state, oidcStateMaxAge)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback finishes the login when the provider sends the browser back,
+// answering like Login.
+func (h *AuthHandler) OIDCCallback(c *gin.Context) {
+	provider := c.Param("provider")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	// the state is used up whatever happens next
+	h.setOIDCState(c, provider, "", -1)
+	if e := c.Query("error"); e != "" {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Identity provider login failed",
+			strings.TrimSpace(e+" "+c.Query("error_description")), h.Log)
+		return
+	}
+	state := c.Query("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid or expired login state",
+			"state does not match the login started in this browser", h.Log)
+		return
+	}
+	sess, err := h.Svc.CompleteOIDCLogin(c, provider, c.Query("code"), state, c.ClientIP())
+	if err != nil {
+		h.writeOIDCError(c, err)
+		return
+	}
+	if sess.MFAToken != "" {
+		helpers.WriteSuccess(c.Writer, "MFA code required", authResponse(sess))
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Login successful", authResponse(sess))
+}
+
+func (h *AuthHandler) setOIDCState(c *gin.Context, provider, state string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc/" + provider,
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(h.Cfg.AppBaseURL, "https://"),
+		HttpOnly: true,
+		// Lax, so the cookie comes along on the provider's redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (h *AuthHandler) writeOIDCError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrUnknownIdentityProvider):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Unknown identity provider", err.Error(), h.Log)
+	case errors.Is(err, service.ErrInvalidOIDCState):
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid or expired login state", err.Error(), h.Log)
+	case errors.Is(err, oidc.ErrCodeRejected), errors.Is(err, oidc.ErrInvalidIDToken):
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Identity provider login failed", err.Error(), h.Log)
+	case errors.Is(err, service.ErrIdentityNotLinked):
+		helpers.WriteError(c.Writer, http.StatusForbidden, "No account for this identity", err.Error(), h.Log)
+	case errors.Is(err, oidc.ErrProviderUnavailable):
+		helpers.WriteError(c.Writer, http.StatusBadGateway, "Identity provider unavailable", err.Error(), h.Log)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+	}
+}
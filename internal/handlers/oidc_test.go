@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ecommerce-shop/internal/oidc"
+	"ecommerce-shop/internal/service"
+	"ecommerce-shop/testutils"
+)
+
+func oidcHandler(t *testing.T, fake *testutils.FakeOIDCProvider) (*AuthHandler, sqlmock.Sqlmock) {
+	db, mock := testutils.MockDB(t)
+	t.Cleanup(func() { db.Close() })
+	p, err := oidc.NewProvider(oidc.Config{Name: "corp", Issuer: fake.URL, ClientID: fake.ClientID, ClientSecret: fake.ClientSecret, RedirectURL: fake.RedirectURL}, nil)
+	require.NoError(t, err)
+	svc := &service.AuthService{
+		DB:                db,
+		Log:               testutils.MockLogger(t),
+		Keys:              testutils.TestKeySet(t),
+		IdentityProviders: map[string]*service.IdentityProvider{"corp": {Provider: p}},
+	}
+	return &AuthHandler{DB: db, Log: svc.Log, Validate: testutils.TestValidator(), Cfg: testutils.TestConfig(), Svc: svc}, mock
+}
+
+func oidcContext(target, provider string, cookie *http.Cookie) (*gin.Context, *httptest.ResponseRecorder) {
+	c, w := testutils.TestGinContext()
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	if cookie != nil {
+		c.Request.AddCookie(cookie)
+	}
+	c.Params = gin.Params{{Key: "provider", Value: provider}}
+	return c, w
+}
+
+func TestAuthHandler_OIDCLogin(t *testing.T) {
+	fake := testutils.NewFakeOIDCProvider(t)
+	handler, mock := oidcHandler(t, fake)
+
+	// login redirects to the provider and remembers the state in a cookie
+	var nonce, verifier string
+	mock.ExpectExec(`INSERT INTO oidc_logins`).
+		WithArgs(sqlmock.AnyArg(), "corp", captured{&nonce}, captured{&verifier}, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	c, w := oidcContext("/api/oidc/corp/login", "corp", nil)
+	handler.OIDCLogin(c)
+
+	require.Equal(t, http.StatusFound, w.Code)
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "oidc_state", cookies[0].Name)
+	assert.Equal(t, "/api/oidc/corp", cookies[0].Path)
+	assert.True(t, cookies[0].HttpOnly)
+	code, state := fake.Authorize(t, w.Header().Get("Location"), testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example", EmailVerified: true})
+	assert.Equal(t, cookies[0].Value, state)
+
+	// the provider sends the browser back
+	mock.ExpectQuery(`DELETE FROM oidc_logins`).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "expires_at"}).AddRow(nonce, verifier, time.Now().Add(time.Minute)))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE user_identities`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-1"))
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery(`SELECT id, role FROM users WHERE id=\$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow("user-1", "customer"))
+	mock.ExpectQuery(`FROM shop_members m`).
+		WillReturnRows(sqlmock.NewRows([]string{"shop_id", "role"}))
+	mock.ExpectExec(`INSERT INTO refresh_tokens`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	c, w = oidcContext("/api/oidc/corp/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), "corp", cookies[0])
+	handler.OIDCCallback(c)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Login successful")
+	assert.Contains(t, w.Body.String(), `"refresh_token"`)
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "oidc_state=;")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthHandler_OIDCCallback_Errors(t *testing.T) {
+	fake := testutils.NewFakeOIDCProvider(t)
+	state := &http.Cookie{Name: "oidc_state", Value: "state-1"}
+
+	tests := []struct {
+		name           string
+		target         string
+		provider       string
+		cookie         *http.Cookie
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "state from another browser",
+			target:         "/api/oidc/corp/callback?code=c&state=state-2",
+			provider:       "corp",
+			cookie:         state,
+			expectedStatus: 400,
+			expectedError:  "Invalid or expired login state",
+		},
+		{
+			name:           "no cookie",
+			target:         "/api/oidc/corp/callback?code=c&state=state-1",
+			provider:       "corp",
+			expectedStatus: 400,
+			expectedError:  "Invalid or expired login state",
+		},
+		{
+			name:           "provider refused",
+			target:         "/api/oidc/corp/callback?error=access_denied&state=state-1",
+			provider:       "corp",
+			cookie:         state,
+			expectedStatus: 401,
+			expectedError:  "Identity provider login failed",
+		},
+		{
+			name:           "unknown provider",
+			target:         "/api/oidc/other/callback?code=c&state=state-1",
+			provider:       "other",
+			cookie:         state,
+			expectedStatus: 404,
+			expectedError:  "Unknown identity provider",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mock := oidcHandler(t, fake)
+			c, w := oidcContext(tt.target, tt.provider, tt.cookie)
+
+			handler.OIDCCallback(c)
+
+			testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// captured records the string a mocked statement was called with
+type captured struct{ v *string }
+
+func (c captured) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.v = s
+	return ok
+}
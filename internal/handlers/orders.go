@@ -1,16 +1,20 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/server/web"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 
+	"ecommerce-shop/internal/allocation"
 	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/models"
 	"ecommerce-shop/internal/service"
 )
 
@@ -23,17 +27,11 @@ type OrdersHandler struct {
 }
 
 func (h *OrdersHandler) Create(c *gin.Context) {
-	idk := c.GetHeader("Idempotency-Key")
-	if idk == "" {
-		helpers.WriteError(c.Writer, http.StatusBadRequest, "Missing Idempotency-Key", "", h.Log)
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
 		return
 	}
-	body, err := c.GetRawData()
-	if err != nil {
-		helpers.WriteError(c.Writer, http.StatusBadRequest, "Bad body", err.Error(), h.Log)
-		return
-	}
-	c.Request.Body = http.NoBody
 	var req entity.CreateOrderReq
 	if err := c.BindJSON(&req); err != nil {
 		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), h.Log)
@@ -43,41 +41,221 @@ func (h *OrdersHandler) Create(c *gin.Context) {
 		helpers.WriteError(c.Writer, http.StatusBadRequest, "Validation error", err.Error(), h.Log)
 		return
 	}
-	orderID, err := h.Svc.Create(c, idk, body, req.ShopID, func() []struct {
-		ProductID string
-		Quantity  int
-	} {
-		out := make([]struct {
-			ProductID string
-			Quantity  int
-		}, 0, len(req.Items))
-		for _, it := range req.Items {
-			out = append(out, struct {
-				ProductID string
-				Quantity  int
-			}{ProductID: it.ProductID, Quantity: it.Quantity})
-		}
-		return out
-	}())
-	if err != nil {
+	lines := make([]service.OrderLine, 0, len(req.Items))
+	for _, it := range req.Items {
+		lines = append(lines, service.OrderLine{ProductID: it.ProductID, Quantity: it.Quantity})
+	}
+	var shipTo *allocation.Point
+	if req.ShipTo != nil {
+		shipTo = &allocation.Point{Lat: req.ShipTo.Lat, Lng: req.ShipTo.Lng}
+	}
+	order, err := h.Svc.Create(c, p.UserID, req.ShopID, lines, shipTo)
+	if errors.Is(err, service.ErrUnknownProduct) || errors.Is(err, service.ErrCurrencyMismatch) {
+		helpers.WriteError(c.Writer, http.StatusUnprocessableEntity, "Cannot price order", err.Error(), h.Log)
+		return
+	}
+	if errors.Is(err, service.ErrShopNotFound) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", err.Error(), h.Log)
+		return
+	}
+	if errors.Is(err, service.ErrInsufficientStock) {
 		helpers.WriteError(c.Writer, http.StatusConflict, "Insufficient stock", err.Error(), h.Log)
 		return
 	}
-	helpers.WriteSuccess(c.Writer, "Order reserved", entity.OrderResponse{
+	if err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "Cannot create order", err.Error(), h.Log)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Order reserved", orderResponse(order))
+}
+
+func (h *OrdersHandler) Pay(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	order, err := h.Svc.Pay(c, p.UserID, c.Param("id"))
+	if err != nil {
+		h.writeOrderError(c, "Cannot pay", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Order paid", orderResponse(order))
+}
+
+func (h *OrdersHandler) Cancel(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	orderID := c.Param("id")
+	if err := h.Svc.Cancel(c, p.UserID, orderID); err != nil {
+		h.writeOrderError(c, "Cannot cancel", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Order cancelled", entity.OrderResponse{
 		ID:     orderID,
-		Status: "reserved",
+		Status: string(models.OrderCancelled),
 	})
 }
 
-func (h *OrdersHandler) Pay(c *gin.Context) {
+func (h *OrdersHandler) Fulfil(c *gin.Context) {
+	h.advance(c, models.OrderFulfilled, "Order fulfilled")
+}
+
+func (h *OrdersHandler) Ship(c *gin.Context) {
+	h.advance(c, models.OrderShipped, "Order shipped")
+}
+
+func (h *OrdersHandler) Deliver(c *gin.Context) {
+	h.advance(c, models.OrderDelivered, "Order delivered")
+}
+
+func (h *OrdersHandler) Refund(c *gin.Context) {
+	h.advance(c, models.OrderRefunded, "Order refunded")
+}
+
+func (h *OrdersHandler) advance(c *gin.Context, next models.OrderStatus, message string) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
 	orderID := c.Param("id")
-	err := h.Svc.Pay(c, orderID)
-	if err != nil {
-		helpers.WriteError(c.Writer, http.StatusBadRequest, "Cannot pay", err.Error(), h.Log)
+	if err := h.Svc.Advance(c, p, orderID, next); err != nil {
+		h.writeOrderError(c, "Cannot update order", err)
 		return
 	}
-	helpers.WriteSuccess(c.Writer, "Order paid", entity.OrderResponse{
+	helpers.WriteSuccess(c.Writer, message, entity.OrderResponse{
 		ID:     orderID,
-		Status: "paid",
+		Status: string(next),
 	})
 }
+
+// writeOrderError maps service errors to HTTP codes; anything unrecognised is
+// a 500 with message, so idempotent retries of it run again.
+func (h *OrdersHandler) writeOrderError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, service.ErrOrderExpired):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Order expired", err.Error(), h.Log)
+	case errors.Is(err, service.ErrOrderNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Order not found", err.Error(), h.Log)
+	case errors.Is(err, service.ErrNotOrderOwner), errors.Is(err, service.ErrNotShopStaff):
+		helpers.WriteError(c.Writer, http.StatusForbidden, "Forbidden", err.Error(), h.Log)
+	case errors.Is(err, models.ErrInvalidTransition):
+		helpers.WriteError(c.Writer, http.StatusConflict, message, err.Error(), h.Log)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, message, err.Error(), h.Log)
+	}
+}
+
+func (h *OrdersHandler) Get(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Order not found", "order id is not a uuid", h.Log)
+		return
+	}
+	d, err := h.Svc.Get(c, p.UserID, id)
+	if errors.Is(err, service.ErrOrderNotFound) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Order not found", err.Error(), h.Log)
+		return
+	}
+	if err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	out := entity.OrderDetailResponse{
+		OrderSummaryResponse: orderSummary(d.Order),
+		Items:                make([]entity.OrderItemResponse, 0, len(d.Items)),
+		Reservations:         make([]entity.ReservationResponse, 0, len(d.Reservations)),
+	}
+	for _, it := range d.Items {
+		out.Items = append(out.Items, entity.OrderItemResponse{
+			ProductID:      it.ProductID,
+			Quantity:       it.Quantity,
+			UnitPriceCents: it.UnitPriceCents,
+			Currency:       it.Currency,
+		})
+	}
+	for _, r := range d.Reservations {
+		out.Reservations = append(out.Reservations, entity.ReservationResponse{
+			WarehouseID: r.WarehouseID,
+			ProductID:   r.ProductID,
+			Quantity:    r.Quantity,
+			ExpiresAt:   r.ExpiresAt,
+			Released:    r.Released,
+		})
+	}
+	helpers.WriteSuccess(c.Writer, "Order found", out)
+}
+
+func (h *OrdersHandler) List(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", h.Log)
+		return
+	}
+	var q entity.ListOrdersQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), h.Log)
+		return
+	}
+	if err := h.Validate.Struct(q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Validation error", err.Error(), h.Log)
+		return
+	}
+	list, next, err := h.Svc.List(c, p.UserID, service.OrderFilter{
+		Status: q.Status,
+		From:   q.From,
+		To:     q.To,
+		Cursor: q.Cursor,
+		Limit:  q.Limit,
+	})
+	if errors.Is(err, service.ErrInvalidCursor) {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid cursor", err.Error(), h.Log)
+		return
+	}
+	if err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), h.Log)
+		return
+	}
+	out := entity.OrderListResponse{
+		Orders:     make([]entity.OrderSummaryResponse, 0, len(list)),
+		NextCursor: next,
+	}
+	for _, o := range list {
+		out.Orders = append(out.Orders, orderSummary(o))
+	}
+	helpers.WriteSuccess(c.Writer, "Orders listed", out)
+}
+
+func orderResponse(o models.Order) entity.OrderResponse {
+	return entity.OrderResponse{
+		ID:         o.ID,
+		Status:     string(o.Status),
+		TotalCents: o.TotalCents,
+		Currency:   o.Currency,
+	}
+}
+
+func orderSummary(o models.Order) entity.OrderSummaryResponse {
+	out := entity.OrderSummaryResponse{
+		ID:         o.ID,
+		ShopID:     o.ShopID,
+		Status:     string(o.Status),
+		TotalCents: o.TotalCents,
+		Currency:   o.Currency,
+		CreatedAt:  o.CreatedAt,
+		UpdatedAt:  o.UpdatedAt,
+	}
+	if o.StatusReason != nil {
+		out.StatusReason = *o.StatusReason
+	}
+	return out
+}
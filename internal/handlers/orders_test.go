@@ -2,109 +2,114 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
+	"ecommerce-shop/internal/auth"
 	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/idempotency"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/server/web"
 	"ecommerce-shop/internal/service"
 	"ecommerce-shop/testutils"
 )
 
+const (
+	testShopID   = "550e8400-e29b-41d4-a716-446655440000"
+	testProduct1 = "550e8400-e29b-41d4-a716-446655440001"
+	testProduct2 = "550e8400-e29b-41d4-a716-446655440002"
+	testUserID   = "550e8400-e29b-41d4-a716-446655440003"
+)
+
 func TestOrdersHandler_Create(t *testing.T) {
 	tests := []struct {
 		name           string
-		idempotencyKey string
+		userID         string
 		request        entity.CreateOrderReq
+		rawBody        string
 		mockSetup      func(sqlmock.Sqlmock)
 		expectedStatus int
 		expectedError  string
 	}{
 		{
-			name:           "successful order creation",
-			idempotencyKey: "test-key-123",
+			name:   "successful order creation",
+			userID: "user-123",
 			request: entity.CreateOrderReq{
-				ShopID: "shop-123",
+				ShopID: testShopID,
 				Items: []entity.OrderItemReq{
-					{ProductID: "prod-1", Quantity: 2},
-					{ProductID: "prod-2", Quantity: 1},
+					{ProductID: testProduct1, Quantity: 2},
+					{ProductID: testProduct2, Quantity: 1},
 				},
+				ShipTo: &entity.GeoPoint{Lat: 50.85, Lng: 4.35},
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
-				// Mock idempotency key check
-				mock.ExpectQuery(`SELECT order_id FROM idempotency_keys WHERE key=\$1 AND request_hash=\$2`).
-					WithArgs("test-key-123", sqlmock.AnyArg()).
-					WillReturnError(sql.ErrNoRows)
-
-				// Mock idempotency key insert
-				mock.ExpectExec(`INSERT INTO idempotency_keys\(key, user_id, request_hash\) VALUES \(\$1, gen_random_uuid\(\), \$2\)`).
-					WithArgs("test-key-123", sqlmock.AnyArg()).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock order creation
-				mock.ExpectQuery(`INSERT INTO orders\(user_id, shop_id, status\) VALUES \(gen_random_uuid\(\), \$1, 'reserved'\) RETURNING id`).
-					WithArgs("shop-123").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("order-123"))
+				// Mock price lookup
+				mock.ExpectQuery(`SELECT p\.id AS product_id, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents`).
+					WithArgs(testShopID, pq.Array([]string{testProduct1, testProduct2})).
+					WillReturnRows(sqlmock.NewRows([]string{"product_id", "price_cents", "currency"}).
+						AddRow(testProduct1, 1000, "USD").
+						AddRow(testProduct2, 250, "USD"))
+
+				// Mock shop allocation strategy
+				mock.ExpectQuery(`SELECT allocation_strategy FROM shops WHERE id=\$1`).
+					WithArgs(testShopID).
+					WillReturnRows(sqlmock.NewRows([]string{"allocation_strategy"}).AddRow("nearest"))
+
+				// Mock order creation with the quoted total
+				mock.ExpectQuery(`INSERT INTO orders\(user_id, shop_id, status, total_cents, currency\) VALUES \(\$1,\$2,'reserved',\$3,\$4\) RETURNING id, created_at, updated_at`).
+					WithArgs("user-123", testShopID, int64(2250), "USD").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow("order-123", time.Now(), time.Now()))
+
+				// Mock active warehouses query; wh-2 is nearer the shipping address
+				mock.ExpectQuery(`SELECT id, priority, latitude, longitude FROM warehouses WHERE shop_id=\$1 AND active=TRUE ORDER BY id`).
+					WithArgs(testShopID).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "priority", "latitude", "longitude"}).
+						AddRow("wh-1", 100, 40.42, -3.70).
+						AddRow("wh-2", 100, 48.86, 2.35))
+
+				lines := []struct {
+					product string
+					qty     int
+					price   int64
+				}{{testProduct1, 2, 1000}, {testProduct2, 1, 250}}
 
 				// Mock order items insert
-				mock.ExpectExec(`INSERT INTO order_items\(order_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)`).
-					WithArgs("order-123", "prod-1", 2).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock active warehouses query
-				mock.ExpectQuery(`SELECT id FROM warehouses WHERE shop_id=\$1 AND active=TRUE`).
-					WithArgs("shop-123").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("wh-1"))
-
-				// Mock inventory lock
-				mock.ExpectQuery(`SELECT quantity FROM inventory WHERE warehouse_id=\$1 AND product_id=\$2 FOR UPDATE`).
-					WithArgs("wh-1", "prod-1").
-					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(10))
-
-				// Mock reserved quantity query
-				mock.ExpectQuery(`SELECT COALESCE\(SUM\(quantity\),0\) FROM reservations WHERE warehouse_id=\$1 AND product_id=\$2 AND released=FALSE AND expires_at>now\(\)`).
-					WithArgs("wh-1", "prod-1").
-					WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
+				for _, line := range lines {
+					mock.ExpectExec(`INSERT INTO order_items\(order_id, product_id, quantity, unit_price_cents, currency\) VALUES \(\$1,\$2,\$3,\$4,\$5\)`).
+						WithArgs("order-123", line.product, line.qty, line.price, "USD").
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				}
+
+				// Mock batched inventory lock and reserved sums
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory WHERE warehouse_id = ANY\(\$1\) AND product_id = ANY\(\$2\) ORDER BY warehouse_id, product_id FOR UPDATE`).
+					WithArgs(pq.Array([]string{"wh-1", "wh-2"}), pq.Array([]string{testProduct1, testProduct2})).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).
+						AddRow("wh-1", testProduct1, 10).
+						AddRow("wh-1", testProduct2, 10).
+						AddRow("wh-2", testProduct1, 10).
+						AddRow("wh-2", testProduct2, 10))
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations`).
+					WithArgs(pq.Array([]string{"wh-1", "wh-2"}), pq.Array([]string{testProduct1, testProduct2})).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}))
 
 				// Mock reservation insert
-				mock.ExpectExec(`INSERT INTO reservations\(order_id, warehouse_id, product_id, quantity, expires_at\) VALUES \(\$1,\$2,\$3,\$4,now\(\)\+interval '\$5 minutes'\)`).
-					WithArgs("order-123", "wh-1", "prod-1", 2, 15).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock second order item
-				mock.ExpectExec(`INSERT INTO order_items\(order_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)`).
-					WithArgs("order-123", "prod-2", 1).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock active warehouses query for second item
-				mock.ExpectQuery(`SELECT id FROM warehouses WHERE shop_id=\$1 AND active=TRUE`).
-					WithArgs("shop-123").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("wh-1"))
-
-				// Mock inventory lock for second item
-				mock.ExpectQuery(`SELECT quantity FROM inventory WHERE warehouse_id=\$1 AND product_id=\$2 FOR UPDATE`).
-					WithArgs("wh-1", "prod-2").
-					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(5))
-
-				// Mock reserved quantity query for second item
-				mock.ExpectQuery(`SELECT COALESCE\(SUM\(quantity\),0\) FROM reservations WHERE warehouse_id=\$1 AND product_id=\$2 AND released=FALSE AND expires_at>now\(\)`).
-					WithArgs("wh-1", "prod-2").
-					WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(0))
-
-				// Mock reservation insert for second item
-				mock.ExpectExec(`INSERT INTO reservations\(order_id, warehouse_id, product_id, quantity, expires_at\) VALUES \(\$1,\$2,\$3,\$4,now\(\)\+interval '\$5 minutes'\)`).
-					WithArgs("order-123", "wh-1", "prod-2", 1, 15).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock idempotency key update
-				mock.ExpectExec(`UPDATE idempotency_keys SET order_id=\$2 WHERE key=\$1`).
-					WithArgs("test-key-123", "order-123").
-					WillReturnResult(sqlmock.NewResult(1, 1))
+				for _, line := range lines {
+					mock.ExpectExec(`INSERT INTO reservations\(order_id, warehouse_id, product_id, quantity, expires_at\) VALUES \(\$1,\$2,\$3,\$4,\$5\)`).
+						WithArgs("order-123", "wh-2", line.product, line.qty, sqlmock.AnyArg()).
+						WillReturnResult(sqlmock.NewResult(1, 1))
+				}
 
 				// Mock transaction commit
 				mock.ExpectCommit()
@@ -112,39 +117,100 @@ func TestOrdersHandler_Create(t *testing.T) {
 			expectedStatus: 200,
 		},
 		{
-			name:           "missing idempotency key",
-			idempotencyKey: "",
+			name:   "insufficient stock",
+			userID: "user-123",
 			request: entity.CreateOrderReq{
-				ShopID: "shop-123",
-				Items:  []entity.OrderItemReq{{ProductID: "prod-1", Quantity: 1}},
+				ShopID: testShopID,
+				Items:  []entity.OrderItemReq{{ProductID: testProduct1, Quantity: 3}},
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT p\.id AS product_id`).
+					WithArgs(testShopID, pq.Array([]string{testProduct1})).
+					WillReturnRows(sqlmock.NewRows([]string{"product_id", "price_cents", "currency"}).AddRow(testProduct1, 1000, "USD"))
+				mock.ExpectQuery(`SELECT allocation_strategy FROM shops`).
+					WithArgs(testShopID).
+					WillReturnRows(sqlmock.NewRows([]string{"allocation_strategy"}).AddRow("priority"))
+				mock.ExpectQuery(`INSERT INTO orders`).
+					WithArgs("user-123", testShopID, int64(3000), "USD").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow("order-123", time.Now(), time.Now()))
+				mock.ExpectQuery(`SELECT id, priority, latitude, longitude FROM warehouses`).
+					WithArgs(testShopID).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "priority", "latitude", "longitude"}).
+						AddRow("wh-1", 100, nil, nil).
+						AddRow("wh-2", 100, nil, nil))
+				mock.ExpectExec(`INSERT INTO order_items`).
+					WithArgs("order-123", testProduct1, 3, int64(1000), "USD").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory`).
+					WithArgs(pq.Array([]string{"wh-1", "wh-2"}), pq.Array([]string{testProduct1})).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).
+						AddRow("wh-1", testProduct1, 1).
+						AddRow("wh-2", testProduct1, 1))
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations`).
+					WithArgs(pq.Array([]string{"wh-1", "wh-2"}), pq.Array([]string{testProduct1})).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Insufficient stock",
+		},
+		{
+			name: "missing principal",
+			request: entity.CreateOrderReq{
+				ShopID: testShopID,
+				Items:  []entity.OrderItemReq{{ProductID: testProduct1, Quantity: 1}},
 			},
 			mockSetup:      func(mock sqlmock.Sqlmock) {},
-			expectedStatus: 400,
-			expectedError:  "Missing Idempotency-Key",
+			expectedStatus: 401,
+			expectedError:  "Unauthorized",
 		},
 		{
 			name:           "invalid JSON",
-			idempotencyKey: "test-key-123",
-			request:        entity.CreateOrderReq{},
+			userID:         "user-123",
+			rawBody:        `{"shop_id":`,
 			mockSetup:      func(mock sqlmock.Sqlmock) {},
 			expectedStatus: 400,
 			expectedError:  "Invalid JSON",
 		},
 		{
-			name:           "validation error - missing shop_id",
-			idempotencyKey: "test-key-123",
+			name:   "validation error - missing shop_id",
+			userID: "user-123",
+			request: entity.CreateOrderReq{
+				Items: []entity.OrderItemReq{{ProductID: testProduct1, Quantity: 1}},
+			},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Validation error",
+		},
+		{
+			name:   "validation error - ship_to out of range",
+			userID: "user-123",
 			request: entity.CreateOrderReq{
-				Items: []entity.OrderItemReq{{ProductID: "prod-1", Quantity: 1}},
+				ShopID: testShopID,
+				Items:  []entity.OrderItemReq{{ProductID: testProduct1, Quantity: 1}},
+				ShipTo: &entity.GeoPoint{Lat: 120, Lng: 0},
 			},
 			mockSetup:      func(mock sqlmock.Sqlmock) {},
 			expectedStatus: 400,
 			expectedError:  "Validation error",
 		},
 		{
-			name:           "validation error - empty items",
-			idempotencyKey: "test-key-123",
+			name:   "validation error - product listed twice",
+			userID: "user-123",
 			request: entity.CreateOrderReq{
-				ShopID: "shop-123",
+				ShopID: testShopID,
+				Items:  []entity.OrderItemReq{{ProductID: testProduct1, Quantity: 1}, {ProductID: testProduct2, Quantity: 1}, {ProductID: testProduct1, Quantity: 2}},
+			},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Validation error",
+		},
+		{
+			name:   "validation error - empty items",
+			userID: "user-123",
+			request: entity.CreateOrderReq{
+				ShopID: testShopID,
 				Items:  []entity.OrderItemReq{},
 			},
 			mockSetup:      func(mock sqlmock.Sqlmock) {},
@@ -179,8 +245,12 @@ func TestOrdersHandler_Create(t *testing.T) {
 
 			// Create test context
 			c, w := testutils.TestGinContextWithBody(t, tt.request)
-			if tt.idempotencyKey != "" {
-				c.Request.Header.Set("Idempotency-Key", tt.idempotencyKey)
+			if tt.rawBody != "" {
+				c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.rawBody))
+				c.Request.Header.Set("Content-Type", "application/json")
+			}
+			if tt.userID != "" {
+				testutils.WithPrincipal(c, tt.userID)
 			}
 
 			// Execute
@@ -192,6 +262,7 @@ func TestOrdersHandler_Create(t *testing.T) {
 			} else {
 				assert.Equal(t, tt.expectedStatus, w.Code)
 				assert.Contains(t, w.Body.String(), "Order reserved")
+				assert.Contains(t, w.Body.String(), `"total_cents":2250`)
 			}
 
 			// Verify all expectations
@@ -203,6 +274,7 @@ func TestOrdersHandler_Create(t *testing.T) {
 func TestOrdersHandler_Pay(t *testing.T) {
 	tests := []struct {
 		name           string
+		userID         string
 		orderID        string
 		mockSetup      func(sqlmock.Sqlmock)
 		expectedStatus int
@@ -210,15 +282,21 @@ func TestOrdersHandler_Pay(t *testing.T) {
 	}{
 		{
 			name:    "successful payment",
+			userID:  "user-123",
 			orderID: "order-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
 				// Mock order status check
-				mock.ExpectQuery(`SELECT status FROM orders WHERE id=\$1 FOR UPDATE`).
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
 					WithArgs("order-123").
-					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+
+				// Mock lapsed reservations check
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM reservations WHERE order_id=\$1 AND \(released OR expires_at<=now\(\)\)`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
 				// Mock reservations query
 				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM reservations WHERE order_id=\$1 AND released=FALSE AND expires_at>now\(\)`).
@@ -227,13 +305,19 @@ func TestOrdersHandler_Pay(t *testing.T) {
 						AddRow("wh-1", "prod-1", 2).
 						AddRow("wh-1", "prod-2", 1))
 
-				// Mock inventory updates
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 2).
+				// Mock inventory deductions and their ledger entries
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3 WHERE warehouse_id=\$1 AND product_id=\$2 RETURNING quantity`).
+					WithArgs("wh-1", "prod-1", -2).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(3))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", -2, 3, models.MovementSale, "order-123", "", "", "user-123").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-2", 1).
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3 WHERE warehouse_id=\$1 AND product_id=\$2 RETURNING quantity`).
+					WithArgs("wh-1", "prod-2", -1).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(3))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-2", -1, 3, models.MovementSale, "order-123", "", "", "user-123").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
 				// Mock reservations release
@@ -242,8 +326,8 @@ func TestOrdersHandler_Pay(t *testing.T) {
 					WillReturnResult(sqlmock.NewResult(1, 2))
 
 				// Mock order status update
-				mock.ExpectExec(`UPDATE orders SET status='paid', updated_at=now\(\) WHERE id=\$1`).
-					WithArgs("order-123").
+				mock.ExpectExec(`UPDATE orders SET status=\$2, updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("order-123", models.OrderPaid).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
 				// Mock transaction commit
@@ -253,40 +337,77 @@ func TestOrdersHandler_Pay(t *testing.T) {
 		},
 		{
 			name:    "order not found",
+			userID:  "user-123",
 			orderID: "order-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
 				// Mock order status check - order not found
-				mock.ExpectQuery(`SELECT status FROM orders WHERE id=\$1 FOR UPDATE`).
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
 					WithArgs("order-123").
 					WillReturnError(sql.ErrNoRows)
 
 				// Mock transaction rollback
 				mock.ExpectRollback()
 			},
-			expectedStatus: 400,
-			expectedError:  "Cannot pay",
+			expectedStatus: 404,
+			expectedError:  "Order not found",
 		},
 		{
 			name:    "order not in reserved status",
+			userID:  "user-123",
 			orderID: "order-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
 				// Mock order status check - order already paid
-				mock.ExpectQuery(`SELECT status FROM orders WHERE id=\$1 FOR UPDATE`).
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
 					WithArgs("order-123").
-					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("paid"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "paid", 2500, "USD"))
 
 				// Mock transaction rollback
 				mock.ExpectRollback()
 			},
-			expectedStatus: 400,
+			expectedStatus: 409,
 			expectedError:  "Cannot pay",
 		},
+		{
+			name:    "order already expired",
+			userID:  "user-123",
+			orderID: "order-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "expired", 2500, "USD"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Order expired",
+		},
+		{
+			name:    "order owned by another user",
+			userID:  "user-456",
+			orderID: "order-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 403,
+			expectedError:  "Forbidden",
+		},
+		{
+			name:           "missing principal",
+			orderID:        "order-123",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 401,
+			expectedError:  "Unauthorized",
+		},
 	}
 
 	for _, tt := range tests {
@@ -315,6 +436,9 @@ func TestOrdersHandler_Pay(t *testing.T) {
 			// Create test context
 			c, w := testutils.TestGinContext()
 			c.Params = gin.Params{{Key: "id", Value: tt.orderID}}
+			if tt.userID != "" {
+				testutils.WithPrincipal(c, tt.userID)
+			}
 
 			// Execute
 			handler.Pay(c)
@@ -332,3 +456,368 @@ func TestOrdersHandler_Pay(t *testing.T) {
 		})
 	}
 }
+
+// A payment that fails on the database is not recorded against its
+// Idempotency-Key, so the client's retry runs it again.
+func TestOrdersHandler_Pay_RetriedAfterDBError(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+	storeDB, storeMock := testutils.MockDB(t)
+	defer storeDB.Close()
+
+	logger := testutils.MockLogger(t)
+	handler := &OrdersHandler{DB: db, Log: logger, Svc: &service.OrdersService{DB: db, Log: logger, TTLMin: 15}}
+	store := &idempotency.PGStore{DB: storeDB, Retention: time.Hour, LockTimeout: time.Minute}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/orders/:id/pay", func(c *gin.Context) {
+		web.SetPrincipal(c, auth.Principal{UserID: "user-123"})
+	}, idempotency.Middleware(store, true, logger), handler.Pay)
+	pay := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/orders/order-123/pay", nil)
+		req.Header.Set(idempotency.HeaderKey, "key-1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	claim := func(token string) {
+		storeMock.ExpectQuery(`INSERT INTO idempotency_requests`).
+			WillReturnRows(sqlmock.NewRows([]string{"claim_token"}).AddRow(token))
+	}
+
+	// first attempt: the connection drops
+	claim("claim-1")
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM orders WHERE id=\$1 FOR UPDATE`).
+		WithArgs("order-123").
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+	storeMock.ExpectExec(`DELETE FROM idempotency_requests WHERE owner=\$1 AND key=\$2 AND claim_token=\$3 AND status_code IS NULL`).
+		WithArgs("user:user-123", "key-1", "claim-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := pay()
+	testutils.AssertErrorResponse(t, w, 500, "Cannot pay")
+
+	// the retry reaches the handler and its response is recorded
+	claim("claim-2")
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM orders WHERE id=\$1 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM reservations`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM reservations`).
+		WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}))
+	mock.ExpectExec(`UPDATE reservations SET released=TRUE`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE orders SET status=\$2`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	storeMock.ExpectExec(`UPDATE idempotency_requests SET status_code=\$4`).
+		WithArgs("user:user-123", "key-1", "claim-2", 200, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w = pay()
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), "Order paid")
+	assert.Empty(t, w.Header().Get(idempotency.HeaderReplayed))
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.NoError(t, storeMock.ExpectationsWereMet())
+}
+
+func TestOrdersHandler_Get(t *testing.T) {
+	now := time.Now()
+	orderID := "0e6c4b2a-7d1f-4a3e-8b5c-9f2d4e6a8b10"
+	tests := []struct {
+		name           string
+		userID         string
+		id             string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:   "order found",
+			userID: "user-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM orders WHERE id=\$1 AND user_id=\$2`).
+					WithArgs(orderID, "user-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "status_reason", "total_cents", "currency", "created_at", "updated_at"}).
+						AddRow(orderID, "user-123", "shop-1", "reserved", nil, 0, "USD", now, now))
+				mock.ExpectQuery(`FROM order_items WHERE order_id=\$1`).
+					WithArgs(orderID).
+					WillReturnRows(sqlmock.NewRows([]string{"order_id", "product_id", "quantity", "unit_price_cents", "currency"}).AddRow(orderID, "prod-1", 2, 1250, "USD"))
+				mock.ExpectQuery(`FROM reservations WHERE order_id=\$1`).
+					WithArgs(orderID).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "warehouse_id", "product_id", "quantity", "expires_at", "released"}).
+						AddRow("res-1", orderID, "wh-1", "prod-1", 2, now, false))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:   "order not found",
+			userID: "user-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM orders WHERE id=\$1 AND user_id=\$2`).
+					WithArgs(orderID, "user-123").
+					WillReturnError(sql.ErrNoRows)
+			},
+			expectedStatus: 404,
+			expectedError:  "Order not found",
+		},
+		{
+			name:           "malformed id",
+			userID:         "user-123",
+			id:             "order-123",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Order not found",
+		},
+		{
+			name:           "missing principal",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 401,
+			expectedError:  "Unauthorized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &OrdersHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				TTLMin:   15,
+				Svc:      &service.OrdersService{DB: db, Log: logger, TTLMin: 15},
+			}
+
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			id := tt.id
+			if id == "" {
+				id = orderID
+			}
+			c.Params = gin.Params{{Key: "id", Value: id}}
+			if tt.userID != "" {
+				testutils.WithPrincipal(c, tt.userID)
+			}
+
+			handler.Get(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Order found")
+				assert.Contains(t, w.Body.String(), `"warehouse_id":"wh-1"`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersHandler_List(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name           string
+		query          string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:  "orders listed",
+			query: "?status=paid&limit=5",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM orders WHERE user_id=\$1 AND status=\$2 ORDER BY created_at DESC, id DESC LIMIT \$3`).
+					WithArgs("user-123", "paid", 6).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "status_reason", "total_cents", "currency", "created_at", "updated_at"}).
+						AddRow("order-123", "user-123", "shop-1", "paid", nil, 0, "USD", now, now))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown status",
+			query:          "?status=lost",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Validation error",
+		},
+		{
+			name:           "malformed date",
+			query:          "?from=yesterday",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid query",
+		},
+		{
+			name:           "malformed cursor",
+			query:          "?cursor=bm9wZQ",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid cursor",
+		},
+		{
+			name:           "cursor with a malformed id",
+			query:          "?cursor=" + base64.RawURLEncoding.EncodeToString([]byte(now.UTC().Format(time.RFC3339Nano)+"|order-123")),
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid cursor",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &OrdersHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				TTLMin:   15,
+				Svc:      &service.OrdersService{DB: db, Log: logger, TTLMin: 15},
+			}
+
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			c.Request = httptest.NewRequest(http.MethodGet, "/api/orders"+tt.query, nil)
+			testutils.WithPrincipal(c, "user-123")
+
+			handler.List(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Orders listed")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersHandler_Cancel(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:   "order cancelled",
+			status: "reserved",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE reservations SET released=TRUE WHERE order_id=\$1 AND released=FALSE`).
+					WithArgs("order-123").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE orders SET status=\$2, updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("order-123", models.OrderCancelled).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:   "already paid",
+			status: "paid",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Cannot cancel",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &OrdersHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				TTLMin:   15,
+				Svc:      &service.OrdersService{DB: db, Log: logger, TTLMin: 15},
+			}
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+				WithArgs("order-123").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", tt.status, 2500, "USD"))
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			c.Params = gin.Params{{Key: "id", Value: "order-123"}}
+			testutils.WithPrincipal(c, "user-123")
+
+			handler.Cancel(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Order cancelled")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersHandler_Ship(t *testing.T) {
+	staff := auth.Principal{UserID: "staff-1", Shops: map[string]models.ShopRole{"shop-1": models.ShopStaff}}
+	tests := []struct {
+		name           string
+		principal      *auth.Principal
+		expectedStatus int
+		expectedError  string
+	}{
+		{name: "paid order must be fulfilled first", principal: &staff, expectedStatus: 409, expectedError: "Cannot update order"},
+		{name: "customer", principal: &auth.Principal{UserID: "user-123"}, expectedStatus: 403, expectedError: "Forbidden"},
+		{name: "staff of another shop", principal: &auth.Principal{UserID: "staff-2", Shops: map[string]models.ShopRole{"shop-2": models.ShopStaff}}, expectedStatus: 403, expectedError: "Forbidden"},
+		{name: "missing principal", expectedStatus: 401, expectedError: "Unauthorized"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			logger := testutils.MockLogger(t)
+			handler := &OrdersHandler{
+				DB:       db,
+				Log:      logger,
+				Validate: testutils.TestValidator(),
+				TTLMin:   15,
+				Svc:      &service.OrdersService{DB: db, Log: logger, TTLMin: 15},
+			}
+
+			c, w := testutils.TestGinContext()
+			c.Params = gin.Params{{Key: "id", Value: "order-123"}}
+			if tt.principal != nil {
+				web.SetPrincipal(c, *tt.principal)
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "paid", 2500, "USD"))
+				mock.ExpectRollback()
+			}
+
+			handler.Ship(c)
+
+			testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 
 	"ecommerce-shop/internal/entity"
@@ -27,11 +28,70 @@ func (h *ProductsHandler) ListByShop(c *gin.Context) {
 	out := make([]entity.ProductResponse, 0, len(list))
 	for _, p := range list {
 		out = append(out, entity.ProductResponse{
-			ID:        p.ID,
-			SKU:       p.SKU,
-			Name:      p.Name,
-			Available: p.Available,
+			ID:         p.ID,
+			SKU:        p.SKU,
+			Name:       p.Name,
+			PriceCents: p.PriceCents,
+			Currency:   p.Currency,
+			Available:  p.Available,
+			InTransit:  p.InTransit,
 		})
 	}
 	helpers.WriteSuccess(c.Writer, "Products listed", out)
 }
+
+// SetPrice overrides the product's list price in the shop.
+func (h *ProductsHandler) SetPrice(c *gin.Context) {
+	shopID, productID := c.Param("shop_id"), c.Param("product_id")
+	if !helpers.IsUUID(shopID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	if !helpers.IsUUID(productID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", "product id is not a uuid", nil)
+		return
+	}
+	var req entity.SetShopPriceReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	p, err := h.Svc.SetShopPrice(c, shopID, productID, *req.PriceCents, req.Currency)
+	if err != nil {
+		writeShopPriceError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Price saved", entity.ShopPriceResponse{
+		ShopID:     p.ShopID,
+		ProductID:  p.ProductID,
+		PriceCents: p.PriceCents,
+		Currency:   p.Currency,
+	})
+}
+
+// ClearPrice drops the shop's price override for the product.
+func (h *ProductsHandler) ClearPrice(c *gin.Context) {
+	shopID, productID := c.Param("shop_id"), c.Param("product_id")
+	if !helpers.IsUUID(shopID) || !helpers.IsUUID(productID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Price override not found", "id is not a uuid", nil)
+		return
+	}
+	if err := h.Svc.ClearShopPrice(c, shopID, productID); err != nil {
+		writeShopPriceError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Price override removed", nil)
+}
+
+func writeShopPriceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrShopNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", err.Error(), nil)
+	case errors.Is(err, service.ErrUnknownProduct):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", err.Error(), nil)
+	case errors.Is(err, service.ErrNoPriceOverride):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Price override not found", err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	}
+}
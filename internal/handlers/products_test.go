@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 
+	"ecommerce-shop/internal/entity"
 	"ecommerce-shop/internal/service"
 	"ecommerce-shop/testutils"
 )
@@ -24,9 +25,9 @@ func TestProductsHandler_ListByShop(t *testing.T) {
 			name:   "successful list products",
 			shopID: "shop-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "sku", "name", "available"}).
-					AddRow("prod-1", "SKU001", "Product 1", 10).
-					AddRow("prod-2", "SKU002", "Product 2", 5)
+				rows := sqlmock.NewRows([]string{"id", "sku", "name", "price_cents", "currency", "available", "in_transit"}).
+					AddRow("prod-1", "SKU001", "Product 1", 1999, "USD", 10, 0).
+					AddRow("prod-2", "SKU002", "Product 2", 500, "USD", 5, 0)
 
 				mock.ExpectQuery(`WITH active_wh as \(
 			SELECT id FROM warehouses WHERE shop_id=\$1 AND active=TRUE
@@ -36,11 +37,20 @@ func TestProductsHandler_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnRows(rows)
@@ -51,7 +61,7 @@ func TestProductsHandler_ListByShop(t *testing.T) {
 			name:   "no products found",
 			shopID: "shop-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "sku", "name", "available"})
+				rows := sqlmock.NewRows([]string{"id", "sku", "name", "price_cents", "currency", "available", "in_transit"})
 
 				mock.ExpectQuery(`WITH active_wh as \(
 			SELECT id FROM warehouses WHERE shop_id=\$1 AND active=TRUE
@@ -61,11 +71,20 @@ func TestProductsHandler_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnRows(rows)
@@ -84,11 +103,20 @@ func TestProductsHandler_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnError(sql.ErrConnDone)
@@ -134,3 +162,170 @@ func TestProductsHandler_ListByShop(t *testing.T) {
 		})
 	}
 }
+
+func TestProductsHandler_SetPrice(t *testing.T) {
+	price := int64(450)
+	tests := []struct {
+		name           string
+		productID      string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "saved",
+			request: entity.SetShopPriceReq{PriceCents: &price, Currency: "EUR"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WithArgs(testShopID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testShopID))
+				mock.ExpectQuery(`INSERT INTO shop_product_prices`).
+					WithArgs(testShopID, testProduct1, price, "EUR").
+					WillReturnRows(sqlmock.NewRows([]string{"shop_id", "product_id", "price_cents", "currency"}).
+						AddRow(testShopID, testProduct1, price, "EUR"))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:    "unknown product",
+			request: entity.SetShopPriceReq{PriceCents: &price, Currency: "EUR"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testShopID))
+				mock.ExpectQuery(`INSERT INTO shop_product_prices`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Product not found",
+		},
+		{
+			name:    "unknown shop",
+			request: entity.SetShopPriceReq{PriceCents: &price, Currency: "EUR"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+		{
+			name:           "missing price",
+			request:        map[string]interface{}{"currency": "EUR"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:           "unknown currency",
+			request:        entity.SetShopPriceReq{PriceCents: &price, Currency: "EURO"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:           "malformed product id",
+			productID:      "prod-1",
+			request:        entity.SetShopPriceReq{PriceCents: &price, Currency: "EUR"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Product not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &ProductsHandler{DB: db, Svc: &service.ProductsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+			productID := testProduct1
+			if tt.productID != "" {
+				productID = tt.productID
+			}
+			c.Params = gin.Params{{Key: "shop_id", Value: testShopID}, {Key: "product_id", Value: productID}}
+
+			handler.SetPrice(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), `"price_cents":450`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestProductsHandler_ClearPrice(t *testing.T) {
+	tests := []struct {
+		name           string
+		productID      string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "removed",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM shop_product_prices WHERE shop_id=\$1 AND product_id=\$2`).
+					WithArgs(testShopID, testProduct1).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name: "no override",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM shop_product_prices`).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: 404,
+			expectedError:  "Price override not found",
+		},
+		{
+			name:           "malformed product id",
+			productID:      "prod-1",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Price override not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &ProductsHandler{DB: db, Svc: &service.ProductsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			productID := testProduct1
+			if tt.productID != "" {
+				productID = tt.productID
+			}
+			c.Params = gin.Params{{Key: "shop_id", Value: testShopID}, {Key: "product_id", Value: productID}}
+
+			handler.ClearPrice(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Price override removed")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/service"
+)
+
+type ShopsHandler struct {
+	DB  *sqlx.DB
+	Svc *service.ShopsService
+}
+
+func (h *ShopsHandler) Create(c *gin.Context) {
+	var req entity.CreateShopReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	shop, err := h.Svc.Create(c, service.ShopInput{Name: &req.Name, AllocationStrategy: req.AllocationStrategy})
+	if err != nil {
+		writeShopError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Shop created", shopResponse(shop))
+}
+
+func (h *ShopsHandler) Get(c *gin.Context) {
+	id := c.Param("shop_id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	shop, err := h.Svc.Get(c, id)
+	if err != nil {
+		writeShopError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Shop retrieved", shopResponse(shop))
+}
+
+func (h *ShopsHandler) Update(c *gin.Context) {
+	id := c.Param("shop_id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	var req entity.UpdateShopReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	shop, err := h.Svc.Update(c, id, service.ShopInput{Name: req.Name, AllocationStrategy: req.AllocationStrategy})
+	if err != nil {
+		writeShopError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Shop updated", shopResponse(shop))
+}
+
+func (h *ShopsHandler) List(c *gin.Context) {
+	var q entity.ListCatalogQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), nil)
+		return
+	}
+	list, next, err := h.Svc.List(c, service.PageFilter{IncludeDeleted: q.IncludeDeleted, Cursor: q.Cursor, Limit: q.Limit})
+	if err != nil {
+		writeShopError(c, err)
+		return
+	}
+	out := entity.ShopListResponse{
+		Shops:      make([]entity.ShopResponse, 0, len(list)),
+		NextCursor: next,
+	}
+	for _, s := range list {
+		out.Shops = append(out.Shops, shopResponse(s))
+	}
+	helpers.WriteSuccess(c.Writer, "Shops listed", out)
+}
+
+// Delete soft-deletes a shop that no longer has warehouses.
+func (h *ShopsHandler) Delete(c *gin.Context) {
+	id := c.Param("shop_id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	if err := h.Svc.Delete(c, id); err != nil {
+		writeShopError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Shop deleted", nil)
+}
+
+func (h *ShopsHandler) Members(c *gin.Context) {
+	id := c.Param("shop_id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	list, err := h.Svc.Members(c, id)
+	if err != nil {
+		writeShopError(c, err)
+		return
+	}
+	out := make([]entity.MemberResponse, 0, len(list))
+	for _, m := range list {
+		out = append(out, memberResponse(m))
+	}
+	helpers.WriteSuccess(c.Writer, "Members listed", out)
+}
+
+// SetMember grants a user the staff or admin role in the shop.
+func (h *ShopsHandler) SetMember(c *gin.Context) {
+	shopID, userID := c.Param("shop_id"), c.Param("user_id")
+	if !helpers.IsUUID(shopID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	if !helpers.IsUUID(userID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "User not found", "user id is not a uuid", nil)
+		return
+	}
+	var req entity.SetMemberReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	m, err := h.Svc.SetMember(c, shopID, userID, models.ShopRole(req.Role))
+	if err != nil {
+		writeShopError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Member saved", memberResponse(m))
+}
+
+func (h *ShopsHandler) RemoveMember(c *gin.Context) {
+	shopID, userID := c.Param("shop_id"), c.Param("user_id")
+	if !helpers.IsUUID(shopID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", "shop id is not a uuid", nil)
+		return
+	}
+	if !helpers.IsUUID(userID) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Member not found", "user id is not a uuid", nil)
+		return
+	}
+	if err := h.Svc.RemoveMember(c, shopID, userID); err != nil {
+		writeShopError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Member removed", nil)
+}
+
+func writeShopError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrShopNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", err.Error(), nil)
+	case errors.Is(err, service.ErrDuplicateShopName):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Shop name already taken", err.Error(), nil)
+	case errors.Is(err, service.ErrUserNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "User not found", err.Error(), nil)
+	case errors.Is(err, service.ErrMemberNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Member not found", err.Error(), nil)
+	case errors.Is(err, service.ErrShopInUse):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Shop has warehouses", err.Error(), nil)
+	case errors.Is(err, service.ErrInvalidCursor):
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid cursor", err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	}
+}
+
+func shopResponse(s models.Shop) entity.ShopResponse {
+	return entity.ShopResponse{
+		ID:                 s.ID,
+		Name:               s.Name,
+		AllocationStrategy: s.AllocationStrategy,
+		CreatedAt:          s.CreatedAt,
+		UpdatedAt:          s.UpdatedAt,
+		DeletedAt:          s.DeletedAt,
+	}
+}
+
+func memberResponse(m models.ShopMember) entity.MemberResponse {
+	return entity.MemberResponse{
+		UserID:    m.UserID,
+		Email:     m.Email,
+		Role:      string(m.Role),
+		CreatedAt: m.CreatedAt,
+	}
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/entity"
+	"ecommerce-shop/internal/service"
+	"ecommerce-shop/testutils"
+)
+
+var shopCols = []string{"id", "name", "allocation_strategy", "created_at", "updated_at", "deleted_at"}
+
+func TestShopsHandler_Create(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "created",
+			request: entity.CreateShopReq{Name: "Main street"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO shops`).
+					WithArgs("Main street", nil).
+					WillReturnRows(sqlmock.NewRows(shopCols).AddRow("shop-1", "Main street", "priority", time.Now(), time.Now(), nil))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown strategy",
+			request:        map[string]interface{}{"name": "Main street", "allocation_strategy": "cheapest"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:    "name taken",
+			request: entity.CreateShopReq{Name: "Main street"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO shops`).
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			expectedStatus: 409,
+			expectedError:  "Shop name already taken",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &ShopsHandler{DB: db, Svc: &service.ShopsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+
+			handler.Create(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Shop created")
+				assert.Contains(t, w.Body.String(), `"allocation_strategy":"priority"`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsHandler_List(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(`FROM shops WHERE TRUE AND deleted_at IS NULL ORDER BY created_at, id LIMIT \$1`).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows(shopCols).
+			AddRow("shop-1", "A", "priority", time.Now(), time.Now(), nil).
+			AddRow("shop-2", "B", "nearest", time.Now(), time.Now(), nil).
+			AddRow("shop-3", "C", "priority", time.Now(), time.Now(), nil))
+
+	handler := &ShopsHandler{DB: db, Svc: &service.ShopsService{DB: db}}
+	c, w := testutils.TestGinContext()
+	c.Request = httptest.NewRequest("GET", "/api/shops?limit=2", nil)
+
+	handler.List(c)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"shop-2"`)
+	assert.NotContains(t, w.Body.String(), `"shop-3"`)
+	assert.Contains(t, w.Body.String(), `"next_cursor"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestShopsHandler_Delete(t *testing.T) {
+	tests := []struct {
+		name           string
+		id             string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "deleted",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WithArgs(testShopID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testShopID))
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM warehouses`).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(`UPDATE shops SET deleted_at=now\(\)`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name: "still has warehouses",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testShopID))
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM warehouses`).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Shop has warehouses",
+		},
+		{
+			name: "not found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+		{
+			name:           "malformed id",
+			id:             "shop-1",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &ShopsHandler{DB: db, Svc: &service.ShopsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			id := testShopID
+			if tt.id != "" {
+				id = tt.id
+			}
+			c.Params = gin.Params{{Key: "shop_id", Value: id}}
+
+			handler.Delete(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Shop deleted")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsHandler_SetMember(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        interface{}
+		shopID         string
+		userID         string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "granted",
+			request: entity.SetMemberReq{Role: "staff"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testShopID))
+				mock.ExpectQuery(`INSERT INTO shop_members`).
+					WithArgs(testShopID, testUserID, "staff").
+					WillReturnRows(sqlmock.NewRows([]string{"shop_id", "user_id", "email", "role", "created_at"}).
+						AddRow(testShopID, testUserID, "staff@example.com", "staff", time.Now()))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown role",
+			request:        map[string]interface{}{"role": "owner"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:    "unknown user",
+			request: entity.SetMemberReq{Role: "admin"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testShopID))
+				mock.ExpectQuery(`INSERT INTO shop_members`).
+					WillReturnError(&pq.Error{Code: "23503"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "User not found",
+		},
+		{
+			name:           "malformed shop id",
+			request:        entity.SetMemberReq{Role: "staff"},
+			shopID:         "shop-1",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+		{
+			name:           "malformed user id",
+			request:        entity.SetMemberReq{Role: "staff"},
+			userID:         "user-2",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "User not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &ShopsHandler{DB: db, Svc: &service.ShopsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+			shopID, userID := testShopID, testUserID
+			if tt.shopID != "" {
+				shopID = tt.shopID
+			}
+			if tt.userID != "" {
+				userID = tt.userID
+			}
+			c.Params = gin.Params{{Key: "shop_id", Value: shopID}, {Key: "user_id", Value: userID}}
+
+			handler.SetMember(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), `"role":"staff"`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsHandler_RemoveMember(t *testing.T) {
+	tests := []struct {
+		name           string
+		shopID         string
+		userID         string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "removed",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM shop_members WHERE shop_id=\$1 AND user_id=\$2`).
+					WithArgs(testShopID, testUserID).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name: "not a member",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM shop_members`).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			expectedStatus: 404,
+			expectedError:  "Member not found",
+		},
+		{
+			name:           "malformed shop id",
+			shopID:         "shop-1",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+		{
+			name:           "malformed user id",
+			userID:         "user-2",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Member not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &ShopsHandler{DB: db, Svc: &service.ShopsService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			shopID, userID := testShopID, testUserID
+			if tt.shopID != "" {
+				shopID = tt.shopID
+			}
+			if tt.userID != "" {
+				userID = tt.userID
+			}
+			c.Params = gin.Params{{Key: "shop_id", Value: shopID}, {Key: "user_id", Value: userID}}
+
+			handler.RemoveMember(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Member removed")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -8,6 +11,8 @@ import (
 
 	"ecommerce-shop/internal/entity"
 	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/server/web"
 	"ecommerce-shop/internal/service"
 )
 
@@ -16,40 +21,444 @@ type WarehousesHandler struct {
 	Svc *service.WarehousesService
 }
 
+func (h *WarehousesHandler) Create(c *gin.Context) {
+	var req entity.CreateWarehouseReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	wh, err := h.Svc.Create(c, req.ShopID, service.WarehouseInput{
+		Name:      &req.Name,
+		Priority:  req.Priority,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		Address:   modelAddress(req.Address),
+		Metadata:  req.Metadata,
+	})
+	if err != nil {
+		writeWarehouseError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Warehouse created", warehouseResponse(wh))
+}
+
+func (h *WarehousesHandler) Get(c *gin.Context) {
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", "warehouse id is not a uuid", nil)
+		return
+	}
+	wh, err := h.Svc.Get(c, id)
+	if err != nil {
+		writeWarehouseError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Warehouse retrieved", warehouseResponse(wh))
+}
+
+func (h *WarehousesHandler) Update(c *gin.Context) {
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", "warehouse id is not a uuid", nil)
+		return
+	}
+	var req entity.UpdateWarehouseReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	wh, err := h.Svc.Update(c, id, service.WarehouseInput{
+		Name:      req.Name,
+		Priority:  req.Priority,
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		Address:   modelAddress(req.Address),
+		Metadata:  req.Metadata,
+	})
+	if err != nil {
+		writeWarehouseError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Warehouse updated", warehouseResponse(wh))
+}
+
+func (h *WarehousesHandler) List(c *gin.Context) {
+	var q entity.ListWarehousesQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), nil)
+		return
+	}
+	list, next, err := h.Svc.List(c, q.ShopID, service.PageFilter{IncludeDeleted: q.IncludeDeleted, Cursor: q.Cursor, Limit: q.Limit})
+	if err != nil {
+		writeWarehouseError(c, err)
+		return
+	}
+	out := entity.WarehouseListResponse{
+		Warehouses: make([]entity.WarehouseResponse, 0, len(list)),
+		NextCursor: next,
+	}
+	for _, wh := range list {
+		out.Warehouses = append(out.Warehouses, warehouseResponse(wh))
+	}
+	helpers.WriteSuccess(c.Writer, "Warehouses listed", out)
+}
+
+// Delete soft-deletes an empty warehouse.
+func (h *WarehousesHandler) Delete(c *gin.Context) {
+	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", "warehouse id is not a uuid", nil)
+		return
+	}
+	if err := h.Svc.Delete(c, id); err != nil {
+		writeWarehouseError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Warehouse deleted", nil)
+}
+
+// Activate puts the warehouse back into checkout allocation.
 func (h *WarehousesHandler) Activate(c *gin.Context) {
 	id := c.Param("id")
+	if !helpers.IsUUID(id) {
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", "warehouse id is not a uuid", nil)
+		return
+	}
 	if err := h.Svc.SetActive(c, id, true); err != nil {
-		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+		writeWarehouseError(c, err)
 		return
 	}
 	helpers.WriteSuccess(c.Writer, "Warehouse activated", nil)
 }
 
+// Deactivate takes the warehouse out of checkout allocation. The policy query
+// parameter decides what happens to its live reservations.
 func (h *WarehousesHandler) Deactivate(c *gin.Context) {
-	id := c.Param("id")
-	if err := h.Svc.SetActive(c, id, false); err != nil {
-		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	var q entity.DeactivateQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), nil)
 		return
 	}
-	helpers.WriteSuccess(c.Writer, "Warehouse deactivated", nil)
+	report, err := h.Svc.Deactivate(c, c.Param("id"), q.Policy)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrWarehouseNotFound):
+			helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", err.Error(), nil)
+		case errors.Is(err, service.ErrWarehouseInUse):
+			helpers.WriteError(c.Writer, http.StatusConflict, "Warehouse has reservations", err.Error(), nil)
+		case errors.Is(err, service.ErrReallocationShortfall):
+			helpers.WriteError(c.Writer, http.StatusConflict, "Insufficient stock", err.Error(), nil)
+		default:
+			helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+		}
+		return
+	}
+	out := entity.DeactivationResponse{
+		WarehouseID: report.WarehouseID,
+		Policy:      report.Policy,
+		Orders:      make([]entity.AffectedOrderResponse, 0, len(report.Orders)),
+	}
+	for _, o := range report.Orders {
+		ao := entity.AffectedOrderResponse{OrderID: o.OrderID}
+		for _, l := range o.Lines {
+			line := entity.AffectedLineResponse{ProductID: l.ProductID, Quantity: l.Quantity}
+			for _, a := range l.MovedTo {
+				line.MovedTo = append(line.MovedTo, entity.MovedReservationResponse{WarehouseID: a.WarehouseID, Quantity: a.Quantity})
+			}
+			ao.Lines = append(ao.Lines, line)
+		}
+		out.Orders = append(out.Orders, ao)
+	}
+	helpers.WriteSuccess(c.Writer, "Warehouse deactivated", out)
 }
 
+// Transfer requests a stock transfer; stock moves on dispatch and receive.
 func (h *WarehousesHandler) Transfer(c *gin.Context) {
 	var req entity.TransferReq
 	if err := c.ShouldBindJSON(&req); err != nil {
 		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
 		return
 	}
-	err := h.Svc.Transfer(c, req.From, req.To, req.ProductID, req.Quantity)
+	t, err := h.Svc.RequestTransfer(c, req.From, req.To, req.ProductID, req.Quantity)
+	if err != nil {
+		writeTransferError(c, "Transfer failed", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Transfer requested", transferResponse(t))
+}
+
+func (h *WarehousesHandler) Dispatch(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", nil)
+		return
+	}
+	t, err := h.Svc.Dispatch(c, p.UserID, c.Param("id"))
+	if err != nil {
+		writeTransferError(c, "Cannot dispatch transfer", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Transfer dispatched", transferResponse(t))
+}
+
+func (h *WarehousesHandler) Receive(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", nil)
+		return
+	}
+	var req entity.ReceiveTransferReq
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	t, err := h.Svc.Receive(c, p.UserID, c.Param("id"), req.Quantity)
+	if err != nil {
+		writeTransferError(c, "Cannot receive transfer", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Transfer received", transferResponse(t))
+}
+
+func (h *WarehousesHandler) CancelTransfer(c *gin.Context) {
+	t, err := h.Svc.CancelTransfer(c, c.Param("id"))
+	if err != nil {
+		writeTransferError(c, "Cannot cancel transfer", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Transfer cancelled", transferResponse(t))
+}
+
+func (h *WarehousesHandler) GetTransfer(c *gin.Context) {
+	t, err := h.Svc.GetTransfer(c, c.Param("id"))
+	if err != nil {
+		writeTransferError(c, "DB error", err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Transfer found", transferResponse(t))
+}
+
+func (h *WarehousesHandler) ListTransfers(c *gin.Context) {
+	var q entity.ListTransfersQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), nil)
+		return
+	}
+	ts, err := h.Svc.ListTransfers(c, service.TransferFilter{
+		Status:      models.TransferStatus(q.Status),
+		WarehouseID: q.WarehouseID,
+		ProductID:   q.ProductID,
+		Limit:       q.Limit,
+	})
+	if err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+		return
+	}
+	out := make([]entity.TransferResponse, 0, len(ts))
+	for _, t := range ts {
+		out = append(out, transferResponse(t))
+	}
+	helpers.WriteSuccess(c.Writer, "Transfers listed", out)
+}
+
+// Adjust applies a signed stock change with a reason code.
+func (h *WarehousesHandler) Adjust(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", nil)
+		return
+	}
+	var req entity.AdjustStockReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	lvl, err := h.Svc.Adjust(c, p.UserID, c.Param("id"), req.ProductID, req.Delta, req.Reason)
+	if err != nil {
+		writeStockError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Stock adjusted", stockLevelResponse(lvl))
+}
+
+// SetStock replaces the on-hand count of a product.
+func (h *WarehousesHandler) SetStock(c *gin.Context) {
+	p, ok := web.CurrentPrincipal(c)
+	if !ok {
+		helpers.WriteError(c.Writer, http.StatusUnauthorized, "Unauthorized", "", nil)
+		return
+	}
+	var req entity.SetStockReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid JSON", err.Error(), nil)
+		return
+	}
+	lvl, err := h.Svc.SetCount(c, p.UserID, c.Param("id"), req.ProductID, *req.Quantity, req.Reason)
 	if err != nil {
-		helpers.WriteError(c.Writer, http.StatusBadRequest, "Transfer failed", err.Error(), nil)
+		writeStockError(c, err)
+		return
+	}
+	helpers.WriteSuccess(c.Writer, "Stock set", stockLevelResponse(lvl))
+}
+
+// Movements lists the warehouse's inventory ledger, newest first.
+func (h *WarehousesHandler) Movements(c *gin.Context) {
+	var q entity.ListMovementsQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid query", err.Error(), nil)
 		return
 	}
-	helpers.WriteSuccess(c.Writer, "Transfer successful", entity.TransferResponse{
-		From:      req.From,
-		To:        req.To,
-		ProductID: req.ProductID,
-		Quantity:  req.Quantity,
-		Status:    "ok",
+	list, next, err := h.Svc.Movements(c, c.Param("id"), service.MovementFilter{
+		ProductID:  q.ProductID,
+		Reason:     q.Reason,
+		OrderID:    q.OrderID,
+		TransferID: q.TransferID,
+		From:       q.From,
+		To:         q.To,
+		Cursor:     q.Cursor,
+		Limit:      q.Limit,
 	})
+	if errors.Is(err, service.ErrInvalidCursor) {
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid cursor", err.Error(), nil)
+		return
+	}
+	if err != nil {
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+		return
+	}
+	out := entity.MovementListResponse{
+		Movements:  make([]entity.MovementResponse, 0, len(list)),
+		NextCursor: next,
+	}
+	for _, m := range list {
+		out.Movements = append(out.Movements, entity.MovementResponse{
+			ID:         m.ID,
+			ProductID:  m.ProductID,
+			Delta:      m.Delta,
+			Balance:    m.Balance,
+			Reason:     m.Reason,
+			OrderID:    m.OrderID,
+			TransferID: m.TransferID,
+			CountID:    m.CountID,
+			ActorID:    m.ActorID,
+			CreatedAt:  m.CreatedAt,
+		})
+	}
+	helpers.WriteSuccess(c.Writer, "Movements listed", out)
+}
+
+func writeTransferError(c *gin.Context, message string, err error) {
+	switch {
+	case errors.Is(err, service.ErrWarehouseNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", err.Error(), nil)
+	case errors.Is(err, service.ErrTransferNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Transfer not found", err.Error(), nil)
+	case errors.Is(err, service.ErrUnknownProduct):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", err.Error(), nil)
+	case errors.Is(err, service.ErrSameWarehouse), errors.Is(err, service.ErrCrossShopTransfer):
+		helpers.WriteError(c.Writer, http.StatusUnprocessableEntity, "Transfer not allowed", err.Error(), nil)
+	case errors.Is(err, service.ErrInvalidReceivedQuantity):
+		helpers.WriteError(c.Writer, http.StatusUnprocessableEntity, message, err.Error(), nil)
+	case errors.Is(err, service.ErrInsufficientStock):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Insufficient stock", err.Error(), nil)
+	case errors.Is(err, models.ErrInvalidTransferTransition):
+		helpers.WriteError(c.Writer, http.StatusConflict, message, err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, message, err.Error(), nil)
+	}
+}
+
+func writeStockError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrWarehouseNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", err.Error(), nil)
+	case errors.Is(err, service.ErrUnknownProduct):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Product not found", err.Error(), nil)
+	case errors.Is(err, service.ErrInvalidAdjustment):
+		helpers.WriteError(c.Writer, http.StatusUnprocessableEntity, "Invalid adjustment", err.Error(), nil)
+	case errors.Is(err, service.ErrBelowReserved):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Stock is reserved", err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	}
+}
+
+func writeWarehouseError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrShopNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Shop not found", err.Error(), nil)
+	case errors.Is(err, service.ErrWarehouseNotFound):
+		helpers.WriteError(c.Writer, http.StatusNotFound, "Warehouse not found", err.Error(), nil)
+	case errors.Is(err, service.ErrWarehouseInUse):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Warehouse has reservations", err.Error(), nil)
+	case errors.Is(err, service.ErrWarehouseNotEmpty):
+		helpers.WriteError(c.Writer, http.StatusConflict, "Warehouse is not empty", err.Error(), nil)
+	case errors.Is(err, service.ErrInvalidCursor):
+		helpers.WriteError(c.Writer, http.StatusBadRequest, "Invalid cursor", err.Error(), nil)
+	default:
+		helpers.WriteError(c.Writer, http.StatusInternalServerError, "DB error", err.Error(), nil)
+	}
+}
+
+func modelAddress(a *entity.Address) *models.Address {
+	if a == nil {
+		return nil
+	}
+	return &models.Address{
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		Region:     a.Region,
+		PostalCode: a.PostalCode,
+		Country:    a.Country,
+	}
+}
+
+func warehouseResponse(wh models.Warehouse) entity.WarehouseResponse {
+	return entity.WarehouseResponse{
+		ID:        wh.ID,
+		ShopID:    wh.ShopID,
+		Name:      wh.Name,
+		Active:    wh.Active,
+		Priority:  wh.Priority,
+		Latitude:  wh.Latitude,
+		Longitude: wh.Longitude,
+		Address: entity.Address{
+			Line1:      wh.Line1,
+			Line2:      wh.Line2,
+			City:       wh.City,
+			Region:     wh.Region,
+			PostalCode: wh.PostalCode,
+			Country:    wh.Country,
+		},
+		Metadata:  json.RawMessage(wh.Metadata),
+		CreatedAt: wh.CreatedAt,
+		UpdatedAt: wh.UpdatedAt,
+		DeletedAt: wh.DeletedAt,
+	}
+}
+
+func stockLevelResponse(l service.StockLevel) entity.StockLevelResponse {
+	return entity.StockLevelResponse{
+		WarehouseID: l.WarehouseID,
+		ProductID:   l.ProductID,
+		OnHand:      l.OnHand,
+		Reserved:    l.Reserved,
+		Available:   l.OnHand - l.Reserved,
+	}
+}
+
+func transferResponse(t models.StockTransfer) entity.TransferResponse {
+	return entity.TransferResponse{
+		ID:               t.ID,
+		From:             t.FromWarehouseID,
+		To:               t.ToWarehouseID,
+		ProductID:        t.ProductID,
+		Quantity:         t.Quantity,
+		ReceivedQuantity: t.ReceivedQuantity,
+		Status:           string(t.Status),
+		CreatedAt:        t.CreatedAt,
+		DispatchedAt:     t.DispatchedAt,
+		ReceivedAt:       t.ReceivedAt,
+	}
 }
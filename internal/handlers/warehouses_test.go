@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"database/sql"
+	"database/sql/driver"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
 	"ecommerce-shop/internal/entity"
@@ -14,6 +18,7 @@ import (
 )
 
 func TestWarehousesHandler_Activate(t *testing.T) {
+	const warehouseID = "5b0c8f7e-2d4a-4e1b-9c3f-6a8d2e4f1b07"
 	tests := []struct {
 		name           string
 		warehouseID    string
@@ -23,30 +28,38 @@ func TestWarehousesHandler_Activate(t *testing.T) {
 	}{
 		{
 			name:        "successful activation",
-			warehouseID: "wh-123",
+			warehouseID: warehouseID,
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				mock.ExpectExec(`UPDATE warehouses SET active=\$2 WHERE id=\$1`).
-					WithArgs("wh-123", true).
+					WithArgs(warehouseID, true).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			expectedStatus: 200,
 		},
 		{
 			name:        "warehouse not found",
-			warehouseID: "wh-123",
+			warehouseID: warehouseID,
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				mock.ExpectExec(`UPDATE warehouses SET active=\$2 WHERE id=\$1`).
-					WithArgs("wh-123", true).
+					WithArgs(warehouseID, true).
 					WillReturnResult(sqlmock.NewResult(0, 0))
 			},
-			expectedStatus: 200, // Still returns 200 even if no rows affected
+			expectedStatus: 404,
+			expectedError:  "Warehouse not found",
+		},
+		{
+			name:           "malformed warehouse id",
+			warehouseID:    "wh-123",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 404,
+			expectedError:  "Warehouse not found",
 		},
 		{
 			name:        "database error",
-			warehouseID: "wh-123",
+			warehouseID: warehouseID,
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				mock.ExpectExec(`UPDATE warehouses SET active=\$2 WHERE id=\$1`).
-					WithArgs("wh-123", true).
+					WithArgs(warehouseID, true).
 					WillReturnError(sql.ErrConnDone)
 			},
 			expectedStatus: 500,
@@ -103,9 +116,14 @@ func TestWarehousesHandler_Deactivate(t *testing.T) {
 			name:        "successful deactivation",
 			warehouseID: "wh-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec(`UPDATE warehouses SET active=\$2 WHERE id=\$1`).
-					WithArgs("wh-123", false).
+				expectDeactivationLocks(mock, "wh-123")
+				mock.ExpectQuery(`FROM reservations WHERE warehouse_id=\$1 AND released=FALSE AND expires_at>now\(\)`).
+					WithArgs("wh-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "warehouse_id", "product_id", "quantity", "expires_at", "released"}))
+				mock.ExpectExec(`UPDATE warehouses SET active=FALSE WHERE id=\$1`).
+					WithArgs("wh-123").
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
 			},
 			expectedStatus: 200,
 		},
@@ -113,19 +131,36 @@ func TestWarehousesHandler_Deactivate(t *testing.T) {
 			name:        "warehouse not found",
 			warehouseID: "wh-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec(`UPDATE warehouses SET active=\$2 WHERE id=\$1`).
-					WithArgs("wh-123", false).
-					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, shop_id, active FROM warehouses WHERE id=\$1 FOR NO KEY UPDATE`).
+					WithArgs("wh-123").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
 			},
-			expectedStatus: 200, // Still returns 200 even if no rows affected
+			expectedStatus: 404,
+			expectedError:  "Warehouse not found",
+		},
+		{
+			name:        "blocked by live reservations",
+			warehouseID: "wh-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectDeactivationLocks(mock, "wh-123")
+				mock.ExpectQuery(`FROM reservations WHERE warehouse_id=\$1`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "warehouse_id", "product_id", "quantity", "expires_at", "released"}).
+						AddRow("r-1", "order-1", "wh-123", "prod-1", 2, time.Now().Add(time.Minute), false))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Warehouse has reservations",
 		},
 		{
 			name:        "database error",
 			warehouseID: "wh-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec(`UPDATE warehouses SET active=\$2 WHERE id=\$1`).
-					WithArgs("wh-123", false).
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, shop_id, active FROM warehouses`).
 					WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
 			},
 			expectedStatus: 500,
 			expectedError:  "DB error",
@@ -150,6 +185,7 @@ func TestWarehousesHandler_Deactivate(t *testing.T) {
 
 			// Create test context
 			c, w := testutils.TestGinContext()
+			c.Request = httptest.NewRequest("POST", "/api/warehouses/"+tt.warehouseID+"/deactivate", nil)
 			c.Params = gin.Params{{Key: "id", Value: tt.warehouseID}}
 
 			// Execute
@@ -170,6 +206,8 @@ func TestWarehousesHandler_Deactivate(t *testing.T) {
 }
 
 func TestWarehousesHandler_Transfer(t *testing.T) {
+	wh1 := "7c9e2f4a-3b5d-4e6f-8a1c-2d4f6b8e0a12"
+	wh2 := "7c9e2f4a-3b5d-4e6f-8a1c-2d4f6b8e0a13"
 	tests := []struct {
 		name           string
 		request        entity.TransferReq
@@ -180,27 +218,19 @@ func TestWarehousesHandler_Transfer(t *testing.T) {
 		{
 			name: "successful transfer",
 			request: entity.TransferReq{
-				From:      "wh-1",
-				To:        "wh-2",
-				ProductID: "prod-1",
+				From:      wh1,
+				To:        wh2,
+				ProductID: testProduct1,
 				Quantity:  5,
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock transaction begin
 				mock.ExpectBegin()
-
-				// Mock inventory reduction
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 5).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock inventory addition
-				mock.ExpectExec(`INSERT INTO inventory\(warehouse_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)
-		ON CONFLICT \(warehouse_id, product_id\) DO UPDATE SET quantity = inventory\.quantity \+ EXCLUDED\.quantity`).
-					WithArgs("wh-2", "prod-1", 5).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock transaction commit
+				mock.ExpectQuery(`SELECT id, shop_id FROM warehouses WHERE id = ANY\(\$1\)`).
+					WithArgs(pq.Array([]string{wh1, wh2})).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "shop_id"}).AddRow(wh1, "shop-1").AddRow(wh2, "shop-1"))
+				mock.ExpectQuery(`INSERT INTO stock_transfers`).
+					WithArgs("shop-1", wh1, wh2, testProduct1, 5).
+					WillReturnRows(transferRow("requested", 0))
 				mock.ExpectCommit()
 			},
 			expectedStatus: 200,
@@ -209,8 +239,8 @@ func TestWarehousesHandler_Transfer(t *testing.T) {
 			name: "missing required fields",
 			request: entity.TransferReq{
 				From:      "",
-				To:        "wh-2",
-				ProductID: "prod-1",
+				To:        wh2,
+				ProductID: testProduct1,
 				Quantity:  5,
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
@@ -219,29 +249,88 @@ func TestWarehousesHandler_Transfer(t *testing.T) {
 			expectedStatus: 400,
 			expectedError:  "Invalid JSON",
 		},
+		{
+			name: "same warehouse",
+			request: entity.TransferReq{
+				From:      wh1,
+				To:        wh1,
+				ProductID: testProduct1,
+				Quantity:  5,
+			},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 422,
+			expectedError:  "Transfer not allowed",
+		},
+		{
+			name: "cross-shop transfer",
+			request: entity.TransferReq{
+				From:      wh1,
+				To:        wh2,
+				ProductID: testProduct1,
+				Quantity:  5,
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, shop_id FROM warehouses`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "shop_id"}).AddRow(wh1, "shop-1").AddRow(wh2, "shop-2"))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 422,
+			expectedError:  "Transfer not allowed",
+		},
 		{
 			name: "database error during transfer",
 			request: entity.TransferReq{
-				From:      "wh-1",
-				To:        "wh-2",
-				ProductID: "prod-1",
+				From:      wh1,
+				To:        wh2,
+				ProductID: testProduct1,
 				Quantity:  5,
 			},
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
-				// Mock inventory reduction - database error
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 5).
+				// Mock warehouse lookup - database error
+				mock.ExpectQuery(`SELECT id, shop_id FROM warehouses`).
 					WillReturnError(sql.ErrConnDone)
 
 				// Mock transaction rollback
 				mock.ExpectRollback()
 			},
-			expectedStatus: 400,
+			expectedStatus: 500,
 			expectedError:  "Transfer failed",
 		},
+		{
+			name: "unknown product",
+			request: entity.TransferReq{
+				From:      wh1,
+				To:        wh2,
+				ProductID: testProduct2,
+				Quantity:  5,
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, shop_id FROM warehouses`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "shop_id"}).AddRow(wh1, "shop-1").AddRow(wh2, "shop-1"))
+				mock.ExpectQuery(`INSERT INTO stock_transfers`).
+					WillReturnError(&pq.Error{Code: "23503"})
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Product not found",
+		},
+		{
+			name: "malformed warehouse id",
+			request: entity.TransferReq{
+				From:      "wh-1",
+				To:        wh2,
+				ProductID: testProduct1,
+				Quantity:  5,
+			},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
 	}
 
 	for _, tt := range tests {
@@ -271,7 +360,7 @@ func TestWarehousesHandler_Transfer(t *testing.T) {
 				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
 			} else {
 				assert.Equal(t, tt.expectedStatus, w.Code)
-				assert.Contains(t, w.Body.String(), "Transfer successful")
+				assert.Contains(t, w.Body.String(), "Transfer requested")
 			}
 
 			// Verify all expectations
@@ -279,3 +368,530 @@ func TestWarehousesHandler_Transfer(t *testing.T) {
 		})
 	}
 }
+
+func TestWarehousesHandler_Dispatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "successful dispatch",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockTransfer(mock, "requested")
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory`).
+					WithArgs(pq.Array([]string{"wh-1"}), pq.Array([]string{"prod-1"})).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).AddRow("wh-1", "prod-1", 5))
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations`).
+					WithArgs(pq.Array([]string{"wh-1"}), pq.Array([]string{"prod-1"})).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}))
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3`).
+					WithArgs("wh-1", "prod-1", -5).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(0))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", -5, 0, "transfer_out", "", "tr-1", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`UPDATE stock_transfers SET status=\$2, dispatched_at=now\(\)`).
+					WillReturnRows(transferRow("dispatched", 0))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name: "not enough available stock",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockTransfer(mock, "requested")
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory`).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).AddRow("wh-1", "prod-1", 4))
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations`).
+					WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Insufficient stock",
+		},
+		{
+			name: "already dispatched",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockTransfer(mock, "dispatched")
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Cannot dispatch transfer",
+		},
+		{
+			name: "transfer not found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM stock_transfers WHERE id=\$1 FOR UPDATE`).
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Transfer not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &WarehousesHandler{
+				DB:  db,
+				Svc: &service.WarehousesService{DB: db},
+			}
+
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			c.Params = gin.Params{{Key: "id", Value: "tr-1"}}
+			testutils.WithPrincipal(c, "user-1")
+
+			handler.Dispatch(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Transfer dispatched")
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesHandler_Receive(t *testing.T) {
+	three, tooMany := 3, 9
+
+	tests := []struct {
+		name           string
+		request        entity.ReceiveTransferReq
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "partial receipt",
+			request: entity.ReceiveTransferReq{Quantity: &three},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockTransfer(mock, "dispatched")
+				mock.ExpectQuery(`INSERT INTO inventory`).
+					WithArgs("wh-2", "prod-1", 3).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(3))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-2", "prod-1", 3, 3, "transfer_in", "", "tr-1", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`UPDATE stock_transfers SET status=\$2, received_quantity=\$3`).
+					WithArgs("tr-1", "partially_received", 3).
+					WillReturnRows(transferRow("partially_received", 3))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:    "more than dispatched",
+			request: entity.ReceiveTransferReq{Quantity: &tooMany},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockTransfer(mock, "dispatched")
+				mock.ExpectRollback()
+			},
+			expectedStatus: 422,
+			expectedError:  "Cannot receive transfer",
+		},
+		{
+			name: "not dispatched",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockTransfer(mock, "requested")
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Cannot receive transfer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &WarehousesHandler{
+				DB:  db,
+				Svc: &service.WarehousesService{DB: db},
+			}
+
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+			c.Params = gin.Params{{Key: "id", Value: "tr-1"}}
+			testutils.WithPrincipal(c, "user-1")
+
+			handler.Receive(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Transfer received")
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesHandler_Movements(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:  "lists the ledger",
+			query: "reason=sale&limit=5",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM inventory_movements WHERE warehouse_id=\$1 AND reason=\$2 ORDER BY id DESC LIMIT \$3`).
+					WithArgs("wh-1", "sale", 6).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "warehouse_id", "product_id", "delta", "balance", "reason", "order_id", "transfer_id", "cycle_count_id", "actor_id", "created_at"}).
+						AddRow(7, "wh-1", "prod-1", -2, 3, "sale", "order-1", nil, nil, "user-1", time.Now()))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown reason",
+			query:          "reason=theft",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid query",
+		},
+		{
+			name:  "filtered by product",
+			query: "product_id=" + testProduct1,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM inventory_movements WHERE warehouse_id=\$1 AND product_id=\$2 ORDER BY id DESC LIMIT \$3`).
+					WithArgs("wh-1", testProduct1, 51).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "warehouse_id", "product_id", "delta", "balance", "reason", "order_id", "transfer_id", "cycle_count_id", "actor_id", "created_at"}).
+						AddRow(7, "wh-1", testProduct1, -2, 3, "sale", "order-1", nil, nil, "user-1", time.Now()))
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "malformed product id",
+			query:          "product_id=prod-1",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid query",
+		},
+		{
+			name:           "malformed order id",
+			query:          "order_id=1",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid query",
+		},
+		{
+			name:           "malformed transfer id",
+			query:          "transfer_id=x",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid query",
+		},
+		{
+			name:           "bad cursor",
+			query:          "cursor=x",
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid cursor",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &WarehousesHandler{
+				DB:  db,
+				Svc: &service.WarehousesService{DB: db},
+			}
+
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContext()
+			c.Request = httptest.NewRequest("GET", "/api/warehouses/wh-1/movements?"+tt.query, nil)
+			c.Params = gin.Params{{Key: "id", Value: "wh-1"}}
+
+			handler.Movements(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Movements listed")
+				assert.Contains(t, w.Body.String(), `"balance":3`)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesHandler_Adjust(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:    "receipt",
+			request: entity.AdjustStockReq{ProductID: "prod-1", Delta: 4, Reason: "receipt"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStockRow(mock, 1, 1)
+				mock.ExpectQuery(`INSERT INTO inventory`).
+					WithArgs("wh-1", "prod-1", 4).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(5))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", 4, 5, "receipt", "", "", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown reason code",
+			request:        map[string]interface{}{"product_id": "prod-1", "delta": 4, "reason": "gift"},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:    "below reservations",
+			request: entity.AdjustStockReq{ProductID: "prod-1", Delta: -1, Reason: "damage"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStockRow(mock, 3, 3)
+				mock.ExpectRollback()
+			},
+			expectedStatus: 409,
+			expectedError:  "Stock is reserved",
+		},
+		{
+			name:    "shrinkage cannot add stock",
+			request: entity.AdjustStockReq{ProductID: "prod-1", Delta: 2, Reason: "shrinkage"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStockRow(mock, 3, 0)
+				mock.ExpectRollback()
+			},
+			expectedStatus: 422,
+			expectedError:  "Invalid adjustment",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &WarehousesHandler{
+				DB:  db,
+				Svc: &service.WarehousesService{DB: db},
+			}
+
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+			c.Params = gin.Params{{Key: "id", Value: "wh-1"}}
+			testutils.WithPrincipal(c, "user-1")
+
+			handler.Adjust(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Stock adjusted")
+				assert.Contains(t, w.Body.String(), `"available":4`)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// expectDeactivationLocks mocks the warehouse and order locks Deactivate takes
+// before reading reservations.
+func expectDeactivationLocks(mock sqlmock.Sqlmock, warehouseID string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, shop_id, active FROM warehouses WHERE id=\$1 FOR NO KEY UPDATE`).
+		WithArgs(warehouseID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "shop_id", "active"}).AddRow(warehouseID, "shop-1", true))
+	mock.ExpectExec(`SELECT id FROM orders WHERE id IN \(`).
+		WithArgs(warehouseID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// expectStockRow mocks the existence check and the locked stock of prod-1 in wh-1.
+func expectStockRow(mock sqlmock.Sqlmock, onHand, held int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WithArgs("wh-1", "prod-1").
+		WillReturnRows(sqlmock.NewRows([]string{"wh", "prod"}).AddRow(true, true))
+	mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory`).
+		WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).AddRow("wh-1", "prod-1", onHand))
+	mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations`).
+		WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}).AddRow("wh-1", "prod-1", held))
+}
+
+func transferRow(status string, received int) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "shop_id", "from_warehouse_id", "to_warehouse_id", "product_id", "quantity", "received_quantity", "status", "created_at", "updated_at", "dispatched_at", "received_at"}).
+		AddRow("tr-1", "shop-1", "wh-1", "wh-2", "prod-1", 5, received, status, time.Now(), time.Now(), nil, nil)
+}
+
+// expectLockTransfer begins the transaction and returns tr-1 in the given
+// status from the row lock.
+func expectLockTransfer(mock sqlmock.Sqlmock, status string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM stock_transfers WHERE id=\$1 FOR UPDATE`).
+		WithArgs("tr-1").
+		WillReturnRows(transferRow(status, 0))
+}
+
+var warehouseCols = []string{"id", "shop_id", "name", "active", "priority", "latitude", "longitude",
+	"address_line1", "address_line2", "city", "region", "postal_code", "country", "metadata",
+	"created_at", "updated_at", "deleted_at"}
+
+func TestWarehousesHandler_Create(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        interface{}
+		mockSetup      func(sqlmock.Sqlmock)
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name: "created",
+			request: map[string]interface{}{
+				"shop_id":  "shop-1",
+				"name":     "North",
+				"address":  map[string]interface{}{"line1": "1 Dock Rd", "city": "Leeds", "country": "GB"},
+				"metadata": map[string]interface{}{"dock": "B"},
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO warehouses`).
+					WithArgs("shop-1", "North", nil, nil, nil, `{"dock":"B"}`, "1 Dock Rd", "", "Leeds", "", "", "GB").
+					WillReturnRows(sqlmock.NewRows(warehouseCols).
+						AddRow("wh-1", "shop-1", "North", true, 100, nil, nil, "1 Dock Rd", "", "Leeds", "", "", "GB", []byte(`{"dock":"B"}`), time.Now(), time.Now(), nil))
+				mock.ExpectCommit()
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:           "bad country code",
+			request:        map[string]interface{}{"shop_id": "shop-1", "name": "North", "address": map[string]interface{}{"country": "England"}},
+			mockSetup:      func(mock sqlmock.Sqlmock) {},
+			expectedStatus: 400,
+			expectedError:  "Invalid JSON",
+		},
+		{
+			name:    "unknown shop",
+			request: entity.CreateWarehouseReq{ShopID: "shop-9", Name: "North"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WithArgs("shop-9").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			expectedStatus: 404,
+			expectedError:  "Shop not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			handler := &WarehousesHandler{DB: db, Svc: &service.WarehousesService{DB: db}}
+			tt.mockSetup(mock)
+
+			c, w := testutils.TestGinContextWithBody(t, tt.request)
+
+			handler.Create(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Warehouse created")
+				assert.Contains(t, w.Body.String(), `"city":"Leeds"`)
+				assert.Contains(t, w.Body.String(), `"metadata":{"dock":"B"}`)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesHandler_Delete(t *testing.T) {
+	whID := "7c9e2f4a-3b5d-4e6f-8a1c-2d4f6b8e0a12"
+	tests := []struct {
+		name           string
+		id             string
+		contents       []driver.Value
+		expectedStatus int
+		expectedError  string
+	}{
+		{name: "deleted", contents: []driver.Value{0, 0, 0}, expectedStatus: 200},
+		{name: "reserved stock", contents: []driver.Value{1, 3, 0}, expectedStatus: 409, expectedError: "Warehouse has reservations"},
+		{name: "stock on hand", contents: []driver.Value{0, 3, 0}, expectedStatus: 409, expectedError: "Warehouse is not empty"},
+		{name: "malformed id", id: "wh-1", expectedStatus: 404, expectedError: "Warehouse not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			id := whID
+			if tt.id != "" {
+				id = tt.id
+			} else {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM warehouses WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WithArgs(whID).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(whID))
+				mock.ExpectQuery(`FROM reservations WHERE warehouse_id=\$1`).
+					WillReturnRows(sqlmock.NewRows([]string{"reserved", "on_hand", "transfers"}).AddRow(tt.contents...))
+				if tt.expectedError == "" {
+					mock.ExpectExec(`UPDATE warehouses SET active=FALSE, deleted_at=now\(\)`).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+					mock.ExpectCommit()
+				} else {
+					mock.ExpectRollback()
+				}
+			}
+
+			handler := &WarehousesHandler{DB: db, Svc: &service.WarehousesService{DB: db}}
+			c, w := testutils.TestGinContext()
+			c.Params = gin.Params{{Key: "id", Value: id}}
+
+			handler.Delete(c)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+				assert.Contains(t, w.Body.String(), "Warehouse deleted")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
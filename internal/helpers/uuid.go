@@ -0,0 +1,12 @@
+package helpers
+
+import "regexp"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IsUUID reports whether s is a uuid in its hyphenated form. Ids taken from
+// requests are checked with it before they reach Postgres, which fails the
+// query on a malformed uuid instead of finding nothing.
+func IsUUID(s string) bool {
+	return uuidPattern.MatchString(s)
+}
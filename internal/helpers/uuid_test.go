@@ -0,0 +1,27 @@
+package helpers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUUID(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"3f0c2a4e-9b1d-4c6f-8a2e-5d7b9c1e3f40", true},
+		{"3F0C2A4E-9B1D-4C6F-8A2E-5D7B9C1E3F40", true},
+		{"3f0c2a4e9b1d4c6f8a2e5d7b9c1e3f40", false},
+		{"3f0c2a4e-9b1d-4c6f-8a2e-5d7b9c1e3f4", false},
+		{"order-123", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsUUID(tt.in))
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/server/web"
+)
+
+const (
+	// HeaderKey carries the client's key for the request.
+	HeaderKey = "Idempotency-Key"
+	// HeaderReplayed is set on responses replayed from the store.
+	HeaderReplayed = "Idempotent-Replayed"
+
+	maxKeyLen = 255
+	// maxBodyLen caps the bodies read into memory to be hashed
+	maxBodyLen = 1 << 20
+)
+
+// Middleware makes the route it guards safe to retry. It runs after
+// authentication, keys being scoped to the caller, and records the response
+// to the first request with a given key; a retry with the same method, path
+// and body gets that response back without reaching the handler. Server
+// errors are not recorded, so such requests can be retried for real.
+//
+// Requests without a key pass straight through unless required is set, in
+// which case they are refused. Bodies of keyed requests are read whole to be
+// hashed, so ones over 1 MiB are refused too.
+func Middleware(store Store, required bool, log *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(HeaderKey)
+		if key == "" {
+			if required {
+				abort(c, http.StatusBadRequest, "Missing Idempotency-Key", "", nil)
+				return
+			}
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLen {
+			abort(c, http.StatusBadRequest, "Invalid Idempotency-Key", "key is longer than 255 characters", nil)
+			return
+		}
+		p, ok := web.CurrentPrincipal(c)
+		if !ok {
+			abort(c, http.StatusUnauthorized, "Unauthorized", "", nil)
+			return
+		}
+		var body []byte
+		if c.Request.Body != nil {
+			b, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyLen))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				abort(c, http.StatusRequestEntityTooLarge, "Request body too large", err.Error(), nil)
+				return
+			}
+			if err != nil {
+				abort(c, http.StatusBadRequest, "Bad body", err.Error(), nil)
+				return
+			}
+			body = b
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		owner := ownerOf(p)
+		// the outcome is stored even when the client has gone away
+		ctx := context.WithoutCancel(c.Request.Context())
+		claim, prev, err := store.Begin(ctx, owner, key, requestHash(c.Request.Method, c.Request.URL.Path, body))
+		switch {
+		case errors.Is(err, ErrKeyReused):
+			abort(c, http.StatusConflict, "Idempotency-Key reused", err.Error(), nil)
+			return
+		case errors.Is(err, ErrInProgress):
+			c.Header("Retry-After", "1")
+			abort(c, http.StatusConflict, "Request in progress", err.Error(), nil)
+			return
+		case err != nil:
+			abort(c, http.StatusInternalServerError, "DB error", err.Error(), log)
+			return
+		case prev != nil:
+			c.Header(HeaderReplayed, "true")
+			c.Data(prev.StatusCode, prev.ContentType, prev.Body)
+			c.Abort()
+			return
+		}
+
+		rec := &recorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			// the handler panicked; let the retry run it again
+			if err := store.Release(ctx, owner, key, claim); err != nil {
+				log.Error("release idempotency key failed", zap.Error(err))
+			}
+		}()
+		c.Next()
+		completed = true
+
+		if rec.Status() >= http.StatusInternalServerError {
+			if err := store.Release(ctx, owner, key, claim); err != nil {
+				log.Error("release idempotency key failed", zap.Error(err))
+			}
+			return
+		}
+		res := Response{StatusCode: rec.Status(), ContentType: rec.Header().Get("Content-Type"), Body: rec.body.Bytes()}
+		if err := store.Complete(ctx, owner, key, claim, res); err != nil {
+			log.Error("record idempotent response failed", zap.Error(err))
+		}
+	}
+}
+
+// ownerOf scopes a caller's keys to the API key it used, or to the user.
+func ownerOf(p auth.Principal) string {
+	if p.APIKeyID != "" {
+		return "api_key:" + p.APIKeyID
+	}
+	return "user:" + p.UserID
+}
+
+// requestHash identifies a request, so a key sent again with another
+// endpoint or body is told apart from a retry.
+func requestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func abort(c *gin.Context, code int, message, detail string, log *zap.Logger) {
+	helpers.WriteError(c.Writer, code, message, detail, log)
+	c.Abort()
+}
+
+// recorder keeps a copy of the response body as it is written.
+type recorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,287 @@
+package idempotency
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/server/web"
+	"ecommerce-shop/testutils"
+)
+
+// memStore is a Store kept in memory.
+type memStore struct {
+	mu       sync.Mutex
+	requests map[string]*memRequest
+	claims   int
+}
+
+type memRequest struct {
+	hash  string
+	claim string
+	res   *Response
+}
+
+func newMemStore() *memStore { return &memStore{requests: map[string]*memRequest{}} }
+
+func (s *memStore) Begin(_ context.Context, owner, key, requestHash string) (string, *Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.requests[owner+"/"+key]
+	switch {
+	case !ok:
+		s.claims++
+		claim := strconv.Itoa(s.claims)
+		s.requests[owner+"/"+key] = &memRequest{hash: requestHash, claim: claim}
+		return claim, nil, nil
+	case r.hash != requestHash:
+		return "", nil, ErrKeyReused
+	case r.res == nil:
+		return "", nil, ErrInProgress
+	}
+	return "", r.res, nil
+}
+
+func (s *memStore) Complete(_ context.Context, owner, key, claim string, res Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.requests[owner+"/"+key]
+	if r == nil || r.claim != claim || r.res != nil {
+		return ErrClaimLost
+	}
+	r.res = &res
+	return nil
+}
+
+func (s *memStore) Release(_ context.Context, owner, key, claim string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.requests[owner+"/"+key]; r != nil && r.claim == claim && r.res == nil {
+		delete(s.requests, owner+"/"+key)
+	}
+	return nil
+}
+
+// payRouter serves POST /orders/:id/pay to whoever principal points to,
+// behind the middleware. The handler answers each call with the next status
+// of statuses, 0 standing for a panic, and counts the calls.
+func payRouter(store Store, required bool, principal *auth.Principal, statuses ...int) (*gin.Engine, *int) {
+	gin.SetMode(gin.TestMode)
+	calls := 0
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.POST("/orders/:id/pay", func(c *gin.Context) {
+		web.SetPrincipal(c, *principal)
+	}, Middleware(store, required, zap.NewNop()), func(c *gin.Context) {
+		status := http.StatusOK
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		if status == 0 {
+			panic("boom")
+		}
+		c.JSON(status, gin.H{"call": calls})
+	})
+	return r, &calls
+}
+
+func pay(r *gin.Engine, order, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/orders/"+order+"/pay", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(HeaderKey, key)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware_Replay(t *testing.T) {
+	user := auth.Principal{UserID: "user-1"}
+	r, calls := payRouter(newMemStore(), false, &user)
+
+	first := pay(r, "order-1", "key-1", `{"method":"card"}`)
+	retry := pay(r, "order-1", "key-1", `{"method":"card"}`)
+
+	require.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, first.Code, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	assert.Equal(t, "true", retry.Header().Get(HeaderReplayed))
+	assert.Empty(t, first.Header().Get(HeaderReplayed))
+}
+
+func TestMiddleware(t *testing.T) {
+	user := auth.Principal{UserID: "user-1"}
+
+	tests := []struct {
+		name string
+		// setup sends earlier requests as user-1
+		setup    func(store *memStore, r *gin.Engine)
+		required bool
+		// principal sends the request, when not user-1
+		principal *auth.Principal
+		statuses  []int
+		key       string
+		order     string
+		// body is sent instead of {"method":"iban"}
+		body           string
+		expectedStatus int
+		expectedError  string
+		expectedCalls  int
+	}{
+		{
+			name: "key reused with another body",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"card"}`)
+			},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 409,
+			expectedError:  "Idempotency-Key reused",
+			expectedCalls:  1,
+		},
+		{
+			name: "key reused on another order",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"iban"}`)
+			},
+			key:            "key-1",
+			order:          "order-2",
+			expectedStatus: 409,
+			expectedError:  "Idempotency-Key reused",
+			expectedCalls:  1,
+		},
+		{
+			name: "first request still in flight",
+			setup: func(store *memStore, _ *gin.Engine) {
+				_, _, _ = store.Begin(context.Background(), "user:user-1", "key-1", requestHash(http.MethodPost, "/orders/order-1/pay", []byte(`{"method":"iban"}`)))
+			},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 409,
+			expectedError:  "Request in progress",
+		},
+		{
+			name: "keys are scoped per user",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"card"}`)
+			},
+			principal:      &auth.Principal{UserID: "user-2"},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 200,
+			expectedCalls:  2,
+		},
+		{
+			name: "API key callers have their own keys",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"card"}`)
+			},
+			principal:      &auth.Principal{UserID: "user-1", APIKeyID: "api-key-1"},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 200,
+			expectedCalls:  2,
+		},
+		{
+			name: "server error is not recorded",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"iban"}`)
+			},
+			statuses:       []int{500, 200},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 200,
+			expectedCalls:  2,
+		},
+		{
+			name: "panic is not recorded",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"iban"}`)
+			},
+			statuses:       []int{0, 200},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 200,
+			expectedCalls:  2,
+		},
+		{
+			name: "client error is replayed",
+			setup: func(_ *memStore, r *gin.Engine) {
+				pay(r, "order-1", "key-1", `{"method":"iban"}`)
+			},
+			statuses:       []int{422, 200},
+			key:            "key-1",
+			order:          "order-1",
+			expectedStatus: 422,
+			expectedCalls:  1,
+		},
+		{
+			name:           "no key",
+			order:          "order-1",
+			expectedStatus: 200,
+			expectedCalls:  1,
+		},
+		{
+			name:           "no key where one is required",
+			required:       true,
+			order:          "order-1",
+			expectedStatus: 400,
+			expectedError:  "Missing Idempotency-Key",
+		},
+		{
+			name:           "body too large",
+			key:            "key-1",
+			order:          "order-1",
+			body:           `{"note":"` + strings.Repeat("x", maxBodyLen) + `"}`,
+			expectedStatus: 413,
+			expectedError:  "Request body too large",
+		},
+		{
+			name:           "key too long",
+			key:            strings.Repeat("k", 256),
+			order:          "order-1",
+			expectedStatus: 400,
+			expectedError:  "Invalid Idempotency-Key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			caller := user
+			r, calls := payRouter(store, tt.required, &caller, tt.statuses...)
+			if tt.setup != nil {
+				tt.setup(store, r)
+			}
+			if tt.principal != nil {
+				caller = *tt.principal
+			}
+
+			body := `{"method":"iban"}`
+			if tt.body != "" {
+				body = tt.body
+			}
+			w := pay(r, tt.order, tt.key, body)
+
+			if tt.expectedError != "" {
+				testutils.AssertErrorResponse(t, w, tt.expectedStatus, tt.expectedError)
+			} else {
+				assert.Equal(t, tt.expectedStatus, w.Code)
+			}
+			assert.Equal(t, tt.expectedCalls, *calls)
+		})
+	}
+}
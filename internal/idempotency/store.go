@@ -0,0 +1,124 @@
+// Package idempotency lets clients retry mutating requests safely: the first
+// response to a request carrying an Idempotency-Key is recorded and replayed
+// for every retry with the same key.
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrKeyReused  = errors.New("idempotency key was used for a different request")
+	ErrInProgress = errors.New("a request with this idempotency key is still in progress")
+	ErrClaimLost  = errors.New("claim on the idempotency key expired and was taken over")
+)
+
+// Response is a recorded response, replayed as is.
+type Response struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// Store records the outcome of requests per owner and key.
+type Store interface {
+	// Begin claims key for the request with hash requestHash. It returns a
+	// claim token when the caller should go ahead and handle the request, the
+	// recorded response when the request was already handled, ErrInProgress
+	// while another claim on the key is live and ErrKeyReused when the key was
+	// used for a different request.
+	Begin(ctx context.Context, owner, key, requestHash string) (claim string, prev *Response, err error)
+	// Complete records the response to the request claimed with claim. It
+	// returns ErrClaimLost when the claim expired and the key was claimed
+	// again since.
+	Complete(ctx context.Context, owner, key, claim string, res Response) error
+	// Release gives up a claim without recording a response, so the request
+	// can be retried. A claim that was taken over is left alone.
+	Release(ctx context.Context, owner, key, claim string) error
+}
+
+// PGStore keeps requests in the idempotency_requests table.
+type PGStore struct {
+	DB *sqlx.DB
+	// Retention is how long a key is remembered; after it the key may be
+	// used again for anything.
+	Retention time.Duration
+	// LockTimeout is how long a claim holds when its request never
+	// completes, such as when the server died handling it. Until then
+	// retries get ErrInProgress.
+	LockTimeout time.Duration
+}
+
+func (s *PGStore) Begin(ctx context.Context, owner, key, requestHash string) (string, *Response, error) {
+	// a row deleted by pruning between the two statements is claimed on the
+	// next pass
+	for attempt := 0; attempt < 2; attempt++ {
+		var claim string
+		err := s.DB.GetContext(ctx, &claim, `
+			INSERT INTO idempotency_requests(owner, key, request_hash, claim_token, locked_until, expires_at)
+			VALUES ($1, $2, $3, gen_random_uuid(), $4, $5)
+			ON CONFLICT (owner, key) DO UPDATE SET request_hash=EXCLUDED.request_hash, claim_token=EXCLUDED.claim_token,
+				status_code=NULL, content_type='', response_body=NULL, locked_until=EXCLUDED.locked_until, created_at=now(),
+				expires_at=EXCLUDED.expires_at
+			WHERE idempotency_requests.expires_at<=now()
+				OR (idempotency_requests.status_code IS NULL AND idempotency_requests.locked_until<=now()
+					AND idempotency_requests.request_hash=EXCLUDED.request_hash)
+			RETURNING claim_token
+		`, owner, key, requestHash, time.Now().Add(s.LockTimeout), time.Now().Add(s.Retention))
+		if err == nil {
+			return claim, nil, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", nil, err
+		}
+		var rec struct {
+			RequestHash string        `db:"request_hash"`
+			StatusCode  sql.NullInt64 `db:"status_code"`
+			ContentType string        `db:"content_type"`
+			Body        []byte        `db:"response_body"`
+		}
+		err = s.DB.GetContext(ctx, &rec, `
+			SELECT request_hash, status_code, content_type, response_body FROM idempotency_requests WHERE owner=$1 AND key=$2
+		`, owner, key)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case rec.RequestHash != requestHash:
+			return "", nil, ErrKeyReused
+		case !rec.StatusCode.Valid:
+			return "", nil, ErrInProgress
+		}
+		return "", &Response{StatusCode: int(rec.StatusCode.Int64), ContentType: rec.ContentType, Body: rec.Body}, nil
+	}
+	return "", nil, ErrInProgress
+}
+
+func (s *PGStore) Complete(ctx context.Context, owner, key, claim string, res Response) error {
+	r, err := s.DB.ExecContext(ctx, `
+		UPDATE idempotency_requests SET status_code=$4, content_type=$5, response_body=$6, locked_until=NULL
+		WHERE owner=$1 AND key=$2 AND claim_token=$3 AND status_code IS NULL
+	`, owner, key, claim, res.StatusCode, res.ContentType, res.Body)
+	if err != nil {
+		return err
+	}
+	if n, _ := r.RowsAffected(); n == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+func (s *PGStore) Release(ctx context.Context, owner, key, claim string) error {
+	_, err := s.DB.ExecContext(ctx, `
+		DELETE FROM idempotency_requests WHERE owner=$1 AND key=$2 AND claim_token=$3 AND status_code IS NULL
+	`, owner, key, claim)
+	return err
+}
@@ -0,0 +1,117 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/testutils"
+)
+
+func TestPGStore_Begin(t *testing.T) {
+	expectClaim := func(mock sqlmock.Sqlmock, claimed bool) {
+		q := mock.ExpectQuery(`INSERT INTO idempotency_requests\(owner, key, request_hash, claim_token, locked_until, expires_at\)`).
+			WithArgs("user:user-1", "key-1", "hash-1", sqlmock.AnyArg(), sqlmock.AnyArg())
+		if claimed {
+			q.WillReturnRows(sqlmock.NewRows([]string{"claim_token"}).AddRow("claim-1"))
+		} else {
+			q.WillReturnError(sql.ErrNoRows)
+		}
+	}
+	recorded := `SELECT request_hash, status_code, content_type, response_body FROM idempotency_requests WHERE owner=\$1 AND key=\$2`
+	columns := []string{"request_hash", "status_code", "content_type", "response_body"}
+
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantClaim string
+		want      *Response
+		wantErr   error
+	}{
+		{
+			name:      "new key is claimed",
+			mockSetup: func(mock sqlmock.Sqlmock) { expectClaim(mock, true) },
+			wantClaim: "claim-1",
+		},
+		{
+			name: "completed request is replayed",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				mock.ExpectQuery(recorded).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("hash-1", 201, "application/json", []byte(`{"id":"order-1"}`)))
+			},
+			want: &Response{StatusCode: 201, ContentType: "application/json", Body: []byte(`{"id":"order-1"}`)},
+		},
+		{
+			name: "request still in flight",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				mock.ExpectQuery(recorded).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("hash-1", nil, "", nil))
+			},
+			wantErr: ErrInProgress,
+		},
+		{
+			name: "key used for another request",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				mock.ExpectQuery(recorded).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("hash-2", 200, "application/json", []byte(`{}`)))
+			},
+			wantErr: ErrKeyReused,
+		},
+		{
+			name: "key pruned in between",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectClaim(mock, false)
+				mock.ExpectQuery(recorded).WillReturnError(sql.ErrNoRows)
+				expectClaim(mock, true)
+			},
+			wantClaim: "claim-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+			store := &PGStore{DB: db, Retention: 24 * time.Hour, LockTimeout: time.Minute}
+			tt.mockSetup(mock)
+
+			claim, got, err := store.Begin(context.Background(), "user:user-1", "key-1", "hash-1")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantClaim, claim)
+				assert.Equal(t, tt.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+// A request that outlived its lock must not record or drop the response of
+// the retry that took the key over.
+func TestPGStore_ClaimTakenOver(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+	store := &PGStore{DB: db, Retention: 24 * time.Hour, LockTimeout: time.Minute}
+
+	mock.ExpectExec(`UPDATE idempotency_requests SET status_code=\$4, content_type=\$5, response_body=\$6, locked_until=NULL\s+WHERE owner=\$1 AND key=\$2 AND claim_token=\$3 AND status_code IS NULL`).
+		WithArgs("user:user-1", "key-1", "claim-1", 200, "application/json", []byte(`{}`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM idempotency_requests WHERE owner=\$1 AND key=\$2 AND claim_token=\$3 AND status_code IS NULL`).
+		WithArgs("user:user-1", "key-1", "claim-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := store.Complete(context.Background(), "user:user-1", "key-1", "claim-1", Response{StatusCode: 200, ContentType: "application/json", Body: []byte(`{}`)})
+	assert.ErrorIs(t, err, ErrClaimLost)
+	assert.NoError(t, store.Release(context.Background(), "user:user-1", "key-1", "claim-1"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"ecommerce-shop/internal/config"
+)
+
+var ErrHeaderInjection = errors.New("mail header contains a line break")
+
+// Message is a plain-text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// New returns an SMTPMailer when SMTP_ADDR is set. Outside production it
+// falls back to a LogMailer; production refuses to start without SMTP, as
+// reset and verification links would never reach anyone.
+func New(cfg config.Config, log *zap.Logger) (Mailer, error) {
+	if cfg.SMTPAddr == "" {
+		if cfg.Env == "production" {
+			return nil, errors.New("SMTP_ADDR is not set")
+		}
+		log.Warn("SMTP_ADDR not set, emails are only logged")
+		return &LogMailer{Log: log, From: cfg.MailFrom, Dir: cfg.MailDir}, nil
+	}
+	var a smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+		a = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return &SMTPMailer{Addr: cfg.SMTPAddr, From: cfg.MailFrom, Auth: a}, nil
+}
+
+// SMTPMailer sends through an SMTP relay, upgrading to TLS when the server
+// offers STARTTLS. PLAIN auth is refused over an unencrypted connection to
+// anything but localhost.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m Message) error {
+	raw, err := encode(s.From, m, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{m.To}, raw)
+}
+
+// LogMailer stands in for SMTP in development and tests. It logs who every
+// message goes to and its subject, but not the body, which carries reset and
+// verification tokens; when Dir is set the whole message is also written
+// there as an .eml file.
+type LogMailer struct {
+	Log  *zap.Logger
+	From string
+	Dir  string
+}
+
+func (l *LogMailer) Send(_ context.Context, m Message) error {
+	raw, err := encode(l.From, m, time.Now())
+	if err != nil {
+		return err
+	}
+	l.Log.Info("email", zap.String("to", m.To), zap.String("subject", m.Subject), zap.String("body", "[redacted]"))
+	if l.Dir == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.NewReplacer("@", "_at_", "/", "_").Replace(m.To))
+	return os.WriteFile(filepath.Join(l.Dir, name), raw, 0o600)
+}
+
+// encode renders m as an RFC 5322 message. Header values come from user
+// input, so line breaks in them are refused rather than escaped.
+func encode(from string, m Message, at time.Time) ([]byte, error) {
+	for _, h := range []string{from, m.To, m.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrHeaderInjection
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", at.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
@@ -0,0 +1,90 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
+
+	"ecommerce-shop/internal/config"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		want    Mailer
+		wantErr bool
+	}{
+		{name: "SMTP relay", cfg: config.Config{Env: "production", SMTPAddr: "smtp.example.com:587"}, want: &SMTPMailer{}},
+		{name: "logged in development", cfg: config.Config{Env: "development"}, want: &LogMailer{}},
+		{name: "production without SMTP", cfg: config.Config{Env: "production"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.cfg, zaptest.NewLogger(t))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.IsType(t, tt.want, m)
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	at := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	raw, err := encode("shop@example.com", Message{To: "a@b.com", Subject: "Hi", Body: "line one\nline two"}, at)
+	require.NoError(t, err)
+
+	msg := string(raw)
+	assert.True(t, strings.HasPrefix(msg, "From: shop@example.com\r\nTo: a@b.com\r\nSubject: Hi\r\n"))
+	assert.Contains(t, msg, "Date: Thu, 01 Oct 2026 12:00:00 +0000\r\n")
+	assert.True(t, strings.HasSuffix(msg, "\r\n\r\nline one\r\nline two"))
+}
+
+func TestEncode_HeaderInjection(t *testing.T) {
+	_, err := encode("shop@example.com", Message{To: "a@b.com\r\nBcc: everyone@example.com", Subject: "Hi"}, time.Now())
+	assert.ErrorIs(t, err, ErrHeaderInjection)
+
+	_, err = encode("shop@example.com", Message{To: "a@b.com", Subject: "Hi\nBcc: x@y.z"}, time.Now())
+	assert.ErrorIs(t, err, ErrHeaderInjection)
+}
+
+func TestLogMailer_WritesFile(t *testing.T) {
+	dir := t.TempDir()
+	m := &LogMailer{Log: zaptest.NewLogger(t), From: "shop@example.com", Dir: dir}
+
+	require.NoError(t, m.Send(context.Background(), Message{To: "a@b.com", Subject: "Hi", Body: "link"}))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Contains(t, filepath.Base(files[0]), "a_at_b.com")
+	raw, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "Subject: Hi")
+}
+
+func TestLogMailer_RedactsBody(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	m := &LogMailer{Log: zap.New(core), From: "shop@example.com"}
+
+	require.NoError(t, m.Send(context.Background(), Message{To: "a@b.com", Subject: "Reset your password", Body: "token=secret"}))
+
+	require.Equal(t, 1, logs.Len())
+	fields := logs.All()[0].ContextMap()
+	assert.Equal(t, "a@b.com", fields["to"])
+	assert.Equal(t, "Reset your password", fields["subject"])
+	assert.Equal(t, "[redacted]", fields["body"])
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIPermission is what an API key may do in its shop. Keys act with a staff
+// member's rights, limited to the endpoints their permissions cover.
+type APIPermission string
+
+const (
+	PermInventoryRead  APIPermission = "inventory:read"
+	PermInventoryWrite APIPermission = "inventory:write"
+	PermTransfersRead  APIPermission = "transfers:read"
+	PermTransfersWrite APIPermission = "transfers:write"
+)
+
+var apiPermissions = map[APIPermission]bool{
+	PermInventoryRead:  true,
+	PermInventoryWrite: true,
+	PermTransfersRead:  true,
+	PermTransfersWrite: true,
+}
+
+func (p APIPermission) Valid() bool { return apiPermissions[p] }
+
+// APIKey is a stored API key. The key itself is only known to the client;
+// KeyHash is its SHA-256 and Prefix its first characters, for display.
+type APIKey struct {
+	ID          string         `db:"id" json:"id"`
+	ShopID      string         `db:"shop_id" json:"shop_id"`
+	Name        string         `db:"name" json:"name"`
+	Prefix      string         `db:"prefix" json:"prefix"`
+	KeyHash     string         `db:"key_hash" json:"-"`
+	Permissions pq.StringArray `db:"permissions" json:"permissions"`
+	// CreatedBy is empty once the creating user has been deleted.
+	CreatedBy  *string    `db:"created_by" json:"created_by,omitempty"`
+	ExpiresAt  *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+}
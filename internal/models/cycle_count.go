@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+type CycleCountStatus string
+
+const (
+	CountOpen      CycleCountStatus = "open"
+	CountApproved  CycleCountStatus = "approved"
+	CountCancelled CycleCountStatus = "cancelled"
+)
+
+type CycleCount struct {
+	ID          string           `db:"id" json:"id"`
+	WarehouseID string           `db:"warehouse_id" json:"warehouse_id"`
+	Status      CycleCountStatus `db:"status" json:"status"`
+	OpenedBy    *string          `db:"opened_by" json:"opened_by,omitempty"`
+	ApprovedBy  *string          `db:"approved_by" json:"approved_by,omitempty"`
+	CreatedAt   time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time        `db:"updated_at" json:"updated_at"`
+	ApprovedAt  *time.Time       `db:"approved_at" json:"approved_at,omitempty"`
+}
+
+// CycleCountLine is one product of a count. SnapshotQty is the on-hand
+// quantity when the count was opened; CountedQty is nil until submitted.
+type CycleCountLine struct {
+	CountID     string     `db:"count_id" json:"count_id"`
+	ProductID   string     `db:"product_id" json:"product_id"`
+	SnapshotQty int        `db:"snapshot_qty" json:"snapshot_qty"`
+	CountedQty  *int       `db:"counted_qty" json:"counted_qty,omitempty"`
+	CountedAt   *time.Time `db:"counted_at" json:"counted_at,omitempty"`
+}
+
+// Variance is the counted quantity minus the snapshot, or nil while uncounted.
+func (l CycleCountLine) Variance() *int {
+	if l.CountedQty == nil {
+		return nil
+	}
+	v := *l.CountedQty - l.SnapshotQty
+	return &v
+}
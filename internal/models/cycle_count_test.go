@@ -0,0 +1,13 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCycleCountLine_Variance(t *testing.T) {
+	counted := 7
+	assert.Nil(t, CycleCountLine{SnapshotQty: 10}.Variance())
+	assert.Equal(t, -3, *CycleCountLine{SnapshotQty: 10, CountedQty: &counted}.Variance())
+}
@@ -1,33 +1,118 @@
 package models
 
-import "time"
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+)
 
 type User struct {
-	ID           string    `db:"id" json:"id"`
-	Email        string    `db:"email" json:"email"`
-	PasswordHash string    `db:"password_hash" json:"-"`
-	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	ID           string   `db:"id" json:"id"`
+	Email        string   `db:"email" json:"email"`
+	PasswordHash string   `db:"password_hash" json:"-"`
+	Role         UserRole `db:"role" json:"role"`
+	// EmailVerifiedAt is nil until the user follows a verification link.
+	EmailVerifiedAt *time.Time `db:"email_verified_at" json:"email_verified_at,omitempty"`
+	CreatedAt       time.Time  `db:"created_at" json:"created_at"`
+}
+
+// RefreshToken is a stored refresh token. The token itself is only known to
+// the client; TokenHash is its SHA-256.
+type RefreshToken struct {
+	ID              string     `db:"id" json:"id"`
+	UserID          string     `db:"user_id" json:"user_id"`
+	FamilyID        string     `db:"family_id" json:"family_id"`
+	TokenHash       string     `db:"token_hash" json:"-"`
+	AccessJTI       string     `db:"access_jti" json:"-"`
+	AccessExpiresAt time.Time  `db:"access_expires_at" json:"-"`
+	ExpiresAt       time.Time  `db:"expires_at" json:"expires_at"`
+	UsedAt          *time.Time `db:"used_at" json:"used_at,omitempty"`
+	RevokedAt       *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+	// AMR is how the session was authenticated, as in the amr claim.
+	AMR       pq.StringArray `db:"amr" json:"amr"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
+
+// Purposes of the single-use tokens handed to users. MFA challenges are
+// returned by login rather than mailed.
+const (
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+	TokenMFAChallenge      = "mfa_challenge"
+)
+
+// UserMFA is a user's TOTP enrolment. It only counts once ConfirmedAt is set.
+type UserMFA struct {
+	UserID       string     `db:"user_id" json:"user_id"`
+	Email        string     `db:"email" json:"email"`
+	Secret       string     `db:"secret" json:"-"`
+	ConfirmedAt  *time.Time `db:"confirmed_at" json:"confirmed_at,omitempty"`
+	LastUsedStep int64      `db:"last_used_step" json:"-"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+}
+
+// UserToken is a stored password reset, email verification or MFA challenge
+// token.
+type UserToken struct {
+	ID        string     `db:"id" json:"id"`
+	UserID    string     `db:"user_id" json:"user_id"`
+	Purpose   string     `db:"purpose" json:"purpose"`
+	TokenHash string     `db:"token_hash" json:"-"`
+	ExpiresAt time.Time  `db:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time `db:"used_at" json:"used_at,omitempty"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
 }
 
 type Shop struct {
-	ID        string    `db:"id" json:"id"`
-	Name      string    `db:"name" json:"name"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	ID                 string     `db:"id" json:"id"`
+	Name               string     `db:"name" json:"name"`
+	AllocationStrategy string     `db:"allocation_strategy" json:"allocation_strategy"`
+	CreatedAt          time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt          time.Time  `db:"updated_at" json:"updated_at"`
+	DeletedAt          *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+}
+
+type Address struct {
+	Line1      string `db:"address_line1" json:"line1"`
+	Line2      string `db:"address_line2" json:"line2"`
+	City       string `db:"city" json:"city"`
+	Region     string `db:"region" json:"region"`
+	PostalCode string `db:"postal_code" json:"postal_code"`
+	Country    string `db:"country" json:"country"`
 }
 
 type Warehouse struct {
-	ID        string    `db:"id" json:"id"`
-	ShopID    string    `db:"shop_id" json:"shop_id"`
-	Name      string    `db:"name" json:"name"`
-	Active    bool      `db:"active" json:"active"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	ID        string   `db:"id" json:"id"`
+	ShopID    string   `db:"shop_id" json:"shop_id"`
+	Name      string   `db:"name" json:"name"`
+	Active    bool     `db:"active" json:"active"`
+	Priority  int      `db:"priority" json:"priority"`
+	Latitude  *float64 `db:"latitude" json:"latitude,omitempty"`
+	Longitude *float64 `db:"longitude" json:"longitude,omitempty"`
+	Address   `json:"address"`
+	Metadata  types.JSONText `db:"metadata" json:"metadata"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `db:"updated_at" json:"updated_at"`
+	DeletedAt *time.Time     `db:"deleted_at" json:"deleted_at,omitempty"`
 }
 
 type Product struct {
-	ID        string    `db:"id" json:"id"`
-	SKU       string    `db:"sku" json:"sku"`
-	Name      string    `db:"name" json:"name"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	ID         string     `db:"id" json:"id"`
+	SKU        string     `db:"sku" json:"sku"`
+	Name       string     `db:"name" json:"name"`
+	PriceCents int64      `db:"price_cents" json:"price_cents"`
+	Currency   string     `db:"currency" json:"currency"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time  `db:"updated_at" json:"updated_at"`
+	DeletedAt  *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+}
+
+type ShopProductPrice struct {
+	ShopID     string `db:"shop_id" json:"shop_id"`
+	ProductID  string `db:"product_id" json:"product_id"`
+	PriceCents int64  `db:"price_cents" json:"price_cents"`
+	Currency   string `db:"currency" json:"currency"`
 }
 
 type Inventory struct {
@@ -36,20 +121,39 @@ type Inventory struct {
 	Quantity    int    `db:"quantity" json:"quantity"`
 }
 
+type StockTransfer struct {
+	ID               string         `db:"id" json:"id"`
+	ShopID           string         `db:"shop_id" json:"shop_id"`
+	FromWarehouseID  string         `db:"from_warehouse_id" json:"from_warehouse_id"`
+	ToWarehouseID    string         `db:"to_warehouse_id" json:"to_warehouse_id"`
+	ProductID        string         `db:"product_id" json:"product_id"`
+	Quantity         int            `db:"quantity" json:"quantity"`
+	ReceivedQuantity int            `db:"received_quantity" json:"received_quantity"`
+	Status           TransferStatus `db:"status" json:"status"`
+	CreatedAt        time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt        time.Time      `db:"updated_at" json:"updated_at"`
+	DispatchedAt     *time.Time     `db:"dispatched_at" json:"dispatched_at,omitempty"`
+	ReceivedAt       *time.Time     `db:"received_at" json:"received_at,omitempty"`
+}
+
 type Order struct {
-	ID         string    `db:"id" json:"id"`
-	UserID     string    `db:"user_id" json:"user_id"`
-	ShopID     string    `db:"shop_id" json:"shop_id"`
-	Status     string    `db:"status" json:"status"`
-	TotalCents int64     `db:"total_cents" json:"total_cents"`
-	CreatedAt  time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
+	ID           string      `db:"id" json:"id"`
+	UserID       string      `db:"user_id" json:"user_id"`
+	ShopID       string      `db:"shop_id" json:"shop_id"`
+	Status       OrderStatus `db:"status" json:"status"`
+	StatusReason *string     `db:"status_reason" json:"status_reason,omitempty"`
+	TotalCents   int64       `db:"total_cents" json:"total_cents"`
+	Currency     string      `db:"currency" json:"currency"`
+	CreatedAt    time.Time   `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time   `db:"updated_at" json:"updated_at"`
 }
 
 type OrderItem struct {
-	OrderID   string `db:"order_id" json:"order_id"`
-	ProductID string `db:"product_id" json:"product_id"`
-	Quantity  int    `db:"quantity" json:"quantity"`
+	OrderID        string `db:"order_id" json:"order_id"`
+	ProductID      string `db:"product_id" json:"product_id"`
+	Quantity       int    `db:"quantity" json:"quantity"`
+	UnitPriceCents int64  `db:"unit_price_cents" json:"unit_price_cents"`
+	Currency       string `db:"currency" json:"currency"`
 }
 
 type Reservation struct {
@@ -61,3 +165,32 @@ type Reservation struct {
 	ExpiresAt   time.Time `db:"expires_at" json:"expires_at"`
 	Released    bool      `db:"released" json:"released"`
 }
+
+// Movement reasons recorded in inventory_movements.reason.
+const (
+	MovementOpening     = "opening"
+	MovementSale        = "sale"
+	MovementTransferOut = "transfer_out"
+	MovementTransferIn  = "transfer_in"
+	MovementReceipt     = "receipt"
+	MovementDamage      = "damage"
+	MovementShrinkage   = "shrinkage"
+	MovementCorrection  = "correction"
+	MovementCycleCount  = "cycle_count"
+)
+
+// InventoryMovement is one ledger entry: a change of Delta units to an
+// inventory row that left it at Balance.
+type InventoryMovement struct {
+	ID          int64     `db:"id" json:"id"`
+	WarehouseID string    `db:"warehouse_id" json:"warehouse_id"`
+	ProductID   string    `db:"product_id" json:"product_id"`
+	Delta       int       `db:"delta" json:"delta"`
+	Balance     int       `db:"balance" json:"balance"`
+	Reason      string    `db:"reason" json:"reason"`
+	OrderID     *string   `db:"order_id" json:"order_id,omitempty"`
+	TransferID  *string   `db:"transfer_id" json:"transfer_id,omitempty"`
+	CountID     *string   `db:"cycle_count_id" json:"cycle_count_id,omitempty"`
+	ActorID     *string   `db:"actor_id" json:"actor_id,omitempty"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+type OrderStatus string
+
+const (
+	OrderReserved  OrderStatus = "reserved"
+	OrderPaid      OrderStatus = "paid"
+	OrderFulfilled OrderStatus = "fulfilled"
+	OrderShipped   OrderStatus = "shipped"
+	OrderDelivered OrderStatus = "delivered"
+	OrderCancelled OrderStatus = "cancelled"
+	OrderExpired   OrderStatus = "expired"
+	OrderRefunded  OrderStatus = "refunded"
+)
+
+// orderTransitions lists, for every status, the statuses an order may move to next.
+// Statuses without an entry are terminal.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderReserved:  {OrderPaid, OrderCancelled, OrderExpired},
+	OrderPaid:      {OrderFulfilled, OrderRefunded},
+	OrderFulfilled: {OrderShipped},
+	OrderShipped:   {OrderDelivered},
+}
+
+var ErrInvalidTransition = errors.New("invalid order status transition")
+
+// TransitionError reports a rejected status change. It matches ErrInvalidTransition with errors.Is.
+type TransitionError struct {
+	From OrderStatus
+	To   OrderStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot move order from %s to %s", e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool { return target == ErrInvalidTransition }
+
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, to := range orderTransitions[s] {
+		if to == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionTo returns a *TransitionError unless next is a legal successor of s.
+func (s OrderStatus) TransitionTo(next OrderStatus) error {
+	if !s.CanTransitionTo(next) {
+		return &TransitionError{From: s, To: next}
+	}
+	return nil
+}
+
+func (s OrderStatus) Terminal() bool { return len(orderTransitions[s]) == 0 }
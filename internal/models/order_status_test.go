@@ -0,0 +1,55 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderStatus_TransitionTo(t *testing.T) {
+	tests := []struct {
+		from    OrderStatus
+		to      OrderStatus
+		wantErr bool
+	}{
+		{OrderReserved, OrderPaid, false},
+		{OrderReserved, OrderCancelled, false},
+		{OrderReserved, OrderExpired, false},
+		{OrderPaid, OrderFulfilled, false},
+		{OrderPaid, OrderRefunded, false},
+		{OrderFulfilled, OrderShipped, false},
+		{OrderShipped, OrderDelivered, false},
+		{OrderReserved, OrderShipped, true},
+		{OrderPaid, OrderPaid, true},
+		{OrderPaid, OrderCancelled, true},
+		{OrderCancelled, OrderPaid, true},
+		{OrderExpired, OrderPaid, true},
+		{OrderDelivered, OrderRefunded, true},
+		{OrderStatus("unknown"), OrderPaid, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			err := tt.from.TransitionTo(tt.to)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidTransition))
+				var te *TransitionError
+				assert.True(t, errors.As(err, &te))
+				assert.Equal(t, tt.from, te.From)
+				assert.Equal(t, tt.to, te.To)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestOrderStatus_Terminal(t *testing.T) {
+	for _, s := range []OrderStatus{OrderDelivered, OrderCancelled, OrderExpired, OrderRefunded} {
+		assert.True(t, s.Terminal(), s)
+	}
+	for _, s := range []OrderStatus{OrderReserved, OrderPaid, OrderFulfilled, OrderShipped} {
+		assert.False(t, s.Terminal(), s)
+	}
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// UserRole is a user's platform-wide role. Shop roles are granted separately
+// through shop memberships.
+type UserRole string
+
+const (
+	RoleCustomer      UserRole = "customer"
+	RolePlatformAdmin UserRole = "platform_admin"
+)
+
+// ShopRole is what a member may do in one shop. Admins can do everything staff
+// can, plus manage the shop, its warehouses and its members.
+type ShopRole string
+
+const (
+	ShopStaff ShopRole = "staff"
+	ShopAdmin ShopRole = "admin"
+)
+
+var shopRoleRank = map[ShopRole]int{ShopStaff: 1, ShopAdmin: 2}
+
+// Satisfies reports whether a member with role r may do what requires required.
+func (r ShopRole) Satisfies(required ShopRole) bool {
+	return shopRoleRank[r] > 0 && shopRoleRank[r] >= shopRoleRank[required]
+}
+
+type ShopMember struct {
+	ShopID    string    `db:"shop_id" json:"shop_id"`
+	UserID    string    `db:"user_id" json:"user_id"`
+	Email     string    `db:"email" json:"email"`
+	Role      ShopRole  `db:"role" json:"role"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShopRole_Satisfies(t *testing.T) {
+	tests := []struct {
+		role     ShopRole
+		required ShopRole
+		want     bool
+	}{
+		{ShopStaff, ShopStaff, true},
+		{ShopAdmin, ShopStaff, true},
+		{ShopAdmin, ShopAdmin, true},
+		{ShopStaff, ShopAdmin, false},
+		{"", ShopStaff, false},
+		{"owner", ShopStaff, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.role)+"/"+string(tt.required), func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.role.Satisfies(tt.required))
+		})
+	}
+}
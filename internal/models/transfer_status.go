@@ -0,0 +1,42 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+type TransferStatus string
+
+const (
+	TransferRequested         TransferStatus = "requested"
+	TransferDispatched        TransferStatus = "dispatched"
+	TransferReceived          TransferStatus = "received"
+	TransferPartiallyReceived TransferStatus = "partially_received"
+	TransferCancelled         TransferStatus = "cancelled"
+)
+
+// transferTransitions lists the statuses a stock transfer may move to next.
+// Once dispatched the goods are on the road, so only receiving remains.
+var transferTransitions = map[TransferStatus][]TransferStatus{
+	TransferRequested:  {TransferDispatched, TransferCancelled},
+	TransferDispatched: {TransferReceived, TransferPartiallyReceived},
+}
+
+var ErrInvalidTransferTransition = errors.New("invalid transfer status transition")
+
+func (s TransferStatus) CanTransitionTo(next TransferStatus) bool {
+	for _, to := range transferTransitions[s] {
+		if to == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionTo wraps ErrInvalidTransferTransition unless next is a legal successor of s.
+func (s TransferStatus) TransitionTo(next TransferStatus) error {
+	if !s.CanTransitionTo(next) {
+		return fmt.Errorf("%w: cannot move transfer from %s to %s", ErrInvalidTransferTransition, s, next)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferStatus_TransitionTo(t *testing.T) {
+	tests := []struct {
+		from    TransferStatus
+		to      TransferStatus
+		wantErr bool
+	}{
+		{TransferRequested, TransferDispatched, false},
+		{TransferRequested, TransferCancelled, false},
+		{TransferDispatched, TransferReceived, false},
+		{TransferDispatched, TransferPartiallyReceived, false},
+		{TransferRequested, TransferReceived, true},
+		{TransferDispatched, TransferCancelled, true},
+		{TransferReceived, TransferDispatched, true},
+		{TransferCancelled, TransferDispatched, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			err := tt.from.TransitionTo(tt.to)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidTransferTransition)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+// Package oidc is a relying party for the OpenID Connect authorization code
+// flow with PKCE, enough to sign users in through a corporate identity
+// provider.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrProviderUnavailable wraps failures to reach the provider or to make
+	// sense of its discovery document and keys.
+	ErrProviderUnavailable = errors.New("identity provider unavailable")
+	// ErrCodeRejected is returned when the token endpoint refuses the code,
+	// e.g. because it expired, was used already or the PKCE verifier is wrong.
+	ErrCodeRejected   = errors.New("identity provider rejected the authorization code")
+	ErrInvalidIDToken = errors.New("id token is invalid")
+)
+
+// idTokenAlgs are the signing algorithms accepted on id tokens. "none" and
+// the HMAC family, which would need the client secret as key, are not.
+var idTokenAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// keysRefreshInterval is how long fetched keys are kept; a token signed with
+// an unknown kid triggers an earlier refetch, at most once per minKeysRefresh.
+const (
+	keysRefreshInterval = time.Hour
+	minKeysRefresh      = time.Minute
+)
+
+// Config describes one identity provider and this service's registration
+// with it.
+type Config struct {
+	// Name identifies the provider in routes and linked identities.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the browser back with the code;
+	// it must be registered with the provider.
+	RedirectURL string
+	// Scopes requested besides "openid". Defaults to email and profile.
+	Scopes []string
+	// GroupsClaim names the id token claim listing the user's groups.
+	// Defaults to "groups".
+	GroupsClaim string
+}
+
+// Identity is what a verified id token says about the user.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+	// AMR lists how the provider authenticated the user, when it says.
+	AMR []string
+}
+
+// Provider talks to one identity provider. Discovery happens on first use,
+// so the service starts even while the provider is unreachable.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+	now    func() time.Time
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider returns a provider for cfg. A nil client uses one with a 10
+// second timeout.
+func NewProvider(cfg Config, client *http.Client) (*Provider, error) {
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc provider %q: name, issuer, client id and redirect url are required", cfg.Name)
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{cfg: cfg, client: client, now: time.Now}, nil
+}
+
+// Name returns the provider's configured name.
+func (p *Provider) Name() string { return p.cfg.Name }
+
+// AuthCodeURL returns the provider URL to send the browser to. state and
+// nonce must be random and remembered for Exchange, as must the verifier
+// challenge was derived from.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: authorization endpoint: %v", ErrProviderUnavailable, err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.cfg.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the identity in the id
+// token, after checking its signature, issuer, audience, expiry and nonce.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (Identity, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, with both parts form encoded as RFC 6749 2.3.1 asks
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	res, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	if res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusUnauthorized {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		_ = json.Unmarshal(body, &e)
+		return Identity{}, fmt.Errorf("%w: %s %s", ErrCodeRejected, e.Error, e.Description)
+	}
+	if res.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("%w: token endpoint answered %d", ErrProviderUnavailable, res.StatusCode)
+	}
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil || tok.IDToken == "" {
+		return Identity{}, fmt.Errorf("%w: no id_token in token response", ErrInvalidIDToken)
+	}
+	return p.verify(ctx, meta, tok.IDToken, nonce)
+}
+
+type idClaims struct {
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified *bool    `json:"email_verified"`
+	AMR           []string `json:"amr"`
+	AZP           string   `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+func (p *Provider) verify(ctx context.Context, meta *metadata, raw, nonce string) (Identity, error) {
+	var c idClaims
+	_, err := jwt.ParseWithClaims(raw, &c, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, meta, kid)
+	},
+		jwt.WithValidMethods(idTokenAlgs),
+		jwt.WithIssuer(meta.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+		jwt.WithTimeFunc(p.now),
+	)
+	if err != nil {
+		if errors.Is(err, ErrProviderUnavailable) {
+			return Identity{}, err
+		}
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if c.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no sub", ErrInvalidIDToken)
+	}
+	if c.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if len(c.Audience) > 1 && c.AZP != p.cfg.ClientID {
+		return Identity{}, fmt.Errorf("%w: azp does not name this client", ErrInvalidIDToken)
+	}
+	id := Identity{
+		Subject: c.Subject,
+		Email:   c.Email,
+		// providers that leave out email_verified vouch for nothing
+		EmailVerified: c.EmailVerified != nil && *c.EmailVerified,
+		AMR:           c.AMR,
+	}
+	id.Groups, err = p.groups(raw)
+	if err != nil {
+		return Identity{}, err
+	}
+	return id, nil
+}
+
+// groups reads the configured groups claim from an id token whose signature
+// has already been checked. A missing claim means no groups.
+func (p *Provider) groups(raw string) ([]string, error) {
+	var m jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	v, ok := m[p.cfg.GroupsClaim]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: %s claim is not a list", ErrInvalidIDToken, p.cfg.GroupsClaim)
+	}
+	out := make([]string, 0, len(list))
+	for _, g := range list {
+		s, ok := g.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s claim holds a non-string", ErrInvalidIDToken, p.cfg.GroupsClaim)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// metadata fetches the discovery document once and keeps it.
+func (p *Provider) metadata(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var m metadata
+	if err := p.getJSON(ctx, strings.TrimRight(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &m); err != nil {
+		return nil, err
+	}
+	if m.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: discovery names issuer %q, configured %q", ErrProviderUnavailable, m.Issuer, p.cfg.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document is incomplete", ErrProviderUnavailable)
+	}
+	p.meta = &m
+	return p.meta, nil
+}
+
+// key returns the provider's verification key with kid, refetching the key
+// set when it is stale or does not have kid, since the provider may have
+// rotated.
+func (p *Provider) key(ctx context.Context, meta *metadata, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	k, ok := p.keys[kid]
+	stale := now.Sub(p.keysFetched) > keysRefreshInterval
+	if ok && !stale {
+		return k, nil
+	}
+	if stale || now.Sub(p.keysFetched) > minKeysRefresh {
+		var set jsonWebKeySet
+		if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+			return nil, err
+		}
+		keys, err := set.parse()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+		}
+		p.keys, p.keysFetched = keys, now
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown kid %q", ErrInvalidIDToken, kid)
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s answered %d", ErrProviderUnavailable, u, res.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProviderUnavailable, u, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package oidc_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ecommerce-shop/internal/oidc"
+	"ecommerce-shop/testutils"
+)
+
+func TestChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", oidc.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+
+	v, err := oidc.NewVerifier()
+	require.NoError(t, err)
+	assert.Len(t, v, 43)
+}
+
+func TestProvider_Exchange(t *testing.T) {
+	user := testutils.FakeOIDCUser{
+		Subject:       "idp-42",
+		Email:         "ops@corp.example",
+		EmailVerified: true,
+		Groups:        []string{"warehouse-ops"},
+		AMR:           []string{"pwd", "mfa"},
+	}
+
+	tests := []struct {
+		name      string
+		overrides map[string]interface{}
+		verifier  func(string) string
+		nonce     string
+		wantErr   error
+	}{
+		{name: "valid"},
+		{
+			name:     "wrong verifier",
+			verifier: func(string) string { return "not-the-verifier-not-the-verifier-not-the-v" },
+			wantErr:  oidc.ErrCodeRejected,
+		},
+		{name: "nonce mismatch", nonce: "other-nonce", wantErr: oidc.ErrInvalidIDToken},
+		{name: "other audience", overrides: map[string]interface{}{"aud": "someone-else"}, wantErr: oidc.ErrInvalidIDToken},
+		{name: "other issuer", overrides: map[string]interface{}{"iss": "https://evil.example"}, wantErr: oidc.ErrInvalidIDToken},
+		{name: "expired", overrides: map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, wantErr: oidc.ErrInvalidIDToken},
+		{
+			name:      "several audiences without azp",
+			overrides: map[string]interface{}{"aud": []string{"shop-client", "someone-else"}},
+			wantErr:   oidc.ErrInvalidIDToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := testutils.NewFakeOIDCProvider(t)
+			fake.Overrides = tt.overrides
+			p, err := oidc.NewProvider(oidc.Config{
+				Name:         "corp",
+				Issuer:       fake.URL,
+				ClientID:     fake.ClientID,
+				ClientSecret: fake.ClientSecret,
+				RedirectURL:  fake.RedirectURL,
+			}, nil)
+			require.NoError(t, err)
+
+			verifier, err := oidc.NewVerifier()
+			require.NoError(t, err)
+			authURL, err := p.AuthCodeURL(context.Background(), "state-1", "nonce-1", oidc.Challenge(verifier))
+			require.NoError(t, err)
+			q := mustQuery(t, authURL)
+			assert.Equal(t, "openid email profile", q.Get("scope"))
+			assert.Equal(t, "S256", q.Get("code_challenge_method"))
+
+			code, state := fake.Authorize(t, authURL, user)
+			assert.Equal(t, "state-1", state)
+
+			if tt.verifier != nil {
+				verifier = tt.verifier(verifier)
+			}
+			nonce := "nonce-1"
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+			id, err := p.Exchange(context.Background(), code, verifier, nonce)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, oidc.Identity{
+				Subject:       "idp-42",
+				Email:         "ops@corp.example",
+				EmailVerified: true,
+				Groups:        []string{"warehouse-ops"},
+				AMR:           []string{"pwd", "mfa"},
+			}, id)
+
+			// codes work once
+			_, err = p.Exchange(context.Background(), code, verifier, nonce)
+			assert.ErrorIs(t, err, oidc.ErrCodeRejected)
+		})
+	}
+}
+
+func TestProvider_Unreachable(t *testing.T) {
+	fake := testutils.NewFakeOIDCProvider(t)
+	fake.Close()
+	p, err := oidc.NewProvider(oidc.Config{Name: "corp", Issuer: fake.URL, ClientID: "c", RedirectURL: "http://localhost/cb"}, nil)
+	require.NoError(t, err)
+
+	_, err = p.AuthCodeURL(context.Background(), "s", "n", "c")
+	assert.ErrorIs(t, err, oidc.ErrProviderUnavailable)
+}
+
+func mustQuery(t *testing.T, raw string) url.Values {
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u.Query()
+}
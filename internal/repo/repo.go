@@ -3,11 +3,20 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/models"
 )
 
+// ReasonReservationExpired is recorded on orders whose stock hold lapsed before payment.
+const ReasonReservationExpired = "reservation_expired"
+
 type Repositories struct {
 	DB *sqlx.DB
 }
@@ -33,38 +42,224 @@ func (r *Repositories) WithTx(ctx context.Context, fn func(*sqlx.Tx) error) erro
 	return tx.Commit()
 }
 
-func LockInventoryRow(ctx context.Context, tx *sqlx.Tx, warehouseID, productID string) (int, error) {
-	var qty int
+const (
+	maxTxAttempts = 4
+	retryBaseWait = 20 * time.Millisecond
+)
 
-	if err := tx.GetContext(ctx, &qty, `
-		WITH up AS (
-			INSERT INTO inventory(warehouse_id, product_id, quantity)
-			VALUES ($1, $2, 0)
-			ON CONFLICT (warehouse_id, product_id) DO NOTHING
-			RETURNING quantity
-		)
-		SELECT quantity FROM inventory WHERE warehouse_id = $1 AND product_id = $2 FOR UPDATE
-	`, warehouseID, productID); err != nil {
-		return 0, err
+// WithTxRetry runs fn in a transaction like WithTx and reruns it from scratch
+// when Postgres aborts it with a deadlock or serialization failure. fn must
+// not carry state over from a failed attempt.
+func (r *Repositories) WithTxRetry(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := r.WithTx(ctx, fn)
+		if err == nil || !IsRetryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+		// exponential backoff with jitter so the losers don't collide again
+		wait := retryBaseWait << (attempt - 1)
+		wait += rand.N(wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// IsRetryable reports whether err is a deadlock (40P01) or serialization
+// failure (40001) that a fresh attempt of the transaction may not hit.
+func IsRetryable(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == "40P01" || pqErr.Code == "40001"
+}
+
+// InventoryKey identifies one inventory row.
+type InventoryKey struct {
+	WarehouseID string
+	ProductID   string
+}
+
+// LockInventory locks every existing inventory row for the given warehouses
+// and products in one statement. Rows are locked in (warehouse_id, product_id)
+// order, so concurrent checkouts always acquire them in the same order and
+// cannot deadlock on each other. Missing rows hold no stock and are absent
+// from the result.
+func LockInventory(ctx context.Context, tx *sqlx.Tx, warehouseIDs, productIDs []string) (map[InventoryKey]int, error) {
+	rows, err := tx.QueryxContext(ctx, `
+		SELECT warehouse_id, product_id, quantity FROM inventory
+		WHERE warehouse_id = ANY($1) AND product_id = ANY($2)
+		ORDER BY warehouse_id, product_id
+		FOR UPDATE
+	`, pq.Array(warehouseIDs), pq.Array(productIDs))
+	if err != nil {
+		return nil, err
 	}
-	return qty, nil
+	return scanInventoryQuantities(rows)
 }
 
-func ActiveWarehousesForShop(ctx context.Context, q sqlx.ExtContext, shopID string) ([]string, error) {
-	rows, err := q.QueryxContext(ctx, `SELECT id FROM warehouses WHERE shop_id=$1 AND active=TRUE`, shopID)
+// SumReserved returns the live (unreleased, unexpired) reserved quantity per
+// inventory row for the given warehouses and products.
+func SumReserved(ctx context.Context, q sqlx.ExtContext, warehouseIDs, productIDs []string) (map[InventoryKey]int, error) {
+	rows, err := q.QueryxContext(ctx, `
+		SELECT warehouse_id, product_id, SUM(quantity) FROM reservations
+		WHERE warehouse_id = ANY($1) AND product_id = ANY($2) AND released=FALSE AND expires_at>now()
+		GROUP BY warehouse_id, product_id
+	`, pq.Array(warehouseIDs), pq.Array(productIDs))
 	if err != nil {
 		return nil, err
 	}
+	return scanInventoryQuantities(rows)
+}
+
+func scanInventoryQuantities(rows *sqlx.Rows) (map[InventoryKey]int, error) {
 	defer rows.Close()
-	var ids []string
+	out := map[InventoryKey]int{}
 	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
+		var k InventoryKey
+		var qty int
+		if err := rows.Scan(&k.WarehouseID, &k.ProductID, &qty); err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
+		out[k] = qty
+	}
+	return out, rows.Err()
+}
+
+// Movement describes a change to one inventory row for the ledger. The
+// references are optional; empty strings are stored as NULL.
+type Movement struct {
+	WarehouseID string
+	ProductID   string
+	Delta       int
+	Reason      string
+	OrderID     string
+	TransferID  string
+	CountID     string
+	ActorID     string
+}
+
+// MoveStock applies m.Delta to the inventory row and appends the movement,
+// with the resulting balance, to inventory_movements in the same transaction.
+// Every write to inventory.quantity must go through here so the ledger can
+// explain the current stock. Removing stock requires the row to exist.
+func MoveStock(ctx context.Context, tx *sqlx.Tx, m Movement) (int, error) {
+	var balance int
+	var err error
+	if m.Delta < 0 {
+		err = tx.GetContext(ctx, &balance, `UPDATE inventory SET quantity = quantity + $3 WHERE warehouse_id=$1 AND product_id=$2 RETURNING quantity`,
+			m.WarehouseID, m.ProductID, m.Delta)
+	} else {
+		err = tx.GetContext(ctx, &balance, `INSERT INTO inventory(warehouse_id, product_id, quantity) VALUES ($1,$2,$3)
+		ON CONFLICT (warehouse_id, product_id) DO UPDATE SET quantity = inventory.quantity + EXCLUDED.quantity RETURNING quantity`,
+			m.WarehouseID, m.ProductID, m.Delta)
 	}
-	return ids, rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO inventory_movements(warehouse_id, product_id, delta, balance, reason, order_id, transfer_id, cycle_count_id, actor_id)
+		VALUES ($1,$2,$3,$4,$5,NULLIF($6,'')::uuid,NULLIF($7,'')::uuid,NULLIF($8,'')::uuid,NULLIF($9,'')::uuid)
+	`, m.WarehouseID, m.ProductID, m.Delta, balance, m.Reason, m.OrderID, m.TransferID, m.CountID, m.ActorID)
+	return balance, err
+}
+
+// Audit actions.
+const (
+	AuditLoginLocked   = "login.locked"
+	AuditLoginUnlocked = "login.unlocked"
+	AuditAPIKeyCreated = "api_key.created"
+	AuditAPIKeyRevoked = "api_key.revoked"
+	// identity provider logins
+	AuditIdentityLinked = "identity.linked"
+	AuditRolesSynced    = "identity.roles_synced"
+)
+
+// AuditEvent is one audit_log entry. ActorID is empty for events the system
+// raised on its own.
+type AuditEvent struct {
+	ActorID string
+	Action  string
+	Target  string
+	IP      string
+	Details map[string]interface{}
+}
+
+// Audit appends e to audit_log.
+func Audit(ctx context.Context, q sqlx.ExtContext, e AuditEvent) error {
+	details := []byte("{}")
+	if len(e.Details) > 0 {
+		var err error
+		if details, err = json.Marshal(e.Details); err != nil {
+			return err
+		}
+	}
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO audit_log(actor_id, action, target, ip, details) VALUES (NULLIF($1,'')::uuid, $2, $3, NULLIF($4,''), $5)
+	`, e.ActorID, e.Action, e.Target, e.IP, string(details))
+	return err
+}
+
+// LedgerMismatch is an inventory row whose quantity differs from the sum of
+// its ledger movements.
+type LedgerMismatch struct {
+	WarehouseID string `db:"warehouse_id"`
+	ProductID   string `db:"product_id"`
+	OnHand      int    `db:"on_hand"`
+	Ledger      int    `db:"ledger"`
+}
+
+// ReconcileInventory recomputes every row's balance from inventory_movements
+// and returns the rows where it disagrees with inventory.quantity, including
+// rows present on only one side.
+func ReconcileInventory(ctx context.Context, q sqlx.ExtContext) ([]LedgerMismatch, error) {
+	var out []LedgerMismatch
+	if err := sqlx.SelectContext(ctx, q, &out, `
+		SELECT warehouse_id, product_id, COALESCE(i.quantity, 0) AS on_hand, COALESCE(m.ledger, 0) AS ledger
+		FROM inventory i
+		FULL JOIN (
+			SELECT warehouse_id, product_id, SUM(delta) AS ledger FROM inventory_movements
+			GROUP BY warehouse_id, product_id
+		) m USING (warehouse_id, product_id)
+		WHERE COALESCE(i.quantity, 0) <> COALESCE(m.ledger, 0)
+		ORDER BY warehouse_id, product_id
+	`); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ActiveWarehousesForShop returns the shop's active warehouses ordered by id,
+// which is also the order their inventory rows are locked in. Inside a
+// transaction the rows stay share-locked, so a concurrent deactivation waits
+// for the checkout to finish instead of having reservations land behind it.
+func ActiveWarehousesForShop(ctx context.Context, q sqlx.ExtContext, shopID string) ([]models.Warehouse, error) {
+	var whs []models.Warehouse
+	if err := sqlx.SelectContext(ctx, q, &whs, `
+		SELECT id, priority, latitude, longitude FROM warehouses
+		WHERE shop_id=$1 AND active=TRUE ORDER BY id
+		FOR SHARE
+	`, shopID); err != nil {
+		return nil, err
+	}
+	return whs, nil
+}
+
+func ShopAllocationStrategy(ctx context.Context, q sqlx.ExtContext, shopID string) (string, error) {
+	var strategy string
+	err := sqlx.GetContext(ctx, q, &strategy, `SELECT allocation_strategy FROM shops WHERE id=$1 AND deleted_at IS NULL`, shopID)
+	return strategy, err
+}
+
+// NextAllocationSeq hands out the shop's next round-robin turn. The row lock
+// serialises checkouts of round-robin shops, so only call it for those.
+func NextAllocationSeq(ctx context.Context, tx *sqlx.Tx, shopID string) (int64, error) {
+	var seq int64
+	err := tx.GetContext(ctx, &seq, `UPDATE shops SET allocation_seq = allocation_seq + 1 WHERE id=$1 RETURNING allocation_seq`, shopID)
+	return seq, err
 }
 
 func ReserveStock(ctx context.Context, tx *sqlx.Tx, orderID, warehouseID, productID string, qty int, ttlMinutes int) error {
@@ -78,18 +273,17 @@ func ReserveStock(ctx context.Context, tx *sqlx.Tx, orderID, warehouseID, produc
 	return err
 }
 
-func SumReservedNotExpired(ctx context.Context, q sqlx.ExtContext, warehouseID, productID string) (int, error) {
-	var sum sql.NullInt64
-	if err := sqlx.GetContext(ctx, q, &sum, `
-		SELECT COALESCE(SUM(quantity),0) FROM reservations
-		WHERE warehouse_id=$1 AND product_id=$2 AND released=FALSE AND expires_at>now()
-	`, warehouseID, productID); err != nil {
-		return 0, err
-	}
-	if !sum.Valid {
-		return 0, nil
-	}
-	return int(sum.Int64), nil
+// AddReservation adds qty to the order's hold on a warehouse's stock, reviving
+// a released row for the same warehouse and product if there is one.
+func AddReservation(ctx context.Context, tx *sqlx.Tx, orderID, warehouseID, productID string, qty int, expires time.Time) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO reservations(order_id, warehouse_id, product_id, quantity, expires_at)
+		VALUES ($1,$2,$3,$4,$5)
+		ON CONFLICT (order_id, warehouse_id, product_id) DO UPDATE SET
+			quantity = CASE WHEN reservations.released THEN EXCLUDED.quantity ELSE reservations.quantity + EXCLUDED.quantity END,
+			expires_at = EXCLUDED.expires_at, released = FALSE
+	`, orderID, warehouseID, productID, qty, expires)
+	return err
 }
 
 func ReleaseExpiredReservations(ctx context.Context, db *sqlx.DB, limit int) (int, error) {
@@ -102,3 +296,139 @@ func ReleaseExpiredReservations(ctx context.Context, db *sqlx.DB, limit int) (in
 	affected, _ := res.RowsAffected()
 	return int(affected), nil
 }
+
+// PruneTokens deletes up to limit each of expired refresh tokens, expired
+// email link tokens, revocation entries for access tokens that have expired
+// anyway, failed login counters that have been idle for a day, identity
+// provider logins that were never finished and idempotency keys past their
+// retention.
+func PruneTokens(ctx context.Context, db *sqlx.DB, limit int) (int, error) {
+	var total int64
+	for _, q := range []string{
+		`DELETE FROM refresh_tokens WHERE id IN (SELECT id FROM refresh_tokens WHERE expires_at<=now() LIMIT $1)`,
+		`DELETE FROM revoked_tokens WHERE jti IN (SELECT jti FROM revoked_tokens WHERE expires_at<=now() LIMIT $1)`,
+		`DELETE FROM user_tokens WHERE id IN (SELECT id FROM user_tokens WHERE expires_at<=now() LIMIT $1)`,
+		`DELETE FROM login_attempts WHERE (scope, key) IN (
+			SELECT scope, key FROM login_attempts
+			WHERE last_failed_at < now() - interval '1 day' AND (locked_until IS NULL OR locked_until<=now()) LIMIT $1
+		)`,
+		`DELETE FROM oidc_logins WHERE state_hash IN (SELECT state_hash FROM oidc_logins WHERE expires_at<=now() LIMIT $1)`,
+		`DELETE FROM idempotency_requests WHERE (owner, key) IN (
+			SELECT owner, key FROM idempotency_requests WHERE expires_at<=now() LIMIT $1
+		)`,
+	} {
+		res, err := db.ExecContext(ctx, q, limit)
+		if err != nil {
+			return int(total), err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return int(total), nil
+}
+
+// ExpireOrders moves up to limit reserved orders that no longer hold a live
+// reservation to expired, releasing their reservation rows in the same transaction.
+func ExpireOrders(ctx context.Context, db *sqlx.DB, limit int) (int, error) {
+	var ids []string
+	err := New(db).WithTx(ctx, func(tx *sqlx.Tx) error {
+		if err := tx.SelectContext(ctx, &ids, `
+			SELECT o.id FROM orders o
+			WHERE o.status=$1 AND NOT EXISTS (
+				SELECT 1 FROM reservations r WHERE r.order_id=o.id AND r.released=FALSE AND r.expires_at>now()
+			)
+			ORDER BY o.created_at LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		`, models.OrderReserved, limit); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+		return MarkOrdersExpired(ctx, tx, ids, ReasonReservationExpired)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// MarkOrdersExpired releases every reservation of the given (already locked) orders and marks them expired.
+func MarkOrdersExpired(ctx context.Context, tx *sqlx.Tx, orderIDs []string, reason string) error {
+	if _, err := tx.ExecContext(ctx, `UPDATE reservations SET released=TRUE WHERE order_id = ANY($1) AND released=FALSE`, pq.Array(orderIDs)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE orders SET status=$2, status_reason=$3, updated_at=now() WHERE id = ANY($1)`, pq.Array(orderIDs), models.OrderExpired, reason)
+	return err
+}
+
+// ProductPrices returns the effective price of each product for shopID, keyed by
+// product ID: the shop override when one exists, else the product list price.
+// Products that do not exist or were deleted are absent from the map.
+func ProductPrices(ctx context.Context, q sqlx.ExtContext, shopID string, productIDs []string) (map[string]models.ShopProductPrice, error) {
+	var rows []models.ShopProductPrice
+	if err := sqlx.SelectContext(ctx, q, &rows, `
+		SELECT p.id AS product_id, COALESCE(sp.price_cents, p.price_cents) AS price_cents, COALESCE(sp.currency, p.currency) AS currency
+		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp.product_id = p.id AND sp.shop_id = $1
+		WHERE p.id = ANY($2) AND p.deleted_at IS NULL
+	`, shopID, pq.Array(productIDs)); err != nil {
+		return nil, err
+	}
+	out := make(map[string]models.ShopProductPrice, len(rows))
+	for _, r := range rows {
+		r.ShopID = shopID
+		out[r.ProductID] = r
+	}
+	return out, nil
+}
+
+// ShopMemberships returns the user's role in each shop they are a member of,
+// leaving out deleted shops.
+func ShopMemberships(ctx context.Context, q sqlx.ExtContext, userID string) (map[string]models.ShopRole, error) {
+	var rows []models.ShopMember
+	if err := sqlx.SelectContext(ctx, q, &rows, `
+		SELECT m.shop_id, m.role FROM shop_members m
+		JOIN shops s ON s.id = m.shop_id AND s.deleted_at IS NULL
+		WHERE m.user_id=$1
+	`, userID); err != nil {
+		return nil, err
+	}
+	out := make(map[string]models.ShopRole, len(rows))
+	for _, r := range rows {
+		out[r.ShopID] = r.Role
+	}
+	return out, nil
+}
+
+// WarehouseShop returns the id of the shop owning the warehouse, or
+// sql.ErrNoRows.
+func WarehouseShop(ctx context.Context, q sqlx.ExtContext, warehouseID string) (string, error) {
+	var shopID string
+	err := sqlx.GetContext(ctx, q, &shopID, `SELECT shop_id FROM warehouses WHERE id=$1`, warehouseID)
+	return shopID, err
+}
+
+// TransferShop returns the id of the shop a stock transfer belongs to, or
+// sql.ErrNoRows.
+func TransferShop(ctx context.Context, q sqlx.ExtContext, transferID string) (string, error) {
+	var shopID string
+	err := sqlx.GetContext(ctx, q, &shopID, `SELECT shop_id FROM stock_transfers WHERE id=$1`, transferID)
+	return shopID, err
+}
+
+// OrderShop returns the id of the shop the order was placed in, or
+// sql.ErrNoRows.
+func OrderShop(ctx context.Context, q sqlx.ExtContext, orderID string) (string, error) {
+	var shopID string
+	err := sqlx.GetContext(ctx, q, &shopID, `SELECT shop_id FROM orders WHERE id=$1`, orderID)
+	return shopID, err
+}
+
+// CycleCountShop returns the id of the shop owning the counted warehouse, or
+// sql.ErrNoRows.
+func CycleCountShop(ctx context.Context, q sqlx.ExtContext, countID string) (string, error) {
+	var shopID string
+	err := sqlx.GetContext(ctx, q, &shopID, `SELECT w.shop_id FROM cycle_counts cc JOIN warehouses w ON w.id = cc.warehouse_id WHERE cc.id=$1`, countID)
+	return shopID, err
+}
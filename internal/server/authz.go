@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/repo"
+	"ecommerce-shop/internal/server/web"
+)
+
+// Shop resolvers for web.RequireShopRole. A resource that does not exist
+// resolves to no shop, so only platform admins reach the handler and see its
+// 404; everyone else gets 403 without learning whether the id exists.
+
+func shopParam(name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return c.Param(name), nil
+	}
+}
+
+func shopQuery(name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return c.Query(name), nil
+	}
+}
+
+func warehouseParam(db *sqlx.DB, name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return ownerOf(repo.WarehouseShop(c, db, c.Param(name)))
+	}
+}
+
+func warehouseQuery(db *sqlx.DB, name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		id := c.Query(name)
+		if id == "" {
+			return "", nil
+		}
+		return ownerOf(repo.WarehouseShop(c, db, id))
+	}
+}
+
+// warehouseBody resolves the warehouse named by a field of the JSON body. The
+// body is put back for the handler to bind.
+func warehouseBody(db *sqlx.DB, field string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		id, err := bodyField(c, field)
+		if err != nil || id == "" {
+			return "", err
+		}
+		return ownerOf(repo.WarehouseShop(c, db, id))
+	}
+}
+
+func shopBody(field string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return bodyField(c, field)
+	}
+}
+
+func transferParam(db *sqlx.DB, name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return ownerOf(repo.TransferShop(c, db, c.Param(name)))
+	}
+}
+
+func countParam(db *sqlx.DB, name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return ownerOf(repo.CycleCountShop(c, db, c.Param(name)))
+	}
+}
+
+func orderParam(db *sqlx.DB, name string) web.ShopResolver {
+	return func(c *gin.Context) (string, error) {
+		return ownerOf(repo.OrderShop(c, db, c.Param(name)))
+	}
+}
+
+func ownerOf(shopID string, err error) (string, error) {
+	var pqErr *pq.Error
+	// 22P02: the id is not a valid uuid, so it names nothing
+	if errors.Is(err, sql.ErrNoRows) || errors.As(err, &pqErr) && pqErr.Code == "22P02" {
+		return "", nil
+	}
+	return shopID, err
+}
+
+// bodyField reads a string field from the JSON body without consuming it. A
+// body that is not a JSON object resolves to "" and is left for the handler
+// to reject.
+func bodyField(c *gin.Context, field string) (string, error) {
+	if c.Request.Body == nil {
+		return "", nil
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) != nil {
+		return "", nil
+	}
+	s, _ := fields[field].(string)
+	return s, nil
+}
@@ -1,46 +1,194 @@
 package server
 
 import (
+	"time"
+
 	"github.com/gin-gonic/gin"
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 
 	"github.com/go-playground/validator/v10"
 
+	"ecommerce-shop/internal/auth"
 	"ecommerce-shop/internal/config"
 	"ecommerce-shop/internal/handlers"
+	"ecommerce-shop/internal/idempotency"
+	"ecommerce-shop/internal/mailer"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/oidc"
 	"ecommerce-shop/internal/server/web"
 	"ecommerce-shop/internal/service"
 )
 
-func RegisterRoutes(r *gin.Engine, cfg config.Config, log *zap.Logger, db *sqlx.DB) {
+func RegisterRoutes(r *gin.Engine, cfg config.Config, log *zap.Logger, db *sqlx.DB, keys *auth.KeySet, mail mailer.Mailer) {
 	api := r.Group("/api")
 	{
 		v := validator.New()
-		authSvc := &service.AuthService{DB: db, Log: log, JWTSecret: cfg.JWTSecret}
+		authSvc := &service.AuthService{
+			DB:         db,
+			Log:        log,
+			Keys:       keys,
+			AccessTTL:  time.Duration(cfg.AccessTokenTTLMinutes) * time.Minute,
+			RefreshTTL: time.Duration(cfg.RefreshTokenTTLHours) * time.Hour,
+
+			Mailer:               mail,
+			BaseURL:              cfg.AppBaseURL,
+			RequireVerifiedEmail: cfg.RequireVerifiedEmail,
+			ResetTTL:             time.Duration(cfg.PasswordResetTTLMinutes) * time.Minute,
+			VerifyTTL:            time.Duration(cfg.EmailVerificationTTLHours) * time.Hour,
+
+			MFARequiredRoles: cfg.MFARequiredRoles,
+			MFAIssuer:        cfg.MFAIssuer,
+
+			IdentityProviders: identityProviders(cfg, log),
+		}
 		prodSvc := &service.ProductsService{DB: db}
+		shopSvc := &service.ShopsService{DB: db}
+		catalogSvc := &service.CatalogService{DB: db}
 		ordSvc := &service.OrdersService{DB: db, Log: log, TTLMin: cfg.ReservationTTLMinutes}
 		whSvc := &service.WarehousesService{DB: db}
+		countSvc := &service.CycleCountsService{DB: db}
+		apiKeySvc := &service.APIKeysService{DB: db}
 
 		authH := &handlers.AuthHandler{DB: db, Log: log, Validate: v, Cfg: cfg, Svc: authSvc}
+		keysH := &handlers.KeysHandler{Keys: keys}
 		prodH := &handlers.ProductsHandler{DB: db, Svc: prodSvc}
+		shopH := &handlers.ShopsHandler{DB: db, Svc: shopSvc}
+		catalogH := &handlers.CatalogHandler{DB: db, Svc: catalogSvc}
 		ordH := &handlers.OrdersHandler{DB: db, Log: log, Validate: v, TTLMin: cfg.ReservationTTLMinutes, Svc: ordSvc}
 		whH := &handlers.WarehousesHandler{DB: db, Svc: whSvc}
+		countH := &handlers.CycleCountsHandler{DB: db, Svc: countSvc}
+		apiKeyH := &handlers.APIKeysHandler{DB: db, Svc: apiKeySvc}
+
+		authn := web.JWTAuth(keys, authSvc.IsRevoked)
+		// routes integrations may call with an API key holding perm
+		authnOrKey := func(perm models.APIPermission) gin.HandlerFunc {
+			return web.APIKeyAuth(apiKeySvc.Authenticate, perm, authn)
+		}
+
+		// authorization, checked after JWTAuth against the shop owning the resource
+		platformAdmin := web.RequirePlatformAdmin()
+		shopAdmin := web.RequireShopRole(models.ShopAdmin, shopParam("shop_id"))
+		warehouseStaff := web.RequireShopRole(models.ShopStaff, warehouseParam(db, "id"))
+		warehouseAdmin := web.RequireShopRole(models.ShopAdmin, warehouseParam(db, "id"))
+		transferStaff := web.RequireShopRole(models.ShopStaff, transferParam(db, "id"))
+		countStaff := web.RequireShopRole(models.ShopStaff, countParam(db, "id"))
+		orderStaff := web.RequireShopRole(models.ShopStaff, orderParam(db, "id"))
+
+		// retries with the same Idempotency-Key get the first response back;
+		// checked after authorization so refusals are not recorded. Routes
+		// answering with tokens or API keys go without: responses are stored
+		// as sent.
+		idemStore := &idempotency.PGStore{
+			DB:          db,
+			Retention:   time.Duration(cfg.IdempotencyRetentionHours) * time.Hour,
+			LockTimeout: time.Minute,
+		}
+		idem := idempotency.Middleware(idemStore, false, log)
+		idemRequired := idempotency.Middleware(idemStore, true, log)
 
 		// auth
+		r.GET("/.well-known/jwks.json", keysH.JWKS)
 		api.POST("/register", authH.Register)
 		api.POST("/login", authH.Login)
+		api.POST("/token/refresh", authH.Refresh)
+		api.POST("/logout", authn, authH.Logout)
+		api.POST("/password-reset/request", authH.RequestPasswordReset)
+		api.POST("/password-reset/confirm", authH.ResetPassword)
+		api.POST("/email-verification/request", authH.RequestEmailVerification)
+		api.POST("/email-verification/confirm", authH.VerifyEmail)
+		api.POST("/users/:id/unlock", authn, platformAdmin, authH.Unlock)
+		api.POST("/login/mfa", authH.LoginMFA)
+		api.POST("/mfa/enroll", authn, authH.EnrollMFA)
+		api.POST("/mfa/confirm", authn, authH.ConfirmMFA)
+		api.POST("/mfa/recovery-codes", authn, authH.RegenerateRecoveryCodes)
+		api.POST("/mfa/disable", authn, authH.DisableMFA)
+		api.GET("/oidc/:provider/login", authH.OIDCLogin)
+		api.GET("/oidc/:provider/callback", authH.OIDCCallback)
 
 		// products
 		api.GET("/shops/:shop_id/products", prodH.ListByShop)
 
+		// catalogue management
+		api.POST("/shops", authn, platformAdmin, idem, shopH.Create)
+		api.GET("/shops", authn, shopH.List)
+		api.GET("/shops/:shop_id", authn, shopH.Get)
+		api.PATCH("/shops/:shop_id", authn, shopAdmin, idem, shopH.Update)
+		api.DELETE("/shops/:shop_id", authn, shopAdmin, idem, shopH.Delete)
+		api.GET("/shops/:shop_id/members", authn, shopAdmin, shopH.Members)
+		api.PUT("/shops/:shop_id/members/:user_id", authn, shopAdmin, idem, shopH.SetMember)
+		api.DELETE("/shops/:shop_id/members/:user_id", authn, shopAdmin, idem, shopH.RemoveMember)
+		api.POST("/shops/:shop_id/api-keys", authn, shopAdmin, apiKeyH.Create)
+		api.GET("/shops/:shop_id/api-keys", authn, shopAdmin, apiKeyH.List)
+		api.DELETE("/shops/:shop_id/api-keys/:key_id", authn, shopAdmin, idem, apiKeyH.Revoke)
+		api.PUT("/shops/:shop_id/prices/:product_id", authn, shopAdmin, idem, prodH.SetPrice)
+		api.DELETE("/shops/:shop_id/prices/:product_id", authn, shopAdmin, idem, prodH.ClearPrice)
+		api.POST("/products", authn, platformAdmin, idem, catalogH.Create)
+		api.GET("/products", authn, catalogH.List)
+		api.GET("/products/:id", authn, catalogH.Get)
+		api.PATCH("/products/:id", authn, platformAdmin, idem, catalogH.Update)
+		api.DELETE("/products/:id", authn, platformAdmin, idem, catalogH.Delete)
+
 		// orders
-		api.POST("/orders", ordH.Create)
-		api.POST("/orders/:id/pay", ordH.Pay)
+		api.GET("/orders", authn, ordH.List)
+		api.GET("/orders/:id", authn, ordH.Get)
+		api.POST("/orders", authn, idemRequired, ordH.Create)
+		api.POST("/orders/:id/pay", authn, idem, ordH.Pay)
+		api.POST("/orders/:id/cancel", authn, idem, ordH.Cancel)
+		api.POST("/orders/:id/fulfil", authn, orderStaff, idem, ordH.Fulfil)
+		api.POST("/orders/:id/ship", authn, orderStaff, idem, ordH.Ship)
+		api.POST("/orders/:id/deliver", authn, orderStaff, idem, ordH.Deliver)
+		api.POST("/orders/:id/refund", authn, orderStaff, idem, ordH.Refund)
 
 		// warehouses
-		api.POST("/warehouses/:id/activate", web.JWTAuth(cfg.JWTSecret), whH.Activate)
-		api.POST("/warehouses/:id/deactivate", web.JWTAuth(cfg.JWTSecret), whH.Deactivate)
-		api.POST("/warehouses/transfer", web.JWTAuth(cfg.JWTSecret), whH.Transfer)
+		api.POST("/warehouses", authn, web.RequireShopRole(models.ShopAdmin, shopBody("shop_id")), idem, whH.Create)
+		api.GET("/warehouses", authnOrKey(models.PermInventoryRead), web.RequireShopRole(models.ShopStaff, shopQuery("shop_id")), whH.List)
+		api.GET("/warehouses/:id", authnOrKey(models.PermInventoryRead), warehouseStaff, whH.Get)
+		api.PATCH("/warehouses/:id", authn, warehouseAdmin, idem, whH.Update)
+		api.DELETE("/warehouses/:id", authn, warehouseAdmin, idem, whH.Delete)
+		api.POST("/warehouses/:id/activate", authn, warehouseStaff, idem, whH.Activate)
+		api.POST("/warehouses/:id/deactivate", authn, warehouseStaff, idem, whH.Deactivate)
+		api.GET("/warehouses/:id/movements", authnOrKey(models.PermInventoryRead), warehouseStaff, whH.Movements)
+		api.POST("/warehouses/:id/adjustments", authnOrKey(models.PermInventoryWrite), warehouseStaff, idem, whH.Adjust)
+		api.PUT("/warehouses/:id/stock", authnOrKey(models.PermInventoryWrite), warehouseStaff, idem, whH.SetStock)
+		api.POST("/warehouses/transfer", authnOrKey(models.PermTransfersWrite), web.RequireShopRole(models.ShopStaff, warehouseBody(db, "from")), idem, whH.Transfer)
+		api.GET("/warehouses/transfers", authnOrKey(models.PermTransfersRead), web.RequireShopRole(models.ShopStaff, warehouseQuery(db, "warehouse_id")), whH.ListTransfers)
+		api.GET("/warehouses/transfers/:id", authnOrKey(models.PermTransfersRead), transferStaff, whH.GetTransfer)
+		api.POST("/warehouses/transfers/:id/dispatch", authnOrKey(models.PermTransfersWrite), transferStaff, idem, whH.Dispatch)
+		api.POST("/warehouses/transfers/:id/receive", authnOrKey(models.PermTransfersWrite), transferStaff, idem, whH.Receive)
+		api.POST("/warehouses/transfers/:id/cancel", authnOrKey(models.PermTransfersWrite), transferStaff, idem, whH.CancelTransfer)
+
+		// cycle counts
+		api.POST("/warehouses/:id/counts", authn, warehouseStaff, idem, countH.Open)
+		api.GET("/warehouses/counts/:id", authn, countStaff, countH.Review)
+		api.PUT("/warehouses/counts/:id/lines", authn, countStaff, idem, countH.Submit)
+		api.POST("/warehouses/counts/:id/approve", authn, countStaff, idem, countH.Approve)
+		api.POST("/warehouses/counts/:id/cancel", authn, countStaff, idem, countH.Cancel)
+	}
+}
+
+// identityProviders sets up the providers named in OIDC_PROVIDERS, refusing
+// to start with a broken one.
+func identityProviders(cfg config.Config, log *zap.Logger) map[string]*service.IdentityProvider {
+	out := make(map[string]*service.IdentityProvider, len(cfg.OIDCProviders))
+	for _, pc := range cfg.OIDCProviders {
+		p, err := oidc.NewProvider(oidc.Config{
+			Name:         pc.Name,
+			Issuer:       pc.Issuer,
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			RedirectURL:  pc.RedirectURL,
+			Scopes:       pc.Scopes,
+			GroupsClaim:  pc.GroupsClaim,
+		}, nil)
+		if err != nil {
+			log.Fatal("invalid OIDC provider", zap.Error(err))
+		}
+		roles, err := service.ParseGroupRoles(pc.GroupRoles)
+		if err != nil {
+			log.Fatal("invalid OIDC group roles", zap.String("provider", pc.Name), zap.Error(err))
+		}
+		out[pc.Name] = &service.IdentityProvider{Provider: p, GroupRoles: roles, AllowSignup: pc.AllowSignup, TrustMFA: pc.TrustMFA}
 	}
+	return out
 }
@@ -9,7 +9,9 @@ import (
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 
+	"ecommerce-shop/internal/auth"
 	"ecommerce-shop/internal/config"
+	"ecommerce-shop/internal/mailer"
 	"ecommerce-shop/internal/server/web"
 )
 
@@ -32,8 +34,13 @@ func (s *HTTPServer) Shutdown(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
-func BuildRouter(cfg config.Config, log *zap.Logger, db *sqlx.DB) *gin.Engine {
+func BuildRouter(cfg config.Config, log *zap.Logger, db *sqlx.DB, keys *auth.KeySet, mail mailer.Mailer) *gin.Engine {
 	r := gin.New()
+	// ClientIP, which login throttling counts failures by, only believes
+	// X-Forwarded-For from these
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal("invalid TRUSTED_PROXIES", zap.Error(err))
+	}
 	r.Use(web.RequestID())
 	r.Use(web.ZapLogger(log))
 	r.Use(gin.Recovery())
@@ -43,6 +50,6 @@ func BuildRouter(cfg config.Config, log *zap.Logger, db *sqlx.DB) *gin.Engine {
 		api.GET("/healthz", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ok", "time": time.Now().UTC()}) })
 	}
 
-	RegisterRoutes(r, cfg, log, db)
+	RegisterRoutes(r, cfg, log, db, keys, mail)
 	return r
 }
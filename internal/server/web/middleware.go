@@ -1,15 +1,23 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"go.uber.org/zap"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
 )
 
-const headerRequestID = "X-Request-ID"
+const (
+	headerRequestID = "X-Request-ID"
+	ctxPrincipal    = "principal"
+)
 
 func RequestID() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -38,27 +46,133 @@ func ZapLogger(log *zap.Logger) gin.HandlerFunc {
 	}
 }
 
-func JWTAuth(secret string) gin.HandlerFunc {
+// RevocationCheck reports whether the access token with the given jti has
+// been revoked.
+type RevocationCheck func(ctx context.Context, jti string) (bool, error)
+
+// JWTAuth verifies the bearer token and stores its principal. Tokens found
+// revoked by isRevoked are refused.
+func JWTAuth(keys *auth.KeySet, isRevoked RevocationCheck) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		auth := c.GetHeader("Authorization")
-		if auth == "" {
+		header := c.GetHeader("Authorization")
+		if header == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
 			return
 		}
 
 		var tokenStr string
-		if len(auth) > 7 && auth[:7] == "Bearer " {
-			tokenStr = auth[7:]
+		if len(header) > 7 && header[:7] == "Bearer " {
+			tokenStr = header[7:]
 		}
 		if tokenStr == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid auth header"})
 			return
 		}
-		token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) { return []byte(secret), nil })
-		if err != nil || !token.Valid {
+		p, err := auth.ParseToken(tokenStr, keys)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
 			return
 		}
+		revoked, err := isRevoked(c, p.TokenID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "token check failed"})
+			return
+		}
+		if revoked {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token revoked"})
+			return
+		}
+		SetPrincipal(c, p)
 		c.Next()
 	}
 }
+
+// APIKeyCheck resolves an API key into the principal it acts as, or returns
+// auth.ErrInvalidAPIKey.
+type APIKeyCheck func(ctx context.Context, key string) (auth.Principal, error)
+
+// APIKeyAuth accepts "Authorization: ApiKey <key>" from keys holding perm and
+// hands every other request to tokenAuth, normally JWTAuth. Routes without it
+// do not accept API keys at all.
+func APIKeyAuth(check APIKeyCheck, perm models.APIPermission, tokenAuth gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "ApiKey ")
+		if !ok {
+			tokenAuth(c)
+			return
+		}
+		p, err := check(c, key)
+		if errors.Is(err, auth.ErrInvalidAPIKey) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "api key check failed"})
+			return
+		}
+		if !p.HasPermission(perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "api key lacks permission " + string(perm)})
+			return
+		}
+		SetPrincipal(c, p)
+		c.Next()
+	}
+}
+
+// ShopResolver finds the shop that owns the resource a request addresses. It
+// returns "" when there is no such shop, which only platform admins get past.
+type ShopResolver func(c *gin.Context) (string, error)
+
+// RequireShopRole lets the request through only when the caller holds at least
+// role in the shop resolved for it. It must run after JWTAuth.
+func RequireShopRole(role models.ShopRole, shopOf ShopResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := CurrentPrincipal(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		shopID, err := shopOf(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "authorization lookup failed"})
+			return
+		}
+		if !p.HasShopRole(shopID, role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequirePlatformAdmin guards platform-wide operations. It must run after
+// JWTAuth.
+func RequirePlatformAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := CurrentPrincipal(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+		if p.Role != models.RolePlatformAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// SetPrincipal stores the authenticated caller on the request context.
+func SetPrincipal(c *gin.Context, p auth.Principal) {
+	c.Set(ctxPrincipal, p)
+}
+
+// CurrentPrincipal returns the caller stored by JWTAuth or APIKeyAuth, if any.
+func CurrentPrincipal(c *gin.Context) (auth.Principal, bool) {
+	v, ok := c.Get(ctxPrincipal)
+	if !ok {
+		return auth.Principal{}, false
+	}
+	p, ok := v.(auth.Principal)
+	return p, ok
+}
@@ -0,0 +1,175 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
+)
+
+func TestRequireShopRole(t *testing.T) {
+	member := auth.Principal{UserID: "user-1", Role: models.RoleCustomer, Shops: map[string]models.ShopRole{"shop-1": models.ShopStaff}}
+	resolved := func(shopID string, err error) ShopResolver {
+		return func(*gin.Context) (string, error) { return shopID, err }
+	}
+	tests := []struct {
+		name           string
+		principal      *auth.Principal
+		role           models.ShopRole
+		shopOf         ShopResolver
+		expectedStatus int
+	}{
+		{name: "staff of the shop", principal: &member, role: models.ShopStaff, shopOf: resolved("shop-1", nil), expectedStatus: 200},
+		{name: "staff needs admin", principal: &member, role: models.ShopAdmin, shopOf: resolved("shop-1", nil), expectedStatus: 403},
+		{name: "other shop", principal: &member, role: models.ShopStaff, shopOf: resolved("shop-2", nil), expectedStatus: 403},
+		{name: "unknown resource", principal: &member, role: models.ShopStaff, shopOf: resolved("", nil), expectedStatus: 403},
+		{name: "platform admin", principal: &auth.Principal{UserID: "admin", Role: models.RolePlatformAdmin}, role: models.ShopAdmin, shopOf: resolved("", nil), expectedStatus: 200},
+		{name: "lookup failure", principal: &member, role: models.ShopStaff, shopOf: resolved("", errors.New("db down")), expectedStatus: 500},
+		{name: "not authenticated", role: models.ShopStaff, shopOf: resolved("shop-1", nil), expectedStatus: 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				if tt.principal != nil {
+					SetPrincipal(c, *tt.principal)
+				}
+			}, RequireShopRole(tt.role, tt.shopOf), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
+
+func TestRequirePlatformAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for role, want := range map[models.UserRole]int{models.RolePlatformAdmin: 200, models.RoleCustomer: 403} {
+		r := gin.New()
+		r.GET("/", func(c *gin.Context) {
+			SetPrincipal(c, auth.Principal{UserID: "user-1", Role: role})
+		}, RequirePlatformAdmin(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		assert.Equal(t, want, w.Code, role)
+	}
+}
+
+func TestJWTAuth_Revocation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keys, err := auth.GenerateKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := auth.GenerateToken(auth.Principal{UserID: "user-1", Role: models.RoleCustomer}, keys, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		isRevoked      RevocationCheck
+		expectedStatus int
+	}{
+		{name: "live token", isRevoked: func(context.Context, string) (bool, error) { return false, nil }, expectedStatus: 200},
+		{name: "revoked token", isRevoked: func(context.Context, string) (bool, error) { return true, nil }, expectedStatus: 401},
+		{name: "lookup failure", isRevoked: func(context.Context, string) (bool, error) { return false, errors.New("db down") }, expectedStatus: 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var checked string
+			r := gin.New()
+			r.GET("/", JWTAuth(keys, func(ctx context.Context, jti string) (bool, error) {
+				checked = jti
+				return tt.isRevoked(ctx, jti)
+			}), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tok.Token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tok.ID, checked)
+		})
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keyPrincipal := auth.Principal{
+		UserID:      "user-1",
+		Shops:       map[string]models.ShopRole{"shop-1": models.ShopStaff},
+		APIKeyID:    "key-1",
+		Permissions: []models.APIPermission{models.PermInventoryRead},
+	}
+	check := func(_ context.Context, key string) (auth.Principal, error) {
+		switch key {
+		case "esk_good":
+			return keyPrincipal, nil
+		case "esk_broken":
+			return auth.Principal{}, errors.New("db down")
+		}
+		return auth.Principal{}, auth.ErrInvalidAPIKey
+	}
+	tokenAuth := func(c *gin.Context) {
+		c.AbortWithStatus(http.StatusTeapot)
+	}
+	tests := []struct {
+		name           string
+		header         string
+		perm           models.APIPermission
+		expectedStatus int
+	}{
+		{name: "key with permission", header: "ApiKey esk_good", perm: models.PermInventoryRead, expectedStatus: 200},
+		{name: "key without permission", header: "ApiKey esk_good", perm: models.PermInventoryWrite, expectedStatus: 403},
+		{name: "unknown key", header: "ApiKey esk_bad", perm: models.PermInventoryRead, expectedStatus: 401},
+		{name: "lookup failure", header: "ApiKey esk_broken", perm: models.PermInventoryRead, expectedStatus: 500},
+		{name: "bearer token goes to token auth", header: "Bearer abc", perm: models.PermInventoryRead, expectedStatus: http.StatusTeapot},
+		{name: "no header goes to token auth", perm: models.PermInventoryRead, expectedStatus: http.StatusTeapot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got auth.Principal
+			r := gin.New()
+			r.GET("/", APIKeyAuth(check, tt.perm, tokenAuth), func(c *gin.Context) {
+				got, _ = CurrentPrincipal(c)
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedStatus == 200 {
+				assert.Equal(t, "key-1", got.APIKeyID)
+				assert.True(t, got.HasShopRole("shop-1", models.ShopStaff))
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrAPIKeyNotFound    = errors.New("api key not found")
+	ErrInvalidPermission = errors.New("unknown api key permission")
+	ErrExpiryInPast      = errors.New("expires_at must be in the future")
+)
+
+// APIKeysService manages the API keys integrations use to act on a shop.
+type APIKeysService struct{ DB *sqlx.DB }
+
+// APIKeyInput describes a key to create. A nil ExpiresAt never expires.
+type APIKeyInput struct {
+	Name        string
+	Permissions []models.APIPermission
+	ExpiresAt   *time.Time
+}
+
+const apiKeyColumns = `id, shop_id, name, prefix, permissions, created_by, expires_at, last_used_at, revoked_at, created_at`
+
+// Create stores a new key for the shop and returns it with the key in clear,
+// which is not available again.
+func (s *APIKeysService) Create(ctx context.Context, shopID, actorID string, in APIKeyInput) (models.APIKey, string, error) {
+	perms := make([]string, 0, len(in.Permissions))
+	for _, p := range in.Permissions {
+		if !p.Valid() {
+			return models.APIKey{}, "", fmt.Errorf("%w: %q", ErrInvalidPermission, p)
+		}
+		perms = append(perms, string(p))
+	}
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(time.Now()) {
+		return models.APIKey{}, "", ErrExpiryInPast
+	}
+	key, prefix, err := auth.NewAPIKey()
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	var k models.APIKey
+	err = repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var locked string
+		if err := tx.GetContext(ctx, &locked, `SELECT id FROM shops WHERE id=$1 AND deleted_at IS NULL FOR KEY SHARE`, shopID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrShopNotFound
+			}
+			return err
+		}
+		if err := tx.GetContext(ctx, &k, `
+			INSERT INTO api_keys(shop_id, name, prefix, key_hash, permissions, created_by, expires_at)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6,'')::uuid, $7)
+			RETURNING `+apiKeyColumns,
+			shopID, in.Name, prefix, auth.HashOpaqueToken(key), pq.Array(perms), actorID, in.ExpiresAt); err != nil {
+			return err
+		}
+		return repo.Audit(ctx, tx, repo.AuditEvent{
+			ActorID: actorID,
+			Action:  repo.AuditAPIKeyCreated,
+			Target:  "api_key:" + k.ID,
+			Details: map[string]interface{}{"shop_id": shopID, "name": in.Name, "permissions": perms},
+		})
+	})
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	return k, key, nil
+}
+
+// List returns the shop's keys, newest first, including revoked and expired
+// ones.
+func (s *APIKeysService) List(ctx context.Context, shopID string) ([]models.APIKey, error) {
+	var out []models.APIKey
+	err := s.DB.SelectContext(ctx, &out, `SELECT `+apiKeyColumns+` FROM api_keys WHERE shop_id=$1 ORDER BY created_at DESC, id`, shopID)
+	return out, err
+}
+
+// Revoke stops a key from working. Revoking a revoked key is a no-op.
+func (s *APIKeysService) Revoke(ctx context.Context, shopID, keyID, actorID string) (models.APIKey, error) {
+	var k models.APIKey
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &k, `
+			UPDATE api_keys SET revoked_at=COALESCE(revoked_at, now()) WHERE id=$1 AND shop_id=$2
+			RETURNING `+apiKeyColumns, keyID, shopID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAPIKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return repo.Audit(ctx, tx, repo.AuditEvent{
+			ActorID: actorID,
+			Action:  repo.AuditAPIKeyRevoked,
+			Target:  "api_key:" + k.ID,
+			Details: map[string]interface{}{"shop_id": shopID},
+		})
+	})
+	if err != nil {
+		return models.APIKey{}, err
+	}
+	return k, nil
+}
+
+// Authenticate resolves a key presented by a caller into a principal with
+// staff rights in the key's shop and the key's permissions. Keys of deleted
+// shops stop working. last_used_at is only written once a minute so busy
+// integrations do not turn every request into a write.
+func (s *APIKeysService) Authenticate(ctx context.Context, key string) (auth.Principal, error) {
+	var k models.APIKey
+	err := s.DB.GetContext(ctx, &k, `
+		SELECT `+apiKeyColumns+` FROM api_keys
+		WHERE key_hash=$1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		AND shop_id IN (SELECT id FROM shops WHERE deleted_at IS NULL)
+	`, auth.HashOpaqueToken(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return auth.Principal{}, auth.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+	if _, err := s.DB.ExecContext(ctx, `
+		UPDATE api_keys SET last_used_at=now() WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')
+	`, k.ID); err != nil {
+		return auth.Principal{}, err
+	}
+	p := auth.Principal{
+		Role:     models.RoleCustomer,
+		Shops:    map[string]models.ShopRole{k.ShopID: models.ShopStaff},
+		APIKeyID: k.ID,
+	}
+	if k.CreatedBy != nil {
+		p.UserID = *k.CreatedBy
+	}
+	for _, perm := range k.Permissions {
+		p.Permissions = append(p.Permissions, models.APIPermission(perm))
+	}
+	return p, nil
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/testutils"
+)
+
+var apiKeyCols = []string{"id", "shop_id", "name", "prefix", "permissions", "created_by", "expires_at", "last_used_at", "revoked_at", "created_at"}
+
+func TestAPIKeysService_Create(t *testing.T) {
+	t.Run("returns the key once", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+			WithArgs("shop-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+		mock.ExpectQuery(`INSERT INTO api_keys`).
+			WithArgs("shop-1", "WMS", sqlmock.AnyArg(), sqlmock.AnyArg(), `{"inventory:read","transfers:write"}`, "admin-1", nil).
+			WillReturnRows(sqlmock.NewRows(apiKeyCols).
+				AddRow("key-1", "shop-1", "WMS", "esk_abcdef12", `{"inventory:read","transfers:write"}`, "admin-1", nil, nil, nil, time.Now()))
+		mock.ExpectExec(`INSERT INTO audit_log`).
+			WithArgs("admin-1", "api_key.created", "api_key:key-1", "", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		service := &APIKeysService{DB: db}
+		k, key, err := service.Create(context.Background(), "shop-1", "admin-1", APIKeyInput{
+			Name:        "WMS",
+			Permissions: []models.APIPermission{models.PermInventoryRead, models.PermTransfersWrite},
+		})
+
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(key, "esk_"))
+		assert.Equal(t, "key-1", k.ID)
+		assert.Equal(t, []string{"inventory:read", "transfers:write"}, []string(k.Permissions))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown permission", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		service := &APIKeysService{DB: db}
+		_, _, err := service.Create(context.Background(), "shop-1", "admin-1", APIKeyInput{
+			Name:        "WMS",
+			Permissions: []models.APIPermission{"orders:write"},
+		})
+
+		assert.ErrorIs(t, err, ErrInvalidPermission)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("expiry in the past", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		past := time.Now().Add(-time.Hour)
+		service := &APIKeysService{DB: db}
+		_, _, err := service.Create(context.Background(), "shop-1", "admin-1", APIKeyInput{
+			Name:        "WMS",
+			Permissions: []models.APIPermission{models.PermInventoryRead},
+			ExpiresAt:   &past,
+		})
+
+		assert.ErrorIs(t, err, ErrExpiryInPast)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestAPIKeysService_Authenticate(t *testing.T) {
+	t.Run("live key", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`FROM api_keys\s+WHERE key_hash=\$1 AND revoked_at IS NULL`).
+			WithArgs(auth.HashOpaqueToken("esk_secret")).
+			WillReturnRows(sqlmock.NewRows(apiKeyCols).
+				AddRow("key-1", "shop-1", "POS", "esk_secret", `{"inventory:read"}`, "admin-1", nil, nil, nil, time.Now()))
+		mock.ExpectExec(`UPDATE api_keys SET last_used_at=now\(\) WHERE id=\$1`).
+			WithArgs("key-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		service := &APIKeysService{DB: db}
+		p, err := service.Authenticate(context.Background(), "esk_secret")
+
+		require.NoError(t, err)
+		assert.Equal(t, "key-1", p.APIKeyID)
+		assert.Equal(t, "admin-1", p.UserID)
+		assert.Equal(t, models.RoleCustomer, p.Role)
+		assert.True(t, p.HasShopRole("shop-1", models.ShopStaff))
+		assert.False(t, p.HasShopRole("shop-1", models.ShopAdmin))
+		assert.True(t, p.HasPermission(models.PermInventoryRead))
+		assert.False(t, p.HasPermission(models.PermInventoryWrite))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown, expired or revoked key", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`FROM api_keys`).
+			WillReturnRows(sqlmock.NewRows(apiKeyCols))
+
+		service := &APIKeysService{DB: db}
+		_, err := service.Authenticate(context.Background(), "esk_secret")
+
+		assert.ErrorIs(t, err, auth.ErrInvalidAPIKey)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestAPIKeysService_Revoke(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE api_keys SET revoked_at=COALESCE\(revoked_at, now\(\)\) WHERE id=\$1 AND shop_id=\$2`).
+		WithArgs("key-1", "shop-2").
+		WillReturnRows(sqlmock.NewRows(apiKeyCols))
+	mock.ExpectRollback()
+
+	service := &APIKeysService{DB: db}
+	_, err := service.Revoke(context.Background(), "shop-2", "key-1", "admin-1")
+
+	assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,42 +2,522 @@ package service
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/bcrypt"
 
 	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/mailer"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid, expired or revoked")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used; the session has been revoked")
+	ErrEmailNotVerified    = errors.New("email address is not verified")
+	ErrInvalidEmailToken   = errors.New("link is invalid, expired or already used")
+)
+
+const (
+	defaultAccessTokenTTL       = 15 * time.Minute
+	defaultRefreshTokenTTL      = 30 * 24 * time.Hour
+	defaultPasswordResetTTL     = time.Hour
+	defaultEmailVerificationTTL = 48 * time.Hour
+
+	// mailTimeout bounds a send, which outlives the request that asked for it
+	mailTimeout = time.Minute
 )
 
 type AuthService struct {
-	DB        *sqlx.DB
-	Log       *zap.Logger
-	JWTSecret string
+	DB         *sqlx.DB
+	Log        *zap.Logger
+	Keys       *auth.KeySet
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	Mailer mailer.Mailer
+	// BaseURL prefixes the links in password reset and verification emails.
+	BaseURL string
+	// RequireVerifiedEmail refuses logins, and tokens at registration, until
+	// the user has followed their verification link.
+	RequireVerifiedEmail bool
+	ResetTTL             time.Duration
+	VerifyTTL            time.Duration
+
+	// AccountThrottle and IPThrottle slow down and lock out repeated failed
+	// logins; zero values use the defaults.
+	AccountThrottle ThrottlePolicy
+	IPThrottle      ThrottlePolicy
+
+	// MFARequiredRoles lists the platform roles ("customer", "platform_admin")
+	// and shop roles ("staff", "admin") that must sign in with a second
+	// factor. A user holding any of them gets no privileges until enrolled.
+	MFARequiredRoles []string
+	// MFAIssuer names the service in authenticator apps.
+	MFAIssuer string
+
+	// IdentityProviders are the OpenID Connect providers users can sign in
+	// with, by name.
+	IdentityProviders map[string]*IdentityProvider
+
+	// sending counts the mails send is still handing to Mailer
+	sending sync.WaitGroup
+}
+
+// Session is the token pair handed out by login, registration and refresh.
+// A login that still needs a second factor carries only MFAToken, to be
+// exchanged with CompleteMFALogin.
+type Session struct {
+	UserID       string
+	AccessToken  string
+	ExpiresAt    time.Time
+	RefreshToken string
+	MFAToken     string
+	// MFAEnrolmentRequired is set when the user's role requires a second
+	// factor they have not enrolled yet; the tokens carry no privileges
+	// beyond a customer's until they do.
+	MFAEnrolmentRequired bool
+}
+
+// Register creates the user and mails them a verification link. When
+// verified emails are required the returned session has no tokens.
+func (s *AuthService) Register(ctx context.Context, email, password string) (Session, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return Session{}, err
+	}
+	var out Session
+	var verify string
+	err = repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		u := models.User{Role: models.RoleCustomer}
+		if err := tx.GetContext(ctx, &u.ID, `INSERT INTO users(email, password_hash) VALUES ($1,$2) RETURNING id`, email, string(hash)); err != nil {
+			return err
+		}
+		var err error
+		if verify, err = newUserToken(ctx, tx, u.ID, models.TokenEmailVerification, s.verifyTTL()); err != nil {
+			return err
+		}
+		if s.RequireVerifiedEmail {
+			out = Session{UserID: u.ID}
+			return nil
+		}
+		out, err = s.issue(ctx, tx, u, nil, nil, []string{auth.AMRPassword})
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	s.sendVerification(ctx, email, verify)
+	return out, nil
+}
+
+// Login checks the password and starts a new session whose access token
+// carries the user's platform role and shop memberships. Every attempt is
+// counted against the email and the client ip before the password is
+// checked, and while either is throttled Login returns a *ThrottledError
+// without checking it. Unknown emails and wrong passwords both return
+// ErrInvalidCredentials after the same amount of work. Users with two-factor
+// authentication get a session holding only an MFA challenge token, and their
+// failures are only cleared once CompleteMFALogin succeeds.
+func (s *AuthService) Login(ctx context.Context, email, password, ip string) (Session, error) {
+	if err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		return s.claimAttempt(ctx, tx, email, ip)
+	}); err != nil {
+		return Session{}, err
+	}
+	var u models.User
+	err := s.DB.GetContext(ctx, &u, `SELECT id, password_hash, role, email_verified_at FROM users WHERE email=$1`, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		compareDummy(password)
+		return Session{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return Session{}, ErrInvalidCredentials
+	}
+	if s.RequireVerifiedEmail && u.EmailVerifiedAt == nil {
+		if err := s.releaseAttempt(ctx, s.DB, email, ip); err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrEmailNotVerified
+	}
+	enrolled, err := mfaEnabled(ctx, s.DB, u.ID)
+	if err != nil {
+		return Session{}, err
+	}
+	if enrolled {
+		// the right password is not a failure, but earlier failures keep
+		// counting until the second factor is passed too, so the password
+		// alone cannot reset a guessing run against the codes
+		if err := s.releaseAttempt(ctx, s.DB, email, ip); err != nil {
+			return Session{}, err
+		}
+		return s.mfaChallenge(ctx, u.ID)
+	}
+	shops, err := repo.ShopMemberships(ctx, s.DB, u.ID)
+	if err != nil {
+		return Session{}, err
+	}
+	sess, err := s.issue(ctx, s.DB, u, shops, nil, []string{auth.AMRPassword})
+	if err != nil {
+		return Session{}, err
+	}
+	if err := s.loginSucceeded(ctx, s.DB, email, ip); err != nil {
+		return Session{}, err
+	}
+	return sess, nil
+}
+
+// Refresh exchanges a refresh token for a new pair in the same session. Role
+// and membership changes made since the last token show up in the new one.
+// Each refresh token works once: presenting a used one again revokes the
+// whole session, since either the client or an attacker holds a stolen copy.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (Session, error) {
+	var out Session
+	var reused *models.RefreshToken
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var rt models.RefreshToken
+		err := tx.GetContext(ctx, &rt, `
+			SELECT id, user_id, family_id, expires_at, used_at, revoked_at, amr FROM refresh_tokens
+			WHERE token_hash=$1 FOR UPDATE
+		`, auth.HashOpaqueToken(refreshToken))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if rt.RevokedAt != nil || !rt.ExpiresAt.After(time.Now()) {
+			return ErrInvalidRefreshToken
+		}
+		if rt.UsedAt != nil {
+			reused = &rt
+			return revokeFamily(ctx, tx, rt.FamilyID)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at=now() WHERE id=$1`, rt.ID); err != nil {
+			return err
+		}
+		var u models.User
+		if err := tx.GetContext(ctx, &u, `SELECT id, role FROM users WHERE id=$1`, rt.UserID); err != nil {
+			return err
+		}
+		shops, err := repo.ShopMemberships(ctx, tx, u.ID)
+		if err != nil {
+			return err
+		}
+		out, err = s.issue(ctx, tx, u, shops, &rt.FamilyID, rt.AMR)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused != nil {
+		s.Log.Warn("refresh token reused, session revoked",
+			zap.String("user_id", reused.UserID), zap.String("family_id", reused.FamilyID))
+		return Session{}, ErrRefreshTokenReused
+	}
+	return out, nil
+}
+
+// Logout revokes the caller's access token and ends the session it was
+// issued in, so neither it nor the session's refresh token work anymore.
+func (s *AuthService) Logout(ctx context.Context, p auth.Principal) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO revoked_tokens(jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING
+		`, p.TokenID, p.ExpiresAt); err != nil {
+			return err
+		}
+		var family string
+		err := tx.GetContext(ctx, &family, `SELECT family_id FROM refresh_tokens WHERE access_jti=$1`, p.TokenID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return revokeFamily(ctx, tx, family)
+	})
 }
 
-func (s *AuthService) Register(ctx context.Context, email, password string) (string, string, error) {
+// IsRevoked reports whether the access token with the given jti was revoked.
+func (s *AuthService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := s.DB.GetContext(ctx, &revoked, `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti=$1)`, jti)
+	return revoked, err
+}
+
+// RequestPasswordReset mails a reset link if an account uses email. It
+// reports success either way, without waiting for the mail, so the endpoint
+// does not reveal which emails are registered.
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email string) error {
+	var userID string
+	err := s.DB.GetContext(ctx, &userID, `SELECT id FROM users WHERE email=$1`, email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var tok string
+	if err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		tok, err = newUserToken(ctx, tx, userID, models.TokenPasswordReset, s.resetTTL())
+		return err
+	}); err != nil {
+		return err
+	}
+	s.send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account. Follow this link within %s to choose a new one:\n\n%s\n\n"+
+			"If that was not you, ignore this email and your password stays as it is.\n", readableDuration(s.resetTTL()), s.link("/reset-password", tok)),
+	})
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and signs the user out
+// everywhere. Having received the email also proves the address is theirs.
+func (s *AuthService) ResetPassword(ctx context.Context, token, password string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return "", "", err
+		return err
+	}
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		userID, err := consumeUserToken(ctx, tx, models.TokenPasswordReset, token)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE users SET password_hash=$2, email_verified_at=COALESCE(email_verified_at, now()) WHERE id=$1
+		`, userID, string(hash)); err != nil {
+			return err
+		}
+		return revokeUserSessions(ctx, tx, userID)
+	})
+}
+
+// RequestEmailVerification mails a fresh verification link if email belongs
+// to an account that is not verified yet, and like RequestPasswordReset
+// reports success either way without waiting for the mail.
+func (s *AuthService) RequestEmailVerification(ctx context.Context, email string) error {
+	var u models.User
+	err := s.DB.GetContext(ctx, &u, `SELECT id, email_verified_at FROM users WHERE email=$1`, email)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && u.EmailVerifiedAt != nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var tok string
+	if err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		tok, err = newUserToken(ctx, tx, u.ID, models.TokenEmailVerification, s.verifyTTL())
+		return err
+	}); err != nil {
+		return err
+	}
+	s.sendVerification(ctx, email, tok)
+	return nil
+}
+
+// VerifyEmail marks the address of the token's user as verified.
+func (s *AuthService) VerifyEmail(ctx context.Context, token string) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		userID, err := consumeUserToken(ctx, tx, models.TokenEmailVerification, token)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE users SET email_verified_at=COALESCE(email_verified_at, now()) WHERE id=$1`, userID)
+		return err
+	})
+}
+
+func (s *AuthService) sendVerification(ctx context.Context, email, token string) {
+	s.send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Follow this link within %s to confirm your email address:\n\n%s\n",
+			readableDuration(s.verifyTTL()), s.link("/verify-email", token)),
+	})
+}
+
+// send delivers m in the background, logging failures instead of returning
+// them: the user can ask for another link, and the caller must not reveal
+// whether the account exists, neither by its answer nor by how long an SMTP
+// round trip made it take.
+func (s *AuthService) send(ctx context.Context, m mailer.Message) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	s.sending.Add(1)
+	go func() {
+		defer s.sending.Done()
+		defer cancel()
+		if err := s.Mailer.Send(ctx, m); err != nil {
+			s.Log.Error("send email failed", zap.String("subject", m.Subject), zap.Error(err))
+		}
+	}()
+}
+
+func (s *AuthService) link(path, token string) string {
+	return strings.TrimRight(s.BaseURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// readableDuration renders link lifetimes for emails, e.g. "48 hours".
+func readableDuration(d time.Duration) string {
+	n, unit := int(d/time.Minute), "minute"
+	if d%time.Hour == 0 {
+		n, unit = int(d/time.Hour), "hour"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
+
+// newUserToken stores a token for purpose, superseding any the user still
+// had, and returns it in clear for the email.
+func newUserToken(ctx context.Context, tx *sqlx.Tx, userID, purpose string, ttl time.Duration) (string, error) {
+	tok, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE user_tokens SET used_at=now() WHERE user_id=$1 AND purpose=$2 AND used_at IS NULL
+	`, userID, purpose); err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_tokens(user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)
+	`, userID, purpose, auth.HashOpaqueToken(tok), time.Now().Add(ttl))
+	return tok, err
+}
+
+// consumeUserToken marks a live token for purpose used and returns its user.
+func consumeUserToken(ctx context.Context, tx *sqlx.Tx, purpose, token string) (string, error) {
+	t, err := lookupUserToken(ctx, tx, purpose, token)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE user_tokens SET used_at=now() WHERE id=$1`, t.ID)
+	return t.UserID, err
+}
+
+// lookupUserToken locks a live token for purpose without using it up, or
+// returns ErrInvalidEmailToken.
+func lookupUserToken(ctx context.Context, tx *sqlx.Tx, purpose, token string) (models.UserToken, error) {
+	var t models.UserToken
+	err := tx.GetContext(ctx, &t, `
+		SELECT id, user_id, expires_at, used_at FROM user_tokens WHERE token_hash=$1 AND purpose=$2 FOR UPDATE
+	`, auth.HashOpaqueToken(token), purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserToken{}, ErrInvalidEmailToken
+	}
+	if err != nil {
+		return models.UserToken{}, err
+	}
+	if t.UsedAt != nil || !t.ExpiresAt.After(time.Now()) {
+		return models.UserToken{}, ErrInvalidEmailToken
+	}
+	return t, nil
+}
+
+// issue signs an access token for u and stores a refresh token for it. A nil
+// family starts a new session; amr says how it was authenticated. While the
+// user's role requires a second factor the session has not passed, the token
+// is issued with a customer's privileges only.
+func (s *AuthService) issue(ctx context.Context, q sqlx.ExtContext, u models.User, shops map[string]models.ShopRole, family *string, amr []string) (Session, error) {
+	p := auth.Principal{UserID: u.ID, Role: u.Role, Shops: shops, AMR: amr}
+	enrol := s.mfaRequired(u.Role, shops) && !p.HasAMR(auth.AMRMFA)
+	if enrol {
+		p.Role, p.Shops = models.RoleCustomer, nil
+	}
+	access, err := auth.GenerateToken(p, s.Keys, s.accessTTL())
+	if err != nil {
+		return Session{}, err
+	}
+	refresh, err := auth.NewOpaqueToken()
+	if err != nil {
+		return Session{}, err
+	}
+	if _, err := q.ExecContext(ctx, `
+		INSERT INTO refresh_tokens(user_id, family_id, token_hash, access_jti, access_expires_at, expires_at, amr)
+		VALUES ($1, COALESCE($2, gen_random_uuid()), $3, $4, $5, $6, $7)
+	`, u.ID, family, auth.HashOpaqueToken(refresh), access.ID, access.ExpiresAt, time.Now().Add(s.refreshTTL()), pq.Array(amr)); err != nil {
+		return Session{}, err
 	}
-	var id string
-	if err := s.DB.GetContext(ctx, &id, `INSERT INTO users(email, password_hash) VALUES ($1,$2) RETURNING id`, email, string(hash)); err != nil {
-		return "", "", err
+	return Session{
+		UserID:               u.ID,
+		AccessToken:          access.Token,
+		ExpiresAt:            access.ExpiresAt,
+		RefreshToken:         refresh,
+		MFAEnrolmentRequired: enrol,
+	}, nil
+}
+
+// revokeFamily revokes every refresh token of a session along with the
+// access tokens issued with them that have not expired yet.
+func revokeFamily(ctx context.Context, tx *sqlx.Tx, familyID string) error {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO revoked_tokens(jti, expires_at)
+		SELECT access_jti, access_expires_at FROM refresh_tokens WHERE family_id=$1 AND access_expires_at > now()
+		ON CONFLICT (jti) DO NOTHING
+	`, familyID); err != nil {
+		return err
 	}
-	tok, err := auth.GenerateToken(id, s.JWTSecret, 24*time.Hour)
-	return id, tok, err
+	_, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL`, familyID)
+	return err
 }
 
-func (s *AuthService) Login(ctx context.Context, email, password string) (string, string, error) {
-	var id, pw string
-	if err := s.DB.QueryRowxContext(ctx, `SELECT id, password_hash FROM users WHERE email=$1`, email).Scan(&id, &pw); err != nil {
-		return "", "", err
+// revokeUserSessions ends every session of the user, as revokeFamily does for
+// one.
+func revokeUserSessions(ctx context.Context, tx *sqlx.Tx, userID string) error {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO revoked_tokens(jti, expires_at)
+		SELECT access_jti, access_expires_at FROM refresh_tokens WHERE user_id=$1 AND access_expires_at > now()
+		ON CONFLICT (jti) DO NOTHING
+	`, userID); err != nil {
+		return err
 	}
-	if bcrypt.CompareHashAndPassword([]byte(pw), []byte(password)) != nil {
-		return "", "", bcrypt.ErrMismatchedHashAndPassword
+	_, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL`, userID)
+	return err
+}
+
+func (s *AuthService) accessTTL() time.Duration {
+	if s.AccessTTL > 0 {
+		return s.AccessTTL
+	}
+	return defaultAccessTokenTTL
+}
+
+func (s *AuthService) refreshTTL() time.Duration {
+	if s.RefreshTTL > 0 {
+		return s.RefreshTTL
+	}
+	return defaultRefreshTokenTTL
+}
+
+func (s *AuthService) resetTTL() time.Duration {
+	if s.ResetTTL > 0 {
+		return s.ResetTTL
+	}
+	return defaultPasswordResetTTL
+}
+
+func (s *AuthService) verifyTTL() time.Duration {
+	if s.VerifyTTL > 0 {
+		return s.VerifyTTL
 	}
-	tok, err := auth.GenerateToken(id, s.JWTSecret, 24*time.Hour)
-	return id, tok, err
+	return defaultEmailVerificationTTL
 }
@@ -4,14 +4,21 @@ import (
 	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/mailer"
+	"ecommerce-shop/internal/models"
 	"ecommerce-shop/testutils"
 )
 
 func TestAuthService_Register(t *testing.T) {
+	keys := testutils.TestKeySet(t)
 	tests := []struct {
 		name      string
 		email     string
@@ -24,9 +31,20 @@ func TestAuthService_Register(t *testing.T) {
 			email:    "test@example.com",
 			password: "password123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
 				mock.ExpectQuery(`INSERT INTO users\(email, password_hash\) VALUES \(\$1,\$2\) RETURNING id`).
 					WithArgs("test@example.com", sqlmock.AnyArg()).
 					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-123"))
+				mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE user_id=\$1 AND purpose=\$2 AND used_at IS NULL`).
+					WithArgs("user-123", "email_verification").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`INSERT INTO user_tokens\(user_id, purpose, token_hash, expires_at\)`).
+					WithArgs("user-123", "email_verification", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO refresh_tokens\(user_id, family_id, token_hash, access_jti, access_expires_at, expires_at, amr\)`).
+					WithArgs("user-123", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
 			},
 			wantErr: false,
 		},
@@ -35,9 +53,11 @@ func TestAuthService_Register(t *testing.T) {
 			email:    "test@example.com",
 			password: "password123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
 				mock.ExpectQuery(`INSERT INTO users\(email, password_hash\) VALUES \(\$1,\$2\) RETURNING id`).
 					WithArgs("test@example.com", sqlmock.AnyArg()).
 					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
 			},
 			wantErr: true,
 		},
@@ -46,9 +66,11 @@ func TestAuthService_Register(t *testing.T) {
 			email:    "test@example.com",
 			password: "password123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
 				mock.ExpectQuery(`INSERT INTO users\(email, password_hash\) VALUES \(\$1,\$2\) RETURNING id`).
 					WithArgs("test@example.com", sqlmock.AnyArg()).
 					WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
 			},
 			wantErr: true,
 		},
@@ -62,25 +84,27 @@ func TestAuthService_Register(t *testing.T) {
 
 			logger := testutils.MockLogger(t)
 			service := &AuthService{
-				DB:        db,
-				Log:       logger,
-				JWTSecret: "test-secret-key",
+				DB:     db,
+				Log:    logger,
+				Keys:   keys,
+				Mailer: &testutils.MockMailer{},
 			}
 
 			tt.mockSetup(mock)
 
 			// Execute
-			id, token, err := service.Register(context.Background(), tt.email, tt.password)
+			sess, err := service.Register(context.Background(), tt.email, tt.password)
 
 			// Assert
 			if tt.wantErr {
 				assert.Error(t, err)
-				assert.Empty(t, id)
-				assert.Empty(t, token)
+				assert.Empty(t, sess.UserID)
+				assert.Empty(t, sess.AccessToken)
 			} else {
 				assert.NoError(t, err)
-				assert.NotEmpty(t, id)
-				assert.NotEmpty(t, token)
+				assert.NotEmpty(t, sess.UserID)
+				assert.NotEmpty(t, sess.AccessToken)
+				assert.NotEmpty(t, sess.RefreshToken)
 			}
 
 			// Verify all expectations
@@ -88,3 +112,382 @@ func TestAuthService_Register(t *testing.T) {
 		})
 	}
 }
+
+var refreshCols = []string{"id", "user_id", "family_id", "expires_at", "used_at", "revoked_at"}
+
+func TestAuthService_Refresh(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	hash := auth.HashOpaqueToken("refresh-1")
+	later := time.Now().Add(time.Hour)
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "rotates token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens\s+WHERE token_hash=\$1 FOR UPDATE`).
+					WithArgs(hash).
+					WillReturnRows(sqlmock.NewRows(refreshCols).AddRow("rt-1", "user-1", "fam-1", later, nil, nil))
+				mock.ExpectExec(`UPDATE refresh_tokens SET used_at=now\(\) WHERE id=\$1`).
+					WithArgs("rt-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`SELECT id, role FROM users WHERE id=\$1`).
+					WithArgs("user-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow("user-1", "customer"))
+				mock.ExpectQuery(`FROM shop_members m`).
+					WithArgs("user-1").
+					WillReturnRows(sqlmock.NewRows([]string{"shop_id", "role"}).AddRow("shop-1", "admin"))
+				mock.ExpectExec(`INSERT INTO refresh_tokens`).
+					WithArgs("user-1", "fam-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "reused token revokes the family",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens`).
+					WillReturnRows(sqlmock.NewRows(refreshCols).AddRow("rt-1", "user-1", "fam-1", later, time.Now(), nil))
+				mock.ExpectExec(`INSERT INTO revoked_tokens\(jti, expires_at\)\s+SELECT access_jti, access_expires_at FROM refresh_tokens WHERE family_id=\$1`).
+					WithArgs("fam-1").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at=now\(\) WHERE family_id=\$1 AND revoked_at IS NULL`).
+					WithArgs("fam-1").
+					WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectCommit()
+			},
+			wantErr: ErrRefreshTokenReused,
+		},
+		{
+			name: "revoked token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens`).
+					WillReturnRows(sqlmock.NewRows(refreshCols).AddRow("rt-1", "user-1", "fam-1", later, time.Now(), time.Now()))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "expired token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens`).
+					WillReturnRows(sqlmock.NewRows(refreshCols).AddRow("rt-1", "user-1", "fam-1", time.Now().Add(-time.Minute), nil, nil))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+		{
+			name: "unknown token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM refresh_tokens`).
+					WillReturnRows(sqlmock.NewRows(refreshCols))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidRefreshToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &AuthService{DB: db, Log: testutils.MockLogger(t), Keys: keys, Mailer: &testutils.MockMailer{}}
+			tt.mockSetup(mock)
+
+			sess, err := service.Refresh(context.Background(), "refresh-1")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Empty(t, sess.AccessToken)
+			} else {
+				require.NoError(t, err)
+				assert.NotEqual(t, "refresh-1", sess.RefreshToken)
+				p, err := auth.ParseToken(sess.AccessToken, keys)
+				require.NoError(t, err)
+				assert.Equal(t, models.ShopAdmin, p.Shops["shop-1"])
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuthService_Logout(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	exp := time.Now().Add(10 * time.Minute)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO revoked_tokens\(jti, expires_at\) VALUES \(\$1, \$2\) ON CONFLICT \(jti\) DO NOTHING`).
+		WithArgs("jti-1", exp).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT family_id FROM refresh_tokens WHERE access_jti=\$1`).
+		WithArgs("jti-1").
+		WillReturnRows(sqlmock.NewRows([]string{"family_id"}).AddRow("fam-1"))
+	mock.ExpectExec(`INSERT INTO revoked_tokens\(jti, expires_at\)\s+SELECT`).
+		WithArgs("fam-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at=now\(\)`).
+		WithArgs("fam-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service := &AuthService{DB: db, Log: testutils.MockLogger(t), Keys: keys, Mailer: &testutils.MockMailer{}}
+	err := service.Logout(context.Background(), auth.Principal{UserID: "user-1", TokenID: "jti-1", ExpiresAt: exp})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+var userTokenCols = []string{"id", "user_id", "expires_at", "used_at"}
+
+// stalledMailer holds every send until release is closed, like a slow SMTP
+// relay, and keeps what the send returned.
+type stalledMailer struct {
+	release chan struct{}
+	err     error
+}
+
+func (m *stalledMailer) Send(ctx context.Context, _ mailer.Message) error {
+	select {
+	case <-m.release:
+	case <-ctx.Done():
+		m.err = ctx.Err()
+	}
+	return m.err
+}
+
+func TestAuthService_RequestPasswordReset(t *testing.T) {
+	t.Run("mails a link", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT id FROM users WHERE email=\$1`).
+			WithArgs("a@b.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\)`).
+			WithArgs("user-1", "password_reset").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO user_tokens`).
+			WithArgs("user-1", "password_reset", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		mail := &testutils.MockMailer{}
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: mail, BaseURL: "https://shop.example/"}
+		err := service.RequestPasswordReset(context.Background(), "a@b.com")
+		service.sending.Wait()
+
+		require.NoError(t, err)
+		require.Len(t, mail.Sent, 1)
+		assert.Equal(t, "a@b.com", mail.Sent[0].To)
+		assert.Contains(t, mail.Sent[0].Body, "https://shop.example/reset-password?token=")
+		assert.Contains(t, mail.Sent[0].Body, "within 1 hour")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// a registered email must not answer later than an unknown one
+	t.Run("does not wait for the mail", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT id FROM users WHERE email=\$1`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\)`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO user_tokens`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		mail := &stalledMailer{release: make(chan struct{})}
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: mail}
+		ctx, cancel := context.WithCancel(context.Background())
+		err := service.RequestPasswordReset(ctx, "a@b.com")
+		// the request ending must not abort the send either
+		cancel()
+		close(mail.release)
+		service.sending.Wait()
+
+		assert.NoError(t, err)
+		assert.NoError(t, mail.err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT id FROM users WHERE email=\$1`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		mail := &testutils.MockMailer{}
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: mail}
+		err := service.RequestPasswordReset(context.Background(), "nobody@b.com")
+		service.sending.Wait()
+
+		assert.NoError(t, err)
+		assert.Empty(t, mail.Sent)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestAuthService_ResetPassword(t *testing.T) {
+	hash := auth.HashOpaqueToken("reset-1")
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "sets password and signs out everywhere",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens WHERE token_hash=\$1 AND purpose=\$2 FOR UPDATE`).
+					WithArgs(hash, "password_reset").
+					WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", time.Now().Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE id=\$1`).
+					WithArgs("tok-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE users SET password_hash=\$2, email_verified_at=COALESCE\(email_verified_at, now\(\)\) WHERE id=\$1`).
+					WithArgs("user-1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO revoked_tokens\(jti, expires_at\)\s+SELECT access_jti, access_expires_at FROM refresh_tokens WHERE user_id=\$1`).
+					WithArgs("user-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at=now\(\) WHERE user_id=\$1`).
+					WithArgs("user-1").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "used token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", time.Now().Add(time.Minute), time.Now()))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidEmailToken,
+		},
+		{
+			name: "expired token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", time.Now().Add(-time.Minute), nil))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidEmailToken,
+		},
+		{
+			name: "unknown token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens`).
+					WillReturnRows(sqlmock.NewRows(userTokenCols))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidEmailToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: &testutils.MockMailer{}}
+			tt.mockSetup(mock)
+
+			err := service.ResetPassword(context.Background(), "reset-1", "new-password")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuthService_VerifyEmail(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM user_tokens WHERE token_hash=\$1 AND purpose=\$2`).
+		WithArgs(auth.HashOpaqueToken("verify-1"), "email_verification").
+		WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", time.Now().Add(time.Hour), nil))
+	mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\)`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE users SET email_verified_at=COALESCE\(email_verified_at, now\(\)\) WHERE id=\$1`).
+		WithArgs("user-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: &testutils.MockMailer{}}
+	err := service.VerifyEmail(context.Background(), "verify-1")
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthService_RequireVerifiedEmail(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	t.Run("register issues no tokens", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO users`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-1"))
+		mock.ExpectExec(`UPDATE user_tokens`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO user_tokens`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		mail := &testutils.MockMailer{}
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: mail, RequireVerifiedEmail: true}
+		sess, err := service.Register(context.Background(), "a@b.com", "password123")
+		service.sending.Wait()
+
+		require.NoError(t, err)
+		assert.Equal(t, "user-1", sess.UserID)
+		assert.Empty(t, sess.AccessToken)
+		assert.Empty(t, sess.RefreshToken)
+		require.Len(t, mail.Sent, 1)
+		assert.Contains(t, mail.Sent[0].Body, "/verify-email?token=")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("login refused until verified", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		expectClaim(mock, "a@b.com", "10.0.0.1", 1)
+		mock.ExpectCommit()
+		mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "role", "email_verified_at"}).AddRow("user-1", string(hash), "customer", nil))
+		expectRelease(mock, "a@b.com", "10.0.0.1")
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Mailer: &testutils.MockMailer{}, RequireVerifiedEmail: true}
+		_, err := service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+
+		assert.ErrorIs(t, err, ErrEmailNotVerified)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/models"
+)
+
+var ErrDuplicateSKU = errors.New("a product with this SKU already exists")
+
+// CatalogService manages the product catalogue; ProductsService serves the
+// per-shop storefront view of it. Deleted products drop out of listings and
+// checkout, while orders and the ledger keep referencing them.
+type CatalogService struct{ DB *sqlx.DB }
+
+// ProductInput holds the fields to set; nil fields are left unchanged on
+// update. Create needs every field, a product having no default price.
+type ProductInput struct {
+	SKU        *string
+	Name       *string
+	PriceCents *int64
+	Currency   *string
+}
+
+const productColumns = `id, sku, name, price_cents, currency, created_at, updated_at, deleted_at`
+
+func (s *CatalogService) Create(ctx context.Context, in ProductInput) (models.Product, error) {
+	var p models.Product
+	err := s.DB.GetContext(ctx, &p, `
+		INSERT INTO products(sku, name, price_cents, currency) VALUES ($1, $2, $3, $4)
+		RETURNING `+productColumns, in.SKU, in.Name, in.PriceCents, in.Currency)
+	if isUniqueViolation(err) {
+		return models.Product{}, ErrDuplicateSKU
+	}
+	return p, err
+}
+
+func (s *CatalogService) Get(ctx context.Context, id string) (models.Product, error) {
+	var p models.Product
+	err := s.DB.GetContext(ctx, &p, `SELECT `+productColumns+` FROM products WHERE id=$1 AND deleted_at IS NULL`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Product{}, ErrUnknownProduct
+	}
+	return p, err
+}
+
+// Update changes a product. A new list price applies to orders placed from
+// now on; reserved orders keep the price they were quoted.
+func (s *CatalogService) Update(ctx context.Context, id string, in ProductInput) (models.Product, error) {
+	var p models.Product
+	err := s.DB.GetContext(ctx, &p, `
+		UPDATE products SET sku=COALESCE($2, sku), name=COALESCE($3, name), price_cents=COALESCE($4, price_cents), currency=COALESCE($5, currency), updated_at=now()
+		WHERE id=$1 AND deleted_at IS NULL
+		RETURNING `+productColumns, id, in.SKU, in.Name, in.PriceCents, in.Currency)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.Product{}, ErrUnknownProduct
+	case isUniqueViolation(err):
+		return models.Product{}, ErrDuplicateSKU
+	}
+	return p, err
+}
+
+// List returns products oldest first. The returned cursor is empty on the
+// last page and otherwise fetches the page after this one.
+func (s *CatalogService) List(ctx context.Context, f PageFilter) ([]models.Product, string, error) {
+	q, args, limit, err := f.page(`SELECT `+productColumns+` FROM products WHERE TRUE`, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var out []models.Product
+	if err := s.DB.SelectContext(ctx, &out, q, args...); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(out) > limit {
+		out = out[:limit]
+		last := out[len(out)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+	return out, next, nil
+}
+
+// Delete soft-deletes a product. Stock and reservations are left alone:
+// reserved orders can still be paid, but the product can no longer be bought
+// and its SKU becomes free for reuse.
+func (s *CatalogService) Delete(ctx context.Context, id string) error {
+	res, err := s.DB.ExecContext(ctx, `UPDATE products SET deleted_at=now(), updated_at=now() WHERE id=$1 AND deleted_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUnknownProduct
+	}
+	return nil
+}
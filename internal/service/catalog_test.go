@@ -0,0 +1,138 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/testutils"
+)
+
+var productCols = []string{"id", "sku", "name", "price_cents", "currency", "created_at", "updated_at", "deleted_at"}
+
+func TestCatalogService_Create(t *testing.T) {
+	sku, name, price, currency := "SKU-1", "Widget", int64(499), "EUR"
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "created",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO products\(sku, name, price_cents, currency\) VALUES \(\$1, \$2, \$3, \$4\)`).
+					WithArgs(sku, name, price, currency).
+					WillReturnRows(sqlmock.NewRows(productCols).AddRow("prod-1", sku, name, price, currency, time.Now(), time.Now(), nil))
+			},
+		},
+		{
+			name: "duplicate SKU",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO products`).
+					WillReturnError(&pq.Error{Code: "23505", Constraint: "products_sku_live_key"})
+			},
+			wantErr: ErrDuplicateSKU,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &CatalogService{DB: db}
+			tt.mockSetup(mock)
+
+			p, err := service.Create(context.Background(), ProductInput{SKU: &sku, Name: &name, PriceCents: &price, Currency: &currency})
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "prod-1", p.ID)
+				assert.Equal(t, price, p.PriceCents)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCatalogService_Update(t *testing.T) {
+	price := int64(1299)
+	sku := "SKU-2"
+	tests := []struct {
+		name      string
+		in        ProductInput
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "new price",
+			in:   ProductInput{PriceCents: &price},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE products SET sku=COALESCE\(\$2, sku\), name=COALESCE\(\$3, name\), price_cents=COALESCE\(\$4, price_cents\)`).
+					WithArgs("prod-1", nil, nil, price, nil).
+					WillReturnRows(sqlmock.NewRows(productCols).AddRow("prod-1", "SKU-1", "Widget", price, "USD", time.Now(), time.Now(), nil))
+			},
+		},
+		{
+			name: "SKU taken by another product",
+			in:   ProductInput{SKU: &sku},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE products`).
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			wantErr: ErrDuplicateSKU,
+		},
+		{
+			name: "deleted product",
+			in:   ProductInput{PriceCents: &price},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE products .* WHERE id=\$1 AND deleted_at IS NULL`).
+					WillReturnRows(sqlmock.NewRows(productCols))
+			},
+			wantErr: ErrUnknownProduct,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &CatalogService{DB: db}
+			tt.mockSetup(mock)
+
+			p, err := service.Update(context.Background(), "prod-1", tt.in)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, price, p.PriceCents)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCatalogService_Delete(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectExec(`UPDATE products SET deleted_at=now\(\), updated_at=now\(\) WHERE id=\$1 AND deleted_at IS NULL`).
+		WithArgs("prod-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE products SET deleted_at`).
+		WithArgs("prod-1").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	service := &CatalogService{DB: db}
+	assert.NoError(t, service.Delete(context.Background(), "prod-1"))
+	assert.ErrorIs(t, service.Delete(context.Background(), "prod-1"), ErrUnknownProduct)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
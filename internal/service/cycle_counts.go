@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrCountNotFound     = errors.New("cycle count not found")
+	ErrCountInProgress   = errors.New("warehouse already has an open cycle count")
+	ErrCountClosed       = errors.New("cycle count is no longer open")
+	ErrCountIncomplete   = errors.New("cycle count has uncounted products")
+	ErrProductNotInCount = errors.New("product is not part of the cycle count")
+	ErrDuplicateProduct  = errors.New("product is listed more than once")
+)
+
+// CycleCountsService runs physical stock counts. Opening a count snapshots the
+// on-hand quantity of each product; approving it posts counted minus snapshot
+// as a cycle_count movement, so sales and transfers made while staff were
+// counting are kept.
+type CycleCountsService struct{ DB *sqlx.DB }
+
+// CountLineReview is a count line next to the current state of its
+// inventory row.
+type CountLineReview struct {
+	models.CycleCountLine
+	OnHand   int `db:"on_hand"`
+	Reserved int `db:"reserved"`
+}
+
+// CountReview is a count with every line, for review before approval.
+type CountReview struct {
+	models.CycleCount
+	Lines []CountLineReview
+}
+
+// CountedLine is a submitted physical count for one product.
+type CountedLine struct {
+	ProductID string
+	Quantity  int
+}
+
+const countColumns = `id, warehouse_id, status, opened_by, approved_by, created_at, updated_at, approved_at`
+
+// Open starts a count of the given products in a warehouse, or of every
+// product the warehouse stocks when productIDs is empty.
+func (s *CycleCountsService) Open(ctx context.Context, actorID, warehouseID string, productIDs []string) (models.CycleCount, error) {
+	// checked up front, as the lines inserted below would fall short of the
+	// list and read as an unknown product
+	seen := make(map[string]bool, len(productIDs))
+	for _, id := range productIDs {
+		if seen[id] {
+			return models.CycleCount{}, fmt.Errorf("%w: %s", ErrDuplicateProduct, id)
+		}
+		seen[id] = true
+	}
+	var cc models.CycleCount
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, `SELECT EXISTS(SELECT 1 FROM warehouses WHERE id=$1 AND deleted_at IS NULL)`, warehouseID); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrWarehouseNotFound
+		}
+		if err := tx.GetContext(ctx, &cc, `INSERT INTO cycle_counts(warehouse_id, opened_by) VALUES ($1, NULLIF($2,'')::uuid) RETURNING `+countColumns, warehouseID, actorID); err != nil {
+			if isUniqueViolation(err) {
+				return ErrCountInProgress
+			}
+			return err
+		}
+		// one statement, so every line sees the same snapshot
+		if len(productIDs) == 0 {
+			_, err := tx.ExecContext(ctx, `
+				INSERT INTO cycle_count_lines(count_id, product_id, snapshot_qty)
+				SELECT $1, product_id, quantity FROM inventory WHERE warehouse_id=$2
+			`, cc.ID, warehouseID)
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO cycle_count_lines(count_id, product_id, snapshot_qty)
+			SELECT $1, p.id, COALESCE(i.quantity, 0) FROM products p
+			LEFT JOIN inventory i ON i.product_id = p.id AND i.warehouse_id = $2
+			WHERE p.id = ANY($3)
+		`, cc.ID, warehouseID, pq.Array(productIDs))
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); int(n) != len(productIDs) {
+			return ErrUnknownProduct
+		}
+		return nil
+	})
+	if err != nil {
+		return models.CycleCount{}, err
+	}
+	return cc, nil
+}
+
+// Review returns the count with, per line, the snapshot, the submitted count
+// and the row's current on-hand and reserved stock.
+func (s *CycleCountsService) Review(ctx context.Context, id string) (CountReview, error) {
+	var r CountReview
+	if err := s.DB.GetContext(ctx, &r.CycleCount, `SELECT `+countColumns+` FROM cycle_counts WHERE id=$1`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return CountReview{}, ErrCountNotFound
+		}
+		return CountReview{}, err
+	}
+	if err := s.DB.SelectContext(ctx, &r.Lines, `
+		SELECT l.count_id, l.product_id, l.snapshot_qty, l.counted_qty, l.counted_at,
+			COALESCE(i.quantity, 0) AS on_hand,
+			COALESCE((
+				SELECT SUM(rs.quantity) FROM reservations rs
+				WHERE rs.warehouse_id = $2 AND rs.product_id = l.product_id AND rs.released=FALSE AND rs.expires_at>now()
+			), 0) AS reserved
+		FROM cycle_count_lines l
+		LEFT JOIN inventory i ON i.warehouse_id = $2 AND i.product_id = l.product_id
+		WHERE l.count_id=$1
+		ORDER BY l.product_id
+	`, id, r.WarehouseID); err != nil {
+		return CountReview{}, err
+	}
+	return r, nil
+}
+
+// Submit records counted quantities. Lines may be submitted in several goes
+// and resubmitted until the count is approved.
+func (s *CycleCountsService) Submit(ctx context.Context, id string, lines []CountedLine) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := lockOpenCount(ctx, tx, id); err != nil {
+			return err
+		}
+		for _, l := range lines {
+			res, err := tx.ExecContext(ctx, `UPDATE cycle_count_lines SET counted_qty=$3, counted_at=now() WHERE count_id=$1 AND product_id=$2`, id, l.ProductID, l.Quantity)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return fmt.Errorf("%w: %s", ErrProductNotInCount, l.ProductID)
+			}
+		}
+		return nil
+	})
+}
+
+// Approve posts the variance of every line as one atomic set of adjustments
+// and closes the count. It fails without posting anything if a line is
+// uncounted or a shortfall would leave less on hand than is reserved.
+func (s *CycleCountsService) Approve(ctx context.Context, actorID, id string) (models.CycleCount, error) {
+	var cc models.CycleCount
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		if cc, err = lockOpenCount(ctx, tx, id); err != nil {
+			return err
+		}
+		var lines []models.CycleCountLine
+		if err := tx.SelectContext(ctx, &lines, `SELECT count_id, product_id, snapshot_qty, counted_qty, counted_at FROM cycle_count_lines WHERE count_id=$1 ORDER BY product_id`, id); err != nil {
+			return err
+		}
+		var changed []models.CycleCountLine
+		var productIDs []string
+		for _, l := range lines {
+			v := l.Variance()
+			if v == nil {
+				return fmt.Errorf("%w: %s", ErrCountIncomplete, l.ProductID)
+			}
+			if *v != 0 {
+				changed = append(changed, l)
+				productIDs = append(productIDs, l.ProductID)
+			}
+		}
+		if len(changed) > 0 {
+			whIDs := []string{cc.WarehouseID}
+			onHand, err := repo.LockInventory(ctx, tx, whIDs, productIDs)
+			if err != nil {
+				return err
+			}
+			reserved, err := repo.SumReserved(ctx, tx, whIDs, productIDs)
+			if err != nil {
+				return err
+			}
+			for _, l := range changed {
+				key := repo.InventoryKey{WarehouseID: cc.WarehouseID, ProductID: l.ProductID}
+				delta := *l.Variance()
+				if onHand[key]+delta < reserved[key] {
+					return fmt.Errorf("%w: %s has %d reserved, %d on hand after count", ErrBelowReserved, l.ProductID, reserved[key], onHand[key]+delta)
+				}
+				if _, err := repo.MoveStock(ctx, tx, repo.Movement{
+					WarehouseID: cc.WarehouseID,
+					ProductID:   l.ProductID,
+					Delta:       delta,
+					Reason:      models.MovementCycleCount,
+					CountID:     id,
+					ActorID:     actorID,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.GetContext(ctx, &cc, `UPDATE cycle_counts SET status=$2, approved_by=NULLIF($3,'')::uuid, approved_at=now(), updated_at=now() WHERE id=$1 RETURNING `+countColumns, id, models.CountApproved, actorID)
+	})
+	if err != nil {
+		return models.CycleCount{}, err
+	}
+	return cc, nil
+}
+
+// Cancel abandons an open count without touching stock.
+func (s *CycleCountsService) Cancel(ctx context.Context, id string) (models.CycleCount, error) {
+	var cc models.CycleCount
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := lockOpenCount(ctx, tx, id); err != nil {
+			return err
+		}
+		return tx.GetContext(ctx, &cc, `UPDATE cycle_counts SET status=$2, updated_at=now() WHERE id=$1 RETURNING `+countColumns, id, models.CountCancelled)
+	})
+	if err != nil {
+		return models.CycleCount{}, err
+	}
+	return cc, nil
+}
+
+func lockOpenCount(ctx context.Context, tx *sqlx.Tx, id string) (models.CycleCount, error) {
+	var cc models.CycleCount
+	if err := tx.GetContext(ctx, &cc, `SELECT `+countColumns+` FROM cycle_counts WHERE id=$1 FOR UPDATE`, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.CycleCount{}, ErrCountNotFound
+		}
+		return models.CycleCount{}, err
+	}
+	if cc.Status != models.CountOpen {
+		return models.CycleCount{}, fmt.Errorf("%w: count is %s", ErrCountClosed, cc.Status)
+	}
+	return cc, nil
+}
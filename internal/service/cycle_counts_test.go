@@ -0,0 +1,230 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/testutils"
+)
+
+var countCols = []string{"id", "warehouse_id", "status", "opened_by", "approved_by", "created_at", "updated_at", "approved_at"}
+
+func countRow(status string) *sqlmock.Rows {
+	return sqlmock.NewRows(countCols).AddRow("cc-1", "wh-1", status, "user-1", nil, time.Now(), time.Now(), nil)
+}
+
+func expectLockCount(mock sqlmock.Sqlmock, status string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM cycle_counts WHERE id=\$1 FOR UPDATE`).
+		WithArgs("cc-1").
+		WillReturnRows(countRow(status))
+}
+
+func TestCycleCountsService_Open(t *testing.T) {
+	tests := []struct {
+		name      string
+		products  []string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name:     "snapshots the chosen products",
+			products: []string{"prod-1", "prod-2"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM warehouses WHERE id=\$1 AND deleted_at IS NULL\)`).
+					WithArgs("wh-1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery(`INSERT INTO cycle_counts\(warehouse_id, opened_by\)`).
+					WithArgs("wh-1", "user-1").
+					WillReturnRows(countRow("open"))
+				mock.ExpectExec(`INSERT INTO cycle_count_lines\(count_id, product_id, snapshot_qty\) SELECT \$1, p.id, COALESCE\(i.quantity, 0\) FROM products p`).
+					WithArgs("cc-1", "wh-1", pq.Array([]string{"prod-1", "prod-2"})).
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "snapshots everything the warehouse stocks",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery(`INSERT INTO cycle_counts`).
+					WillReturnRows(countRow("open"))
+				mock.ExpectExec(`SELECT \$1, product_id, quantity FROM inventory WHERE warehouse_id=\$2`).
+					WithArgs("cc-1", "wh-1").
+					WillReturnResult(sqlmock.NewResult(0, 7))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:     "unknown product",
+			products: []string{"prod-1", "nope"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery(`INSERT INTO cycle_counts`).
+					WillReturnRows(countRow("open"))
+				mock.ExpectExec(`INSERT INTO cycle_count_lines`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrUnknownProduct,
+		},
+		{
+			name:      "product listed twice",
+			products:  []string{"prod-1", "prod-2", "prod-1"},
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrDuplicateProduct,
+		},
+		{
+			name: "count already running",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery(`INSERT INTO cycle_counts`).
+					WillReturnError(&pq.Error{Code: "23505"})
+				mock.ExpectRollback()
+			},
+			wantErr: ErrCountInProgress,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &CycleCountsService{DB: db}
+			tt.mockSetup(mock)
+
+			cc, err := service.Open(context.Background(), "user-1", "wh-1", tt.products)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, models.CountOpen, cc.Status)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCycleCountsService_Submit(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	expectLockCount(mock, "open")
+	mock.ExpectExec(`UPDATE cycle_count_lines SET counted_qty=\$3, counted_at=now\(\) WHERE count_id=\$1 AND product_id=\$2`).
+		WithArgs("cc-1", "prod-1", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE cycle_count_lines`).
+		WithArgs("cc-1", "prod-9", 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	service := &CycleCountsService{DB: db}
+	err := service.Submit(context.Background(), "cc-1", []CountedLine{{"prod-1", 4}, {"prod-9", 1}})
+
+	assert.ErrorIs(t, err, ErrProductNotInCount)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCycleCountsService_Approve(t *testing.T) {
+	lineCols := []string{"count_id", "product_id", "snapshot_qty", "counted_qty", "counted_at"}
+	stock := func(mock sqlmock.Sqlmock, onHand, held int) {
+		mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory`).
+			WithArgs(pq.Array([]string{"wh-1"}), pq.Array([]string{"prod-1"})).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).AddRow("wh-1", "prod-1", onHand))
+		mock.ExpectQuery(`FROM reservations`).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}).AddRow("wh-1", "prod-1", held))
+	}
+
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "posts variance against the snapshot",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockCount(mock, "open")
+				// prod-1 was 10 at open and 7 were counted; prod-2 matched
+				mock.ExpectQuery(`FROM cycle_count_lines WHERE count_id=\$1`).
+					WillReturnRows(sqlmock.NewRows(lineCols).
+						AddRow("cc-1", "prod-1", 10, 7, time.Now()).
+						AddRow("cc-1", "prod-2", 4, 4, time.Now()))
+				// two units were sold since the count started
+				stock(mock, 8, 1)
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3`).
+					WithArgs("wh-1", "prod-1", -3).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(5))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", -3, 5, models.MovementCycleCount, "", "", "cc-1", "user-2").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`UPDATE cycle_counts SET status=\$2, approved_by=NULLIF\(\$3,''\)::uuid, approved_at=now\(\)`).
+					WithArgs("cc-1", models.CountApproved, "user-2").
+					WillReturnRows(countRow("approved"))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "uncounted line",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockCount(mock, "open")
+				mock.ExpectQuery(`FROM cycle_count_lines`).
+					WillReturnRows(sqlmock.NewRows(lineCols).AddRow("cc-1", "prod-1", 10, nil, nil))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrCountIncomplete,
+		},
+		{
+			name: "shortfall would eat into reservations",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockCount(mock, "open")
+				mock.ExpectQuery(`FROM cycle_count_lines`).
+					WillReturnRows(sqlmock.NewRows(lineCols).AddRow("cc-1", "prod-1", 10, 2, time.Now()))
+				stock(mock, 10, 5)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrBelowReserved,
+		},
+		{
+			name: "already approved",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectLockCount(mock, "approved")
+				mock.ExpectRollback()
+			},
+			wantErr: ErrCountClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &CycleCountsService{DB: db}
+			tt.mockSetup(mock)
+
+			_, err := service.Approve(context.Background(), "user-2", "cc-1")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
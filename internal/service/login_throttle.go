@@ -0,0 +1,248 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrLoginThrottled     = errors.New("too many failed logins")
+)
+
+// ThrottledError reports a login refused because of earlier failures. It
+// matches ErrLoginThrottled with errors.Is.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottledError) Is(target error) bool { return target == ErrLoginThrottled }
+
+// Failed logins are counted per account and per client IP.
+const (
+	throttleAccount = "account"
+	throttleIP      = "ip"
+)
+
+// ThrottlePolicy decides how long logins are refused after a failure. The
+// first FreeAttempts failures cost nothing, each one after that doubles the
+// wait from BaseDelay up to MaxDelay, and LockoutAfter failures lock the key
+// for LockoutDuration. The count starts over once Window has passed without
+// a failure.
+type ThrottlePolicy struct {
+	FreeAttempts    int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+var (
+	defaultAccountThrottle = ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 30 * time.Minute,
+		Window:          time.Hour,
+	}
+	// an IP may front many users behind NAT, so it gets more room
+	defaultIPThrottle = ThrottlePolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+		Window:          2 * time.Hour,
+	}
+)
+
+// delay returns how long logins are refused after the given number of
+// consecutive failures.
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+func (p ThrottlePolicy) locks(failures int) bool {
+	return p.LockoutAfter > 0 && failures >= p.LockoutAfter
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummy spends as long as a real password check, so a login for an
+// unknown email takes as long as one with a wrong password.
+func compareDummy(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// accountKey normalises an email into the key its failures are counted
+// under, whether or not it is registered.
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// claimAttempt counts a login attempt against the account and the IP before
+// any credential is checked, and returns a *ThrottledError instead while
+// either is waiting out a delay or lockout. Every attempt is assumed to fail,
+// so a burst of parallel requests cannot all slip in under the same count;
+// releaseAttempt takes the claim back for attempts that turn out not to be
+// failures.
+func (s *AuthService) claimAttempt(ctx context.Context, tx *sqlx.Tx, email, ip string) error {
+	if err := s.claim(ctx, tx, throttleAccount, accountKey(email), ip, s.accountThrottle()); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return s.claim(ctx, tx, throttleIP, ip, ip, s.ipThrottle())
+}
+
+func (s *AuthService) claim(ctx context.Context, tx *sqlx.Tx, scope, key, ip string, p ThrottlePolicy) error {
+	// the upsert locks the row, so concurrent claims on a key take turns and
+	// each sees the count the one before it left
+	var failures int
+	err := tx.GetContext(ctx, &failures, `
+		INSERT INTO login_attempts(scope, key, failures, last_failed_at) VALUES ($1, $2, 1, now())
+		ON CONFLICT (scope, key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failed_at < now() - make_interval(secs => $3) THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failed_at = now()
+		WHERE login_attempts.locked_until IS NULL OR login_attempts.locked_until <= now()
+		RETURNING failures
+	`, scope, key, p.Window.Seconds())
+	if errors.Is(err, sql.ErrNoRows) {
+		var until time.Time
+		if err := tx.GetContext(ctx, &until, `
+			SELECT locked_until FROM login_attempts WHERE scope=$1 AND key=$2
+		`, scope, key); err != nil {
+			return err
+		}
+		return &ThrottledError{RetryAfter: max(time.Until(until), time.Second)}
+	}
+	if err != nil {
+		return err
+	}
+	d := p.delay(failures)
+	if d == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE login_attempts SET locked_until=$3 WHERE scope=$1 AND key=$2
+	`, scope, key, time.Now().Add(d)); err != nil {
+		return err
+	}
+	if !p.locks(failures) {
+		return nil
+	}
+	s.Log.Warn("login locked", zap.String("scope", scope), zap.String("key", key), zap.Int("failures", failures))
+	return repo.Audit(ctx, tx, repo.AuditEvent{
+		Action:  repo.AuditLoginLocked,
+		Target:  scope + ":" + key,
+		IP:      ip,
+		Details: map[string]interface{}{"failures": failures, "locked_seconds": int(d.Seconds())},
+	})
+}
+
+// releaseAttempt takes back an attempt claimed by claimAttempt that did not
+// fail, along with the wait it started.
+func (s *AuthService) releaseAttempt(ctx context.Context, q sqlx.ExecerContext, email, ip string) error {
+	if err := release(ctx, q, throttleAccount, accountKey(email)); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return release(ctx, q, throttleIP, ip)
+}
+
+func release(ctx context.Context, q sqlx.ExecerContext, scope, key string) error {
+	_, err := q.ExecContext(ctx, `
+		UPDATE login_attempts SET failures=GREATEST(failures-1, 0), locked_until=NULL WHERE scope=$1 AND key=$2
+	`, scope, key)
+	return err
+}
+
+// loginSucceeded clears the account's failures. The IP only gets its attempt
+// back, so a valid login of its own does not reset a guessing run against
+// others.
+func (s *AuthService) loginSucceeded(ctx context.Context, q sqlx.ExecerContext, email, ip string) error {
+	if _, err := q.ExecContext(ctx, `DELETE FROM login_attempts WHERE scope=$1 AND key=$2`, throttleAccount, accountKey(email)); err != nil {
+		return err
+	}
+	if ip == "" {
+		return nil
+	}
+	return release(ctx, q, throttleIP, ip)
+}
+
+// UnlockAccount lifts a lockout on the user's account and clears its failed
+// logins. Lockouts on the IPs involved are left to expire.
+func (s *AuthService) UnlockAccount(ctx context.Context, actorID, userID string) error {
+	var email string
+	err := s.DB.GetContext(ctx, &email, `SELECT email FROM users WHERE id=$1`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM login_attempts WHERE scope=$1 AND key=$2`, throttleAccount, accountKey(email)); err != nil {
+			return err
+		}
+		return repo.Audit(ctx, tx, repo.AuditEvent{
+			ActorID: actorID,
+			Action:  repo.AuditLoginUnlocked,
+			Target:  throttleAccount + ":" + accountKey(email),
+			Details: map[string]interface{}{"user_id": userID},
+		})
+	})
+}
+
+func (s *AuthService) accountThrottle() ThrottlePolicy {
+	if s.AccountThrottle != (ThrottlePolicy{}) {
+		return s.AccountThrottle
+	}
+	return defaultAccountThrottle
+}
+
+func (s *AuthService) ipThrottle() ThrottlePolicy {
+	if s.IPThrottle != (ThrottlePolicy{}) {
+		return s.IPThrottle
+	}
+	return defaultIPThrottle
+}
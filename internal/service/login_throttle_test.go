@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/testutils"
+)
+
+func TestThrottlePolicy_Delay(t *testing.T) {
+	p := ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        10 * time.Second,
+		LockoutAfter:    10,
+		LockoutDuration: 30 * time.Minute,
+	}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{7, 8 * time.Second},
+		{8, 10 * time.Second},
+		{9, 10 * time.Second},
+		{10, 30 * time.Minute},
+		{25, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, p.delay(tt.failures), "failures=%d", tt.failures)
+	}
+}
+
+// expectClaim expects claimAttempt to count one more attempt against the
+// account and the IP, leaving neither locked.
+func expectClaim(mock sqlmock.Sqlmock, email, ip string, failures int) {
+	mock.ExpectQuery(`INSERT INTO login_attempts`).
+		WithArgs("account", email, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(failures))
+	mock.ExpectQuery(`INSERT INTO login_attempts`).
+		WithArgs("ip", ip, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(failures))
+}
+
+// expectRelease expects releaseAttempt to give both attempts back.
+func expectRelease(mock sqlmock.Sqlmock, email, ip string) {
+	mock.ExpectExec(`UPDATE login_attempts SET failures=GREATEST\(failures-1, 0\), locked_until=NULL`).
+		WithArgs("account", email).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE login_attempts SET failures=GREATEST\(failures-1, 0\), locked_until=NULL`).
+		WithArgs("ip", ip).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestAuthService_Login_Throttle(t *testing.T) {
+	t.Run("locked account is refused before the password check", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		until := time.Now().Add(10 * time.Minute)
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}))
+		mock.ExpectQuery(`SELECT locked_until FROM login_attempts WHERE scope=\$1 AND key=\$2`).
+			WithArgs("account", "a@b.com").
+			WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(until))
+		mock.ExpectRollback()
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t)}
+		_, err := service.Login(context.Background(), "A@b.com ", "password123", "10.0.0.1")
+
+		var te *ThrottledError
+		assert.True(t, errors.As(err, &te))
+		assert.InDelta(t, (10 * time.Minute).Seconds(), te.RetryAfter.Seconds(), 5)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("locked ip takes back the account's count", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("ip", "10.0.0.1", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}))
+		mock.ExpectQuery(`SELECT locked_until FROM login_attempts WHERE scope=\$1 AND key=\$2`).
+			WithArgs("ip", "10.0.0.1").
+			WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(time.Now().Add(time.Hour)))
+		mock.ExpectRollback()
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t)}
+		_, err := service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+
+		assert.ErrorIs(t, err, ErrLoginThrottled)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	// the wait is taken when the attempt is claimed, so parallel guesses
+	// behind it are refused before their passwords are checked
+	t.Run("claim past the free attempts starts the wait", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(4))
+		mock.ExpectExec(`UPDATE login_attempts SET locked_until=\$3 WHERE scope=\$1 AND key=\$2`).
+			WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("ip", "10.0.0.1", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(4))
+		mock.ExpectCommit()
+		mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
+			WillReturnError(sql.ErrNoRows)
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t)}
+		_, err := service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestThrottledError(t *testing.T) {
+	var err error = &ThrottledError{RetryAfter: 90 * time.Second}
+	assert.ErrorIs(t, err, ErrLoginThrottled)
+	var te *ThrottledError
+	assert.True(t, errors.As(err, &te))
+	assert.Equal(t, "too many failed logins, retry in 1m30s", err.Error())
+}
+
+func TestAuthService_UnlockAccount(t *testing.T) {
+	t.Run("clears failures and audits", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT email FROM users WHERE id=\$1`).
+			WithArgs("user-1").
+			WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("Bob@Example.com"))
+		mock.ExpectBegin()
+		mock.ExpectExec(`DELETE FROM login_attempts WHERE scope=\$1 AND key=\$2`).
+			WithArgs("account", "bob@example.com").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO audit_log`).
+			WithArgs("admin-1", "login.unlocked", "account:bob@example.com", "", `{"user_id":"user-1"}`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t)}
+		assert.NoError(t, service.UnlockAccount(context.Background(), "admin-1", "user-1"))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT email FROM users WHERE id=\$1`).
+			WillReturnError(sql.ErrNoRows)
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t)}
+		assert.ErrorIs(t, service.UnlockAccount(context.Background(), "admin-1", "user-1"), ErrUserNotFound)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
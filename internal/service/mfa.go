@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrInvalidMFAChallenge = errors.New("mfa challenge is invalid, expired or already used")
+	ErrInvalidMFACode      = errors.New("invalid authentication code")
+	ErrMFAAlreadyEnabled   = errors.New("two-factor authentication is already enabled")
+	ErrMFANotEnabled       = errors.New("two-factor authentication is not enabled")
+	ErrMFARequired         = errors.New("two-factor authentication is required for this account")
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+	defaultMFAIssuer  = "ecommerce-shop"
+)
+
+// MFAEnrolment is what the user needs to add the account to an authenticator
+// app: the secret to type in, or the URI to show as a QR code.
+type MFAEnrolment struct {
+	Secret string
+	URI    string
+}
+
+// BeginMFAEnrolment generates a TOTP secret for the user. It takes effect once
+// ConfirmMFAEnrolment has seen a code from it; starting over replaces a
+// secret that was never confirmed.
+func (s *AuthService) BeginMFAEnrolment(ctx context.Context, userID string) (MFAEnrolment, error) {
+	var email string
+	err := s.DB.GetContext(ctx, &email, `SELECT email FROM users WHERE id=$1`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return MFAEnrolment{}, ErrUserNotFound
+	}
+	if err != nil {
+		return MFAEnrolment{}, err
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return MFAEnrolment{}, err
+	}
+	res, err := s.DB.ExecContext(ctx, `
+		INSERT INTO user_mfa(user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, last_used_step=0, created_at=now()
+		WHERE user_mfa.confirmed_at IS NULL
+	`, userID, secret)
+	if err != nil {
+		return MFAEnrolment{}, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return MFAEnrolment{}, ErrMFAAlreadyEnabled
+	}
+	return MFAEnrolment{Secret: secret, URI: auth.TOTPURI(s.mfaIssuer(), email, secret)}, nil
+}
+
+// ConfirmMFAEnrolment turns two-factor authentication on with the first code
+// from the authenticator and returns the recovery codes, which are shown
+// once, along with a new session that has passed the second factor.
+func (s *AuthService) ConfirmMFAEnrolment(ctx context.Context, userID, code, ip string) (Session, []string, error) {
+	var out Session
+	var codes []string
+	var failed bool
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := lockMFA(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if m.ConfirmedAt != nil {
+			return ErrMFAAlreadyEnabled
+		}
+		if err := s.claimAttempt(ctx, tx, m.Email, ip); err != nil {
+			return err
+		}
+		ok, err := useTOTP(ctx, tx, m, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed = true
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE user_mfa SET confirmed_at=now() WHERE user_id=$1`, userID); err != nil {
+			return err
+		}
+		if codes, err = replaceRecoveryCodes(ctx, tx, userID); err != nil {
+			return err
+		}
+		if err := s.releaseAttempt(ctx, tx, m.Email, ip); err != nil {
+			return err
+		}
+		out, err = s.issueForUser(ctx, tx, userID, []string{auth.AMRPassword, auth.AMROTP, auth.AMRMFA})
+		return err
+	})
+	if err != nil {
+		return Session{}, nil, err
+	}
+	if failed {
+		return Session{}, nil, ErrInvalidMFACode
+	}
+	return out, codes, nil
+}
+
+// CompleteMFALogin finishes a login that Login answered with an MFA challenge.
+// code is either a current authenticator code or an unused recovery code.
+// Wrong codes count as failed logins, and the challenge stays usable until it
+// expires or succeeds.
+func (s *AuthService) CompleteMFALogin(ctx context.Context, challenge, code, ip string) (Session, error) {
+	var out Session
+	var failed bool
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		t, err := lookupUserToken(ctx, tx, models.TokenMFAChallenge, challenge)
+		if errors.Is(err, ErrInvalidEmailToken) {
+			return ErrInvalidMFAChallenge
+		}
+		if err != nil {
+			return err
+		}
+		m, err := lockMFA(ctx, tx, t.UserID)
+		if errors.Is(err, ErrMFANotEnabled) {
+			// turned off since the password was checked
+			return ErrInvalidMFAChallenge
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.claimAttempt(ctx, tx, m.Email, ip); err != nil {
+			return err
+		}
+		amr, err := checkSecondFactor(ctx, tx, m, code, true)
+		if err != nil {
+			return err
+		}
+		if amr == nil {
+			failed = true
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE user_tokens SET used_at=now() WHERE id=$1`, t.ID); err != nil {
+			return err
+		}
+		if err := s.loginSucceeded(ctx, tx, m.Email, ip); err != nil {
+			return err
+		}
+		out, err = s.issueForUser(ctx, tx, t.UserID, amr)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if failed {
+		return Session{}, ErrInvalidMFACode
+	}
+	return out, nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking
+// an authenticator code.
+func (s *AuthService) RegenerateRecoveryCodes(ctx context.Context, userID, code, ip string) ([]string, error) {
+	var codes []string
+	err := s.withSecondFactor(ctx, userID, code, ip, false, func(tx *sqlx.Tx) error {
+		var err error
+		codes, err = replaceRecoveryCodes(ctx, tx, userID)
+		return err
+	})
+	return codes, err
+}
+
+// DisableMFA turns two-factor authentication off after checking an
+// authenticator or recovery code. Users whose role requires it cannot.
+func (s *AuthService) DisableMFA(ctx context.Context, userID, code, ip string) error {
+	var u models.User
+	if err := s.DB.GetContext(ctx, &u, `SELECT id, role FROM users WHERE id=$1`, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		return err
+	}
+	shops, err := repo.ShopMemberships(ctx, s.DB, userID)
+	if err != nil {
+		return err
+	}
+	if s.mfaRequired(u.Role, shops) {
+		return ErrMFARequired
+	}
+	return s.withSecondFactor(ctx, userID, code, ip, true, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id=$1`, userID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `DELETE FROM user_mfa WHERE user_id=$1`, userID)
+		return err
+	})
+}
+
+// withSecondFactor runs fn once code has been checked against the user's
+// confirmed enrolment, counting a wrong code as a failed login.
+func (s *AuthService) withSecondFactor(ctx context.Context, userID, code, ip string, allowRecovery bool, fn func(tx *sqlx.Tx) error) error {
+	var failed bool
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		m, err := lockMFA(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+		if m.ConfirmedAt == nil {
+			return ErrMFANotEnabled
+		}
+		if err := s.claimAttempt(ctx, tx, m.Email, ip); err != nil {
+			return err
+		}
+		amr, err := checkSecondFactor(ctx, tx, m, code, allowRecovery)
+		if err != nil {
+			return err
+		}
+		if amr == nil {
+			failed = true
+			return nil
+		}
+		if err := s.releaseAttempt(ctx, tx, m.Email, ip); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// mfaChallenge stores a short-lived token standing in for the checked
+// password until the second factor is given.
+func (s *AuthService) mfaChallenge(ctx context.Context, userID string) (Session, error) {
+	var tok string
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		tok, err = newUserToken(ctx, tx, userID, models.TokenMFAChallenge, mfaChallengeTTL)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	return Session{UserID: userID, MFAToken: tok}, nil
+}
+
+// issueForUser starts a session for the user with their current role and
+// memberships.
+func (s *AuthService) issueForUser(ctx context.Context, tx *sqlx.Tx, userID string, amr []string) (Session, error) {
+	var u models.User
+	if err := tx.GetContext(ctx, &u, `SELECT id, role FROM users WHERE id=$1`, userID); err != nil {
+		return Session{}, err
+	}
+	shops, err := repo.ShopMemberships(ctx, tx, userID)
+	if err != nil {
+		return Session{}, err
+	}
+	return s.issue(ctx, tx, u, shops, nil, amr)
+}
+
+// mfaRequired applies MFARequiredRoles to a user's platform role and shop
+// memberships.
+func (s *AuthService) mfaRequired(role models.UserRole, shops map[string]models.ShopRole) bool {
+	for _, r := range s.MFARequiredRoles {
+		if r == string(role) {
+			return true
+		}
+		for _, sr := range shops {
+			if r == string(sr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *AuthService) mfaIssuer() string {
+	if s.MFAIssuer != "" {
+		return s.MFAIssuer
+	}
+	return defaultMFAIssuer
+}
+
+// mfaEnabled reports whether the user has a confirmed TOTP enrolment.
+func mfaEnabled(ctx context.Context, q sqlx.QueryerContext, userID string) (bool, error) {
+	var enabled bool
+	err := sqlx.GetContext(ctx, q, &enabled, `
+		SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id=$1 AND confirmed_at IS NOT NULL)
+	`, userID)
+	return enabled, err
+}
+
+// lockMFA loads the user's enrolment, confirmed or not, for update.
+func lockMFA(ctx context.Context, tx *sqlx.Tx, userID string) (models.UserMFA, error) {
+	var m models.UserMFA
+	err := tx.GetContext(ctx, &m, `
+		SELECT m.user_id, u.email, m.secret, m.confirmed_at, m.last_used_step, m.created_at
+		FROM user_mfa m JOIN users u ON u.id = m.user_id
+		WHERE m.user_id=$1 FOR UPDATE OF m
+	`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.UserMFA{}, ErrMFANotEnabled
+	}
+	return m, err
+}
+
+// checkSecondFactor accepts an authenticator code or, if allowRecovery is
+// set, an unused recovery code, and returns the amr values of a session
+// authenticated with it. It returns nil for a wrong code.
+func checkSecondFactor(ctx context.Context, tx *sqlx.Tx, m models.UserMFA, code string, allowRecovery bool) ([]string, error) {
+	ok, err := useTOTP(ctx, tx, m, code)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return []string{auth.AMRPassword, auth.AMROTP, auth.AMRMFA}, nil
+	}
+	if !allowRecovery {
+		return nil, nil
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE mfa_recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL
+	`, m.UserID, auth.HashOpaqueToken(auth.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	return []string{auth.AMRPassword, auth.AMRMFA}, nil
+}
+
+// useTOTP checks an authenticator code and records its time step, so neither
+// it nor an earlier code is accepted again.
+func useTOTP(ctx context.Context, tx *sqlx.Tx, m models.UserMFA, code string) (bool, error) {
+	step, ok := auth.VerifyTOTP(m.Secret, code, time.Now())
+	if !ok || step <= m.LastUsedStep {
+		return false, nil
+	}
+	_, err := tx.ExecContext(ctx, `UPDATE user_mfa SET last_used_step=$2 WHERE user_id=$1`, m.UserID, step)
+	return err == nil, err
+}
+
+// replaceRecoveryCodes stores a fresh set of recovery codes, hashed, in place
+// of the user's old ones and returns them in clear.
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID string) ([]string, error) {
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = auth.HashOpaqueToken(auth.NormalizeRecoveryCode(c))
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO mfa_recovery_codes(user_id, code_hash) SELECT $1, unnest($2::text[])
+	`, userID, pq.Array(hashes))
+	return codes, err
+}
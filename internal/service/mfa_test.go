@@ -0,0 +1,327 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+	"ecommerce-shop/testutils"
+)
+
+var mfaCols = []string{"user_id", "email", "secret", "confirmed_at", "last_used_step", "created_at"}
+
+func TestAuthService_CompleteMFALogin(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	secret, err := auth.NewTOTPSecret()
+	require.NoError(t, err)
+	now := time.Now()
+	code, err := auth.TOTPCode(secret, now)
+	require.NoError(t, err)
+	step := now.Unix() / 30
+
+	expectChallenge := func(mock sqlmock.Sqlmock, lastUsedStep int64) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FROM user_tokens WHERE token_hash=\$1 AND purpose=\$2`).
+			WithArgs(auth.HashOpaqueToken("challenge-1"), "mfa_challenge").
+			WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", now.Add(time.Minute), nil))
+		mock.ExpectQuery(`FROM user_mfa m JOIN users u`).
+			WithArgs("user-1").
+			WillReturnRows(sqlmock.NewRows(mfaCols).AddRow("user-1", "a@b.com", secret, now, lastUsedStep, now))
+		expectClaim(mock, "a@b.com", "10.0.0.1", 1)
+	}
+	expectSession := func(mock sqlmock.Sqlmock, amr string) {
+		mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE id=\$1`).
+			WithArgs("tok-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`DELETE FROM login_attempts WHERE scope=\$1 AND key=\$2`).
+			WithArgs("account", "a@b.com").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`UPDATE login_attempts SET failures=GREATEST\(failures-1, 0\), locked_until=NULL`).
+			WithArgs("ip", "10.0.0.1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`SELECT id, role FROM users WHERE id=\$1`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow("user-1", "customer"))
+		mock.ExpectQuery(`FROM shop_members m`).
+			WillReturnRows(sqlmock.NewRows([]string{"shop_id", "role"}).AddRow("shop-1", "staff"))
+		mock.ExpectExec(`INSERT INTO refresh_tokens`).
+			WithArgs("user-1", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), amr).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	expectFailure := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`UPDATE mfa_recovery_codes SET used_at=now\(\)`).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+	}
+
+	tests := []struct {
+		name      string
+		code      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+		wantAMR   []string
+	}{
+		{
+			name: "authenticator code",
+			code: code,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock, 0)
+				mock.ExpectExec(`UPDATE user_mfa SET last_used_step=\$2 WHERE user_id=\$1`).
+					WithArgs("user-1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectSession(mock, `{"pwd","otp","mfa"}`)
+			},
+			wantAMR: []string{"pwd", "otp", "mfa"},
+		},
+		{
+			name: "recovery code",
+			code: "K3M9X-7QP2D",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock, 0)
+				mock.ExpectExec(`UPDATE mfa_recovery_codes SET used_at=now\(\) WHERE user_id=\$1 AND code_hash=\$2 AND used_at IS NULL`).
+					WithArgs("user-1", auth.HashOpaqueToken("k3m9x7qp2d")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				expectSession(mock, `{"pwd","mfa"}`)
+			},
+			wantAMR: []string{"pwd", "mfa"},
+		},
+		{
+			name: "wrong code counts as a failed login",
+			code: "000000",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock, 0)
+				expectFailure(mock)
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name: "replayed code",
+			code: code,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock, step+1)
+				expectFailure(mock)
+			},
+			wantErr: ErrInvalidMFACode,
+		},
+		{
+			name: "expired challenge",
+			code: code,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM user_tokens WHERE token_hash=\$1 AND purpose=\$2`).
+					WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", now.Add(-time.Minute), nil))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidMFAChallenge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+			tt.mockSetup(mock)
+
+			service := &AuthService{DB: db, Log: testutils.MockLogger(t), Keys: keys, Mailer: &testutils.MockMailer{}}
+			sess, err := service.CompleteMFALogin(context.Background(), "challenge-1", tt.code, "10.0.0.1")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				p, err := auth.ParseToken(sess.AccessToken, keys)
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantAMR, p.AMR)
+				assert.Equal(t, models.ShopStaff, p.Shops["shop-1"])
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuthService_Login_MFA(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	expectPassword := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		expectClaim(mock, "a@b.com", "10.0.0.1", 1)
+		mock.ExpectCommit()
+		mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "role", "email_verified_at"}).AddRow("user-1", string(hash), "customer", time.Now()))
+	}
+
+	t.Run("enrolled user gets a challenge", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		expectPassword(mock)
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		expectRelease(mock, "a@b.com", "10.0.0.1")
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE user_id=\$1 AND purpose=\$2`).
+			WithArgs("user-1", "mfa_challenge").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO user_tokens`).
+			WithArgs("user-1", "mfa_challenge", sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Keys: keys, Mailer: &testutils.MockMailer{}}
+		sess, err := service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+
+		require.NoError(t, err)
+		assert.NotEmpty(t, sess.MFAToken)
+		assert.Empty(t, sess.AccessToken)
+		assert.Empty(t, sess.RefreshToken)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("staff without MFA get no shop privileges", func(t *testing.T) {
+		db, mock := testutils.MockDB(t)
+		defer db.Close()
+
+		expectPassword(mock)
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery(`FROM shop_members m`).
+			WillReturnRows(sqlmock.NewRows([]string{"shop_id", "role"}).AddRow("shop-1", "staff"))
+		mock.ExpectExec(`INSERT INTO refresh_tokens`).
+			WithArgs("user-1", nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), `{"pwd"}`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`DELETE FROM login_attempts`).
+			WithArgs("account", "a@b.com").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`UPDATE login_attempts SET failures=GREATEST\(failures-1, 0\), locked_until=NULL`).
+			WithArgs("ip", "10.0.0.1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		service := &AuthService{DB: db, Log: testutils.MockLogger(t), Keys: keys, Mailer: &testutils.MockMailer{}, MFARequiredRoles: []string{"staff", "admin"}}
+		sess, err := service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+
+		require.NoError(t, err)
+		assert.True(t, sess.MFAEnrolmentRequired)
+		p, err := auth.ParseToken(sess.AccessToken, keys)
+		require.NoError(t, err)
+		assert.Empty(t, p.Shops)
+		assert.False(t, p.HasShopRole("shop-1", models.ShopStaff))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// A correct password must not clear the failures run up against the second
+// factor, or logging in again between guesses would avoid the lockout.
+func TestAuthService_Login_MFAGuessesReachLockout(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.MinCost)
+	require.NoError(t, err)
+	secret, err := auth.NewTOTPSecret()
+	require.NoError(t, err)
+	now := time.Now()
+
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+	service := &AuthService{
+		DB:              db,
+		Log:             testutils.MockLogger(t),
+		Keys:            keys,
+		Mailer:          &testutils.MockMailer{},
+		AccountThrottle: ThrottlePolicy{FreeAttempts: 5, LockoutAfter: 3, LockoutDuration: 30 * time.Minute, Window: time.Hour},
+		IPThrottle:      ThrottlePolicy{FreeAttempts: 100, Window: time.Hour},
+	}
+	// claim expects an attempt counted against the account and the IP, with
+	// the account locked once it reaches the third
+	claim := func(failures int) {
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(failures))
+		if failures == 3 {
+			mock.ExpectExec(`UPDATE login_attempts SET locked_until=\$3 WHERE scope=\$1 AND key=\$2`).
+				WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(`INSERT INTO audit_log`).
+				WithArgs("", repo.AuditLoginLocked, "account:a@b.com", "10.0.0.1", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+		mock.ExpectQuery(`INSERT INTO login_attempts`).
+			WithArgs("ip", "10.0.0.1", sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(failures))
+	}
+
+	for failures := 1; failures <= 3; failures++ {
+		// the password is right: its attempt is given back, but the
+		// failures before it stay
+		mock.ExpectBegin()
+		claim(failures)
+		mock.ExpectCommit()
+		mock.ExpectQuery(`SELECT id, password_hash, role, email_verified_at FROM users WHERE email=\$1`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "password_hash", "role", "email_verified_at"}).AddRow("user-1", string(hash), "customer", now))
+		mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+		expectRelease(mock, "a@b.com", "10.0.0.1")
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE user_id=\$1 AND purpose=\$2`).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO user_tokens`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		sess, err := service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+		require.NoError(t, err)
+		require.NotEmpty(t, sess.MFAToken)
+
+		// the code is wrong, and its attempt is kept
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FROM user_tokens WHERE token_hash=\$1 AND purpose=\$2`).
+			WithArgs(auth.HashOpaqueToken(sess.MFAToken), "mfa_challenge").
+			WillReturnRows(sqlmock.NewRows(userTokenCols).AddRow("tok-1", "user-1", now.Add(time.Minute), nil))
+		mock.ExpectQuery(`FROM user_mfa m JOIN users u`).
+			WillReturnRows(sqlmock.NewRows(mfaCols).AddRow("user-1", "a@b.com", secret, now, 0, now))
+		claim(failures)
+		mock.ExpectExec(`UPDATE mfa_recovery_codes SET used_at=now\(\)`).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+
+		_, err = service.CompleteMFALogin(context.Background(), sess.MFAToken, "000000", "10.0.0.1")
+		require.ErrorIs(t, err, ErrInvalidMFACode)
+	}
+
+	// locked out, even with the right password
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO login_attempts`).
+		WithArgs("account", "a@b.com", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"failures"}))
+	mock.ExpectQuery(`SELECT locked_until FROM login_attempts`).
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}).AddRow(now.Add(30 * time.Minute)))
+	mock.ExpectRollback()
+	_, err = service.Login(context.Background(), "a@b.com", "password123", "10.0.0.1")
+
+	assert.ErrorIs(t, err, ErrLoginThrottled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAuthService_DisableMFA_RequiredByRole(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT id, role FROM users WHERE id=\$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow("user-1", "platform_admin"))
+	mock.ExpectQuery(`FROM shop_members m`).
+		WillReturnRows(sqlmock.NewRows([]string{"shop_id", "role"}))
+
+	service := &AuthService{DB: db, Log: testutils.MockLogger(t), MFARequiredRoles: []string{"platform_admin"}}
+	err := service.DisableMFA(context.Background(), "user-1", "123456", "10.0.0.1")
+
+	assert.ErrorIs(t, err, ErrMFARequired)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
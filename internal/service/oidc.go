@@ -0,0 +1,343 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/oidc"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrUnknownIdentityProvider = errors.New("unknown identity provider")
+	ErrInvalidOIDCState        = errors.New("login is invalid, expired or already finished")
+	ErrIdentityNotLinked       = errors.New("no account matches this identity")
+)
+
+// oidcLoginTTL is how long the user has to sign in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// IdentityProvider is an OpenID Connect provider users may sign in with.
+type IdentityProvider struct {
+	*oidc.Provider
+	// GroupRoles maps the provider's groups to the roles they grant. The
+	// provider is authoritative for every role it can grant: at each login
+	// the user gets the roles of their groups and loses the mapped roles
+	// their groups no longer grant. Other roles are left alone.
+	GroupRoles map[string][]RoleGrant
+	// AllowSignup creates an account for a verified email that has none.
+	// Otherwise only existing users can sign in through the provider.
+	AllowSignup bool
+	// TrustMFA accepts the provider's word, its amr listing "mfa", that the
+	// user passed a second factor there. Otherwise users who set up their own
+	// second factor are asked for it and the provider's "mfa" is dropped.
+	TrustMFA bool
+}
+
+// RoleGrant is a role an identity provider group confers: the platform role
+// Platform, or ShopRole in the shop ShopID.
+type RoleGrant struct {
+	Platform models.UserRole
+	ShopID   string
+	ShopRole models.ShopRole
+}
+
+// ParseGroupRoles reads "group=grant" entries, where grant is
+// "platform_admin", "staff@<shop id>" or "admin@<shop id>". A group may be
+// listed more than once.
+func ParseGroupRoles(entries []string) (map[string][]RoleGrant, error) {
+	out := make(map[string][]RoleGrant, len(entries))
+	for _, e := range entries {
+		group, grant, ok := strings.Cut(e, "=")
+		group, grant = strings.TrimSpace(group), strings.TrimSpace(grant)
+		if !ok || group == "" {
+			return nil, fmt.Errorf("group role %q: want group=role", e)
+		}
+		g, err := parseRoleGrant(grant)
+		if err != nil {
+			return nil, fmt.Errorf("group role %q: %w", e, err)
+		}
+		out[group] = append(out[group], g)
+	}
+	return out, nil
+}
+
+func parseRoleGrant(s string) (RoleGrant, error) {
+	if s == string(models.RolePlatformAdmin) {
+		return RoleGrant{Platform: models.RolePlatformAdmin}, nil
+	}
+	role, shopID, ok := strings.Cut(s, "@")
+	r := models.ShopRole(role)
+	if !ok || !r.Satisfies(models.ShopStaff) {
+		return RoleGrant{}, fmt.Errorf("role must be platform_admin, staff@<shop id> or admin@<shop id>")
+	}
+	if !helpers.IsUUID(shopID) {
+		return RoleGrant{}, fmt.Errorf("shop id %q is not a uuid", shopID)
+	}
+	return RoleGrant{ShopID: strings.ToLower(shopID), ShopRole: r}, nil
+}
+
+// BeginOIDCLogin starts a login through the named provider and returns the
+// provider URL to send the browser to, along with the state the provider
+// will hand back to CompleteOIDCLogin.
+func (s *AuthService) BeginOIDCLogin(ctx context.Context, provider string) (authURL, state string, err error) {
+	idp, ok := s.IdentityProviders[provider]
+	if !ok {
+		return "", "", ErrUnknownIdentityProvider
+	}
+	if state, err = auth.NewOpaqueToken(); err != nil {
+		return "", "", err
+	}
+	nonce, err := auth.NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		return "", "", err
+	}
+	if authURL, err = idp.AuthCodeURL(ctx, state, nonce, oidc.Challenge(verifier)); err != nil {
+		return "", "", err
+	}
+	if _, err := s.DB.ExecContext(ctx, `
+		INSERT INTO oidc_logins(state_hash, provider, nonce, code_verifier, expires_at) VALUES ($1, $2, $3, $4, $5)
+	`, auth.HashOpaqueToken(state), provider, nonce, verifier, time.Now().Add(oidcLoginTTL)); err != nil {
+		return "", "", err
+	}
+	return authURL, state, nil
+}
+
+// CompleteOIDCLogin redeems the code the provider sent back with state and
+// starts a session for the user linked to the identity, linking it first by
+// verified email when it is new. Users with their own second factor get an
+// MFA challenge instead, unless the provider is trusted to check one and
+// reports it did.
+func (s *AuthService) CompleteOIDCLogin(ctx context.Context, provider, code, state, ip string) (Session, error) {
+	idp, ok := s.IdentityProviders[provider]
+	if !ok {
+		return Session{}, ErrUnknownIdentityProvider
+	}
+	var login struct {
+		Nonce        string    `db:"nonce"`
+		CodeVerifier string    `db:"code_verifier"`
+		ExpiresAt    time.Time `db:"expires_at"`
+	}
+	err := s.DB.GetContext(ctx, &login, `
+		DELETE FROM oidc_logins WHERE state_hash=$1 AND provider=$2 RETURNING nonce, code_verifier, expires_at
+	`, auth.HashOpaqueToken(state), provider)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrInvalidOIDCState
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if !login.ExpiresAt.After(time.Now()) {
+		return Session{}, ErrInvalidOIDCState
+	}
+	id, err := idp.Exchange(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		return Session{}, err
+	}
+	amr := federatedAMR(id.AMR, idp.TrustMFA)
+	var out Session
+	var challenge string
+	err = repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		userID, err := linkIdentity(ctx, tx, idp, id, ip)
+		if err != nil {
+			return err
+		}
+		if len(idp.GroupRoles) > 0 {
+			if err := syncGroupRoles(ctx, tx, idp, userID, id.Groups, ip); err != nil {
+				return err
+			}
+		}
+		if !contains(amr, auth.AMRMFA) {
+			enrolled, err := mfaEnabled(ctx, tx, userID)
+			if err != nil {
+				return err
+			}
+			if enrolled {
+				challenge = userID
+				return nil
+			}
+		}
+		out, err = s.issueForUser(ctx, tx, userID, amr)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if challenge != "" {
+		return s.mfaChallenge(ctx, challenge)
+	}
+	return out, nil
+}
+
+// federatedAMR is the amr of a session started through a provider: "fed"
+// followed by whatever the provider reported, less "mfa" unless the provider
+// is trusted with it.
+func federatedAMR(provided []string, trustMFA bool) []string {
+	out := []string{auth.AMRFederated}
+	for _, m := range provided {
+		if m == auth.AMRMFA && !trustMFA {
+			continue
+		}
+		if !contains(out, m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// linkIdentity returns the user the identity belongs to. An identity seen
+// for the first time is linked to the user with its email, which the
+// provider must have verified, or to a new user when the provider allows
+// signups.
+func linkIdentity(ctx context.Context, tx *sqlx.Tx, idp *IdentityProvider, id oidc.Identity, ip string) (string, error) {
+	var userID string
+	err := tx.GetContext(ctx, &userID, `
+		UPDATE user_identities SET email=$3, last_login_at=now() WHERE provider=$1 AND subject=$2 RETURNING user_id
+	`, idp.Name(), id.Subject, id.Email)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	if id.Email == "" || !id.EmailVerified {
+		return "", ErrIdentityNotLinked
+	}
+	created := false
+	err = tx.GetContext(ctx, &userID, `SELECT id FROM users WHERE email=$1`, id.Email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && idp.AllowSignup:
+		// an empty hash matches no password, so only the provider or a
+		// password reset signs this user in
+		if err := tx.GetContext(ctx, &userID, `
+			INSERT INTO users(email, password_hash, email_verified_at) VALUES ($1, '', now()) RETURNING id
+		`, id.Email); err != nil {
+			return "", err
+		}
+		created = true
+	case errors.Is(err, sql.ErrNoRows):
+		return "", ErrIdentityNotLinked
+	case err != nil:
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_identities(provider, subject, user_id, email) VALUES ($1, $2, $3, $4)
+	`, idp.Name(), id.Subject, userID, id.Email); err != nil {
+		return "", err
+	}
+	return userID, repo.Audit(ctx, tx, repo.AuditEvent{
+		ActorID: userID,
+		Action:  repo.AuditIdentityLinked,
+		Target:  "user:" + userID,
+		IP:      ip,
+		Details: map[string]interface{}{"provider": idp.Name(), "subject": id.Subject, "email": id.Email, "created": created},
+	})
+}
+
+// syncGroupRoles gives the user the roles the provider's groups map to and
+// takes away mapped roles their groups no longer grant. Changes are audited;
+// memberships of deleted shops are skipped.
+func syncGroupRoles(ctx context.Context, tx *sqlx.Tx, idp *IdentityProvider, userID string, groups []string, ip string) error {
+	member := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		member[g] = true
+	}
+	managePlatform, platform := false, models.RoleCustomer
+	shops := map[string]models.ShopRole{}
+	for group, grants := range idp.GroupRoles {
+		for _, g := range grants {
+			if g.ShopID == "" {
+				managePlatform = true
+				if member[group] {
+					platform = g.Platform
+				}
+				continue
+			}
+			r := shops[g.ShopID]
+			if member[group] && !r.Satisfies(g.ShopRole) {
+				r = g.ShopRole
+			}
+			shops[g.ShopID] = r
+		}
+	}
+
+	var role models.UserRole
+	if err := tx.GetContext(ctx, &role, `SELECT role FROM users WHERE id=$1 FOR UPDATE`, userID); err != nil {
+		return err
+	}
+	have, err := repo.ShopMemberships(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	changes := map[string]interface{}{}
+	if managePlatform && role != platform {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET role=$2 WHERE id=$1`, userID, platform); err != nil {
+			return err
+		}
+		changes["role"] = platform
+	}
+	ids := make([]string, 0, len(shops))
+	for id := range shops {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	shopChanges := map[string]interface{}{}
+	for _, shopID := range ids {
+		want := shops[shopID]
+		if have[shopID] == want {
+			continue
+		}
+		var res sql.Result
+		if want == "" {
+			res, err = tx.ExecContext(ctx, `DELETE FROM shop_members WHERE shop_id=$1 AND user_id=$2`, shopID, userID)
+		} else {
+			res, err = tx.ExecContext(ctx, `
+				INSERT INTO shop_members(shop_id, user_id, role)
+				SELECT id, $2, $3 FROM shops WHERE id=$1 AND deleted_at IS NULL
+				ON CONFLICT (shop_id, user_id) DO UPDATE SET role=EXCLUDED.role
+			`, shopID, userID, want)
+		}
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			shopChanges[shopID] = want
+		}
+	}
+	if len(shopChanges) > 0 {
+		changes["shops"] = shopChanges
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	changes["provider"] = idp.Name()
+	return repo.Audit(ctx, tx, repo.AuditEvent{
+		Action:  repo.AuditRolesSynced,
+		Target:  "user:" + userID,
+		IP:      ip,
+		Details: changes,
+	})
+}
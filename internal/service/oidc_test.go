@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/oidc"
+	"ecommerce-shop/testutils"
+)
+
+const oidcShop = "5b0e8c4a-3f7e-4a55-9a6e-0c6d2b1f9e21"
+
+// captured records the string a mocked statement was called with
+type captured struct{ v *string }
+
+func (c captured) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*c.v = s
+	return ok
+}
+
+func TestParseGroupRoles(t *testing.T) {
+	roles, err := ParseGroupRoles([]string{"it-admins=platform_admin", "wh-ops=staff@" + oidcShop, "wh-leads = admin@" + oidcShop})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]RoleGrant{
+		"it-admins": {{Platform: models.RolePlatformAdmin}},
+		"wh-ops":    {{ShopID: oidcShop, ShopRole: models.ShopStaff}},
+		"wh-leads":  {{ShopID: oidcShop, ShopRole: models.ShopAdmin}},
+	}, roles)
+
+	for _, bad := range []string{"wh-ops", "=staff@" + oidcShop, "wh-ops=owner@" + oidcShop, "wh-ops=staff@main-street", "wh-ops=customer"} {
+		_, err := ParseGroupRoles([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAuthService_CompleteOIDCLogin(t *testing.T) {
+	keys := testutils.TestKeySet(t)
+	user := testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example", EmailVerified: true}
+
+	expectSession := func(mock sqlmock.Sqlmock, userID, role string, shops *sqlmock.Rows, amr string) {
+		mock.ExpectQuery(`SELECT id, role FROM users WHERE id=\$1`).
+			WithArgs(userID).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "role"}).AddRow(userID, role))
+		mock.ExpectQuery(`FROM shop_members m`).
+			WillReturnRows(shops)
+		mock.ExpectExec(`INSERT INTO refresh_tokens`).
+			WithArgs(userID, nil, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), amr).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	expectKnownIdentity := func(mock sqlmock.Sqlmock, userID string) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`UPDATE user_identities SET email=\$3, last_login_at=now\(\) WHERE provider=\$1 AND subject=\$2 RETURNING user_id`).
+			WithArgs("corp", "idp-42", "ops@corp.example").
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(userID))
+	}
+	expectNewIdentity := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`UPDATE user_identities`).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	}
+	memberRows := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"shop_id", "role"}) }
+
+	tests := []struct {
+		name        string
+		user        testutils.FakeOIDCUser
+		groupRoles  []string
+		allowSignup bool
+		trustMFA    bool
+		mockSetup   func(sqlmock.Sqlmock)
+		wantErr     error
+		wantMFA     bool
+		wantRole    models.UserRole
+		wantShops   map[string]models.ShopRole
+		wantAMR     []string
+	}{
+		{
+			name:       "known identity gets the roles of its groups",
+			user:       testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example", EmailVerified: true, Groups: []string{"wh-ops"}, AMR: []string{"pwd", "mfa"}},
+			groupRoles: []string{"wh-ops=staff@" + oidcShop, "it-admins=platform_admin"},
+			trustMFA:   true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectKnownIdentity(mock, "user-1")
+				mock.ExpectQuery(`SELECT role FROM users WHERE id=\$1 FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("platform_admin"))
+				mock.ExpectQuery(`FROM shop_members m`).
+					WillReturnRows(memberRows())
+				mock.ExpectExec(`UPDATE users SET role=\$2 WHERE id=\$1`).
+					WithArgs("user-1", models.RoleCustomer).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO shop_members\(shop_id, user_id, role\)\s+SELECT id, \$2, \$3 FROM shops WHERE id=\$1 AND deleted_at IS NULL`).
+					WithArgs(oidcShop, "user-1", models.ShopStaff).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO audit_log`).
+					WithArgs("", "identity.roles_synced", "user:user-1", "10.0.0.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSession(mock, "user-1", "customer", memberRows().AddRow(oidcShop, "staff"), `{"fed","pwd","mfa"}`)
+			},
+			wantRole:  models.RoleCustomer,
+			wantShops: map[string]models.ShopRole{oidcShop: models.ShopStaff},
+			wantAMR:   []string{"fed", "pwd", "mfa"},
+		},
+		{
+			name:       "membership the groups no longer grant is removed",
+			user:       testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example", EmailVerified: true, AMR: []string{"mfa"}},
+			groupRoles: []string{"wh-ops=staff@" + oidcShop},
+			trustMFA:   true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectKnownIdentity(mock, "user-1")
+				mock.ExpectQuery(`SELECT role FROM users WHERE id=\$1 FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("customer"))
+				mock.ExpectQuery(`FROM shop_members m`).
+					WillReturnRows(memberRows().AddRow(oidcShop, "admin"))
+				mock.ExpectExec(`DELETE FROM shop_members WHERE shop_id=\$1 AND user_id=\$2`).
+					WithArgs(oidcShop, "user-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO audit_log`).
+					WithArgs("", "identity.roles_synced", "user:user-1", "10.0.0.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				expectSession(mock, "user-1", "customer", memberRows(), `{"fed","mfa"}`)
+			},
+			wantRole:  models.RoleCustomer,
+			wantShops: nil,
+			wantAMR:   []string{"fed", "mfa"},
+		},
+		{
+			name: "new identity is linked by verified email",
+			user: user,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectNewIdentity(mock)
+				mock.ExpectQuery(`SELECT id FROM users WHERE email=\$1`).
+					WithArgs("ops@corp.example").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-2"))
+				mock.ExpectExec(`INSERT INTO user_identities\(provider, subject, user_id, email\)`).
+					WithArgs("corp", "idp-42", "user-2", "ops@corp.example").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO audit_log`).
+					WithArgs("user-2", "identity.linked", "user:user-2", "10.0.0.1", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+					WithArgs("user-2").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				expectSession(mock, "user-2", "customer", memberRows(), `{"fed"}`)
+			},
+			wantRole: models.RoleCustomer,
+			wantAMR:  []string{"fed"},
+		},
+		{
+			name:        "unknown email signs up when allowed",
+			user:        user,
+			allowSignup: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectNewIdentity(mock)
+				mock.ExpectQuery(`SELECT id FROM users WHERE email=\$1`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectQuery(`INSERT INTO users\(email, password_hash, email_verified_at\) VALUES \(\$1, '', now\(\)\)`).
+					WithArgs("ops@corp.example").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("user-3"))
+				mock.ExpectExec(`INSERT INTO user_identities`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO audit_log`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				expectSession(mock, "user-3", "customer", memberRows(), `{"fed"}`)
+			},
+			wantRole: models.RoleCustomer,
+			wantAMR:  []string{"fed"},
+		},
+		{
+			name: "unknown email without signups",
+			user: user,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectNewIdentity(mock)
+				mock.ExpectQuery(`SELECT id FROM users WHERE email=\$1`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrIdentityNotLinked,
+		},
+		{
+			name:        "unverified email is not linked",
+			user:        testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example"},
+			allowSignup: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectNewIdentity(mock)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrIdentityNotLinked,
+		},
+		{
+			name: "own second factor is still asked for",
+			user: user,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectKnownIdentity(mock, "user-1")
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectCommit()
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE user_id=\$1 AND purpose=\$2`).
+					WithArgs("user-1", "mfa_challenge").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`INSERT INTO user_tokens`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantMFA: true,
+		},
+		{
+			name: "provider's mfa does not stand in for own second factor",
+			user: testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example", EmailVerified: true, AMR: []string{"mfa"}},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectKnownIdentity(mock, "user-1")
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+					WithArgs("user-1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectCommit()
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE user_tokens SET used_at=now\(\) WHERE user_id=\$1 AND purpose=\$2`).
+					WithArgs("user-1", "mfa_challenge").
+					WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(`INSERT INTO user_tokens`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			wantMFA: true,
+		},
+		{
+			name: "untrusted provider's mfa is left out of the session",
+			user: testutils.FakeOIDCUser{Subject: "idp-42", Email: "ops@corp.example", EmailVerified: true, AMR: []string{"pwd", "mfa"}},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectKnownIdentity(mock, "user-1")
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM user_mfa`).
+					WithArgs("user-1").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				expectSession(mock, "user-1", "customer", memberRows(), `{"fed","pwd"}`)
+			},
+			wantRole: models.RoleCustomer,
+			wantAMR:  []string{"fed", "pwd"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+			fake := testutils.NewFakeOIDCProvider(t)
+			p, err := oidc.NewProvider(oidc.Config{Name: "corp", Issuer: fake.URL, ClientID: fake.ClientID, ClientSecret: fake.ClientSecret, RedirectURL: fake.RedirectURL}, nil)
+			require.NoError(t, err)
+			roles, err := ParseGroupRoles(tt.groupRoles)
+			require.NoError(t, err)
+			service := &AuthService{
+				DB: db, Log: testutils.MockLogger(t), Keys: keys,
+				MFARequiredRoles:  []string{"staff", "admin"},
+				IdentityProviders: map[string]*IdentityProvider{"corp": {Provider: p, GroupRoles: roles, AllowSignup: tt.allowSignup, TrustMFA: tt.trustMFA}},
+			}
+
+			var stateHash, nonce, verifier string
+			mock.ExpectExec(`INSERT INTO oidc_logins\(state_hash, provider, nonce, code_verifier, expires_at\)`).
+				WithArgs(captured{&stateHash}, "corp", captured{&nonce}, captured{&verifier}, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			authURL, state, err := service.BeginOIDCLogin(context.Background(), "corp")
+			require.NoError(t, err)
+			assert.Equal(t, auth.HashOpaqueToken(state), stateHash)
+			code, returned := fake.Authorize(t, authURL, tt.user)
+			assert.Equal(t, state, returned)
+
+			mock.ExpectQuery(`DELETE FROM oidc_logins WHERE state_hash=\$1 AND provider=\$2 RETURNING nonce, code_verifier, expires_at`).
+				WithArgs(stateHash, "corp").
+				WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "expires_at"}).AddRow(nonce, verifier, time.Now().Add(time.Minute)))
+			tt.mockSetup(mock)
+			sess, err := service.CompleteOIDCLogin(context.Background(), "corp", code, state, "10.0.0.1")
+
+			switch {
+			case tt.wantErr != nil:
+				assert.ErrorIs(t, err, tt.wantErr)
+			case tt.wantMFA:
+				require.NoError(t, err)
+				assert.NotEmpty(t, sess.MFAToken)
+				assert.Empty(t, sess.AccessToken)
+			default:
+				require.NoError(t, err)
+				pr, err := auth.ParseToken(sess.AccessToken, keys)
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantRole, pr.Role)
+				assert.Equal(t, tt.wantShops, pr.Shops)
+				assert.Equal(t, tt.wantAMR, pr.AMR)
+				assert.False(t, sess.MFAEnrolmentRequired)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestAuthService_CompleteOIDCLogin_State(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	p, err := oidc.NewProvider(oidc.Config{Name: "corp", Issuer: "http://idp.invalid", ClientID: "c", RedirectURL: "http://localhost/cb"}, nil)
+	require.NoError(t, err)
+	service := &AuthService{DB: db, Log: testutils.MockLogger(t), IdentityProviders: map[string]*IdentityProvider{"corp": {Provider: p}}}
+
+	mock.ExpectQuery(`DELETE FROM oidc_logins`).
+		WithArgs(auth.HashOpaqueToken("used-state"), "corp").
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "expires_at"}))
+	_, err = service.CompleteOIDCLogin(context.Background(), "corp", "code", "used-state", "10.0.0.1")
+	assert.ErrorIs(t, err, ErrInvalidOIDCState)
+
+	mock.ExpectQuery(`DELETE FROM oidc_logins`).
+		WillReturnRows(sqlmock.NewRows([]string{"nonce", "code_verifier", "expires_at"}).AddRow("n", "v", time.Now().Add(-time.Second)))
+	_, err = service.CompleteOIDCLogin(context.Background(), "corp", "code", "old-state", "10.0.0.1")
+	assert.ErrorIs(t, err, ErrInvalidOIDCState)
+
+	_, err = service.CompleteOIDCLogin(context.Background(), "other", "code", "state", "10.0.0.1")
+	assert.ErrorIs(t, err, ErrUnknownIdentityProvider)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -2,13 +2,20 @@ package service
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 
+	"ecommerce-shop/internal/allocation"
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/helpers"
+	"ecommerce-shop/internal/models"
 	"ecommerce-shop/internal/repo"
 )
 
@@ -18,94 +25,379 @@ type OrdersService struct {
 	TTLMin int
 }
 
-func hash(b []byte) string { h := sha256.Sum256(b); return hex.EncodeToString(h[:]) }
+var (
+	ErrNotOrderOwner = errors.New("order belongs to another user")
+	ErrNotShopStaff  = errors.New("order belongs to a shop the caller does not staff")
+	ErrOrderNotFound = errors.New("order not found")
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrOrderExpired  = errors.New("order reservation expired")
 
-func (s *OrdersService) Create(ctx context.Context, idempotencyKey string, rawBody []byte, shopID string, items []struct {
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrShopNotFound      = errors.New("shop not found")
+	ErrUnknownProduct    = errors.New("unknown product")
+	ErrCurrencyMismatch  = errors.New("order items are priced in different currencies")
+)
+
+// OrderLine is one requested product and quantity in a new order.
+type OrderLine struct {
 	ProductID string
 	Quantity  int
-}) (string, error) {
-	var orderID string
-	requestHash := hash(rawBody)
-	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
-		var existing sql.NullString
-		if err := tx.QueryRowxContext(ctx, `SELECT order_id FROM idempotency_keys WHERE key=$1 AND request_hash=$2`, idempotencyKey, requestHash).Scan(&existing); err == nil {
-			if existing.Valid {
-				orderID = existing.String
-				return nil
-			}
-		} else if err != sql.ErrNoRows {
+}
+
+// Create reserves stock for items and records the order with prices quoted at
+// this moment.
+func (s *OrdersService) Create(ctx context.Context, userID, shopID string, items []OrderLine, shipTo *allocation.Point) (models.Order, error) {
+	var order models.Order
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		order = models.Order{UserID: userID, ShopID: shopID, Status: models.OrderReserved}
+		prices, err := quote(ctx, tx, shopID, items)
+		if err != nil {
 			return err
 		}
-		if _, err := tx.ExecContext(ctx, `INSERT INTO idempotency_keys(key, user_id, request_hash) VALUES ($1, gen_random_uuid(), $2)`, idempotencyKey, requestHash); err != nil {
+		for _, it := range items {
+			order.TotalCents += prices[it.ProductID].PriceCents * int64(it.Quantity)
+			order.Currency = prices[it.ProductID].Currency
+		}
+		strategy, seq, err := allocator(ctx, tx, shopID)
+		if err != nil {
 			return err
 		}
-		if err := tx.GetContext(ctx, &orderID, `INSERT INTO orders(user_id, shop_id, status) VALUES (gen_random_uuid(), $1, 'reserved') RETURNING id`, shopID); err != nil {
+		if err := tx.QueryRowxContext(ctx, `INSERT INTO orders(user_id, shop_id, status, total_cents, currency) VALUES ($1,$2,'reserved',$3,$4) RETURNING id, created_at, updated_at`,
+			userID, shopID, order.TotalCents, order.Currency).Scan(&order.ID, &order.CreatedAt, &order.UpdatedAt); err != nil {
+			return err
+		}
+		whs, err := repo.ActiveWarehousesForShop(ctx, tx, shopID)
+		if err != nil {
 			return err
 		}
+		whIDs := make([]string, 0, len(whs))
+		for _, wh := range whs {
+			whIDs = append(whIDs, wh.ID)
+		}
+		productIDs := make([]string, 0, len(items))
 		for _, it := range items {
-			if _, err := tx.ExecContext(ctx, `INSERT INTO order_items(order_id, product_id, quantity) VALUES ($1,$2,$3)`, orderID, it.ProductID, it.Quantity); err != nil {
+			p := prices[it.ProductID]
+			if _, err := tx.ExecContext(ctx, `INSERT INTO order_items(order_id, product_id, quantity, unit_price_cents, currency) VALUES ($1,$2,$3,$4,$5)`, order.ID, it.ProductID, it.Quantity, p.PriceCents, p.Currency); err != nil {
 				return err
 			}
-			whIDs, err := repo.ActiveWarehousesForShop(ctx, tx, shopID)
-			if err != nil {
-				return err
+			productIDs = append(productIDs, it.ProductID)
+		}
+		// one statement locks the whole cart in canonical order, so concurrent
+		// checkouts of overlapping carts queue instead of deadlocking
+		onHand, err := repo.LockInventory(ctx, tx, whIDs, productIDs)
+		if err != nil {
+			return err
+		}
+		reserved, err := repo.SumReserved(ctx, tx, whIDs, productIDs)
+		if err != nil {
+			return err
+		}
+		for _, it := range items {
+			cands := make([]allocation.Candidate, 0, len(whs))
+			for _, wh := range whs {
+				k := repo.InventoryKey{WarehouseID: wh.ID, ProductID: it.ProductID}
+				cands = append(cands, candidate(wh, onHand[k]-reserved[k]))
 			}
-			reserved := false
-			for _, wh := range whIDs {
-				invQty, err := repo.LockInventoryRow(ctx, tx, wh, it.ProductID)
-				if err != nil {
-					return err
-				}
-				resQty, err := repo.SumReservedNotExpired(ctx, tx, wh, it.ProductID)
-				if err != nil {
+			// a line may be split over several warehouses, one reservation row each
+			allocs, short := allocation.Allocate(strategy, allocation.Line{Quantity: it.Quantity, ShipTo: shipTo, Seq: seq}, cands)
+			if short > 0 {
+				return fmt.Errorf("%w: %s", ErrInsufficientStock, it.ProductID)
+			}
+			for _, a := range allocs {
+				if err := repo.ReserveStock(ctx, tx, order.ID, a.WarehouseID, it.ProductID, a.Quantity, s.TTLMin); err != nil {
 					return err
 				}
-				if invQty-resQty >= it.Quantity {
-					if err := repo.ReserveStock(ctx, tx, orderID, wh, it.ProductID, it.Quantity, s.TTLMin); err != nil {
-						return err
-					}
-					reserved = true
-					break
-				}
-			}
-			if !reserved {
-				return sql.ErrNoRows
 			}
 		}
-		_, err := tx.ExecContext(ctx, `UPDATE idempotency_keys SET order_id=$2 WHERE key=$1`, idempotencyKey, orderID)
-		return err
+		return nil
 	})
-	return orderID, err
+	if err != nil {
+		return models.Order{}, err
+	}
+	return order, nil
 }
 
-func (s *OrdersService) Pay(ctx context.Context, orderID string) error {
-	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
-		var status string
-		if err := tx.GetContext(ctx, &status, `SELECT status FROM orders WHERE id=$1 FOR UPDATE`, orderID); err != nil {
-			return err
+// allocator loads the shop's allocation strategy and, for round-robin shops,
+// the turn this order takes.
+func allocator(ctx context.Context, tx *sqlx.Tx, shopID string) (allocation.Strategy, int64, error) {
+	name, err := repo.ShopAllocationStrategy(ctx, tx, shopID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, ErrShopNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	strategy, err := allocation.ByName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	var seq int64
+	if strategy.Name() == allocation.RoundRobin {
+		if seq, err = repo.NextAllocationSeq(ctx, tx, shopID); err != nil {
+			return nil, 0, err
+		}
+	}
+	return strategy, seq, nil
+}
+
+func candidate(wh models.Warehouse, available int) allocation.Candidate {
+	c := allocation.Candidate{WarehouseID: wh.ID, Priority: wh.Priority, Available: available}
+	if wh.Latitude != nil && wh.Longitude != nil {
+		c.Location = &allocation.Point{Lat: *wh.Latitude, Lng: *wh.Longitude}
+	}
+	return c
+}
+
+// quote looks up the current price of every line and checks they share one currency.
+func quote(ctx context.Context, tx *sqlx.Tx, shopID string, items []OrderLine) (map[string]models.ShopProductPrice, error) {
+	ids := make([]string, 0, len(items))
+	for _, it := range items {
+		ids = append(ids, it.ProductID)
+	}
+	prices, err := repo.ProductPrices(ctx, tx, shopID, ids)
+	if err != nil {
+		return nil, err
+	}
+	currency := ""
+	for _, it := range items {
+		p, ok := prices[it.ProductID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownProduct, it.ProductID)
 		}
-		if status != "reserved" {
-			return sql.ErrNoRows
+		if currency != "" && p.Currency != currency {
+			return nil, ErrCurrencyMismatch
 		}
-		rows, err := tx.QueryxContext(ctx, `SELECT warehouse_id, product_id, quantity FROM reservations WHERE order_id=$1 AND released=FALSE AND expires_at>now()`, orderID)
+		currency = p.Currency
+	}
+	return prices, nil
+}
+
+// Pay deducts the reserved stock and marks the order paid, returning the order
+// with the total quoted at reservation time. If any of the order's reservations
+// has lapsed the order is expired instead, that change is committed, and
+// ErrOrderExpired is returned.
+func (s *OrdersService) Pay(ctx context.Context, userID, orderID string) (models.Order, error) {
+	var order models.Order
+	expired := false
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		expired = false
+		var err error
+		order, err = lockOrder(ctx, tx, orderID)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-		for rows.Next() {
-			var wh, pid string
-			var qty int
-			if err := rows.Scan(&wh, &pid, &qty); err != nil {
-				return err
-			}
-			if _, err := tx.ExecContext(ctx, `UPDATE inventory SET quantity = quantity - $3 WHERE warehouse_id=$1 AND product_id=$2`, wh, pid, qty); err != nil {
+		if order.UserID != userID {
+			return ErrNotOrderOwner
+		}
+		if order.Status == models.OrderExpired {
+			return ErrOrderExpired
+		}
+		if err := order.Status.TransitionTo(models.OrderPaid); err != nil {
+			return err
+		}
+		var lapsed int
+		if err := tx.GetContext(ctx, &lapsed, `SELECT COUNT(*) FROM reservations WHERE order_id=$1 AND (released OR expires_at<=now())`, orderID); err != nil {
+			return err
+		}
+		if lapsed > 0 {
+			expired = true
+			return repo.MarkOrdersExpired(ctx, tx, []string{orderID}, repo.ReasonReservationExpired)
+		}
+		var live []models.Reservation
+		if err := tx.SelectContext(ctx, &live, `SELECT warehouse_id, product_id, quantity FROM reservations WHERE order_id=$1 AND released=FALSE AND expires_at>now() ORDER BY warehouse_id, product_id`, orderID); err != nil {
+			return err
+		}
+		for _, r := range live {
+			if _, err := repo.MoveStock(ctx, tx, repo.Movement{
+				WarehouseID: r.WarehouseID,
+				ProductID:   r.ProductID,
+				Delta:       -r.Quantity,
+				Reason:      models.MovementSale,
+				OrderID:     orderID,
+				ActorID:     userID,
+			}); err != nil {
 				return err
 			}
 		}
 		if _, err := tx.ExecContext(ctx, `UPDATE reservations SET released=TRUE WHERE order_id=$1`, orderID); err != nil {
 			return err
 		}
-		_, err = tx.ExecContext(ctx, `UPDATE orders SET status='paid', updated_at=now() WHERE id=$1`, orderID)
-		return err
+		order.Status = models.OrderPaid
+		return setOrderStatus(ctx, tx, orderID, models.OrderPaid)
 	})
+	if err != nil {
+		return models.Order{}, err
+	}
+	if expired {
+		return models.Order{}, ErrOrderExpired
+	}
+	return order, nil
+}
+
+// Cancel lets the owner abandon a reserved order, releasing its stock in the same transaction.
+func (s *OrdersService) Cancel(ctx context.Context, userID, orderID string) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		o, err := lockOrder(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		if o.UserID != userID {
+			return ErrNotOrderOwner
+		}
+		if err := o.Status.TransitionTo(models.OrderCancelled); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE reservations SET released=TRUE WHERE order_id=$1 AND released=FALSE`, orderID); err != nil {
+			return err
+		}
+		return setOrderStatus(ctx, tx, orderID, models.OrderCancelled)
+	})
+}
+
+// Advance applies one of the post-payment transitions (fulfilled, shipped,
+// delivered, refunded), none of which touch stock. Only staff of the shop
+// the order was placed in may apply them.
+func (s *OrdersService) Advance(ctx context.Context, p auth.Principal, orderID string, next models.OrderStatus) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		o, err := lockOrder(ctx, tx, orderID)
+		if err != nil {
+			return err
+		}
+		if !p.HasShopRole(o.ShopID, models.ShopStaff) {
+			return ErrNotShopStaff
+		}
+		switch next {
+		case models.OrderFulfilled, models.OrderShipped, models.OrderDelivered, models.OrderRefunded:
+		default:
+			return &models.TransitionError{From: o.Status, To: next}
+		}
+		if err := o.Status.TransitionTo(next); err != nil {
+			return err
+		}
+		return setOrderStatus(ctx, tx, orderID, next)
+	})
+}
+
+func lockOrder(ctx context.Context, tx *sqlx.Tx, orderID string) (models.Order, error) {
+	var o models.Order
+	if err := tx.GetContext(ctx, &o, `SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=$1 FOR UPDATE`, orderID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) || isInvalidText(err) {
+			return models.Order{}, ErrOrderNotFound
+		}
+		return models.Order{}, err
+	}
+	return o, nil
+}
+
+func setOrderStatus(ctx context.Context, tx *sqlx.Tx, orderID string, status models.OrderStatus) error {
+	_, err := tx.ExecContext(ctx, `UPDATE orders SET status=$2, updated_at=now() WHERE id=$1`, orderID, status)
+	return err
+}
+
+// OrderDetail is an order together with its lines and stock reservations.
+type OrderDetail struct {
+	models.Order
+	Items        []models.OrderItem
+	Reservations []models.Reservation
+}
+
+// OrderFilter narrows an order history listing. Zero values mean no filter.
+type OrderFilter struct {
+	Status string
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Limit  int
+}
+
+const (
+	defaultOrderPageSize = 20
+	maxOrderPageSize     = 100
+)
+
+func (s *OrdersService) Get(ctx context.Context, userID, orderID string) (OrderDetail, error) {
+	var d OrderDetail
+	if err := s.DB.GetContext(ctx, &d.Order, `SELECT id, user_id, shop_id, status, status_reason, total_cents, currency, created_at, updated_at FROM orders WHERE id=$1 AND user_id=$2`, orderID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OrderDetail{}, ErrOrderNotFound
+		}
+		return OrderDetail{}, err
+	}
+	if err := s.DB.SelectContext(ctx, &d.Items, `SELECT order_id, product_id, quantity, unit_price_cents, currency FROM order_items WHERE order_id=$1 ORDER BY product_id`, orderID); err != nil {
+		return OrderDetail{}, err
+	}
+	if err := s.DB.SelectContext(ctx, &d.Reservations, `SELECT id, order_id, warehouse_id, product_id, quantity, expires_at, released FROM reservations WHERE order_id=$1 ORDER BY product_id, warehouse_id`, orderID); err != nil {
+		return OrderDetail{}, err
+	}
+	return d, nil
+}
+
+// List returns the caller's orders newest first. The returned cursor is empty
+// on the last page and otherwise fetches the page after this one.
+func (s *OrdersService) List(ctx context.Context, userID string, f OrderFilter) ([]models.Order, string, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultOrderPageSize
+	}
+	if limit > maxOrderPageSize {
+		limit = maxOrderPageSize
+	}
+	q := `SELECT id, user_id, shop_id, status, status_reason, total_cents, currency, created_at, updated_at FROM orders WHERE user_id=$1`
+	args := []interface{}{userID}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		q += fmt.Sprintf(" AND status=$%d", len(args))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		q += fmt.Sprintf(" AND created_at>=$%d", len(args))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		q += fmt.Sprintf(" AND created_at<$%d", len(args))
+	}
+	if f.Cursor != "" {
+		at, id, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		args = append(args, at, id)
+		q += fmt.Sprintf(" AND (created_at, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+	q += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	var out []models.Order
+	if err := s.DB.SelectContext(ctx, &out, q, args...); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(out) > limit {
+		out = out[:limit]
+		last := out[len(out)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+	return out, next, nil
+}
+
+// encodeCursor makes an opaque keyset cursor from the last row of a page
+// ordered by (created_at, id).
+func encodeCursor(at time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(at.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok || !helpers.IsUUID(id) {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	at, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, "", ErrInvalidCursor
+	}
+	return at, id, nil
 }
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"ecommerce-shop/internal/repo"
+	"ecommerce-shop/testutils"
+)
+
+// The tests in this file run against a real Postgres (see
+// testutils.IntegrationDB) and are started with `make test-integration`.
+
+const (
+	stressWorkers  = 300
+	stockPerRow    = 5
+	stressUsers    = 8
+	stressProducts = 3
+	stressSites    = 3
+)
+
+type stockFixture struct {
+	shopID     string
+	users      []string
+	warehouses []string
+	products   []string
+}
+
+func seedStock(t *testing.T, db *sqlx.DB) stockFixture {
+	t.Helper()
+	var fx stockFixture
+	require.NoError(t, db.Get(&fx.shopID, `INSERT INTO shops(name) VALUES ('stress') RETURNING id`))
+	for i := 0; i < stressUsers; i++ {
+		var id string
+		require.NoError(t, db.Get(&id, `INSERT INTO users(email, password_hash) VALUES ($1, 'x') RETURNING id`, fmt.Sprintf("stress-%d@example.com", i)))
+		fx.users = append(fx.users, id)
+	}
+	for i := 0; i < stressSites; i++ {
+		var id string
+		require.NoError(t, db.Get(&id, `INSERT INTO warehouses(shop_id, name, priority) VALUES ($1, $2, $3) RETURNING id`, fx.shopID, fmt.Sprintf("wh-%d", i), i))
+		fx.warehouses = append(fx.warehouses, id)
+	}
+	for i := 0; i < stressProducts; i++ {
+		var id string
+		require.NoError(t, db.Get(&id, `INSERT INTO products(sku, name, price_cents) VALUES ($1, $1, 100) RETURNING id`, fmt.Sprintf("SKU-%d", i)))
+		fx.products = append(fx.products, id)
+	}
+	for _, wh := range fx.warehouses {
+		for _, p := range fx.products {
+			_, err := db.Exec(`INSERT INTO inventory(warehouse_id, product_id, quantity) VALUES ($1, $2, $3)`, wh, p, stockPerRow)
+			require.NoError(t, err)
+			_, err = db.Exec(`INSERT INTO inventory_movements(warehouse_id, product_id, delta, balance, reason) VALUES ($1, $2, $3, $3, 'opening')`, wh, p, stockPerRow)
+			require.NoError(t, err)
+		}
+	}
+	return fx
+}
+
+// runCheckoutStress fires stressWorkers concurrent operations at the fixture:
+// mostly checkouts (half of them paid straight away), plus warehouse
+// activations, deactivations under every policy and, when withTransfers is
+// set, stock transfers. It returns the ids of the orders Create reported as
+// placed.
+func runCheckoutStress(t *testing.T, db *sqlx.DB, fx stockFixture, withTransfers bool) []string {
+	t.Helper()
+	ctx := context.Background()
+	orders := &OrdersService{DB: db, Log: zap.NewNop(), TTLMin: 15}
+	warehouses := &WarehousesService{DB: db}
+
+	var (
+		mu     sync.Mutex
+		placed []string
+		wg     sync.WaitGroup
+	)
+	start := make(chan struct{})
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(i), 9))
+			<-start
+
+			switch {
+			case i%10 == 0 && withTransfers:
+				from, to := fx.warehouses[rng.IntN(stressSites)], fx.warehouses[rng.IntN(stressSites)]
+				tr, err := warehouses.RequestTransfer(ctx, from, to, fx.products[rng.IntN(stressProducts)], 1+rng.IntN(3))
+				if errors.Is(err, ErrSameWarehouse) {
+					return
+				}
+				if err != nil {
+					t.Errorf("RequestTransfer: %v", err)
+					return
+				}
+				actor := fx.users[rng.IntN(stressUsers)]
+				if _, err := warehouses.Dispatch(ctx, actor, tr.ID); err != nil {
+					if !errors.Is(err, ErrInsufficientStock) && !repo.IsRetryable(err) {
+						t.Errorf("Dispatch %s: %v", tr.ID, err)
+					}
+					return
+				}
+				// some transfers stay in transit, some arrive short
+				switch rng.IntN(3) {
+				case 0:
+					return
+				case 1:
+					got := rng.IntN(tr.Quantity + 1)
+					_, err = warehouses.Receive(ctx, actor, tr.ID, &got)
+				default:
+					_, err = warehouses.Receive(ctx, actor, tr.ID, nil)
+				}
+				if err != nil && !repo.IsRetryable(err) {
+					t.Errorf("Receive %s: %v", tr.ID, err)
+				}
+			case i%10 == 1:
+				wh := fx.warehouses[rng.IntN(stressSites)]
+				if rng.IntN(2) == 0 {
+					if err := warehouses.SetActive(ctx, wh, true); err != nil {
+						t.Errorf("SetActive: %v", err)
+					}
+					return
+				}
+				policy := []string{DeactivateBlock, DeactivateDrain, DeactivateReallocate}[rng.IntN(3)]
+				_, err := warehouses.Deactivate(ctx, wh, policy)
+				if err != nil && !errors.Is(err, ErrWarehouseInUse) && !errors.Is(err, ErrReallocationShortfall) && !repo.IsRetryable(err) {
+					t.Errorf("Deactivate(%s): %v", policy, err)
+				}
+			default:
+				user := fx.users[rng.IntN(stressUsers)]
+				perm := rng.Perm(stressProducts)
+				lines := make([]OrderLine, 1+rng.IntN(2))
+				for j := range lines {
+					lines[j] = OrderLine{ProductID: fx.products[perm[j]], Quantity: 1 + rng.IntN(3)}
+				}
+				order, err := orders.Create(ctx, user, fx.shopID, lines, nil)
+				if errors.Is(err, ErrInsufficientStock) || repo.IsRetryable(err) {
+					return
+				}
+				if err != nil {
+					t.Errorf("Create: %v", err)
+					return
+				}
+				mu.Lock()
+				placed = append(placed, order.ID)
+				mu.Unlock()
+				if rng.IntN(2) == 0 {
+					if _, err := orders.Pay(ctx, user, order.ID); err != nil && !repo.IsRetryable(err) {
+						t.Errorf("Pay %s: %v", order.ID, err)
+					}
+				}
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return placed
+}
+
+func assertStockInvariants(t *testing.T, db *sqlx.DB, fx stockFixture, placed []string) {
+	t.Helper()
+	count := func(query string, args ...interface{}) int {
+		var n int
+		require.NoError(t, db.Get(&n, query, args...))
+		return n
+	}
+
+	assert.Zero(t, count(`SELECT COUNT(*) FROM inventory WHERE quantity < 0`), "negative inventory")
+
+	assert.Zero(t, count(`
+		SELECT COUNT(*) FROM (
+			SELECT warehouse_id, product_id, SUM(quantity) AS held FROM reservations
+			WHERE released=FALSE AND expires_at>now()
+			GROUP BY warehouse_id, product_id
+		) r
+		LEFT JOIN inventory i USING (warehouse_id, product_id)
+		WHERE r.held > COALESCE(i.quantity, 0)
+	`), "reserved exceeds on-hand")
+
+	assert.Equal(t, len(placed), count(`SELECT COUNT(*) FROM orders`), "orders left behind by failed checkouts")
+	assert.Zero(t, count(`
+		SELECT COUNT(*) FROM order_items oi
+		WHERE oi.order_id = ANY($1) AND oi.quantity <> (
+			SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+			WHERE r.order_id = oi.order_id AND r.product_id = oi.product_id
+		)
+	`, pq.Array(placed)), "order lines not fully reserved")
+
+	mismatches, err := repo.ReconcileInventory(context.Background(), db)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches, "inventory differs from ledger")
+	assert.Zero(t, count(`
+		SELECT COUNT(*) FROM (
+			SELECT balance, delta, LAG(balance, 1, 0) OVER (PARTITION BY warehouse_id, product_id ORDER BY id) AS prev
+			FROM inventory_movements
+		) m WHERE m.balance <> m.prev + m.delta
+	`), "ledger balances do not chain")
+
+	// units only leave the shelves through payment, a transfer still in
+	// transit or the shortfall of a partially received transfer
+	for _, p := range fx.products {
+		onHand := count(`SELECT COALESCE(SUM(quantity), 0) FROM inventory WHERE product_id=$1`, p)
+		sold := count(`
+			SELECT COALESCE(SUM(r.quantity), 0) FROM reservations r
+			JOIN orders o ON o.id = r.order_id
+			WHERE o.status = 'paid' AND r.product_id = $1
+		`, p)
+		inTransit := count(`SELECT COALESCE(SUM(quantity), 0) FROM stock_transfers WHERE status='dispatched' AND product_id=$1`, p)
+		lost := count(`
+			SELECT COALESCE(SUM(quantity - received_quantity), 0) FROM stock_transfers
+			WHERE status IN ('received','partially_received') AND product_id=$1
+		`, p)
+		assert.Equal(t, stockPerRow*stressSites, onHand+sold+inTransit+lost, "stock not conserved for %s", p)
+	}
+}
+
+func TestOrdersIntegration_NoOversell(t *testing.T) {
+	db := testutils.IntegrationDB(t)
+	fx := seedStock(t, db)
+
+	placed := runCheckoutStress(t, db, fx, false)
+
+	assert.NotEmpty(t, placed)
+	assertStockInvariants(t, db, fx, placed)
+}
+
+func TestOrdersIntegration_NoOversellWithTransfers(t *testing.T) {
+	db := testutils.IntegrationDB(t)
+	fx := seedStock(t, db)
+
+	placed := runCheckoutStress(t, db, fx, true)
+
+	assert.NotEmpty(t, placed)
+	assertStockInvariants(t, db, fx, placed)
+}
@@ -4,31 +4,44 @@ import (
 	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
+	"ecommerce-shop/internal/allocation"
+	"ecommerce-shop/internal/auth"
+	"ecommerce-shop/internal/models"
 	"ecommerce-shop/testutils"
 )
 
 func TestOrdersService_Pay(t *testing.T) {
 	tests := []struct {
 		name      string
+		userID    string
 		orderID   string
 		mockSetup func(sqlmock.Sqlmock)
 		wantErr   bool
+		wantErrIs error
 	}{
 		{
 			name:    "successful payment",
+			userID:  "user-123",
 			orderID: "order-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
 				// Mock order status check
-				mock.ExpectQuery(`SELECT status FROM orders WHERE id=\$1 FOR UPDATE`).
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
 					WithArgs("order-123").
-					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("reserved"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+
+				// Mock lapsed reservations check
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM reservations WHERE order_id=\$1 AND \(released OR expires_at<=now\(\)\)`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
 
 				// Mock reservations query
 				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM reservations WHERE order_id=\$1 AND released=FALSE AND expires_at>now\(\)`).
@@ -37,13 +50,19 @@ func TestOrdersService_Pay(t *testing.T) {
 						AddRow("wh-1", "prod-1", 2).
 						AddRow("wh-1", "prod-2", 1))
 
-				// Mock inventory updates
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 2).
+				// Mock inventory deductions and their ledger entries
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3 WHERE warehouse_id=\$1 AND product_id=\$2 RETURNING quantity`).
+					WithArgs("wh-1", "prod-1", -2).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(3))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", -2, 3, models.MovementSale, "order-123", "", "", "user-123").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-2", 1).
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3 WHERE warehouse_id=\$1 AND product_id=\$2 RETURNING quantity`).
+					WithArgs("wh-1", "prod-2", -1).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(3))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-2", -1, 3, models.MovementSale, "order-123", "", "", "user-123").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
 				// Mock reservations release
@@ -52,8 +71,8 @@ func TestOrdersService_Pay(t *testing.T) {
 					WillReturnResult(sqlmock.NewResult(1, 2))
 
 				// Mock order status update
-				mock.ExpectExec(`UPDATE orders SET status='paid', updated_at=now\(\) WHERE id=\$1`).
-					WithArgs("order-123").
+				mock.ExpectExec(`UPDATE orders SET status=\$2, updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("order-123", models.OrderPaid).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 
 				// Mock transaction commit
@@ -63,13 +82,14 @@ func TestOrdersService_Pay(t *testing.T) {
 		},
 		{
 			name:    "order not found",
+			userID:  "user-123",
 			orderID: "order-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
 				// Mock order status check - order not found
-				mock.ExpectQuery(`SELECT status FROM orders WHERE id=\$1 FOR UPDATE`).
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
 					WithArgs("order-123").
 					WillReturnError(sql.ErrNoRows)
 
@@ -80,15 +100,72 @@ func TestOrdersService_Pay(t *testing.T) {
 		},
 		{
 			name:    "order not in reserved status",
+			userID:  "user-123",
 			orderID: "order-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				// Mock transaction begin
 				mock.ExpectBegin()
 
 				// Mock order status check - order already paid
-				mock.ExpectQuery(`SELECT status FROM orders WHERE id=\$1 FOR UPDATE`).
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "paid", 2500, "USD"))
+
+				// Mock transaction rollback
+				mock.ExpectRollback()
+			},
+			wantErr: true,
+		},
+		{
+			name:    "lapsed reservation expires the order",
+			userID:  "user-123",
+			orderID: "order-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM reservations WHERE order_id=\$1 AND \(released OR expires_at<=now\(\)\)`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+				mock.ExpectExec(`UPDATE reservations SET released=TRUE WHERE order_id = ANY\(\$1\) AND released=FALSE`).
+					WithArgs(pq.Array([]string{"order-123"})).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`UPDATE orders SET status=\$2, status_reason=\$3, updated_at=now\(\) WHERE id = ANY\(\$1\)`).
+					WithArgs(pq.Array([]string{"order-123"}), models.OrderExpired, "reservation_expired").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				// the expiry is committed even though payment fails
+				mock.ExpectCommit()
+			},
+			wantErr:   true,
+			wantErrIs: ErrOrderExpired,
+		},
+		{
+			name:    "already expired order",
+			userID:  "user-123",
+			orderID: "order-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "expired", 2500, "USD"))
+				mock.ExpectRollback()
+			},
+			wantErr:   true,
+			wantErrIs: ErrOrderExpired,
+		},
+		{
+			name:    "order owned by another user",
+			userID:  "user-456",
+			orderID: "order-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				// Mock transaction begin
+				mock.ExpectBegin()
+
+				// Mock order status check - different owner
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
 					WithArgs("order-123").
-					WillReturnRows(sqlmock.NewRows([]string{"status"}).AddRow("paid"))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
 
 				// Mock transaction rollback
 				mock.ExpectRollback()
@@ -113,11 +190,14 @@ func TestOrdersService_Pay(t *testing.T) {
 			tt.mockSetup(mock)
 
 			// Execute
-			err := service.Pay(context.Background(), tt.orderID)
+			_, err := service.Pay(context.Background(), tt.userID, tt.orderID)
 
 			// Assert
 			if tt.wantErr {
 				assert.Error(t, err)
+				if tt.wantErrIs != nil {
+					assert.ErrorIs(t, err, tt.wantErrIs)
+				}
 			} else {
 				assert.NoError(t, err)
 			}
@@ -127,3 +207,535 @@ func TestOrdersService_Pay(t *testing.T) {
 		})
 	}
 }
+
+func TestOrdersService_Get(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+		wantItems int
+		wantRes   int
+	}{
+		{
+			name: "order with items and reservations",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, status_reason, total_cents, currency, created_at, updated_at FROM orders WHERE id=\$1 AND user_id=\$2`).
+					WithArgs("order-123", "user-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "status_reason", "total_cents", "currency", "created_at", "updated_at"}).
+						AddRow("order-123", "user-123", "shop-1", "reserved", nil, 0, "USD", now, now))
+				mock.ExpectQuery(`SELECT order_id, product_id, quantity, unit_price_cents, currency FROM order_items WHERE order_id=\$1`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"order_id", "product_id", "quantity", "unit_price_cents", "currency"}).
+						AddRow("order-123", "prod-1", 2, 1250, "USD"))
+				mock.ExpectQuery(`SELECT id, order_id, warehouse_id, product_id, quantity, expires_at, released FROM reservations WHERE order_id=\$1`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "order_id", "warehouse_id", "product_id", "quantity", "expires_at", "released"}).
+						AddRow("res-1", "order-123", "wh-1", "prod-1", 2, now, false))
+			},
+			wantItems: 1,
+			wantRes:   1,
+		},
+		{
+			name: "order of another user is not found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, status_reason, total_cents, currency, created_at, updated_at FROM orders WHERE id=\$1 AND user_id=\$2`).
+					WithArgs("order-123", "user-123").
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantErr: ErrOrderNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &OrdersService{DB: db, Log: testutils.MockLogger(t), TTLMin: 15}
+			tt.mockSetup(mock)
+
+			d, err := service.Get(context.Background(), "user-123", "order-123")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "order-123", d.ID)
+				assert.Len(t, d.Items, tt.wantItems)
+				assert.Len(t, d.Reservations, tt.wantRes)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersService_List(t *testing.T) {
+	now := time.Now().UTC()
+	cols := []string{"id", "user_id", "shop_id", "status", "status_reason", "total_cents", "currency", "created_at", "updated_at"}
+
+	tests := []struct {
+		name      string
+		filter    OrderFilter
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+		wantLen   int
+		wantNext  bool
+	}{
+		{
+			name:   "first page with more results",
+			filter: OrderFilter{Limit: 2},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, status_reason, total_cents, currency, created_at, updated_at FROM orders WHERE user_id=\$1 ORDER BY created_at DESC, id DESC LIMIT \$2`).
+					WithArgs("user-123", 3).
+					WillReturnRows(sqlmock.NewRows(cols).
+						AddRow("o-3", "user-123", "shop-1", "paid", nil, 0, "USD", now, now).
+						AddRow("o-2", "user-123", "shop-1", "reserved", nil, 0, "USD", now.Add(-time.Minute), now).
+						AddRow("o-1", "user-123", "shop-1", "reserved", nil, 0, "USD", now.Add(-2*time.Minute), now))
+			},
+			wantLen:  2,
+			wantNext: true,
+		},
+		{
+			name: "filtered by status and date range",
+			filter: OrderFilter{
+				Status: "paid",
+				From:   now.Add(-time.Hour),
+				To:     now,
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM orders WHERE user_id=\$1 AND status=\$2 AND created_at>=\$3 AND created_at<\$4 ORDER BY created_at DESC, id DESC LIMIT \$5`).
+					WithArgs("user-123", "paid", now.Add(-time.Hour), now, defaultOrderPageSize+1).
+					WillReturnRows(sqlmock.NewRows(cols).
+						AddRow("o-3", "user-123", "shop-1", "paid", nil, 0, "USD", now, now))
+			},
+			wantLen: 1,
+		},
+		{
+			name:   "continues after cursor",
+			filter: OrderFilter{Cursor: encodeCursor(now, "6b1f0c3e-2a4d-4e8b-9c7f-1d3e5a7b9c20"), Limit: 10},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM orders WHERE user_id=\$1 AND \(created_at, id\) < \(\$2, \$3\) ORDER BY created_at DESC, id DESC LIMIT \$4`).
+					WithArgs("user-123", sqlmock.AnyArg(), "6b1f0c3e-2a4d-4e8b-9c7f-1d3e5a7b9c20", 11).
+					WillReturnRows(sqlmock.NewRows(cols).
+						AddRow("o-1", "user-123", "shop-1", "reserved", nil, 0, "USD", now.Add(-time.Minute), now))
+			},
+			wantLen: 1,
+		},
+		{
+			name:      "malformed cursor",
+			filter:    OrderFilter{Cursor: "not-a-cursor"},
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidCursor,
+		},
+		{
+			name:      "cursor with a malformed id",
+			filter:    OrderFilter{Cursor: encodeCursor(now, "o-2")},
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidCursor,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &OrdersService{DB: db, Log: testutils.MockLogger(t), TTLMin: 15}
+			tt.mockSetup(mock)
+
+			list, next, err := service.List(context.Background(), "user-123", tt.filter)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, list, tt.wantLen)
+				assert.Equal(t, tt.wantNext, next != "")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersService_Cancel(t *testing.T) {
+	tests := []struct {
+		name      string
+		userID    string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name:   "reserved order is cancelled and its stock released",
+			userID: "user-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+				mock.ExpectExec(`UPDATE reservations SET released=TRUE WHERE order_id=\$1 AND released=FALSE`).
+					WithArgs("order-123").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+				mock.ExpectExec(`UPDATE orders SET status=\$2, updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("order-123", models.OrderCancelled).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:   "paid order cannot be cancelled",
+			userID: "user-123",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "paid", 2500, "USD"))
+				mock.ExpectRollback()
+			},
+			wantErr: models.ErrInvalidTransition,
+		},
+		{
+			name:   "other user's order",
+			userID: "user-456",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+					WithArgs("order-123").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", "reserved", 2500, "USD"))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrNotOrderOwner,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &OrdersService{DB: db, Log: testutils.MockLogger(t), TTLMin: 15}
+			tt.mockSetup(mock)
+
+			err := service.Cancel(context.Background(), tt.userID, "order-123")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersService_Advance(t *testing.T) {
+	staff := auth.Principal{UserID: "staff-1", Shops: map[string]models.ShopRole{"shop-1": models.ShopStaff}}
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		current   string
+		next      models.OrderStatus
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name:    "paid to fulfilled",
+			current: "paid",
+			next:    models.OrderFulfilled,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE orders SET status=\$2, updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("order-123", models.OrderFulfilled).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name:    "reserved cannot be shipped",
+			current: "reserved",
+			next:    models.OrderShipped,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectRollback()
+			},
+			wantErr: models.ErrInvalidTransition,
+		},
+		{
+			name:    "payment is not an advance transition",
+			current: "reserved",
+			next:    models.OrderPaid,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectRollback()
+			},
+			wantErr: models.ErrInvalidTransition,
+		},
+		{
+			name:      "customer cannot refund",
+			principal: &auth.Principal{UserID: "user-123"},
+			current:   "paid",
+			next:      models.OrderRefunded,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectRollback()
+			},
+			wantErr: ErrNotShopStaff,
+		},
+		{
+			name:      "staff of another shop",
+			principal: &auth.Principal{UserID: "staff-2", Shops: map[string]models.ShopRole{"shop-2": models.ShopAdmin}},
+			current:   "paid",
+			next:      models.OrderFulfilled,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectRollback()
+			},
+			wantErr: ErrNotShopStaff,
+		},
+		{
+			name:      "platform admin",
+			principal: &auth.Principal{UserID: "admin-1", Role: models.RolePlatformAdmin},
+			current:   "paid",
+			next:      models.OrderRefunded,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE orders SET status=\$2, updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("order-123", models.OrderRefunded).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &OrdersService{DB: db, Log: testutils.MockLogger(t), TTLMin: 15}
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT id, user_id, shop_id, status, total_cents, currency FROM orders WHERE id=\$1 FOR UPDATE`).
+				WithArgs("order-123").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "shop_id", "status", "total_cents", "currency"}).AddRow("order-123", "user-123", "shop-1", tt.current, 2500, "USD"))
+			tt.mockSetup(mock)
+
+			p := staff
+			if tt.principal != nil {
+				p = *tt.principal
+			}
+			err := service.Advance(context.Background(), p, "order-123", tt.next)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestOrdersService_Create(t *testing.T) {
+	items := []OrderLine{{ProductID: "prod-1", Quantity: 2}, {ProductID: "prod-2", Quantity: 1}}
+	priceQuery := `SELECT p\.id AS product_id, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency FROM products p LEFT JOIN shop_product_prices sp`
+	expectQuote := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(priceQuery).
+			WithArgs("shop-1", pq.Array([]string{"prod-1", "prod-2"})).
+			WillReturnRows(sqlmock.NewRows([]string{"product_id", "price_cents", "currency"}).
+				AddRow("prod-1", 1000, "USD").
+				AddRow("prod-2", 250, "USD"))
+	}
+	// expectOrder covers the strategy lookup, the order row and the shop's
+	// warehouses (priorities given per id).
+	expectOrder := func(mock sqlmock.Sqlmock, strategy string, whs []string, priorities []int) {
+		mock.ExpectQuery(`SELECT allocation_strategy FROM shops WHERE id=\$1`).
+			WithArgs("shop-1").
+			WillReturnRows(sqlmock.NewRows([]string{"allocation_strategy"}).AddRow(strategy))
+		if strategy == "round_robin" {
+			mock.ExpectQuery(`UPDATE shops SET allocation_seq = allocation_seq \+ 1 WHERE id=\$1 RETURNING allocation_seq`).
+				WithArgs("shop-1").
+				WillReturnRows(sqlmock.NewRows([]string{"allocation_seq"}).AddRow(1))
+		}
+		mock.ExpectQuery(`INSERT INTO orders`).
+			WithArgs("user-123", "shop-1", int64(2250), "USD").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow("order-123", time.Now(), time.Now()))
+		rows := sqlmock.NewRows([]string{"id", "priority", "latitude", "longitude"})
+		for i, wh := range whs {
+			rows.AddRow(wh, priorities[i], nil, nil)
+		}
+		mock.ExpectQuery(`SELECT id, priority, latitude, longitude FROM warehouses WHERE shop_id=\$1 AND active=TRUE ORDER BY id`).
+			WithArgs("shop-1").
+			WillReturnRows(rows)
+	}
+	expectLines := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`INSERT INTO order_items`).
+			WithArgs("order-123", "prod-1", 2, int64(1000), "USD").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO order_items`).
+			WithArgs("order-123", "prod-2", 1, int64(250), "USD").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	whs := []string{"wh-1", "wh-2"}
+	// expectStock locks the cart in one statement; free lists the unreserved
+	// stock of prod-1 and prod-2 in wh-1 and then wh-2, each row carrying two
+	// reserved units on top.
+	expectStock := func(mock sqlmock.Sqlmock, free ...int) {
+		onHand := sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"})
+		held := sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"})
+		n := 0
+		for _, wh := range whs {
+			for _, prod := range []string{"prod-1", "prod-2"} {
+				onHand.AddRow(wh, prod, free[n]+2)
+				held.AddRow(wh, prod, 2)
+				n++
+			}
+		}
+		mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory WHERE warehouse_id = ANY\(\$1\) AND product_id = ANY\(\$2\) ORDER BY warehouse_id, product_id FOR UPDATE`).
+			WithArgs(pq.Array(whs), pq.Array([]string{"prod-1", "prod-2"})).
+			WillReturnRows(onHand)
+		mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations WHERE warehouse_id = ANY\(\$1\) AND product_id = ANY\(\$2\) AND released=FALSE AND expires_at>now\(\) GROUP BY warehouse_id, product_id`).
+			WithArgs(pq.Array(whs), pq.Array([]string{"prod-1", "prod-2"})).
+			WillReturnRows(held)
+	}
+	expectReserve := func(mock sqlmock.Sqlmock, productID string, allocs ...allocation.Allocation) {
+		for _, a := range allocs {
+			mock.ExpectExec(`INSERT INTO reservations`).
+				WithArgs("order-123", a.WarehouseID, productID, a.Quantity, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+	}
+
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+		wantTotal int64
+	}{
+		{
+			name: "unknown product",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(priceQuery).
+					WithArgs("shop-1", pq.Array([]string{"prod-1", "prod-2"})).
+					WillReturnRows(sqlmock.NewRows([]string{"product_id", "price_cents", "currency"}).AddRow("prod-1", 1000, "USD"))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrUnknownProduct,
+		},
+		{
+			name: "mixed currencies",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(priceQuery).
+					WithArgs("shop-1", pq.Array([]string{"prod-1", "prod-2"})).
+					WillReturnRows(sqlmock.NewRows([]string{"product_id", "price_cents", "currency"}).
+						AddRow("prod-1", 1000, "USD").
+						AddRow("prod-2", 900, "EUR"))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrCurrencyMismatch,
+		},
+		{
+			name: "line split across warehouses",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectQuote(mock)
+				expectOrder(mock, "priority", whs, []int{100, 100})
+				expectLines(mock)
+				expectStock(mock, 1, 0, 5, 3)
+				expectReserve(mock, "prod-1", allocation.Allocation{WarehouseID: "wh-1", Quantity: 1}, allocation.Allocation{WarehouseID: "wh-2", Quantity: 1})
+				expectReserve(mock, "prod-2", allocation.Allocation{WarehouseID: "wh-2", Quantity: 1})
+				mock.ExpectCommit()
+			},
+			wantTotal: 2250,
+		},
+		{
+			name: "warehouse priority decides where stock comes from",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectQuote(mock)
+				expectOrder(mock, "priority", whs, []int{50, 10})
+				expectLines(mock)
+				expectStock(mock, 5, 5, 5, 5)
+				expectReserve(mock, "prod-1", allocation.Allocation{WarehouseID: "wh-2", Quantity: 2})
+				expectReserve(mock, "prod-2", allocation.Allocation{WarehouseID: "wh-2", Quantity: 1})
+				mock.ExpectCommit()
+			},
+			wantTotal: 2250,
+		},
+		{
+			name: "round robin takes the shop's next turn",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectQuote(mock)
+				expectOrder(mock, "round_robin", whs, []int{100, 100})
+				expectLines(mock)
+				expectStock(mock, 5, 5, 5, 5)
+				expectReserve(mock, "prod-1", allocation.Allocation{WarehouseID: "wh-2", Quantity: 2})
+				expectReserve(mock, "prod-2", allocation.Allocation{WarehouseID: "wh-2", Quantity: 1})
+				mock.ExpectCommit()
+			},
+			wantTotal: 2250,
+		},
+		{
+			name: "deadlock is retried from the start",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectQuote(mock)
+				expectOrder(mock, "priority", whs, []int{100, 100})
+				expectLines(mock)
+				mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory`).
+					WillReturnError(&pq.Error{Code: "40P01"})
+				mock.ExpectRollback()
+
+				mock.ExpectBegin()
+				expectQuote(mock)
+				expectOrder(mock, "priority", whs, []int{100, 100})
+				expectLines(mock)
+				expectStock(mock, 5, 5, 5, 5)
+				expectReserve(mock, "prod-1", allocation.Allocation{WarehouseID: "wh-1", Quantity: 2})
+				expectReserve(mock, "prod-2", allocation.Allocation{WarehouseID: "wh-1", Quantity: 1})
+				mock.ExpectCommit()
+			},
+			wantTotal: 2250,
+		},
+		{
+			name: "unknown shop",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectQuote(mock)
+				mock.ExpectQuery(`SELECT allocation_strategy FROM shops WHERE id=\$1`).
+					WithArgs("shop-1").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrShopNotFound,
+		},
+		{
+			name: "not enough stock across all warehouses",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectQuote(mock)
+				expectOrder(mock, "priority", whs, []int{100, 100})
+				expectLines(mock)
+				expectStock(mock, 1, 5, 0, 5)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInsufficientStock,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &OrdersService{DB: db, Log: testutils.MockLogger(t), TTLMin: 15}
+			tt.mockSetup(mock)
+
+			order, err := service.Create(context.Background(), "user-123", "shop-1", items, nil)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantTotal, order.TotalCents)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
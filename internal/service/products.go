@@ -2,17 +2,27 @@ package service
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 
 	"github.com/jmoiron/sqlx"
+
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
 )
 
+var ErrNoPriceOverride = errors.New("shop has no price override for the product")
+
 type ProductsService struct {
 	DB *sqlx.DB
 }
 
 type ProductAvailability struct {
 	ID, SKU, Name string
+	PriceCents    int64
+	Currency      string
 	Available     int
+	InTransit     int // dispatched to one of the shop's warehouses, not yet received
 }
 
 func (s *ProductsService) ListByShop(ctx context.Context, shopID string) ([]ProductAvailability, error) {
@@ -25,11 +35,20 @@ func (s *ProductsService) ListByShop(ctx context.Context, shopID string) ([]Prod
 			SELECT product_id, COALESCE(SUM(quantity),0) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now() AND warehouse_id IN (SELECT id FROM active_wh)
 			GROUP BY product_id
+		), transit as (
+			SELECT product_id, SUM(quantity) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=$1
+			GROUP BY product_id
 		)
-		SELECT p.id, p.sku, p.name, COALESCE(inv.qty,0) - COALESCE(res.reserved,0) AS available
+		SELECT p.id, p.sku, p.name, COALESCE(sp.price_cents, p.price_cents) AS price_cents, COALESCE(sp.currency, p.currency) AS currency,
+			COALESCE(inv.qty,0) - COALESCE(res.reserved,0) AS available,
+			COALESCE(transit.qty,0) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp.product_id = p.id AND sp.shop_id = $1
 		LEFT JOIN inv ON inv.product_id = p.id
 		LEFT JOIN res ON res.product_id = p.id
+		LEFT JOIN transit ON transit.product_id = p.id
+		WHERE p.deleted_at IS NULL
 		ORDER BY p.name
 	`, shopID)
 	if err != nil {
@@ -39,10 +58,52 @@ func (s *ProductsService) ListByShop(ctx context.Context, shopID string) ([]Prod
 	var out []ProductAvailability
 	for rows.Next() {
 		var p ProductAvailability
-		if err := rows.Scan(&p.ID, &p.SKU, &p.Name, &p.Available); err != nil {
+		if err := rows.Scan(&p.ID, &p.SKU, &p.Name, &p.PriceCents, &p.Currency, &p.Available, &p.InTransit); err != nil {
 			return nil, err
 		}
 		out = append(out, p)
 	}
 	return out, rows.Err()
 }
+
+// SetShopPrice makes the shop sell the product at its own price instead of
+// the list price. Orders already reserved keep the price they were quoted.
+func (s *ProductsService) SetShopPrice(ctx context.Context, shopID, productID string, priceCents int64, currency string) (models.ShopProductPrice, error) {
+	var p models.ShopProductPrice
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var locked string
+		if err := tx.GetContext(ctx, &locked, `SELECT id FROM shops WHERE id=$1 AND deleted_at IS NULL FOR KEY SHARE`, shopID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrShopNotFound
+			}
+			return err
+		}
+		err := tx.GetContext(ctx, &p, `
+			INSERT INTO shop_product_prices(shop_id, product_id, price_cents, currency)
+			SELECT $1, id, $3, $4 FROM products WHERE id=$2 AND deleted_at IS NULL
+			ON CONFLICT (shop_id, product_id) DO UPDATE SET price_cents=EXCLUDED.price_cents, currency=EXCLUDED.currency
+			RETURNING shop_id, product_id, price_cents, currency
+		`, shopID, productID, priceCents, currency)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownProduct
+		}
+		return err
+	})
+	if err != nil {
+		return models.ShopProductPrice{}, err
+	}
+	return p, nil
+}
+
+// ClearShopPrice drops the shop's override, so the product sells at its list
+// price again.
+func (s *ProductsService) ClearShopPrice(ctx context.Context, shopID, productID string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM shop_product_prices WHERE shop_id=$1 AND product_id=$2`, shopID, productID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoPriceOverride
+	}
+	return nil
+}
@@ -23,9 +23,9 @@ func TestProductsService_ListByShop(t *testing.T) {
 			name:   "successful list with products",
 			shopID: "shop-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "sku", "name", "available"}).
-					AddRow("prod-1", "SKU001", "Product 1", 10).
-					AddRow("prod-2", "SKU002", "Product 2", 5)
+				rows := sqlmock.NewRows([]string{"id", "sku", "name", "price_cents", "currency", "available", "in_transit"}).
+					AddRow("prod-1", "SKU001", "Product 1", 1999, "USD", 10, 0).
+					AddRow("prod-2", "SKU002", "Product 2", 500, "USD", 5, 0)
 
 				mock.ExpectQuery(`WITH active_wh as \(
 			SELECT id FROM warehouses WHERE shop_id=\$1 AND active=TRUE
@@ -35,11 +35,20 @@ func TestProductsService_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnRows(rows)
@@ -51,7 +60,7 @@ func TestProductsService_ListByShop(t *testing.T) {
 			name:   "successful list with no products",
 			shopID: "shop-123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "sku", "name", "available"})
+				rows := sqlmock.NewRows([]string{"id", "sku", "name", "price_cents", "currency", "available", "in_transit"})
 
 				mock.ExpectQuery(`WITH active_wh as \(
 			SELECT id FROM warehouses WHERE shop_id=\$1 AND active=TRUE
@@ -61,11 +70,20 @@ func TestProductsService_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnRows(rows)
@@ -85,11 +103,20 @@ func TestProductsService_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnError(sql.ErrConnDone)
@@ -113,11 +140,20 @@ func TestProductsService_ListByShop(t *testing.T) {
 			SELECT product_id, COALESCE\(SUM\(quantity\),0\) as reserved
 			FROM reservations WHERE released=FALSE AND expires_at>now\(\) AND warehouse_id IN \(SELECT id FROM active_wh\)
 			GROUP BY product_id
+		\), transit as \(
+			SELECT product_id, SUM\(quantity\) as qty
+			FROM stock_transfers WHERE status='dispatched' AND shop_id=\$1
+			GROUP BY product_id
 		\)
-		SELECT p\.id, p\.sku, p\.name, COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available
+		SELECT p\.id, p\.sku, p\.name, COALESCE\(sp\.price_cents, p\.price_cents\) AS price_cents, COALESCE\(sp\.currency, p\.currency\) AS currency,
+			COALESCE\(inv\.qty,0\) - COALESCE\(res\.reserved,0\) AS available,
+			COALESCE\(transit\.qty,0\) AS in_transit
 		FROM products p
+		LEFT JOIN shop_product_prices sp ON sp\.product_id = p\.id AND sp\.shop_id = \$1
 		LEFT JOIN inv ON inv\.product_id = p\.id
 		LEFT JOIN res ON res\.product_id = p\.id
+		LEFT JOIN transit ON transit\.product_id = p\.id
+		WHERE p\.deleted_at IS NULL
 		ORDER BY p\.name`).
 					WithArgs("shop-123").
 					WillReturnRows(rows)
@@ -155,3 +191,67 @@ func TestProductsService_ListByShop(t *testing.T) {
 		})
 	}
 }
+
+func TestProductsService_SetShopPrice(t *testing.T) {
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "saved",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WithArgs("shop-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO shop_product_prices\(shop_id, product_id, price_cents, currency\)\s+SELECT \$1, id, \$3, \$4 FROM products WHERE id=\$2 AND deleted_at IS NULL\s+ON CONFLICT \(shop_id, product_id\) DO UPDATE`).
+					WithArgs("shop-1", "prod-1", int64(450), "EUR").
+					WillReturnRows(sqlmock.NewRows([]string{"shop_id", "product_id", "price_cents", "currency"}).AddRow("shop-1", "prod-1", 450, "EUR"))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "deleted product",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO shop_product_prices`).
+					WillReturnRows(sqlmock.NewRows([]string{"shop_id", "product_id", "price_cents", "currency"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrUnknownProduct,
+		},
+		{
+			name: "deleted shop",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrShopNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+			tt.mockSetup(mock)
+
+			service := &ProductsService{DB: db}
+			p, err := service.SetShopPrice(context.Background(), "shop-1", "prod-1", 450, "EUR")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(450), p.PriceCents)
+				assert.Equal(t, "EUR", p.Currency)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
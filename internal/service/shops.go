@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrDuplicateShopName = errors.New("a shop with this name already exists")
+	ErrShopInUse         = errors.New("shop still has warehouses")
+	ErrUserNotFound      = errors.New("user not found")
+	ErrMemberNotFound    = errors.New("user is not a member of the shop")
+)
+
+const (
+	defaultCatalogPageSize = 50
+	maxCatalogPageSize     = 100
+)
+
+// PageFilter pages through shops, warehouses or products oldest first.
+// Soft-deleted rows are left out unless IncludeDeleted is set.
+type PageFilter struct {
+	IncludeDeleted bool
+	Cursor         string
+	Limit          int
+}
+
+// page appends the deleted, cursor, order and limit clauses to a query whose
+// WHERE clause is already open, returning the effective page size.
+func (f PageFilter) page(q string, args []interface{}) (string, []interface{}, int, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultCatalogPageSize
+	}
+	if limit > maxCatalogPageSize {
+		limit = maxCatalogPageSize
+	}
+	if !f.IncludeDeleted {
+		q += " AND deleted_at IS NULL"
+	}
+	if f.Cursor != "" {
+		at, id, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		args = append(args, at, id)
+		q += fmt.Sprintf(" AND (created_at, id) > ($%d, $%d)", len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+	q += fmt.Sprintf(" ORDER BY created_at, id LIMIT $%d", len(args))
+	return q, args, limit, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// isInvalidText reports a value Postgres could not parse, such as a malformed
+// uuid; no row can have it.
+func isInvalidText(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "22P02"
+}
+
+// ShopsService manages shops. Shops are soft-deleted so their orders keep
+// pointing at them.
+type ShopsService struct{ DB *sqlx.DB }
+
+// ShopInput holds the fields to set; nil fields are left unchanged on update
+// and take their defaults on create.
+type ShopInput struct {
+	Name               *string
+	AllocationStrategy *string
+}
+
+const shopColumns = `id, name, allocation_strategy, created_at, updated_at, deleted_at`
+
+func (s *ShopsService) Create(ctx context.Context, in ShopInput) (models.Shop, error) {
+	var shop models.Shop
+	err := s.DB.GetContext(ctx, &shop, `
+		INSERT INTO shops(name, allocation_strategy) VALUES ($1, COALESCE($2, 'priority'))
+		RETURNING `+shopColumns, in.Name, in.AllocationStrategy)
+	if isUniqueViolation(err) {
+		return models.Shop{}, ErrDuplicateShopName
+	}
+	return shop, err
+}
+
+func (s *ShopsService) Get(ctx context.Context, id string) (models.Shop, error) {
+	var shop models.Shop
+	err := s.DB.GetContext(ctx, &shop, `SELECT `+shopColumns+` FROM shops WHERE id=$1 AND deleted_at IS NULL`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Shop{}, ErrShopNotFound
+	}
+	return shop, err
+}
+
+func (s *ShopsService) Update(ctx context.Context, id string, in ShopInput) (models.Shop, error) {
+	var shop models.Shop
+	err := s.DB.GetContext(ctx, &shop, `
+		UPDATE shops SET name=COALESCE($2, name), allocation_strategy=COALESCE($3, allocation_strategy), updated_at=now()
+		WHERE id=$1 AND deleted_at IS NULL
+		RETURNING `+shopColumns, id, in.Name, in.AllocationStrategy)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return models.Shop{}, ErrShopNotFound
+	case isUniqueViolation(err):
+		return models.Shop{}, ErrDuplicateShopName
+	}
+	return shop, err
+}
+
+// List returns shops oldest first. The returned cursor is empty on the last
+// page and otherwise fetches the page after this one.
+func (s *ShopsService) List(ctx context.Context, f PageFilter) ([]models.Shop, string, error) {
+	q, args, limit, err := f.page(`SELECT `+shopColumns+` FROM shops WHERE TRUE`, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var out []models.Shop
+	if err := s.DB.SelectContext(ctx, &out, q, args...); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(out) > limit {
+		out = out[:limit]
+		last := out[len(out)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+	return out, next, nil
+}
+
+// Delete soft-deletes a shop. Its warehouses must be deleted first, which in
+// turn requires them to be empty.
+func (s *ShopsService) Delete(ctx context.Context, id string) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var locked string
+		if err := tx.GetContext(ctx, &locked, `SELECT id FROM shops WHERE id=$1 AND deleted_at IS NULL FOR UPDATE`, id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrShopNotFound
+			}
+			return err
+		}
+		var warehouses int
+		if err := tx.GetContext(ctx, &warehouses, `SELECT COUNT(*) FROM warehouses WHERE shop_id=$1 AND deleted_at IS NULL`, id); err != nil {
+			return err
+		}
+		if warehouses > 0 {
+			return fmt.Errorf("%w: %d left", ErrShopInUse, warehouses)
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE shops SET deleted_at=now(), updated_at=now() WHERE id=$1`, id)
+		return err
+	})
+}
+
+// Members lists the shop's staff and admins.
+func (s *ShopsService) Members(ctx context.Context, shopID string) ([]models.ShopMember, error) {
+	if _, err := s.Get(ctx, shopID); err != nil {
+		return nil, err
+	}
+	var out []models.ShopMember
+	err := s.DB.SelectContext(ctx, &out, `
+		SELECT m.shop_id, m.user_id, u.email, m.role, m.created_at FROM shop_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.shop_id=$1 ORDER BY m.created_at, m.user_id
+	`, shopID)
+	return out, err
+}
+
+// SetMember grants a user a role in the shop, replacing any role they had.
+// The user's access token picks it up at their next login or token refresh.
+func (s *ShopsService) SetMember(ctx context.Context, shopID, userID string, role models.ShopRole) (models.ShopMember, error) {
+	var m models.ShopMember
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var locked string
+		if err := tx.GetContext(ctx, &locked, `SELECT id FROM shops WHERE id=$1 AND deleted_at IS NULL FOR KEY SHARE`, shopID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrShopNotFound
+			}
+			return err
+		}
+		err := tx.GetContext(ctx, &m, `
+			WITH upserted AS (
+				INSERT INTO shop_members(shop_id, user_id, role) VALUES ($1, $2, $3)
+				ON CONFLICT (shop_id, user_id) DO UPDATE SET role = EXCLUDED.role
+				RETURNING shop_id, user_id, role, created_at
+			)
+			SELECT up.shop_id, up.user_id, u.email, up.role, up.created_at FROM upserted up JOIN users u ON u.id = up.user_id
+		`, shopID, userID, role)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return ErrUserNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return models.ShopMember{}, err
+	}
+	return m, nil
+}
+
+// RemoveMember revokes the user's role in the shop. Access tokens issued
+// before keep it until they expire or are refreshed.
+func (s *ShopsService) RemoveMember(ctx context.Context, shopID, userID string) error {
+	res, err := s.DB.ExecContext(ctx, `DELETE FROM shop_members WHERE shop_id=$1 AND user_id=$2`, shopID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/testutils"
+)
+
+var shopCols = []string{"id", "name", "allocation_strategy", "created_at", "updated_at", "deleted_at"}
+
+func TestShopsService_Create(t *testing.T) {
+	name := "Main street"
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "creates with default strategy",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO shops\(name, allocation_strategy\) VALUES \(\$1, COALESCE\(\$2, 'priority'\)\)`).
+					WithArgs(name, nil).
+					WillReturnRows(sqlmock.NewRows(shopCols).AddRow("shop-1", name, "priority", time.Now(), time.Now(), nil))
+			},
+		},
+		{
+			name: "duplicate name",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO shops`).
+					WillReturnError(&pq.Error{Code: "23505"})
+			},
+			wantErr: ErrDuplicateShopName,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &ShopsService{DB: db}
+			tt.mockSetup(mock)
+
+			shop, err := service.Create(context.Background(), ShopInput{Name: &name})
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "shop-1", shop.ID)
+				assert.Equal(t, "priority", shop.AllocationStrategy)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsService_Update(t *testing.T) {
+	strategy := "nearest"
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "changes only the given fields",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE shops SET name=COALESCE\(\$2, name\), allocation_strategy=COALESCE\(\$3, allocation_strategy\)`).
+					WithArgs("shop-1", nil, strategy).
+					WillReturnRows(sqlmock.NewRows(shopCols).AddRow("shop-1", "Main street", strategy, time.Now(), time.Now(), nil))
+			},
+		},
+		{
+			name: "deleted or missing shop",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE shops .* WHERE id=\$1 AND deleted_at IS NULL`).
+					WillReturnRows(sqlmock.NewRows(shopCols))
+			},
+			wantErr: ErrShopNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &ShopsService{DB: db}
+			tt.mockSetup(mock)
+
+			shop, err := service.Update(context.Background(), "shop-1", ShopInput{AllocationStrategy: &strategy})
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, strategy, shop.AllocationStrategy)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsService_List(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		filter    PageFilter
+		mockSetup func(sqlmock.Sqlmock)
+		wantLen   int
+		wantNext  bool
+		wantErr   error
+	}{
+		{
+			name:   "first page has a cursor when more rows exist",
+			filter: PageFilter{Limit: 1},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM shops WHERE TRUE AND deleted_at IS NULL ORDER BY created_at, id LIMIT \$1`).
+					WithArgs(2).
+					WillReturnRows(sqlmock.NewRows(shopCols).
+						AddRow("shop-1", "A", "priority", now, now, nil).
+						AddRow("shop-2", "B", "priority", now, now, nil))
+			},
+			wantLen:  1,
+			wantNext: true,
+		},
+		{
+			name:   "cursor and deleted rows",
+			filter: PageFilter{IncludeDeleted: true, Cursor: encodeCursor(now, "9d2b4f6a-1c3e-4a5b-8d7f-0e2c4a6b8d10")},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM shops WHERE TRUE AND \(created_at, id\) > \(\$1, \$2\) ORDER BY created_at, id LIMIT \$3`).
+					WithArgs(now, "9d2b4f6a-1c3e-4a5b-8d7f-0e2c4a6b8d10", defaultCatalogPageSize+1).
+					WillReturnRows(sqlmock.NewRows(shopCols).AddRow("shop-2", "B", "priority", now, now, now))
+			},
+			wantLen: 1,
+		},
+		{
+			name:      "bad cursor",
+			filter:    PageFilter{Cursor: "%%%"},
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidCursor,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &ShopsService{DB: db}
+			tt.mockSetup(mock)
+
+			list, next, err := service.List(context.Background(), tt.filter)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, list, tt.wantLen)
+				assert.Equal(t, tt.wantNext, next != "")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsService_Delete(t *testing.T) {
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "empty shop",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WithArgs("shop-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM warehouses WHERE shop_id=\$1 AND deleted_at IS NULL`).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec(`UPDATE shops SET deleted_at=now\(\)`).
+					WithArgs("shop-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "shop with warehouses",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`SELECT COUNT\(\*\) FROM warehouses`).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrShopInUse,
+		},
+		{
+			name: "already deleted",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrShopNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &ShopsService{DB: db}
+			tt.mockSetup(mock)
+
+			err := service.Delete(context.Background(), "shop-1")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsService_SetMember(t *testing.T) {
+	memberCols := []string{"shop_id", "user_id", "email", "role", "created_at"}
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "grants role",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WithArgs("shop-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO shop_members\(shop_id, user_id, role\) VALUES \(\$1, \$2, \$3\)\s+ON CONFLICT \(shop_id, user_id\) DO UPDATE SET role = EXCLUDED.role`).
+					WithArgs("shop-1", "user-2", models.ShopAdmin).
+					WillReturnRows(sqlmock.NewRows(memberCols).AddRow("shop-1", "user-2", "staff@example.com", "admin", time.Now()))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "unknown user",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO shop_members`).
+					WillReturnError(&pq.Error{Code: "23503"})
+				mock.ExpectRollback()
+			},
+			wantErr: ErrUserNotFound,
+		},
+		{
+			name: "deleted shop",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrShopNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &ShopsService{DB: db}
+			tt.mockSetup(mock)
+
+			m, err := service.SetMember(context.Background(), "shop-1", "user-2", models.ShopAdmin)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, models.ShopAdmin, m.Role)
+				assert.Equal(t, "staff@example.com", m.Email)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestShopsService_RemoveMember(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectExec(`DELETE FROM shop_members WHERE shop_id=\$1 AND user_id=\$2`).
+		WithArgs("shop-1", "user-2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := (&ShopsService{DB: db}).RemoveMember(context.Background(), "shop-1", "user-2")
+
+	assert.ErrorIs(t, err, ErrMemberNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
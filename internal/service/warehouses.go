@@ -2,30 +2,761 @@ package service
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"ecommerce-shop/internal/allocation"
+	"ecommerce-shop/internal/models"
+	"ecommerce-shop/internal/repo"
+)
+
+var (
+	ErrWarehouseNotFound = errors.New("warehouse not found")
+	ErrSameWarehouse     = errors.New("source and destination warehouse are the same")
+	ErrCrossShopTransfer = errors.New("warehouses belong to different shops")
+	ErrTransferNotFound  = errors.New("transfer not found")
+
+	ErrInvalidReceivedQuantity = errors.New("received quantity must be between 0 and the dispatched quantity")
+	ErrInvalidAdjustment       = errors.New("adjustment does not match its reason")
+	ErrBelowReserved           = errors.New("on-hand stock cannot drop below reserved stock")
+	ErrUnknownPolicy           = errors.New("unknown deactivation policy")
+	ErrWarehouseInUse          = errors.New("warehouse holds live reservations")
+	ErrReallocationShortfall   = errors.New("other warehouses cannot take over the reservations")
+	ErrWarehouseNotEmpty       = errors.New("warehouse still holds stock")
+)
+
+// Deactivation policies for warehouses that still hold live reservations.
+const (
+	// DeactivateBlock refuses to deactivate while reservations are live.
+	DeactivateBlock = "block"
+	// DeactivateDrain stops new checkouts but lets reserved orders be paid
+	// from the warehouse or expire.
+	DeactivateDrain = "drain"
+	// DeactivateReallocate moves every live reservation to the shop's other
+	// active warehouses, or fails if they lack the stock.
+	DeactivateReallocate = "reallocate"
 )
 
 type WarehousesService struct{ DB *sqlx.DB }
 
 func (s *WarehousesService) SetActive(ctx context.Context, id string, active bool) error {
-	_, err := s.DB.ExecContext(ctx, `UPDATE warehouses SET active=$2 WHERE id=$1`, id, active)
-	return err
+	res, err := s.DB.ExecContext(ctx, `UPDATE warehouses SET active=$2 WHERE id=$1 AND deleted_at IS NULL`, id, active)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWarehouseNotFound
+	}
+	return nil
+}
+
+// WarehouseInput holds the fields to set; nil fields are left unchanged on
+// update and take their defaults on create. Address and Metadata replace the
+// stored value as a whole.
+type WarehouseInput struct {
+	Name      *string
+	Priority  *int
+	Latitude  *float64
+	Longitude *float64
+	Address   *models.Address
+	Metadata  map[string]interface{}
+}
+
+// addressArgs expands an optional address into one nullable argument per
+// column.
+func (in WarehouseInput) addressArgs() []interface{} {
+	if in.Address == nil {
+		return make([]interface{}, 6)
+	}
+	a := in.Address
+	return []interface{}{a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country}
+}
+
+func (in WarehouseInput) metadataArg() (interface{}, error) {
+	if in.Metadata == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(in.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+const warehouseColumns = `id, shop_id, name, active, priority, latitude, longitude,
+	address_line1, address_line2, city, region, postal_code, country, metadata,
+	created_at, updated_at, deleted_at`
+
+// Create adds an active warehouse to a shop. It holds no stock until some is
+// received or transferred in.
+func (s *WarehousesService) Create(ctx context.Context, shopID string, in WarehouseInput) (models.Warehouse, error) {
+	meta, err := in.metadataArg()
+	if err != nil {
+		return models.Warehouse{}, err
+	}
+	var wh models.Warehouse
+	err = repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		// keeps the shop from being deleted until the warehouse is in
+		var locked string
+		if err := tx.GetContext(ctx, &locked, `SELECT id FROM shops WHERE id=$1 AND deleted_at IS NULL FOR KEY SHARE`, shopID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrShopNotFound
+			}
+			return err
+		}
+		args := append([]interface{}{shopID, in.Name, in.Priority, in.Latitude, in.Longitude, meta}, in.addressArgs()...)
+		return tx.GetContext(ctx, &wh, `
+			INSERT INTO warehouses(shop_id, name, priority, latitude, longitude, metadata,
+				address_line1, address_line2, city, region, postal_code, country)
+			VALUES ($1, $2, COALESCE($3, 100), $4, $5, COALESCE($6::jsonb, '{}'),
+				COALESCE($7, ''), COALESCE($8, ''), COALESCE($9, ''), COALESCE($10, ''), COALESCE($11, ''), COALESCE($12, ''))
+			RETURNING `+warehouseColumns, args...)
+	})
+	if err != nil {
+		return models.Warehouse{}, err
+	}
+	return wh, nil
 }
 
-func (s *WarehousesService) Transfer(ctx context.Context, from, to, productID string, qty int) error {
-	tx, err := s.DB.BeginTxx(ctx, nil)
+func (s *WarehousesService) Get(ctx context.Context, id string) (models.Warehouse, error) {
+	var wh models.Warehouse
+	err := s.DB.GetContext(ctx, &wh, `SELECT `+warehouseColumns+` FROM warehouses WHERE id=$1 AND deleted_at IS NULL`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Warehouse{}, ErrWarehouseNotFound
+	}
+	return wh, err
+}
+
+// Update changes a warehouse's details. Activation has its own endpoints,
+// since deactivating has to deal with live reservations.
+func (s *WarehousesService) Update(ctx context.Context, id string, in WarehouseInput) (models.Warehouse, error) {
+	meta, err := in.metadataArg()
+	if err != nil {
+		return models.Warehouse{}, err
+	}
+	var wh models.Warehouse
+	args := append([]interface{}{id, in.Name, in.Priority, in.Latitude, in.Longitude, meta}, in.addressArgs()...)
+	err = s.DB.GetContext(ctx, &wh, `
+		UPDATE warehouses SET name=COALESCE($2, name), priority=COALESCE($3, priority),
+			latitude=COALESCE($4, latitude), longitude=COALESCE($5, longitude), metadata=COALESCE($6::jsonb, metadata),
+			address_line1=COALESCE($7, address_line1), address_line2=COALESCE($8, address_line2), city=COALESCE($9, city),
+			region=COALESCE($10, region), postal_code=COALESCE($11, postal_code), country=COALESCE($12, country),
+			updated_at=now()
+		WHERE id=$1 AND deleted_at IS NULL
+		RETURNING `+warehouseColumns, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Warehouse{}, ErrWarehouseNotFound
+	}
+	return wh, err
+}
+
+// List returns warehouses oldest first, optionally only those of one shop.
+// The returned cursor is empty on the last page and otherwise fetches the
+// page after this one.
+func (s *WarehousesService) List(ctx context.Context, shopID string, f PageFilter) ([]models.Warehouse, string, error) {
+	q := `SELECT ` + warehouseColumns + ` FROM warehouses WHERE TRUE`
+	var args []interface{}
+	if shopID != "" {
+		args = append(args, shopID)
+		q += fmt.Sprintf(" AND shop_id=$%d", len(args))
+	}
+	q, args, limit, err := f.page(q, args)
 	if err != nil {
+		return nil, "", err
+	}
+	var out []models.Warehouse
+	if err := s.DB.SelectContext(ctx, &out, q, args...); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(out) > limit {
+		out = out[:limit]
+		last := out[len(out)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+	return out, next, nil
+}
+
+// Delete deactivates and soft-deletes a warehouse. It must be emptied first:
+// no live reservations, no stock on hand and no transfer in flight.
+func (s *WarehousesService) Delete(ctx context.Context, id string) error {
+	return repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		// a full lock, unlike Deactivate: it also waits out transactions that
+		// are writing stock or reservations against the warehouse
+		var locked string
+		if err := tx.GetContext(ctx, &locked, `SELECT id FROM warehouses WHERE id=$1 AND deleted_at IS NULL FOR UPDATE`, id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrWarehouseNotFound
+			}
+			return err
+		}
+		var reserved, onHand, transfers int
+		if err := tx.QueryRowxContext(ctx, `
+			SELECT
+				(SELECT COUNT(*) FROM reservations WHERE warehouse_id=$1 AND released=FALSE AND expires_at>now()),
+				(SELECT COALESCE(SUM(quantity), 0) FROM inventory WHERE warehouse_id=$1),
+				(SELECT COUNT(*) FROM stock_transfers WHERE status IN ($2, $3) AND $1 IN (from_warehouse_id, to_warehouse_id))
+		`, id, models.TransferRequested, models.TransferDispatched).Scan(&reserved, &onHand, &transfers); err != nil {
+			return err
+		}
+		switch {
+		case reserved > 0:
+			return fmt.Errorf("%w: %d reservations", ErrWarehouseInUse, reserved)
+		case onHand > 0:
+			return fmt.Errorf("%w: %d units on hand", ErrWarehouseNotEmpty, onHand)
+		case transfers > 0:
+			return fmt.Errorf("%w: %d transfers in flight", ErrWarehouseNotEmpty, transfers)
+		}
+		_, err := tx.ExecContext(ctx, `UPDATE warehouses SET active=FALSE, deleted_at=now(), updated_at=now() WHERE id=$1`, id)
+		return err
+	})
+}
+
+// AffectedLine is a live reservation of the deactivated warehouse. MovedTo is
+// only set under the reallocate policy.
+type AffectedLine struct {
+	ProductID string
+	Quantity  int
+	MovedTo   []allocation.Allocation
+}
+
+type AffectedOrder struct {
+	OrderID string
+	Lines   []AffectedLine
+}
+
+// DeactivationReport lists the orders that held stock in the warehouse when it
+// was deactivated and what happened to their reservations.
+type DeactivationReport struct {
+	WarehouseID string
+	Policy      string
+	Orders      []AffectedOrder
+}
+
+// Deactivate takes a warehouse out of checkout allocation, handling its live
+// reservations according to policy ("" means block).
+func (s *WarehousesService) Deactivate(ctx context.Context, id, policy string) (DeactivationReport, error) {
+	if policy == "" {
+		policy = DeactivateBlock
+	}
+	if policy != DeactivateBlock && policy != DeactivateDrain && policy != DeactivateReallocate {
+		return DeactivationReport{}, fmt.Errorf("%w: %q", ErrUnknownPolicy, policy)
+	}
+	var report DeactivationReport
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		report = DeactivationReport{WarehouseID: id, Policy: policy}
+		// waits for checkouts that are allocating from this warehouse; NO KEY
+		// keeps ledger and reservation inserts (foreign key checks) unblocked
+		var wh models.Warehouse
+		if err := tx.GetContext(ctx, &wh, `SELECT id, shop_id, active FROM warehouses WHERE id=$1 FOR NO KEY UPDATE`, id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrWarehouseNotFound
+			}
+			return err
+		}
+		// Pay and Cancel lock the order first, so holding the orders keeps
+		// their reservations from changing under us
+		if _, err := tx.ExecContext(ctx, `
+			SELECT id FROM orders WHERE id IN (
+				SELECT order_id FROM reservations WHERE warehouse_id=$1 AND released=FALSE AND expires_at>now()
+			) ORDER BY id FOR UPDATE
+		`, id); err != nil {
+			return err
+		}
+		var live []models.Reservation
+		if err := tx.SelectContext(ctx, &live, `
+			SELECT id, order_id, warehouse_id, product_id, quantity, expires_at, released FROM reservations
+			WHERE warehouse_id=$1 AND released=FALSE AND expires_at>now()
+			ORDER BY order_id, product_id
+		`, id); err != nil {
+			return err
+		}
+		if policy == DeactivateBlock && len(live) > 0 {
+			return fmt.Errorf("%w: %d reservations across orders %s", ErrWarehouseInUse, len(live), strings.Join(orderIDs(live), ", "))
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE warehouses SET active=FALSE WHERE id=$1`, id); err != nil {
+			return err
+		}
+		moved := map[string][]allocation.Allocation{}
+		if policy == DeactivateReallocate && len(live) > 0 {
+			var err error
+			if moved, err = reallocate(ctx, tx, wh.ShopID, live); err != nil {
+				return err
+			}
+		}
+		for _, r := range live {
+			if n := len(report.Orders); n == 0 || report.Orders[n-1].OrderID != r.OrderID {
+				report.Orders = append(report.Orders, AffectedOrder{OrderID: r.OrderID})
+			}
+			o := &report.Orders[len(report.Orders)-1]
+			o.Lines = append(o.Lines, AffectedLine{ProductID: r.ProductID, Quantity: r.Quantity, MovedTo: moved[r.ID]})
+		}
+		return nil
+	})
+	if err != nil {
+		return DeactivationReport{}, err
+	}
+	return report, nil
+}
+
+// reallocate moves each reservation to the shop's remaining active warehouses
+// using the shop's allocation strategy, keeping its expiry. It returns the new
+// placements keyed by the id of the reservation they replace.
+func reallocate(ctx context.Context, tx *sqlx.Tx, shopID string, live []models.Reservation) (map[string][]allocation.Allocation, error) {
+	strategy, seq, err := allocator(ctx, tx, shopID)
+	if err != nil {
+		return nil, err
+	}
+	whs, err := repo.ActiveWarehousesForShop(ctx, tx, shopID)
+	if err != nil {
+		return nil, err
+	}
+	whIDs := make([]string, 0, len(whs))
+	for _, wh := range whs {
+		whIDs = append(whIDs, wh.ID)
+	}
+	var productIDs []string
+	seen := map[string]bool{}
+	for _, r := range live {
+		if !seen[r.ProductID] {
+			seen[r.ProductID] = true
+			productIDs = append(productIDs, r.ProductID)
+		}
+	}
+	onHand, err := repo.LockInventory(ctx, tx, whIDs, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := repo.SumReserved(ctx, tx, whIDs, productIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	moved := map[string][]allocation.Allocation{}
+	for _, r := range live {
+		cands := make([]allocation.Candidate, 0, len(whs))
+		for _, wh := range whs {
+			k := repo.InventoryKey{WarehouseID: wh.ID, ProductID: r.ProductID}
+			cands = append(cands, candidate(wh, onHand[k]-reserved[k]))
+		}
+		allocs, short := allocation.Allocate(strategy, allocation.Line{Quantity: r.Quantity, Seq: seq}, cands)
+		if short > 0 {
+			return nil, fmt.Errorf("%w: order %s is %d short of product %s", ErrReallocationShortfall, r.OrderID, short, r.ProductID)
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM reservations WHERE id=$1`, r.ID); err != nil {
+			return nil, err
+		}
+		for _, a := range allocs {
+			if err := repo.AddReservation(ctx, tx, r.OrderID, a.WarehouseID, r.ProductID, a.Quantity, r.ExpiresAt); err != nil {
+				return nil, err
+			}
+			reserved[repo.InventoryKey{WarehouseID: a.WarehouseID, ProductID: r.ProductID}] += a.Quantity
+		}
+		moved[r.ID] = allocs
+	}
+	return moved, nil
+}
+
+func orderIDs(rs []models.Reservation) []string {
+	var out []string
+	for i, r := range rs {
+		if i == 0 || rs[i-1].OrderID != r.OrderID {
+			out = append(out, r.OrderID)
+		}
+	}
+	return out
+}
+
+// StockLevel is an inventory row after a manual change.
+type StockLevel struct {
+	WarehouseID string
+	ProductID   string
+	OnHand      int
+	Reserved    int
+}
+
+// Adjust applies a signed change to a warehouse's stock of a product. Receipts
+// must add stock, damage and shrinkage must remove it and corrections may go
+// either way.
+func (s *WarehousesService) Adjust(ctx context.Context, actorID, warehouseID, productID string, delta int, reason string) (StockLevel, error) {
+	if delta == 0 {
+		return StockLevel{}, fmt.Errorf("%w: delta must not be zero", ErrInvalidAdjustment)
+	}
+	return s.adjust(ctx, actorID, warehouseID, productID, reason, func(int) int { return delta })
+}
+
+// SetCount replaces a warehouse's stock of a product with an absolute count,
+// recording the difference with the given reason. Setting the current count
+// again changes nothing.
+func (s *WarehousesService) SetCount(ctx context.Context, actorID, warehouseID, productID string, qty int, reason string) (StockLevel, error) {
+	if qty < 0 {
+		return StockLevel{}, fmt.Errorf("%w: count must not be negative", ErrInvalidAdjustment)
+	}
+	return s.adjust(ctx, actorID, warehouseID, productID, reason, func(onHand int) int { return qty - onHand })
+}
+
+// adjust locks the inventory row, derives the change from the locked on-hand
+// quantity and applies it unless it would leave less than is reserved.
+func (s *WarehousesService) adjust(ctx context.Context, actorID, warehouseID, productID, reason string, deltaFor func(onHand int) int) (StockLevel, error) {
+	var lvl StockLevel
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		lvl = StockLevel{WarehouseID: warehouseID, ProductID: productID}
+		if err := stockTargetExists(ctx, tx, warehouseID, productID); err != nil {
+			return err
+		}
+		key := repo.InventoryKey{WarehouseID: warehouseID, ProductID: productID}
+		onHand, err := repo.LockInventory(ctx, tx, []string{warehouseID}, []string{productID})
+		if err != nil {
+			return err
+		}
+		reserved, err := repo.SumReserved(ctx, tx, []string{warehouseID}, []string{productID})
+		if err != nil {
+			return err
+		}
+		lvl.OnHand, lvl.Reserved = onHand[key], reserved[key]
+		delta := deltaFor(lvl.OnHand)
+		if delta == 0 {
+			return nil
+		}
+		if err := checkAdjustmentReason(reason, delta); err != nil {
+			return err
+		}
+		if lvl.OnHand+delta < lvl.Reserved {
+			return fmt.Errorf("%w: %d reserved, %d on hand after change", ErrBelowReserved, lvl.Reserved, lvl.OnHand+delta)
+		}
+		lvl.OnHand, err = repo.MoveStock(ctx, tx, repo.Movement{
+			WarehouseID: warehouseID,
+			ProductID:   productID,
+			Delta:       delta,
+			Reason:      reason,
+			ActorID:     actorID,
+		})
 		return err
+	})
+	if err != nil {
+		return StockLevel{}, err
+	}
+	return lvl, nil
+}
+
+func checkAdjustmentReason(reason string, delta int) error {
+	switch reason {
+	case models.MovementReceipt:
+		if delta < 0 {
+			return fmt.Errorf("%w: a receipt must add stock", ErrInvalidAdjustment)
+		}
+	case models.MovementDamage, models.MovementShrinkage:
+		if delta > 0 {
+			return fmt.Errorf("%w: %s must remove stock", ErrInvalidAdjustment, reason)
+		}
+	case models.MovementCorrection:
+	default:
+		return fmt.Errorf("%w: unknown reason %q", ErrInvalidAdjustment, reason)
 	}
-	defer tx.Rollback()
-	if _, err := tx.ExecContext(ctx, `UPDATE inventory SET quantity = quantity - $3 WHERE warehouse_id=$1 AND product_id=$2`, from, productID, qty); err != nil {
+	return nil
+}
+
+func stockTargetExists(ctx context.Context, tx *sqlx.Tx, warehouseID, productID string) error {
+	var wh, prod bool
+	if err := tx.QueryRowxContext(ctx, `SELECT EXISTS(SELECT 1 FROM warehouses WHERE id=$1 AND deleted_at IS NULL), EXISTS(SELECT 1 FROM products WHERE id=$2)`, warehouseID, productID).Scan(&wh, &prod); err != nil {
 		return err
 	}
-	if _, err := tx.ExecContext(ctx, `INSERT INTO inventory(warehouse_id, product_id, quantity) VALUES ($1,$2,$3)
-		ON CONFLICT (warehouse_id, product_id) DO UPDATE SET quantity = inventory.quantity + EXCLUDED.quantity`, to, productID, qty); err != nil {
+	if !wh {
+		return ErrWarehouseNotFound
+	}
+	if !prod {
+		return fmt.Errorf("%w: %s", ErrUnknownProduct, productID)
+	}
+	return nil
+}
+
+const (
+	defaultTransferPageSize = 50
+	maxTransferPageSize     = 100
+	defaultMovementPageSize = 50
+	maxMovementPageSize     = 200
+)
+
+const transferColumns = `id, shop_id, from_warehouse_id, to_warehouse_id, product_id, quantity, received_quantity, status, created_at, updated_at, dispatched_at, received_at`
+
+// TransferFilter narrows ListTransfers; zero fields are ignored. WarehouseID
+// matches either end of the transfer.
+type TransferFilter struct {
+	Status      models.TransferStatus
+	WarehouseID string
+	ProductID   string
+	Limit       int
+}
+
+// RequestTransfer records a transfer of qty units between two warehouses of
+// the same shop. No stock moves until it is dispatched.
+func (s *WarehousesService) RequestTransfer(ctx context.Context, from, to, productID string, qty int) (models.StockTransfer, error) {
+	if from == to {
+		return models.StockTransfer{}, ErrSameWarehouse
+	}
+	var t models.StockTransfer
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		shopID, err := sameShop(ctx, tx, from, to)
+		if err != nil {
+			return err
+		}
+		err = tx.GetContext(ctx, &t, `INSERT INTO stock_transfers(shop_id, from_warehouse_id, to_warehouse_id, product_id, quantity)
+			VALUES ($1,$2,$3,$4,$5) RETURNING `+transferColumns, shopID, from, to, productID, qty)
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return fmt.Errorf("%w: %s", ErrUnknownProduct, productID)
+		}
 		return err
+	})
+	if err != nil {
+		return models.StockTransfer{}, err
 	}
-	return tx.Commit()
+	return t, nil
 }
 
+// Dispatch takes the units out of the source warehouse and puts them in
+// transit. Only stock that is on hand and not held by a live reservation can
+// leave. actorID is recorded on the ledger movement.
+func (s *WarehousesService) Dispatch(ctx context.Context, actorID, id string) (models.StockTransfer, error) {
+	var t models.StockTransfer
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		if t, err = lockTransfer(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := t.Status.TransitionTo(models.TransferDispatched); err != nil {
+			return err
+		}
+		src := repo.InventoryKey{WarehouseID: t.FromWarehouseID, ProductID: t.ProductID}
+		onHand, err := repo.LockInventory(ctx, tx, []string{src.WarehouseID}, []string{src.ProductID})
+		if err != nil {
+			return err
+		}
+		reserved, err := repo.SumReserved(ctx, tx, []string{src.WarehouseID}, []string{src.ProductID})
+		if err != nil {
+			return err
+		}
+		if available := onHand[src] - reserved[src]; available < t.Quantity {
+			return fmt.Errorf("%w: %d available in source warehouse", ErrInsufficientStock, max(available, 0))
+		}
+		if _, err := repo.MoveStock(ctx, tx, repo.Movement{
+			WarehouseID: src.WarehouseID,
+			ProductID:   src.ProductID,
+			Delta:       -t.Quantity,
+			Reason:      models.MovementTransferOut,
+			TransferID:  t.ID,
+			ActorID:     actorID,
+		}); err != nil {
+			return err
+		}
+		return tx.GetContext(ctx, &t, `UPDATE stock_transfers SET status=$2, dispatched_at=now(), updated_at=now() WHERE id=$1 RETURNING `+transferColumns, id, models.TransferDispatched)
+	})
+	if err != nil {
+		return models.StockTransfer{}, err
+	}
+	return t, nil
+}
+
+// Receive books the units that arrived into the destination warehouse. A nil
+// qty means everything dispatched arrived; fewer units leave the transfer
+// partially received and the difference is written off.
+func (s *WarehousesService) Receive(ctx context.Context, actorID, id string, qty *int) (models.StockTransfer, error) {
+	var t models.StockTransfer
+	err := repo.New(s.DB).WithTxRetry(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		if t, err = lockTransfer(ctx, tx, id); err != nil {
+			return err
+		}
+		received := t.Quantity
+		if qty != nil {
+			received = *qty
+		}
+		if received < 0 || received > t.Quantity {
+			return ErrInvalidReceivedQuantity
+		}
+		next := models.TransferReceived
+		if received < t.Quantity {
+			next = models.TransferPartiallyReceived
+		}
+		if err := t.Status.TransitionTo(next); err != nil {
+			return err
+		}
+		if received > 0 {
+			if _, err := repo.MoveStock(ctx, tx, repo.Movement{
+				WarehouseID: t.ToWarehouseID,
+				ProductID:   t.ProductID,
+				Delta:       received,
+				Reason:      models.MovementTransferIn,
+				TransferID:  t.ID,
+				ActorID:     actorID,
+			}); err != nil {
+				return err
+			}
+		}
+		return tx.GetContext(ctx, &t, `UPDATE stock_transfers SET status=$2, received_quantity=$3, received_at=now(), updated_at=now() WHERE id=$1 RETURNING `+transferColumns, id, next, received)
+	})
+	if err != nil {
+		return models.StockTransfer{}, err
+	}
+	return t, nil
+}
+
+// CancelTransfer drops a transfer that has not been dispatched yet.
+func (s *WarehousesService) CancelTransfer(ctx context.Context, id string) (models.StockTransfer, error) {
+	var t models.StockTransfer
+	err := repo.New(s.DB).WithTx(ctx, func(tx *sqlx.Tx) error {
+		var err error
+		if t, err = lockTransfer(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := t.Status.TransitionTo(models.TransferCancelled); err != nil {
+			return err
+		}
+		return tx.GetContext(ctx, &t, `UPDATE stock_transfers SET status=$2, updated_at=now() WHERE id=$1 RETURNING `+transferColumns, id, models.TransferCancelled)
+	})
+	if err != nil {
+		return models.StockTransfer{}, err
+	}
+	return t, nil
+}
+
+func (s *WarehousesService) GetTransfer(ctx context.Context, id string) (models.StockTransfer, error) {
+	var t models.StockTransfer
+	err := s.DB.GetContext(ctx, &t, `SELECT `+transferColumns+` FROM stock_transfers WHERE id=$1`, id)
+	if errors.Is(err, sql.ErrNoRows) || isInvalidText(err) {
+		return models.StockTransfer{}, ErrTransferNotFound
+	}
+	return t, err
+}
+
+// ListTransfers returns the newest transfers matching f.
+func (s *WarehousesService) ListTransfers(ctx context.Context, f TransferFilter) ([]models.StockTransfer, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultTransferPageSize
+	}
+	if limit > maxTransferPageSize {
+		limit = maxTransferPageSize
+	}
+	q := `SELECT ` + transferColumns + ` FROM stock_transfers WHERE TRUE`
+	var args []interface{}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		q += fmt.Sprintf(" AND status=$%d", len(args))
+	}
+	if f.WarehouseID != "" {
+		args = append(args, f.WarehouseID)
+		q += fmt.Sprintf(" AND (from_warehouse_id=$%d OR to_warehouse_id=$%d)", len(args), len(args))
+	}
+	if f.ProductID != "" {
+		args = append(args, f.ProductID)
+		q += fmt.Sprintf(" AND product_id=$%d", len(args))
+	}
+	args = append(args, limit)
+	q += fmt.Sprintf(" ORDER BY created_at DESC, id DESC LIMIT $%d", len(args))
+
+	out := []models.StockTransfer{}
+	if err := s.DB.SelectContext(ctx, &out, q, args...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MovementFilter narrows a warehouse's ledger listing. Zero values mean no
+// filter; Cursor is the next_cursor of the previous page.
+type MovementFilter struct {
+	ProductID  string
+	Reason     string
+	OrderID    string
+	TransferID string
+	From       time.Time
+	To         time.Time
+	Cursor     string
+	Limit      int
+}
+
+// Movements returns the warehouse's ledger entries newest first. The returned
+// cursor is empty on the last page.
+func (s *WarehousesService) Movements(ctx context.Context, warehouseID string, f MovementFilter) ([]models.InventoryMovement, string, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultMovementPageSize
+	}
+	if limit > maxMovementPageSize {
+		limit = maxMovementPageSize
+	}
+	q := `SELECT id, warehouse_id, product_id, delta, balance, reason, order_id, transfer_id, cycle_count_id, actor_id, created_at FROM inventory_movements WHERE warehouse_id=$1`
+	args := []interface{}{warehouseID}
+	for _, c := range []struct{ col, val string }{
+		{"product_id", f.ProductID},
+		{"reason", f.Reason},
+		{"order_id", f.OrderID},
+		{"transfer_id", f.TransferID},
+	} {
+		if c.val != "" {
+			args = append(args, c.val)
+			q += fmt.Sprintf(" AND %s=$%d", c.col, len(args))
+		}
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		q += fmt.Sprintf(" AND created_at>=$%d", len(args))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		q += fmt.Sprintf(" AND created_at<$%d", len(args))
+	}
+	if f.Cursor != "" {
+		before, err := strconv.ParseInt(f.Cursor, 10, 64)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		args = append(args, before)
+		q += fmt.Sprintf(" AND id<$%d", len(args))
+	}
+	args = append(args, limit+1)
+	q += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	out := []models.InventoryMovement{}
+	if err := s.DB.SelectContext(ctx, &out, q, args...); err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(out) > limit {
+		out = out[:limit]
+		next = strconv.FormatInt(out[len(out)-1].ID, 10)
+	}
+	return out, next, nil
+}
+
+// sameShop checks both warehouses exist and share a shop, returning it.
+func sameShop(ctx context.Context, tx *sqlx.Tx, from, to string) (string, error) {
+	var whs []models.Warehouse
+	if err := tx.SelectContext(ctx, &whs, `SELECT id, shop_id FROM warehouses WHERE id = ANY($1) AND deleted_at IS NULL`, pq.Array([]string{from, to})); err != nil {
+		return "", err
+	}
+	if len(whs) != 2 {
+		return "", ErrWarehouseNotFound
+	}
+	if whs[0].ShopID != whs[1].ShopID {
+		return "", ErrCrossShopTransfer
+	}
+	return whs[0].ShopID, nil
+}
+
+func lockTransfer(ctx context.Context, tx *sqlx.Tx, id string) (models.StockTransfer, error) {
+	var t models.StockTransfer
+	err := tx.GetContext(ctx, &t, `SELECT `+transferColumns+` FROM stock_transfers WHERE id=$1 FOR UPDATE`, id)
+	if errors.Is(err, sql.ErrNoRows) || isInvalidText(err) {
+		return models.StockTransfer{}, ErrTransferNotFound
+	}
+	return t, err
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
+	"ecommerce-shop/internal/allocation"
+	"ecommerce-shop/internal/models"
 	"ecommerce-shop/testutils"
 )
 
@@ -17,7 +21,7 @@ func TestWarehousesService_SetActive(t *testing.T) {
 		id        string
 		active    bool
 		mockSetup func(sqlmock.Sqlmock)
-		wantErr   bool
+		wantErr   error
 	}{
 		{
 			name:   "successful activation",
@@ -28,7 +32,6 @@ func TestWarehousesService_SetActive(t *testing.T) {
 					WithArgs("wh-123", true).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
-			wantErr: false,
 		},
 		{
 			name:   "successful deactivation",
@@ -39,7 +42,6 @@ func TestWarehousesService_SetActive(t *testing.T) {
 					WithArgs("wh-123", false).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
-			wantErr: false,
 		},
 		{
 			name:   "warehouse not found",
@@ -50,7 +52,7 @@ func TestWarehousesService_SetActive(t *testing.T) {
 					WithArgs("wh-123", true).
 					WillReturnResult(sqlmock.NewResult(0, 0))
 			},
-			wantErr: false, // No error even if no rows affected
+			wantErr: ErrWarehouseNotFound,
 		},
 		{
 			name:   "database error",
@@ -61,7 +63,7 @@ func TestWarehousesService_SetActive(t *testing.T) {
 					WithArgs("wh-123", true).
 					WillReturnError(sql.ErrConnDone)
 			},
-			wantErr: true,
+			wantErr: sql.ErrConnDone,
 		},
 	}
 
@@ -81,8 +83,8 @@ func TestWarehousesService_SetActive(t *testing.T) {
 			err := service.SetActive(context.Background(), tt.id, tt.active)
 
 			// Assert
-			if tt.wantErr {
-				assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
 			} else {
 				assert.NoError(t, err)
 			}
@@ -93,139 +95,821 @@ func TestWarehousesService_SetActive(t *testing.T) {
 	}
 }
 
-func TestWarehousesService_Transfer(t *testing.T) {
+var transferCols = []string{"id", "shop_id", "from_warehouse_id", "to_warehouse_id", "product_id", "quantity", "received_quantity", "status", "created_at", "updated_at", "dispatched_at", "received_at"}
+
+func transferRow(status string, received int) *sqlmock.Rows {
+	return sqlmock.NewRows(transferCols).
+		AddRow("tr-1", "shop-1", "wh-1", "wh-2", "prod-1", 5, received, status, time.Now(), time.Now(), nil, nil)
+}
+
+func expectLockTransfer(mock sqlmock.Sqlmock, status string) {
+	mock.ExpectQuery(`SELECT id, shop_id, from_warehouse_id, to_warehouse_id, product_id, quantity, received_quantity, status, created_at, updated_at, dispatched_at, received_at FROM stock_transfers WHERE id=\$1 FOR UPDATE`).
+		WithArgs("tr-1").
+		WillReturnRows(transferRow(status, 0))
+}
+
+func TestWarehousesService_RequestTransfer(t *testing.T) {
+	lookup := func(mock sqlmock.Sqlmock, shops ...string) {
+		rows := sqlmock.NewRows([]string{"id", "shop_id"})
+		for i, shop := range shops {
+			rows.AddRow([]string{"wh-1", "wh-2"}[i], shop)
+		}
+		mock.ExpectQuery(`SELECT id, shop_id FROM warehouses WHERE id = ANY\(\$1\)`).
+			WithArgs(pq.Array([]string{"wh-1", "wh-2"})).
+			WillReturnRows(rows)
+	}
+
 	tests := []struct {
 		name      string
 		from      string
 		to        string
-		productID string
-		qty       int
 		mockSetup func(sqlmock.Sqlmock)
-		wantErr   bool
+		wantErr   error
 	}{
 		{
-			name:      "successful transfer",
-			from:      "wh-1",
-			to:        "wh-2",
-			productID: "prod-1",
-			qty:       5,
+			name: "records a requested transfer",
+			from: "wh-1",
+			to:   "wh-2",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock transaction begin
 				mock.ExpectBegin()
-
-				// Mock inventory reduction
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 5).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock inventory addition
-				mock.ExpectExec(`INSERT INTO inventory\(warehouse_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)
-		ON CONFLICT \(warehouse_id, product_id\) DO UPDATE SET quantity = inventory\.quantity \+ EXCLUDED\.quantity`).
-					WithArgs("wh-2", "prod-1", 5).
-					WillReturnResult(sqlmock.NewResult(1, 1))
-
-				// Mock transaction commit
+				lookup(mock, "shop-1", "shop-1")
+				mock.ExpectQuery(`INSERT INTO stock_transfers\(shop_id, from_warehouse_id, to_warehouse_id, product_id, quantity\)`).
+					WithArgs("shop-1", "wh-1", "wh-2", "prod-1", 5).
+					WillReturnRows(transferRow("requested", 0))
 				mock.ExpectCommit()
 			},
-			wantErr: false,
 		},
 		{
 			name:      "transfer to same warehouse",
 			from:      "wh-1",
 			to:        "wh-1",
-			productID: "prod-1",
-			qty:       5,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrSameWarehouse,
+		},
+		{
+			name: "unknown warehouse",
+			from: "wh-1",
+			to:   "wh-2",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				lookup(mock, "shop-1")
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseNotFound,
+		},
+		{
+			name: "warehouses of different shops",
+			from: "wh-1",
+			to:   "wh-2",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock transaction begin
 				mock.ExpectBegin()
+				lookup(mock, "shop-1", "shop-2")
+				mock.ExpectRollback()
+			},
+			wantErr: ErrCrossShopTransfer,
+		},
+	}
 
-				// Mock inventory reduction
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 5).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
 
-				// Mock inventory addition (same warehouse)
-				mock.ExpectExec(`INSERT INTO inventory\(warehouse_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)
-		ON CONFLICT \(warehouse_id, product_id\) DO UPDATE SET quantity = inventory\.quantity \+ EXCLUDED\.quantity`).
-					WithArgs("wh-1", "prod-1", 5).
-					WillReturnResult(sqlmock.NewResult(1, 1))
+			service := &WarehousesService{DB: db}
+			tt.mockSetup(mock)
+
+			tr, err := service.RequestTransfer(context.Background(), tt.from, tt.to, "prod-1", 5)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, models.TransferRequested, tr.Status)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesService_Dispatch(t *testing.T) {
+	stock := func(mock sqlmock.Sqlmock, onHand, held int) {
+		mock.ExpectQuery(`SELECT warehouse_id, product_id, quantity FROM inventory WHERE warehouse_id = ANY\(\$1\) AND product_id = ANY\(\$2\) ORDER BY warehouse_id, product_id FOR UPDATE`).
+			WithArgs(pq.Array([]string{"wh-1"}), pq.Array([]string{"prod-1"})).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).AddRow("wh-1", "prod-1", onHand))
+		mock.ExpectQuery(`SELECT warehouse_id, product_id, SUM\(quantity\) FROM reservations`).
+			WithArgs(pq.Array([]string{"wh-1"}), pq.Array([]string{"prod-1"})).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}).AddRow("wh-1", "prod-1", held))
+	}
 
-				// Mock transaction commit
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "stock leaves the source",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectLockTransfer(mock, "requested")
+				stock(mock, 8, 3)
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3 WHERE warehouse_id=\$1 AND product_id=\$2 RETURNING quantity`).
+					WithArgs("wh-1", "prod-1", -5).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(3))
+				mock.ExpectExec(`INSERT INTO inventory_movements\(warehouse_id, product_id, delta, balance, reason, order_id, transfer_id, cycle_count_id, actor_id\)`).
+					WithArgs("wh-1", "prod-1", -5, 3, models.MovementTransferOut, "", "tr-1", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`UPDATE stock_transfers SET status=\$2, dispatched_at=now\(\), updated_at=now\(\) WHERE id=\$1 RETURNING`).
+					WithArgs("tr-1", models.TransferDispatched).
+					WillReturnRows(transferRow("dispatched", 0))
 				mock.ExpectCommit()
 			},
-			wantErr: false,
 		},
 		{
-			name:      "database error during reduction",
-			from:      "wh-1",
-			to:        "wh-2",
-			productID: "prod-1",
-			qty:       5,
+			name: "reserved units cannot leave",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectLockTransfer(mock, "requested")
+				stock(mock, 6, 2)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInsufficientStock,
+		},
+		{
+			name: "already dispatched",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock transaction begin
 				mock.ExpectBegin()
+				expectLockTransfer(mock, "dispatched")
+				mock.ExpectRollback()
+			},
+			wantErr: models.ErrInvalidTransferTransition,
+		},
+		{
+			name: "unknown transfer",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM stock_transfers WHERE id=\$1 FOR UPDATE`).
+					WithArgs("tr-1").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrTransferNotFound,
+		},
+	}
 
-				// Mock inventory reduction - database error
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 5).
-					WillReturnError(sql.ErrConnDone)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &WarehousesService{DB: db}
+			tt.mockSetup(mock)
+
+			_, err := service.Dispatch(context.Background(), "user-1", "tr-1")
 
-				// Mock transaction rollback
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesService_Receive(t *testing.T) {
+	intPtr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name       string
+		qty        *int
+		mockSetup  func(sqlmock.Sqlmock)
+		wantErr    error
+		wantStatus models.TransferStatus
+	}{
+		{
+			name: "whole shipment arrives",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectLockTransfer(mock, "dispatched")
+				mock.ExpectQuery(`INSERT INTO inventory\(warehouse_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)`).
+					WithArgs("wh-2", "prod-1", 5).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(5))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-2", "prod-1", 5, 5, models.MovementTransferIn, "", "tr-1", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`UPDATE stock_transfers SET status=\$2, received_quantity=\$3, received_at=now\(\), updated_at=now\(\) WHERE id=\$1 RETURNING`).
+					WithArgs("tr-1", models.TransferReceived, 5).
+					WillReturnRows(transferRow("received", 5))
+				mock.ExpectCommit()
+			},
+			wantStatus: models.TransferReceived,
+		},
+		{
+			name: "short delivery",
+			qty:  intPtr(3),
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectLockTransfer(mock, "dispatched")
+				mock.ExpectQuery(`INSERT INTO inventory`).
+					WithArgs("wh-2", "prod-1", 3).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(7))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-2", "prod-1", 3, 7, models.MovementTransferIn, "", "tr-1", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectQuery(`UPDATE stock_transfers SET status=\$2, received_quantity=\$3`).
+					WithArgs("tr-1", models.TransferPartiallyReceived, 3).
+					WillReturnRows(transferRow("partially_received", 3))
+				mock.ExpectCommit()
+			},
+			wantStatus: models.TransferPartiallyReceived,
+		},
+		{
+			name: "more than dispatched",
+			qty:  intPtr(6),
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				expectLockTransfer(mock, "dispatched")
 				mock.ExpectRollback()
 			},
-			wantErr: true,
+			wantErr: ErrInvalidReceivedQuantity,
 		},
 		{
-			name:      "database error during addition",
-			from:      "wh-1",
-			to:        "wh-2",
-			productID: "prod-1",
-			qty:       5,
+			name: "not dispatched yet",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				// Mock transaction begin
 				mock.ExpectBegin()
+				expectLockTransfer(mock, "requested")
+				mock.ExpectRollback()
+			},
+			wantErr: models.ErrInvalidTransferTransition,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &WarehousesService{DB: db}
+			tt.mockSetup(mock)
+
+			tr, err := service.Receive(context.Background(), "user-1", "tr-1", tt.qty)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantStatus, tr.Status)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesService_CancelTransfer(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectLockTransfer(mock, "dispatched")
+	mock.ExpectRollback()
+
+	service := &WarehousesService{DB: db}
+	_, err := service.CancelTransfer(context.Background(), "tr-1")
+
+	assert.ErrorIs(t, err, models.ErrInvalidTransferTransition)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
 
-				// Mock inventory reduction
-				mock.ExpectExec(`UPDATE inventory SET quantity = quantity - \$3 WHERE warehouse_id=\$1 AND product_id=\$2`).
-					WithArgs("wh-1", "prod-1", 5).
+func TestWarehousesService_ListTransfers(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(`FROM stock_transfers WHERE TRUE AND status=\$1 AND \(from_warehouse_id=\$2 OR to_warehouse_id=\$2\) ORDER BY created_at DESC, id DESC LIMIT \$3`).
+		WithArgs(models.TransferDispatched, "wh-2", 50).
+		WillReturnRows(transferRow("dispatched", 0))
+
+	service := &WarehousesService{DB: db}
+	out, err := service.ListTransfers(context.Background(), TransferFilter{Status: models.TransferDispatched, WarehouseID: "wh-2"})
+
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWarehousesService_Movements(t *testing.T) {
+	movementCols := []string{"id", "warehouse_id", "product_id", "delta", "balance", "reason", "order_id", "transfer_id", "cycle_count_id", "actor_id", "created_at"}
+
+	tests := []struct {
+		name      string
+		filter    MovementFilter
+		mockSetup func(sqlmock.Sqlmock)
+		wantLen   int
+		wantNext  string
+		wantErr   error
+	}{
+		{
+			name:   "filters and pages newest first",
+			filter: MovementFilter{ProductID: "prod-1", Reason: models.MovementSale, Cursor: "40", Limit: 2},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM inventory_movements WHERE warehouse_id=\$1 AND product_id=\$2 AND reason=\$3 AND id<\$4 ORDER BY id DESC LIMIT \$5`).
+					WithArgs("wh-1", "prod-1", models.MovementSale, int64(40), 3).
+					WillReturnRows(sqlmock.NewRows(movementCols).
+						AddRow(39, "wh-1", "prod-1", -1, 4, "sale", "order-1", nil, nil, "user-1", time.Now()).
+						AddRow(31, "wh-1", "prod-1", -2, 5, "sale", "order-2", nil, nil, "user-1", time.Now()).
+						AddRow(30, "wh-1", "prod-1", -1, 7, "sale", "order-3", nil, nil, "user-2", time.Now()))
+			},
+			wantLen:  2,
+			wantNext: "31",
+		},
+		{
+			name:    "malformed cursor",
+			filter:  MovementFilter{Cursor: "abc"},
+			wantErr: ErrInvalidCursor,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			if tt.mockSetup != nil {
+				tt.mockSetup(mock)
+			}
+			service := &WarehousesService{DB: db}
+
+			out, next, err := service.Movements(context.Background(), "wh-1", tt.filter)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Len(t, out, tt.wantLen)
+				assert.Equal(t, tt.wantNext, next)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWarehousesService_Adjust(t *testing.T) {
+	expectStock := func(mock sqlmock.Sqlmock, onHand, held int) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM warehouses WHERE id=\$1 AND deleted_at IS NULL\), EXISTS\(SELECT 1 FROM products WHERE id=\$2\)`).
+			WithArgs("wh-1", "prod-1").
+			WillReturnRows(sqlmock.NewRows([]string{"wh", "prod"}).AddRow(true, true))
+		inv := sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"})
+		if onHand > 0 {
+			inv.AddRow("wh-1", "prod-1", onHand)
+		}
+		mock.ExpectQuery(`FROM inventory WHERE warehouse_id = ANY\(\$1\) AND product_id = ANY\(\$2\)`).WillReturnRows(inv)
+		mock.ExpectQuery(`FROM reservations`).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}).AddRow("wh-1", "prod-1", held))
+	}
+
+	tests := []struct {
+		name      string
+		delta     int
+		reason    string
+		mockSetup func(sqlmock.Sqlmock)
+		want      StockLevel
+		wantErr   error
+	}{
+		{
+			name:   "receipt into an empty row",
+			delta:  10,
+			reason: models.MovementReceipt,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStock(mock, 0, 0)
+				mock.ExpectQuery(`INSERT INTO inventory\(warehouse_id, product_id, quantity\)`).
+					WithArgs("wh-1", "prod-1", 10).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(10))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", 10, 10, models.MovementReceipt, "", "", "", "user-1").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			want: StockLevel{WarehouseID: "wh-1", ProductID: "prod-1", OnHand: 10},
+		},
+		{
+			name:   "damage down to the reserved units",
+			delta:  -3,
+			reason: models.MovementDamage,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStock(mock, 5, 2)
+				mock.ExpectQuery(`UPDATE inventory SET quantity = quantity \+ \$3`).
+					WithArgs("wh-1", "prod-1", -3).
+					WillReturnRows(sqlmock.NewRows([]string{"quantity"}).AddRow(2))
+				mock.ExpectExec(`INSERT INTO inventory_movements`).
+					WithArgs("wh-1", "prod-1", -3, 2, models.MovementDamage, "", "", "", "user-1").
 					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			want: StockLevel{WarehouseID: "wh-1", ProductID: "prod-1", OnHand: 2, Reserved: 2},
+		},
+		{
+			name:   "shrinkage into reserved stock",
+			delta:  -4,
+			reason: models.MovementShrinkage,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStock(mock, 5, 2)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrBelowReserved,
+		},
+		{
+			name:   "receipt that removes stock",
+			delta:  -1,
+			reason: models.MovementReceipt,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectStock(mock, 5, 0)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrInvalidAdjustment,
+		},
+		{
+			name:      "zero delta",
+			reason:    models.MovementCorrection,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidAdjustment,
+		},
+		{
+			name:   "unknown warehouse",
+			delta:  1,
+			reason: models.MovementReceipt,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT EXISTS`).
+					WillReturnRows(sqlmock.NewRows([]string{"wh", "prod"}).AddRow(false, true))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseNotFound,
+		},
+	}
 
-				// Mock inventory addition - database error
-				mock.ExpectExec(`INSERT INTO inventory\(warehouse_id, product_id, quantity\) VALUES \(\$1,\$2,\$3\)
-		ON CONFLICT \(warehouse_id, product_id\) DO UPDATE SET quantity = inventory\.quantity \+ EXCLUDED\.quantity`).
-					WithArgs("wh-2", "prod-1", 5).
-					WillReturnError(sql.ErrConnDone)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &WarehousesService{DB: db}
+			tt.mockSetup(mock)
+
+			got, err := service.Adjust(context.Background(), "user-1", "wh-1", "prod-1", tt.delta, tt.reason)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
 
-				// Mock transaction rollback
+func TestWarehousesService_SetCount(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	// counting what is already there records nothing
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT EXISTS`).
+		WillReturnRows(sqlmock.NewRows([]string{"wh", "prod"}).AddRow(true, true))
+	mock.ExpectQuery(`FROM inventory WHERE`).
+		WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).AddRow("wh-1", "prod-1", 7))
+	mock.ExpectQuery(`FROM reservations`).
+		WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}))
+	mock.ExpectCommit()
+
+	service := &WarehousesService{DB: db}
+	got, err := service.SetCount(context.Background(), "user-1", "wh-1", "prod-1", 7, models.MovementCorrection)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 7, got.OnHand)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWarehousesService_Deactivate(t *testing.T) {
+	resCols := []string{"id", "order_id", "warehouse_id", "product_id", "quantity", "expires_at", "released"}
+	expires := time.Now().Add(10 * time.Minute)
+	locks := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT id, shop_id, active FROM warehouses WHERE id=\$1 FOR NO KEY UPDATE`).
+			WithArgs("wh-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "shop_id", "active"}).AddRow("wh-1", "shop-1", true))
+		mock.ExpectExec(`SELECT id FROM orders WHERE id IN \(.*\) ORDER BY id FOR UPDATE`).
+			WithArgs("wh-1").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SELECT id, order_id, warehouse_id, product_id, quantity, expires_at, released FROM reservations WHERE warehouse_id=\$1`).
+			WithArgs("wh-1").
+			WillReturnRows(sqlmock.NewRows(resCols).
+				AddRow("r-1", "order-1", "wh-1", "prod-1", 3, expires, false).
+				AddRow("r-2", "order-1", "wh-1", "prod-2", 1, expires, false))
+	}
+	flip := func(mock sqlmock.Sqlmock) {
+		mock.ExpectExec(`UPDATE warehouses SET active=FALSE WHERE id=\$1`).
+			WithArgs("wh-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	others := func(mock sqlmock.Sqlmock, prod1wh2, prod1wh3 int) {
+		mock.ExpectQuery(`SELECT allocation_strategy FROM shops WHERE id=\$1`).
+			WithArgs("shop-1").
+			WillReturnRows(sqlmock.NewRows([]string{"allocation_strategy"}).AddRow("priority"))
+		mock.ExpectQuery(`SELECT id, priority, latitude, longitude FROM warehouses WHERE shop_id=\$1 AND active=TRUE ORDER BY id FOR SHARE`).
+			WithArgs("shop-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "priority", "latitude", "longitude"}).
+				AddRow("wh-2", 10, nil, nil).
+				AddRow("wh-3", 20, nil, nil))
+		mock.ExpectQuery(`FROM inventory WHERE warehouse_id = ANY\(\$1\)`).
+			WithArgs(pq.Array([]string{"wh-2", "wh-3"}), pq.Array([]string{"prod-1", "prod-2"})).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "quantity"}).
+				AddRow("wh-2", "prod-1", prod1wh2).
+				AddRow("wh-3", "prod-1", prod1wh3).
+				AddRow("wh-3", "prod-2", 5))
+		mock.ExpectQuery(`FROM reservations`).
+			WillReturnRows(sqlmock.NewRows([]string{"warehouse_id", "product_id", "sum"}))
+	}
+
+	tests := []struct {
+		name      string
+		policy    string
+		mockSetup func(sqlmock.Sqlmock)
+		want      []AffectedOrder
+		wantErr   error
+	}{
+		{
+			name:   "block refuses while reservations are live",
+			policy: "",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				locks(mock)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseInUse,
+		},
+		{
+			name:   "drain leaves reservations in place",
+			policy: DeactivateDrain,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				locks(mock)
+				flip(mock)
+				mock.ExpectCommit()
+			},
+			want: []AffectedOrder{{OrderID: "order-1", Lines: []AffectedLine{
+				{ProductID: "prod-1", Quantity: 3},
+				{ProductID: "prod-2", Quantity: 1},
+			}}},
+		},
+		{
+			name:   "reallocate moves reservations by priority",
+			policy: DeactivateReallocate,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				locks(mock)
+				flip(mock)
+				others(mock, 2, 4)
+				mock.ExpectExec(`DELETE FROM reservations WHERE id=\$1`).WithArgs("r-1").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO reservations`).
+					WithArgs("order-1", "wh-2", "prod-1", 2, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO reservations`).
+					WithArgs("order-1", "wh-3", "prod-1", 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`DELETE FROM reservations WHERE id=\$1`).WithArgs("r-2").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO reservations`).
+					WithArgs("order-1", "wh-3", "prod-2", 1, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			want: []AffectedOrder{{OrderID: "order-1", Lines: []AffectedLine{
+				{ProductID: "prod-1", Quantity: 3, MovedTo: []allocation.Allocation{{WarehouseID: "wh-2", Quantity: 2}, {WarehouseID: "wh-3", Quantity: 1}}},
+				{ProductID: "prod-2", Quantity: 1, MovedTo: []allocation.Allocation{{WarehouseID: "wh-3", Quantity: 1}}},
+			}}},
+		},
+		{
+			name:   "reallocate fails when the others are short",
+			policy: DeactivateReallocate,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				locks(mock)
+				flip(mock)
+				others(mock, 1, 1)
 				mock.ExpectRollback()
 			},
-			wantErr: true,
+			wantErr: ErrReallocationShortfall,
+		},
+		{
+			name:      "unknown policy",
+			policy:    "evacuate",
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrUnknownPolicy,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Setup
 			db, mock := testutils.MockDB(t)
 			defer db.Close()
 
-			service := &WarehousesService{
-				DB: db,
+			service := &WarehousesService{DB: db}
+			tt.mockSetup(mock)
+
+			report, err := service.Deactivate(context.Background(), "wh-1", tt.policy)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, report.Orders)
 			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
 
+var warehouseCols = []string{"id", "shop_id", "name", "active", "priority", "latitude", "longitude",
+	"address_line1", "address_line2", "city", "region", "postal_code", "country", "metadata",
+	"created_at", "updated_at", "deleted_at"}
+
+func warehouseRow(id string) *sqlmock.Rows {
+	return sqlmock.NewRows(warehouseCols).
+		AddRow(id, "shop-1", "North", true, 100, nil, nil, "1 Dock Rd", "", "Leeds", "", "LS1 1AA", "GB", []byte(`{"dock":"B"}`), time.Now(), time.Now(), nil)
+}
+
+func TestWarehousesService_Create(t *testing.T) {
+	name := "North"
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "creates with address and metadata",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`SELECT id FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WithArgs("shop-1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("shop-1"))
+				mock.ExpectQuery(`INSERT INTO warehouses\(shop_id, name, priority, latitude, longitude, metadata,`).
+					WithArgs("shop-1", name, nil, nil, nil, `{"dock":"B"}`, "1 Dock Rd", "", "Leeds", "", "LS1 1AA", "GB").
+					WillReturnRows(warehouseRow("wh-1"))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "deleted shop",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM shops WHERE id=\$1 AND deleted_at IS NULL FOR KEY SHARE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrShopNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &WarehousesService{DB: db}
 			tt.mockSetup(mock)
 
-			// Execute
-			err := service.Transfer(context.Background(), tt.from, tt.to, tt.productID, tt.qty)
+			wh, err := service.Create(context.Background(), "shop-1", WarehouseInput{
+				Name:     &name,
+				Address:  &models.Address{Line1: "1 Dock Rd", City: "Leeds", PostalCode: "LS1 1AA", Country: "GB"},
+				Metadata: map[string]interface{}{"dock": "B"},
+			})
 
-			// Assert
-			if tt.wantErr {
-				assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
 			} else {
 				assert.NoError(t, err)
+				assert.Equal(t, "Leeds", wh.City)
+				assert.JSONEq(t, `{"dock":"B"}`, string(wh.Metadata))
 			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
 
-			// Verify all expectations
+func TestWarehousesService_Update(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	priority := 5
+	mock.ExpectQuery(`UPDATE warehouses SET name=COALESCE\(\$2, name\), priority=COALESCE\(\$3, priority\)`).
+		WithArgs("wh-1", nil, priority, nil, nil, nil, nil, nil, nil, nil, nil, nil).
+		WillReturnRows(warehouseRow("wh-1"))
+	mock.ExpectQuery(`UPDATE warehouses .* WHERE id=\$1 AND deleted_at IS NULL`).
+		WillReturnRows(sqlmock.NewRows(warehouseCols))
+
+	service := &WarehousesService{DB: db}
+	_, err := service.Update(context.Background(), "wh-1", WarehouseInput{Priority: &priority})
+	assert.NoError(t, err)
+	_, err = service.Update(context.Background(), "wh-1", WarehouseInput{Priority: &priority})
+	assert.ErrorIs(t, err, ErrWarehouseNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWarehousesService_List(t *testing.T) {
+	db, mock := testutils.MockDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(`FROM warehouses WHERE TRUE AND shop_id=\$1 AND deleted_at IS NULL ORDER BY created_at, id LIMIT \$2`).
+		WithArgs("shop-1", defaultCatalogPageSize+1).
+		WillReturnRows(warehouseRow("wh-1"))
+
+	service := &WarehousesService{DB: db}
+	list, next, err := service.List(context.Background(), "shop-1", PageFilter{})
+
+	assert.NoError(t, err)
+	assert.Len(t, list, 1)
+	assert.Empty(t, next)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWarehousesService_Delete(t *testing.T) {
+	lock := func(mock sqlmock.Sqlmock) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT id FROM warehouses WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+			WithArgs("wh-1").
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("wh-1"))
+	}
+	contents := func(mock sqlmock.Sqlmock, reserved, onHand, transfers int) {
+		mock.ExpectQuery(`FROM reservations WHERE warehouse_id=\$1.* FROM inventory WHERE warehouse_id=\$1.* FROM stock_transfers WHERE status IN \(\$2, \$3\)`).
+			WithArgs("wh-1", models.TransferRequested, models.TransferDispatched).
+			WillReturnRows(sqlmock.NewRows([]string{"reserved", "on_hand", "transfers"}).AddRow(reserved, onHand, transfers))
+	}
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "empty warehouse",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				lock(mock)
+				contents(mock, 0, 0, 0)
+				mock.ExpectExec(`UPDATE warehouses SET active=FALSE, deleted_at=now\(\), updated_at=now\(\) WHERE id=\$1`).
+					WithArgs("wh-1").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "live reservations",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				lock(mock)
+				contents(mock, 2, 5, 0)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseInUse,
+		},
+		{
+			name: "stock on hand",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				lock(mock)
+				contents(mock, 0, 5, 0)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseNotEmpty,
+		},
+		{
+			name: "transfer in flight",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				lock(mock)
+				contents(mock, 0, 0, 1)
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseNotEmpty,
+		},
+		{
+			name: "already deleted",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`FROM warehouses WHERE id=\$1 AND deleted_at IS NULL FOR UPDATE`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrWarehouseNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := testutils.MockDB(t)
+			defer db.Close()
+
+			service := &WarehousesService{DB: db}
+			tt.mockSetup(mock)
+
+			err := service.Delete(context.Background(), "wh-1")
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
 			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
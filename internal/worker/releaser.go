@@ -27,14 +27,22 @@ func (w *Releaser) Start(ctx context.Context) {
 			w.Ticker.Stop()
 			return
 		case <-w.Ticker.C:
-			count, err := repo.ReleaseExpiredReservations(ctx, w.DB, 10)
-			if err != nil {
-				w.Log.Error("release reservations failed", zap.Error(err))
-				continue
+			// the steps are independent, so one failing does not hold up the rest
+			if expired, err := repo.ExpireOrders(ctx, w.DB, 10); err != nil {
+				w.Log.Error("expire orders failed", zap.Error(err))
+			} else if expired > 0 {
+				w.Log.Info("expired orders", zap.Int("count", expired))
 			}
-			if count > 0 {
+			if count, err := repo.ReleaseExpiredReservations(ctx, w.DB, 10); err != nil {
+				w.Log.Error("release reservations failed", zap.Error(err))
+			} else if count > 0 {
 				w.Log.Info("released expired reservations", zap.Int("count", count))
 			}
+			if pruned, err := repo.PruneTokens(ctx, w.DB, 100); err != nil {
+				w.Log.Error("prune tokens failed", zap.Error(err))
+			} else if pruned > 0 {
+				w.Log.Info("pruned expired tokens", zap.Int("count", pruned))
+			}
 		}
 	}
 }
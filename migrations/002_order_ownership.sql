@@ -0,0 +1,11 @@
+-- +migrate Up
+-- idempotency keys are scoped per user: two users may pick the same key
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (user_id, key);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user ON orders (user_id);
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_orders_user;
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key);
@@ -0,0 +1,8 @@
+-- +migrate Up
+-- keep in sync with models.OrderStatus
+ALTER TABLE orders ADD CONSTRAINT orders_status_check CHECK (
+    status IN ('reserved', 'paid', 'fulfilled', 'shipped', 'delivered', 'cancelled', 'expired', 'refunded')
+);
+
+-- +migrate Down
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
@@ -0,0 +1,8 @@
+-- +migrate Up
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status_reason TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_orders_reserved ON orders (created_at) WHERE status = 'reserved';
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_orders_reserved;
+ALTER TABLE orders DROP COLUMN IF EXISTS status_reason;
@@ -0,0 +1,26 @@
+-- +migrate Up
+-- prices are integer minor units (cents) in an ISO 4217 currency
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price_cents BIGINT NOT NULL DEFAULT 0 CHECK (price_cents >= 0);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+
+-- optional per-shop override of the product list price
+CREATE TABLE IF NOT EXISTS shop_product_prices (
+    shop_id UUID NOT NULL REFERENCES shops(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    price_cents BIGINT NOT NULL CHECK (price_cents >= 0),
+    currency TEXT NOT NULL,
+    PRIMARY KEY (shop_id, product_id)
+);
+
+-- price snapshot taken when the order is reserved
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS unit_price_cents BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency TEXT NOT NULL DEFAULT 'USD';
+
+-- +migrate Down
+ALTER TABLE orders DROP COLUMN IF EXISTS currency;
+ALTER TABLE order_items DROP COLUMN IF EXISTS currency;
+ALTER TABLE order_items DROP COLUMN IF EXISTS unit_price_cents;
+DROP TABLE IF EXISTS shop_product_prices;
+ALTER TABLE products DROP COLUMN IF EXISTS currency;
+ALTER TABLE products DROP COLUMN IF EXISTS price_cents;
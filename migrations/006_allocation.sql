@@ -0,0 +1,17 @@
+-- +migrate Up
+-- lower priority ships first; coordinates are used by the "nearest" strategy
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 100;
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS latitude DOUBLE PRECISION CHECK (latitude BETWEEN -90 AND 90);
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS longitude DOUBLE PRECISION CHECK (longitude BETWEEN -180 AND 180);
+
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS allocation_strategy TEXT NOT NULL DEFAULT 'priority'
+    CHECK (allocation_strategy IN ('priority', 'most_stock', 'fewest_splits', 'round_robin', 'nearest'));
+-- bumped once per order when the shop allocates round-robin
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS allocation_seq BIGINT NOT NULL DEFAULT 0;
+
+-- +migrate Down
+ALTER TABLE shops DROP COLUMN IF EXISTS allocation_seq;
+ALTER TABLE shops DROP COLUMN IF EXISTS allocation_strategy;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS longitude;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS latitude;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS priority;
@@ -0,0 +1,7 @@
+-- +migrate Up
+-- rows driven negative by the old unchecked transfer cannot satisfy the constraint
+UPDATE inventory SET quantity = 0 WHERE quantity < 0;
+ALTER TABLE inventory ADD CONSTRAINT inventory_quantity_nonnegative CHECK (quantity >= 0);
+
+-- +migrate Down
+ALTER TABLE inventory DROP CONSTRAINT IF EXISTS inventory_quantity_nonnegative;
@@ -0,0 +1,25 @@
+-- +migrate Up
+-- stock moving between two warehouses of a shop; units leave the source on
+-- dispatch and land in the destination on receive
+CREATE TABLE IF NOT EXISTS stock_transfers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    shop_id UUID NOT NULL REFERENCES shops(id) ON DELETE CASCADE,
+    from_warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    to_warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    product_id UUID NOT NULL REFERENCES products(id),
+    quantity INT NOT NULL CHECK (quantity > 0),
+    received_quantity INT NOT NULL DEFAULT 0 CHECK (received_quantity BETWEEN 0 AND quantity),
+    status TEXT NOT NULL DEFAULT 'requested'
+        CHECK (status IN ('requested', 'dispatched', 'received', 'partially_received', 'cancelled')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    dispatched_at TIMESTAMPTZ,
+    received_at TIMESTAMPTZ,
+    CHECK (from_warehouse_id <> to_warehouse_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_transfers_shop ON stock_transfers (shop_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_stock_transfers_in_transit ON stock_transfers (to_warehouse_id, product_id) WHERE status = 'dispatched';
+
+-- +migrate Down
+DROP TABLE IF EXISTS stock_transfers;
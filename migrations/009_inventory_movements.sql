@@ -0,0 +1,37 @@
+-- +migrate Up
+-- append-only history of every change to inventory.quantity; the balance is
+-- the row's quantity right after the movement was applied
+CREATE TABLE IF NOT EXISTS inventory_movements (
+    id BIGSERIAL PRIMARY KEY,
+    warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    product_id UUID NOT NULL REFERENCES products(id),
+    delta INT NOT NULL CHECK (delta <> 0),
+    balance INT NOT NULL,
+    reason TEXT NOT NULL CHECK (reason IN ('opening', 'sale', 'transfer_out', 'transfer_in')),
+    order_id UUID REFERENCES orders(id),
+    transfer_id UUID REFERENCES stock_transfers(id),
+    actor_id UUID REFERENCES users(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_inventory_movements_row ON inventory_movements (warehouse_id, product_id, id);
+
+CREATE OR REPLACE FUNCTION inventory_movements_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'inventory_movements is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS inventory_movements_no_rewrite ON inventory_movements;
+CREATE TRIGGER inventory_movements_no_rewrite
+    BEFORE UPDATE OR DELETE ON inventory_movements
+    FOR EACH ROW EXECUTE FUNCTION inventory_movements_append_only();
+
+-- existing stock becomes the opening balance of each row
+INSERT INTO inventory_movements (warehouse_id, product_id, delta, balance, reason)
+SELECT warehouse_id, product_id, quantity, quantity, 'opening'
+FROM inventory WHERE quantity <> 0;
+
+-- +migrate Down
+DROP TABLE IF EXISTS inventory_movements;
+DROP FUNCTION IF EXISTS inventory_movements_append_only();
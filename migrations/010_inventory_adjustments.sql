@@ -0,0 +1,10 @@
+-- +migrate Up
+-- manual stock changes made through the warehouse API
+ALTER TABLE inventory_movements DROP CONSTRAINT IF EXISTS inventory_movements_reason_check;
+ALTER TABLE inventory_movements ADD CONSTRAINT inventory_movements_reason_check
+    CHECK (reason IN ('opening', 'sale', 'transfer_out', 'transfer_in', 'receipt', 'damage', 'shrinkage', 'correction'));
+
+-- +migrate Down
+ALTER TABLE inventory_movements DROP CONSTRAINT IF EXISTS inventory_movements_reason_check;
+ALTER TABLE inventory_movements ADD CONSTRAINT inventory_movements_reason_check
+    CHECK (reason IN ('opening', 'sale', 'transfer_out', 'transfer_in'));
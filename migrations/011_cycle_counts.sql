@@ -0,0 +1,38 @@
+-- +migrate Up
+-- periodic physical counts; each line snapshots the on-hand quantity when the
+-- count is opened so stock moving during the count does not skew the variance
+CREATE TABLE IF NOT EXISTS cycle_counts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    warehouse_id UUID NOT NULL REFERENCES warehouses(id),
+    status TEXT NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'approved', 'cancelled')),
+    opened_by UUID REFERENCES users(id),
+    approved_by UUID REFERENCES users(id),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    approved_at TIMESTAMPTZ
+);
+
+-- one count in progress per warehouse
+CREATE UNIQUE INDEX IF NOT EXISTS uq_cycle_counts_open ON cycle_counts (warehouse_id) WHERE status = 'open';
+
+CREATE TABLE IF NOT EXISTS cycle_count_lines (
+    count_id UUID NOT NULL REFERENCES cycle_counts(id) ON DELETE CASCADE,
+    product_id UUID NOT NULL REFERENCES products(id),
+    snapshot_qty INT NOT NULL,
+    counted_qty INT CHECK (counted_qty >= 0),
+    counted_at TIMESTAMPTZ,
+    PRIMARY KEY (count_id, product_id)
+);
+
+ALTER TABLE inventory_movements ADD COLUMN IF NOT EXISTS cycle_count_id UUID REFERENCES cycle_counts(id);
+ALTER TABLE inventory_movements DROP CONSTRAINT IF EXISTS inventory_movements_reason_check;
+ALTER TABLE inventory_movements ADD CONSTRAINT inventory_movements_reason_check
+    CHECK (reason IN ('opening', 'sale', 'transfer_out', 'transfer_in', 'receipt', 'damage', 'shrinkage', 'correction', 'cycle_count'));
+
+-- +migrate Down
+ALTER TABLE inventory_movements DROP CONSTRAINT IF EXISTS inventory_movements_reason_check;
+ALTER TABLE inventory_movements ADD CONSTRAINT inventory_movements_reason_check
+    CHECK (reason IN ('opening', 'sale', 'transfer_out', 'transfer_in', 'receipt', 'damage', 'shrinkage', 'correction'));
+ALTER TABLE inventory_movements DROP COLUMN IF EXISTS cycle_count_id;
+DROP TABLE IF EXISTS cycle_count_lines;
+DROP TABLE IF EXISTS cycle_counts;
@@ -0,0 +1,46 @@
+-- +migrate Up
+-- soft delete: rows stay referenced by orders and the ledger, deleted_at hides them
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE shops ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+-- postal address and free-form attributes (dock hours, contact, ...)
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS address_line1 TEXT NOT NULL DEFAULT '';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS address_line2 TEXT NOT NULL DEFAULT '';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS city TEXT NOT NULL DEFAULT '';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS region TEXT NOT NULL DEFAULT '';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS postal_code TEXT NOT NULL DEFAULT '';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT '';
+ALTER TABLE warehouses ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'
+    CHECK (jsonb_typeof(metadata) = 'object');
+
+-- names and SKUs of deleted rows may be reused
+ALTER TABLE shops DROP CONSTRAINT IF EXISTS shops_name_key;
+CREATE UNIQUE INDEX IF NOT EXISTS shops_name_live_key ON shops (name) WHERE deleted_at IS NULL;
+ALTER TABLE products DROP CONSTRAINT IF EXISTS products_sku_key;
+CREATE UNIQUE INDEX IF NOT EXISTS products_sku_live_key ON products (sku) WHERE deleted_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_warehouses_shop ON warehouses (shop_id) WHERE deleted_at IS NULL;
+
+-- +migrate Down
+DROP INDEX IF EXISTS idx_warehouses_shop;
+DROP INDEX IF EXISTS products_sku_live_key;
+ALTER TABLE products ADD CONSTRAINT products_sku_key UNIQUE (sku);
+DROP INDEX IF EXISTS shops_name_live_key;
+ALTER TABLE shops ADD CONSTRAINT shops_name_key UNIQUE (name);
+ALTER TABLE warehouses DROP COLUMN IF EXISTS metadata;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS country;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS postal_code;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS region;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS city;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS address_line2;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS address_line1;
+ALTER TABLE products DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE products DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE warehouses DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE shops DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE shops DROP COLUMN IF EXISTS updated_at;
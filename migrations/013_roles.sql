@@ -0,0 +1,18 @@
+-- +migrate Up
+-- platform-wide role; everything shop specific lives in shop_members
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'customer'
+    CHECK (role IN ('customer', 'platform_admin'));
+
+CREATE TABLE IF NOT EXISTS shop_members (
+    shop_id UUID NOT NULL REFERENCES shops(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('staff', 'admin')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (shop_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_shop_members_user ON shop_members (user_id);
+
+-- +migrate Down
+DROP TABLE IF EXISTS shop_members;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,30 @@
+-- +migrate Up
+-- failed logins per account (keyed by normalised email, registered or not) and
+-- per client IP; a row is cleared when the account logs in successfully
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope TEXT NOT NULL CHECK (scope IN ('account', 'ip')),
+    key TEXT NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_last_failed ON login_attempts (last_failed_at);
+
+-- security relevant events; actor_id is NULL for events the system raised itself
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id UUID REFERENCES users(id) ON DELETE SET NULL,
+    action TEXT NOT NULL,
+    target TEXT NOT NULL,
+    ip TEXT,
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log (target, created_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS login_attempts;
@@ -0,0 +1,30 @@
+-- +migrate Up
+-- accounts at external identity providers, keyed by the provider's stable subject
+-- rather than the email, which can change at the provider
+CREATE TABLE IF NOT EXISTS user_identities (
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_login_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities (user_id);
+
+-- logins sent to a provider and not back yet; state is stored hashed, the
+-- nonce and PKCE verifier are needed in clear to finish the login
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_logins_expires ON oidc_logins (expires_at);
+
+-- +migrate Down
+DROP TABLE IF EXISTS oidc_logins;
+DROP TABLE IF EXISTS user_identities;
@@ -0,0 +1,35 @@
+-- +migrate Up
+-- responses to requests sent with an Idempotency-Key, replayed when a client
+-- retries; owner is "user:<id>" or "api_key:<id>". status_code stays NULL
+-- while the first request is in flight, and claim_token tells that request
+-- apart from one that took the key over after its lock ran out. Replaces the
+-- order-only idempotency_keys table.
+CREATE TABLE IF NOT EXISTS idempotency_requests (
+    owner TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    claim_token UUID NOT NULL,
+    status_code INT,
+    content_type TEXT NOT NULL DEFAULT '',
+    response_body BYTEA,
+    locked_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (owner, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_requests_expires ON idempotency_requests (expires_at);
+
+DROP TABLE IF EXISTS idempotency_keys;
+
+-- +migrate Down
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES users(id),
+    request_hash TEXT NOT NULL,
+    order_id UUID,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, key)
+);
+
+DROP TABLE IF EXISTS idempotency_requests;
@@ -0,0 +1,92 @@
+package testutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// IntegrationDB connects to the Postgres in TEST_DATABASE_URL, creates a
+// throwaway schema, applies every migration in it and drops it again when the
+// test ends. Tests calling it are skipped under -short or when the variable is
+// unset, so `make test` stays database-free.
+func IntegrationDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test skipped in -short mode")
+	}
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	admin, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	suffix := make([]byte, 6)
+	_, _ = rand.Read(suffix)
+	schema := "it_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		_, _ = admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		_ = admin.Close()
+	})
+
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("Invalid TEST_DATABASE_URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	db, err := sqlx.Connect("postgres", u.String())
+	if err != nil {
+		t.Fatalf("Failed to connect to test schema: %v", err)
+	}
+	db.SetMaxOpenConns(25)
+	t.Cleanup(func() { _ = db.Close() })
+
+	for _, file := range migrationFiles(t) {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if _, err := db.Exec(migrateUp(string(body))); err != nil {
+			t.Fatalf("Failed to apply %s: %v", filepath.Base(file), err)
+		}
+	}
+	return db
+}
+
+func migrationFiles(t *testing.T) []string {
+	_, self, _, _ := runtime.Caller(0)
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(self), "..", "migrations", "*.sql"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No migrations found: %v", err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// migrateUp returns the part of a migration between its Up and Down markers.
+func migrateUp(sql string) string {
+	if i := strings.Index(sql, "-- +migrate Up"); i >= 0 {
+		sql = sql[i:]
+	}
+	if i := strings.Index(sql, "-- +migrate Down"); i >= 0 {
+		sql = sql[:i]
+	}
+	return sql
+}
@@ -1,6 +1,7 @@
 package testutils
 
 import (
+	"context"
 	"database/sql/driver"
 	"testing"
 
@@ -8,6 +9,8 @@ import (
 	"github.com/jmoiron/sqlx"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+
+	"ecommerce-shop/internal/mailer"
 )
 
 // MockDB creates a mock database for testing
@@ -26,6 +29,18 @@ func MockLogger(t *testing.T) *zap.Logger {
 	return zaptest.NewLogger(t)
 }
 
+// MockMailer records the messages it is asked to send
+type MockMailer struct {
+	Sent []mailer.Message
+	Err  error
+}
+
+// Send records m and returns Err
+func (m *MockMailer) Send(_ context.Context, msg mailer.Message) error {
+	m.Sent = append(m.Sent, msg)
+	return m.Err
+}
+
 // MockRows creates mock rows for database queries
 func MockRows(columns []string, values ...[]driver.Value) *sqlmock.Rows {
 	rows := sqlmock.NewRows(columns)
@@ -0,0 +1,197 @@
+package testutils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	fakeOIDCKeyOnce sync.Once
+	fakeOIDCKey     *rsa.PrivateKey
+)
+
+// FakeOIDCUser is who signs in at a FakeOIDCProvider
+type FakeOIDCUser struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+	AMR           []string
+}
+
+// FakeOIDCProvider is an in-process OpenID Connect provider supporting the
+// authorization code flow with S256 PKCE and client_secret_basic
+type FakeOIDCProvider struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Overrides replace claims of the id tokens issued from now on, to test
+	// that bad tokens are rejected
+	Overrides map[string]interface{}
+
+	mu    sync.Mutex
+	next  FakeOIDCUser
+	codes map[string]fakeOIDCGrant
+}
+
+type fakeOIDCGrant struct {
+	user        FakeOIDCUser
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// NewFakeOIDCProvider starts a fake provider that is shut down with the test
+func NewFakeOIDCProvider(t *testing.T) *FakeOIDCProvider {
+	fakeOIDCKeyOnce.Do(func() {
+		var err error
+		if fakeOIDCKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+	})
+	f := &FakeOIDCProvider{
+		ClientID:     "shop-client",
+		ClientSecret: "shop-secret",
+		RedirectURL:  "http://localhost:8080/api/oidc/corp/callback",
+		codes:        map[string]fakeOIDCGrant{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/jwks", f.jwks)
+	mux.HandleFunc("/authorize", f.authorize)
+	mux.HandleFunc("/token", f.token)
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Server.Close)
+	return f
+}
+
+// Authorize signs user in at authURL the way a browser would and returns the
+// code and state the provider redirects back with
+func (f *FakeOIDCProvider) Authorize(t *testing.T, authURL string, user FakeOIDCUser) (code, state string) {
+	f.mu.Lock()
+	f.next = user
+	f.mu.Unlock()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", res.StatusCode)
+	}
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func (f *FakeOIDCProvider) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                 f.URL,
+		"authorization_endpoint": f.URL + "/authorize",
+		"token_endpoint":         f.URL + "/token",
+		"jwks_uri":               f.URL + "/jwks",
+	})
+}
+
+func (f *FakeOIDCProvider) jwks(w http.ResponseWriter, _ *http.Request) {
+	pub := fakeOIDCKey.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "fake-1",
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (f *FakeOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != f.ClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	code := base64.RawURLEncoding.EncodeToString(b)
+	f.mu.Lock()
+	f.codes[code] = fakeOIDCGrant{user: f.next, nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+	f.mu.Unlock()
+	back, _ := url.Parse(q.Get("redirect_uri"))
+	v := back.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	back.RawQuery = v.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (f *FakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != f.ClientID || secret != f.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	f.mu.Lock()
+	g, ok := f.codes[r.PostForm.Get("code")]
+	delete(f.codes, r.PostForm.Get("code"))
+	overrides := f.Overrides
+	f.mu.Unlock()
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || g.redirectURI != r.PostForm.Get("redirect_uri") || base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            f.URL,
+		"sub":            g.user.Subject,
+		"aud":            f.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          g.nonce,
+		"email":          g.user.Email,
+		"email_verified": g.user.EmailVerified,
+		"groups":         g.user.Groups,
+	}
+	if len(g.user.AMR) > 0 {
+		claims["amr"] = g.user.AMR
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = "fake-1"
+	signed, err := tok.SignedString(fakeOIDCKey)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "at-" + g.user.Subject, "token_type": "Bearer", "id_token": signed})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}